@@ -33,24 +33,25 @@ package archive
 import (
 	"archive/zip"
 	"bufio"
-	"bytes"
-	"container/ring"
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 	"github.com/klauspost/compress/gzip"
 	"github.com/uwedeportivo/lzmadec"
+	"github.com/uwedeportivo/romba/config"
 	"github.com/uwedeportivo/romba/types"
 	"github.com/uwedeportivo/romba/util"
 	"github.com/uwedeportivo/romba/worker"
@@ -59,17 +60,15 @@ import (
 
 const ResumeDateFormat = "2006-01-02-15_04_05"
 
-type completed struct {
-	path        string
-	workerIndex int
-}
-
 type archiveWorker struct {
 	depot        *Depot
 	hh           *Hashes
 	md5crcBuffer []byte
 	index        int
+	seq          int
 	pm           *archiveGru
+	// pf tracks the depot writes of the file being processed
+	pf *pendingFile
 }
 
 type archiveGru struct {
@@ -78,8 +77,8 @@ type archiveGru struct {
 	numWorkers      int
 	pt              worker.ProgressTracker
 	soFar           chan *completed
-	resumeLogFile   *os.File
-	resumeLogWriter *bufio.Writer
+	observerDone    chan bool
+	resumeLog       *resumeLogWriter
 	includezips     int
 	includegzips    int
 	include7zips    int
@@ -87,97 +86,75 @@ type archiveGru struct {
 	skipInitialScan bool
 	useGoZip        bool
 	noDB            bool
+	verifyExisting  bool
+	maxDepth        int
+	trackZipHashes  bool
+	hashBufferSize  int
+	fileLimiter     *worker.FileLimiter
+	writeRetrier    *writeRetrier
+	skipExtensions  map[string]bool
+	maxFileSize     int64
+	recordNames     bool
+	checkRoom       bool
+	hook            ArchiveHook
+	writes          chan *depotWrite
+	writersDone     sync.WaitGroup
+
+	mutex         sync.Mutex
+	numMismatches int
+	counters      ingestCounters
+	writeErr      error
 }
 
-func extractResumePoint(resumePath string, numWorkers int) (string, error) {
-	// we need the last n lines from the file, where n == numWorkers
-	f, err := os.Open(resumePath)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-
-	fi, err := f.Stat()
-	if err != nil {
-		return "", err
-	}
-
-	bufSize := int64(10240)
-	if bufSize > fi.Size() {
-		bufSize = fi.Size()
-	}
-
-	buf := make([]byte, bufSize)
-	_, err = f.ReadAt(buf, fi.Size()-bufSize)
-	if err != nil {
-		return "", err
-	}
-
-	rng := ring.New(numWorkers)
-	reader := bufio.NewReader(bytes.NewReader(buf))
-
-	numLines := 0
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil && err != io.EOF {
-			return "", err
-		}
-
-		line = strings.TrimSpace(line)
-
-		if len(line) > 41 {
-			numLines++
-
-			sha1Str := line[len(line)-40:]
-			line := line[:len(line)-41]
-
-			computedSha1Str := fmt.Sprintf("%x", sha1.Sum([]byte(line)))
-
-			if sha1Str == computedSha1Str {
-				rng.Value = line
-				rng = rng.Next()
-			}
-		}
-		if err == io.EOF {
-			break
-		}
-	}
-
-	if numLines == 0 {
-		return "", fmt.Errorf("could not extract a resume point from %s, file seems empty", resumePath)
-	}
-
-	nl := numWorkers
-	if numLines < numWorkers {
-		glog.Warningf("extracting resume point from %s: expected %d lines, got %d, cannot resume", resumePath, numWorkers, numLines)
-		return "", nil
-	}
-
-	lines := make([]string, 0, nl)
-
-	rng.Do(func(v interface{}) {
-		if v != nil {
-			line := v.(string)
-			if len(line) > 0 {
-				lines = append(lines, line)
-			}
-		}
-	})
+// ArchiveOptions are the settings of an archive run beyond the ones every run needs.
+type ArchiveOptions struct {
+	// VerifyExisting compares files already in the depot with the archived ones.
+	VerifyExisting bool
+	// MaxDepth is the maximum dir depth below each path, 0 means only top-level
+	// files and a negative depth means no limit.
+	MaxDepth int
+	// TrackZipHashes records the hashes of archived zips in the DB.
+	TrackZipHashes bool
+	// HashBufferSize is the size of the hashing buffer, 0 for the default.
+	HashBufferSize int
+	// MaxOpenFiles limits the source files open at once, 0 for no limit.
+	MaxOpenFiles int
+	// ReportOut is the path the ingest report is written to, if not empty.
+	ReportOut string
+	// NoSkipExtensions hashes files with the configured skip extensions too.
+	NoSkipExtensions bool
+	// NumWriters is the number of depot writers, 0 for one per worker.
+	NumWriters int
+	// MaxFileSize skips files larger than it, 0 for no limit.
+	MaxFileSize int64
+	// RecordNames records the names of archived files in the DB.
+	RecordNames bool
+	// CheckRoom calls off the run if the depot doesn't have room for the scanned files.
+	CheckRoom bool
+	// Hook is told about the events of the run, if not nil.
+	Hook ArchiveHook
+}
 
-	sort.Strings(lines)
-	return lines[0], nil
+// defaultArchiveOptions are the options of an archive run passed nil options.
+var defaultArchiveOptions = ArchiveOptions{
+	MaxDepth: -1,
 }
 
 func (depot *Depot) Archive(paths []string, resumePath string, includezips int, includegzips int, include7zips int,
 	onlyneeded bool, numWorkers int,
-	logDir string, pt worker.ProgressTracker, skipInitialScan bool, useGoZip bool, noDB bool) (string, error) {
+	logDir string, pt worker.ProgressTracker, skipInitialScan bool, useGoZip bool, noDB bool,
+	opts *ArchiveOptions) (string, error) {
+	start := time.Now()
+
+	if opts == nil {
+		opts = &defaultArchiveOptions
+	}
 
 	resumeLogPath := filepath.Join(logDir, fmt.Sprintf("archive-resume-%s.log", time.Now().Format(ResumeDateFormat)))
-	resumeLogFile, err := os.Create(resumeLogPath)
+	resumeLog, err := newResumeLogWriter(resumeLogPath)
 	if err != nil {
 		return "", err
 	}
-	resumeLogWriter := bufio.NewWriter(resumeLogFile)
 
 	resumePoint := ""
 	if len(resumePath) > 0 {
@@ -195,24 +172,98 @@ func (depot *Depot) Archive(paths []string, resumePath string, includezips int,
 	pm.pt = pt
 	pm.numWorkers = numWorkers
 	pm.soFar = make(chan *completed)
-	pm.resumeLogWriter = resumeLogWriter
-	pm.resumeLogFile = resumeLogFile
+	pm.observerDone = make(chan bool)
+	pm.resumeLog = resumeLog
 	pm.includezips = includezips
 	pm.includegzips = includegzips
 	pm.include7zips = include7zips
+	if onlyneeded && noDB {
+		glog.Warningf("only-needed needs the DB index, archiving all roms with no-db")
+	}
 	pm.onlyneeded = onlyneeded
 	pm.skipInitialScan = skipInitialScan
 	pm.useGoZip = useGoZip
 	pm.noDB = noDB
+	pm.verifyExisting = opts.VerifyExisting
+	pm.maxDepth = opts.MaxDepth
+	pm.trackZipHashes = opts.TrackZipHashes && !noDB
+	pm.hashBufferSize = HashBufferSize(opts.HashBufferSize)
+	pm.fileLimiter = worker.NewFileLimiter(opts.MaxOpenFiles, pt)
+	pm.writeRetrier = newWriteRetrier(config.GlobalConfig.Depot.WriteRetries,
+		config.GlobalConfig.Depot.WriteRetryBackoff)
+	if !opts.NoSkipExtensions {
+		pm.skipExtensions = configuredSkipExtensions()
+	}
+	pm.maxFileSize = opts.MaxFileSize
+	pm.recordNames = opts.RecordNames && !noDB
+	pm.checkRoom = opts.CheckRoom
+	pm.hook = opts.Hook
+	pm.startDepotWriters(opts.NumWriters)
+
+	go loopObserver(pm.numWorkers, pm.soFar, pm.observerDone, pm.depot, pm.resumeLog, func() {
+		pm.fireReport(EventCheckpoint, paths, start, nil)
+	})
+
+	endMsg, err := worker.Work("archive roms", paths, pm)
+	if err == nil {
+		err = pm.firstWriteErr()
+	}
+	pm.fireReport(EventComplete, paths, start, err)
 
-	go loopObserver(pm.numWorkers, pm.soFar, pm.depot, pm.resumeLogWriter)
+	if opts.ReportOut != "" {
+		rerr := writeIngestReport(opts.ReportOut, pm.report(paths, start, err))
+		if rerr != nil {
+			glog.Errorf("failed to write ingest report %s: %v", opts.ReportOut, rerr)
+		}
+	}
 
-	return worker.Work("archive roms", paths, pm)
+	if err == nil && pm.counters.filesSkippedExtension > 0 {
+		endMsg += fmt.Sprintf("number of files skipped by extension: %d\n", pm.counters.filesSkippedExtension)
+	}
+	if err == nil && pm.counters.filesSkippedSize > 0 {
+		endMsg += fmt.Sprintf("number of files skipped by size: %d\n", pm.counters.filesSkippedSize)
+	}
+
+	if err != nil || !opts.VerifyExisting {
+		return endMsg, err
+	}
+
+	return endMsg + fmt.Sprintf("number of verify mismatches: %d\n", pm.numMismatches), nil
+}
+
+// defaultSkipExtensions are the extensions of files archive doesn't hash unless
+// the archive section of the config lists others.
+var defaultSkipExtensions = []string{".nfo", ".sfv", ".txt", ".diz", ".jpg", ".jpeg", ".png", ".pdf",
+	".url", ".md5", ".sha1"}
+
+// configuredSkipExtensions returns the lowercased extensions of files archive skips.
+func configuredSkipExtensions() map[string]bool {
+	exts := defaultSkipExtensions
+	if config.GlobalConfig != nil && len(config.GlobalConfig.Archive.SkipExtensions) > 0 {
+		exts = config.GlobalConfig.Archive.SkipExtensions
+	}
+
+	skip := make(map[string]bool)
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		skip[ext] = true
+	}
+	return skip
 }
 
 func (pm *archiveGru) Accept(path string) bool {
-	if pm.resumePath != "" {
-		return path > pm.resumePath
+	if pm.resumePath != "" && path <= pm.resumePath {
+		return false
+	}
+	if pm.skipExtensions[strings.ToLower(filepath.Ext(path))] {
+		pm.countSkippedExtension()
+		return false
 	}
 	return true
 }
@@ -227,6 +278,10 @@ func (pm *archiveGru) NewWorker(workerIndex int) worker.Worker {
 	}
 }
 
+func (pm *archiveGru) MaxDepth() int {
+	return pm.maxDepth
+}
+
 func (pm *archiveGru) CalculateWork() bool {
 	return !pm.skipInitialScan
 }
@@ -244,22 +299,54 @@ func (pm *archiveGru) ProgressTracker() worker.ProgressTracker {
 }
 
 func (pm *archiveGru) FinishUp() error {
+	pm.stopDepotWriters()
+
 	pm.soFar <- &completed{
 		workerIndex: -1,
 	}
+	<-pm.observerDone
 
 	pm.depot.writeSizes()
-	pm.resumeLogWriter.Flush()
 
-	return pm.resumeLogFile.Close()
+	return pm.resumeLog.close()
 }
 
 func (pm *archiveGru) Start() error {
 	return nil
 }
 
-func (pm *archiveGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+// CheckScanned calls off the archive run with checkRoom set if the scanned files
+// don't fit into the depot. Files are counted with their size before compression
+// and whether or not they're already in the depot, so the check errs on the safe side.
+func (pm *archiveGru) CheckScanned(numFiles int, numBytes int64) error {
+	if !pm.checkRoom {
+		return nil
+	}
+	return pm.depot.checkRoom(numBytes)
+}
+
+// Scanned resets the count of files skipped by extension, since the initial
+// scan already passed them to Accept once.
+func (pm *archiveGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.counters.filesSkippedExtension = 0
+}
+
+// errAllRootsFull is returned by reserveRoot if no depot root has room for a file.
+var errAllRootsFull = errors.New("all depot roots full")
 
+// compressedSizeBound is the most a file of size bytes can take up once gzipped
+// into the depot: deflate adds 5 bytes per stored block when the data doesn't
+// compress, plus the gzip header with the hashes and the trailer.
+func compressedSizeBound(size int64) int64 {
+	return size + (size/16384+1)*5 + 1024
+}
+
+// reserveRoot adds size to the first depot root that stays within its maxSize and
+// returns its index. It fails with errAllRootsFull, leaving all roots untouched,
+// if no root can take size more bytes.
 func (depot *Depot) reserveRoot(size int64) (int, error) {
 	depot.lock.Lock()
 	start := depot.start
@@ -268,7 +355,7 @@ func (depot *Depot) reserveRoot(size int64) (int, error) {
 	for i := start; i < len(depot.roots); i++ {
 		dr := depot.roots[i]
 		dr.Lock()
-		if dr.size+size < dr.maxSize {
+		if dr.size+size <= dr.maxSize {
 			dr.size += size
 			dr.Unlock()
 			return i, nil
@@ -277,24 +364,46 @@ func (depot *Depot) reserveRoot(size int64) (int, error) {
 			depot.lock.Lock()
 			depot.start = i
 			depot.lock.Unlock()
+		} else {
+			dr.Unlock()
 		}
 	}
 
-	glog.Error("Depot with the following roots ran out of disk space")
+	glog.Errorf("no depot root has room for %s more", humanize.IBytes(uint64(size)))
 	for _, dr := range depot.roots {
 		glog.Errorf("root = %s, maxSize = %s, size = %s", dr.path,
 			humanize.IBytes(uint64(dr.maxSize)), humanize.IBytes(uint64(dr.size)))
 	}
 
-	return -1, worker.StopProcessing.New("depot ran out of disk space")
+	return -1, errAllRootsFull
 }
 
 func (w *archiveWorker) Process(path string, size int64) error {
 	var err error
 
-	pathext := filepath.Ext(path)
+	w.pf = &pendingFile{
+		pm: w.pm,
+		comp: &completed{
+			path:        path,
+			status:      resumeStatusDone,
+			workerIndex: w.index,
+			seq:         w.seq,
+		},
+		processing: true,
+	}
+	w.seq++
+
+	// the slot of the source file is held until the depot writers are done
+	// reading it, so they never wait for the limiter themselves
+	w.pm.fileLimiter.Acquire()
 
-	if pathext == zipSuffix {
+	pathext := strings.ToLower(filepath.Ext(path))
+
+	if w.pm.maxFileSize > 0 && size > w.pm.maxFileSize {
+		glog.Infof("skipping %s, its size %s is above the limit of %s", path,
+			humanize.IBytes(uint64(size)), humanize.IBytes(uint64(w.pm.maxFileSize)))
+		w.pm.countSkippedSize()
+	} else if pathext == zipSuffix {
 		_, err = w.archiveZip(path, size, w.pm.includezips)
 	} else if pathext == gzipSuffix {
 		_, err = w.archiveGzip(path, size, w.pm.includegzips)
@@ -304,15 +413,11 @@ func (w *archiveWorker) Process(path string, size int64) error {
 		_, err = w.archiveRom(path, size)
 	}
 
-	if err != nil {
-		return err
-	}
-
-	w.pm.soFar <- &completed{
-		path:        path,
-		workerIndex: w.index,
-	}
-	return nil
+	// the file completes once the depot writers are done with its roms
+	w.pf.releaseAfterWrites(w.pm.fileLimiter.Release)
+	w.pf.processed(err)
+	w.pf = nil
+	return err
 }
 
 func (w *archiveWorker) Close() error {
@@ -327,9 +432,7 @@ func (w *archiveWorker) archive(ro readerOpener, name, path string, size int64,
 		return 0, err
 	}
 
-	br := bufio.NewReader(r)
-
-	err = hh.forReader(br)
+	err = hh.forReaderSize(r, w.pm.hashBufferSize)
 	if err != nil {
 		r.Close()
 		return 0, err
@@ -344,6 +447,14 @@ func (w *archiveWorker) archive(ro readerOpener, name, path string, size int64,
 		size = hh.Size
 	}
 
+	identity, err := readerIdentitySha1(name, ro)
+	if err != nil {
+		return 0, err
+	}
+	if identity != nil {
+		copy(hh.Sha1, identity)
+	}
+
 	copy(md5crcBuffer[0:md5.Size], hh.Md5)
 	copy(md5crcBuffer[md5.Size:md5.Size+crc32.Size], hh.Crc)
 	util.Int64ToBytes(size, md5crcBuffer[md5.Size+crc32.Size:])
@@ -359,6 +470,8 @@ func (w *archiveWorker) archive(ro readerOpener, name, path string, size int64,
 	rom.Size = size
 	rom.Path = path
 
+	// without the DB roms are still deduplicated against the depot below,
+	// RomInDepot only looks at the bloom filters and files of the depot roots
 	if !w.pm.noDB {
 		if w.pm.onlyneeded {
 			hasDats, err := w.depot.RomDB.IsRomReferencedByDats(rom)
@@ -367,6 +480,8 @@ func (w *archiveWorker) archive(ro readerOpener, name, path string, size int64,
 			}
 
 			if !hasDats {
+				w.pm.countSkipped(false)
+				w.pf.skip()
 				return 0, nil
 			}
 		}
@@ -375,48 +490,264 @@ func (w *archiveWorker) archive(ro readerOpener, name, path string, size int64,
 		if err != nil {
 			return 0, err
 		}
+
+		if w.pm.recordNames {
+			err = w.depot.RomDB.IndexRomName(rom.Sha1, path)
+			if err != nil {
+				return 0, err
+			}
+		}
 	}
 
 	sha1Hex := hex.EncodeToString(hh.Sha1)
-	exists, _, err := w.depot.RomInDepot(sha1Hex)
+	exists, rompath, err := w.depot.RomInDepot(sha1Hex)
 	if err != nil {
 		return 0, err
 	}
 
 	if exists {
+		w.pm.countSkipped(true)
+
+		if w.pm.verifyExisting {
+			return 0, w.verifyExisting(ro, name, path, rompath)
+		}
+
 		glog.V(4).Infof("%s already in depot, skipping %s/%s", sha1Hex, path, name)
 		return 0, nil
 	}
 
-	estimatedCompressedSize := size / 5
+	// reserve the worst case so that the root can't end up above its maxSize,
+	// the difference to the actual compressed size is handed back afterwards
+	reservedSize := compressedSizeBound(size)
 
-	root, err := w.depot.reserveRoot(estimatedCompressedSize)
+	root, err := w.depot.reserveRoot(reservedSize)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("failed to store %s: %v", path, err)
 	}
 
-	outpath := pathFromSha1HexEncoding(w.depot.roots[root].path, sha1Hex, gzipSuffix)
-
 	w.depot.cache.Set(sha1Hex, &cacheValue{
 		hh:        hh,
 		rootIndex: root,
 	}, 1)
 
-	r, err = ro()
+	dw := &depotWrite{
+		outpath:      pathFromSha1HexEncoding(w.depot.roots[root].path, sha1Hex, gzipSuffix),
+		ro:           ro,
+		md5crcBuffer: make([]byte, len(md5crcBuffer)),
+		root:         root,
+		reservedSize: reservedSize,
+		sha1Hex:      sha1Hex,
+		path:         path,
+		size:         size,
+		pf:           w.pf,
+	}
+	copy(dw.md5crcBuffer, md5crcBuffer)
+
+	return w.pm.writeToDepot(dw)
+}
+
+// depotWrite is a rom handed from a hashing worker to the depot writers.
+type depotWrite struct {
+	outpath      string
+	ro           readerOpener
+	md5crcBuffer []byte
+	root         int
+	reservedSize int64
+	sha1Hex      string
+	path         string
+	size         int64
+	pf           *pendingFile
+}
+
+// pendingFile tracks a file processed by a worker until the depot writers
+// have written all of its roms, at which point it is reported to the resume
+// log observer.
+type pendingFile struct {
+	pm   *archiveGru
+	comp *completed
+
+	mutex      sync.Mutex
+	processing bool
+	writes     int
+	releases   []func()
+	skipped    bool
+}
+
+// skip records that a rom of the file isn't stored because no DAT needs it.
+func (pf *pendingFile) skip() {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	pf.skipped = true
+}
+
+// stored tells whether every rom of the file is in the depot, once the pending
+// writes of the file are done.
+func (pf *pendingFile) stored() bool {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	return !pf.skipped && pf.comp.status != resumeStatusFailed
+}
+
+func (pf *pendingFile) addWrite() {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	pf.writes++
+}
+
+// releaseAfterWrites calls release once the pending writes of the file are done.
+func (pf *pendingFile) releaseAfterWrites(release func()) {
+	pf.mutex.Lock()
+	if pf.writes > 0 {
+		pf.releases = append(pf.releases, release)
+		release = nil
+	}
+	pf.mutex.Unlock()
+
+	if release != nil {
+		release()
+	}
+}
+
+func (pf *pendingFile) writeDone(err error) {
+	pf.mutex.Lock()
+	pf.writes--
+	pf.fail(err)
+	var releases []func()
+	if pf.writes == 0 {
+		releases = pf.releases
+		pf.releases = nil
+	}
+	complete := pf.writes == 0 && !pf.processing
+	pf.mutex.Unlock()
+
+	for _, release := range releases {
+		release()
+	}
+	if complete {
+		pf.pm.soFar <- pf.comp
+	}
+}
+
+// processed ends the processing of the file by its worker.
+func (pf *pendingFile) processed(err error) {
+	pf.mutex.Lock()
+	pf.processing = false
+	pf.fail(err)
+	complete := pf.writes == 0
+	pf.mutex.Unlock()
+
+	if complete {
+		pf.pm.soFar <- pf.comp
+	}
+}
+
+func (pf *pendingFile) fail(err error) {
 	if err != nil {
-		return 0, err
+		pf.comp.status = resumeStatusFailed
 	}
-	defer r.Close()
+}
 
-	compressedSize, err := archive(outpath, r, md5crcBuffer)
+// startDepotWriters launches numWriters goroutines that gzip roms into the
+// depot, fed by the hashing workers over a channel bounded to numWriters
+// pending writes. With numWriters <= 0 every worker writes its roms itself.
+func (pm *archiveGru) startDepotWriters(numWriters int) {
+	if numWriters <= 0 {
+		return
+	}
+
+	pm.writes = make(chan *depotWrite, numWriters)
+	pm.writersDone.Add(numWriters)
+	for i := 0; i < numWriters; i++ {
+		go func() {
+			defer pm.writersDone.Done()
+
+			for dw := range pm.writes {
+				_, err := pm.writeDepotRom(dw)
+				if err != nil {
+					glog.Errorf("failed to store %s: %v", dw.path, err)
+					pm.recordWriteErr(err)
+
+					// the worker of dw has moved on and can't stop the run
+					if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENOSPC {
+						pm.pt.Stop(nil)
+					}
+				}
+				dw.pf.writeDone(err)
+			}
+		}()
+	}
+}
+
+func (pm *archiveGru) stopDepotWriters() {
+	if pm.writes == nil {
+		return
+	}
+
+	close(pm.writes)
+	pm.writersDone.Wait()
+}
+
+// writeToDepot stores the rom of dw in the depot. With depot writers it hands
+// dw to them and returns right away with a compressed size of 0, the file of dw
+// stays pending until the rom is written.
+func (pm *archiveGru) writeToDepot(dw *depotWrite) (int64, error) {
+	if pm.writes == nil {
+		return pm.writeDepotRom(dw)
+	}
+
+	dw.pf.addWrite()
+	pm.writes <- dw
+	return 0, nil
+}
+
+// writeDepotRom writes the rom of dw and settles the size reserved for it.
+func (pm *archiveGru) writeDepotRom(dw *depotWrite) (int64, error) {
+	compressedSize, err := pm.writeRom(dw.outpath, dw.ro, dw.md5crcBuffer)
 	if err != nil {
+		pm.depot.adjustSize(dw.root, -dw.reservedSize, "")
 		return 0, err
 	}
 
-	w.depot.adjustSize(root, compressedSize-estimatedCompressedSize, sha1Hex)
+	pm.depot.adjustSize(dw.root, compressedSize-dw.reservedSize, dw.sha1Hex)
+	pm.countAdded(dw.size, compressedSize)
+	pm.fireRomAdded(dw.sha1Hex, dw.path, dw.size)
 	return compressedSize, nil
 }
 
+func (pm *archiveGru) recordWriteErr(err error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if pm.writeErr == nil {
+		pm.writeErr = err
+	}
+}
+
+func (pm *archiveGru) firstWriteErr() error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return pm.writeErr
+}
+
+func (pm *archiveGru) writeRom(outpath string, ro readerOpener, md5crcBuffer []byte) (int64, error) {
+	var compressedSize int64
+	err := pm.writeRetrier.do(outpath, func() error {
+		r, err := ro()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		compressedSize, err = archive(outpath, r, md5crcBuffer, !pm.depot.noFsync)
+		return err
+	})
+	return compressedSize, err
+}
+
 type zipWorkResult struct {
 	compressedSize int64
 	err            error
@@ -446,6 +777,8 @@ func (zw *zipWorker) Work() {
 	var nrProcessed int
 
 	for zf := range zw.in {
+		// the depot writers open zf after the loop moved on
+		zf := zf
 		glog.V(4).Infof("subworker %d: archiving zip %s: file %s", zw.index, zw.inpath, zf.FileInfo().Name())
 
 		cs, err := zw.w.archive(func() (io.ReadCloser, error) { return zf.Open() },
@@ -468,89 +801,124 @@ func (zw *zipWorker) Work() {
 func (w *archiveWorker) archiveZip(inpath string, size int64, addZipItself int) (int64, error) {
 	glog.V(4).Infof("archiving zip %s ", inpath)
 
-	var compressedSize int64
+	var zipSha1 []byte
 
-	if addZipItself <= 1 {
-		var zfs []zipF
+	if w.pm.trackZipHashes {
+		var err error
+		zipSha1, err = sha1ForFile(inpath)
+		if err != nil {
+			return 0, err
+		}
 
-		if w.pm.useGoZip {
-			zr, err := zip.OpenReader(inpath)
-			if err != nil {
-				return 0, err
-			}
-			defer zr.Close()
+		seen, err := w.depot.RomDB.IsZipSeen(zipSha1)
+		if err != nil {
+			return 0, err
+		}
 
-			zfs = make([]zipF, len(zr.File))
-			for i, zf := range zr.File {
-				zfs[i] = zipF(zf)
+		if seen {
+			glog.V(4).Infof("zip %s with sha1 %s already archived, skipping", inpath, hex.EncodeToString(zipSha1))
+			return 0, nil
+		}
+	}
+
+	compressedSize, err := w.archiveZipContents(inpath, size, addZipItself)
+	if err != nil {
+		return 0, err
+	}
+
+	if zipSha1 != nil {
+		// the zip is only seen once all of its roms made it into the depot,
+		// a later run still archives the ones skipped or failed now
+		pf := w.pf
+		pf.releaseAfterWrites(func() {
+			if !pf.stored() {
+				glog.V(4).Infof("not all roms of zip %s stored, not recording it", inpath)
+				return
 			}
-		} else {
-			zr, err := czip.OpenReader(inpath)
+			err := w.depot.RomDB.IndexZip(zipSha1)
 			if err != nil {
-				return 0, err
-			}
-			defer zr.Close()
-
-			zfs = make([]zipF, len(zr.File))
-			for i, zf := range zr.File {
-				zfs[i] = zipF(zf)
+				glog.Errorf("failed to record zip %s: %v", inpath, err)
+				w.pm.recordWriteErr(err)
 			}
-		}
+		})
+	}
+	return compressedSize, nil
+}
 
-		glog.V(4).Infof("zip entries %d: %s", len(zfs), inpath)
+// archiveZipEntries archives the files in the zip file at inpath. The zip file is closed
+// once the depot writers are done with its entries, before the slot of the source file
+// in the file limiter is released.
+func (w *archiveWorker) archiveZipEntries(inpath string) (int64, error) {
+	var compressedSize int64
+	var zfs []zipF
 
-		in := make(chan zipF)
-		out := make(chan zipWorkResult)
+	closeZip := func(zr io.Closer) {
+		w.pf.releaseAfterWrites(func() {
+			err := zr.Close()
+			if err != nil {
+				glog.Errorf("error closing zip %s: %v", inpath, err)
+			}
+		})
+	}
 
-		numWorkers := w.pm.NumWorkers()
+	if w.pm.useGoZip {
+		zr, err := zip.OpenReader(inpath)
+		if err != nil {
+			return 0, err
+		}
+		defer closeZip(zr)
 
-		for i := 0; i < numWorkers; i++ {
-			zw := &zipWorker{
-				index:        i,
-				inpath:       inpath,
-				w:            w,
-				in:           in,
-				out:          out,
-				hh:           newHashes(),
-				md5crcBuffer: make([]byte, md5.Size+crc32.Size+8),
-			}
-			go zw.Work()
+		zfs = make([]zipF, len(zr.File))
+		for i, zf := range zr.File {
+			zfs[i] = zipF(zf)
 		}
+	} else {
+		zr, err := czip.OpenReader(inpath)
+		if err != nil {
+			return 0, err
+		}
+		defer closeZip(zr)
 
-		var perr error
-		var nrProcessed int
-		var nrScheduled int
-
-		expectedResults := numWorkers
-
-		for _, zf := range zfs {
-			select {
-			case in <- zf:
-				glog.V(4).Infof("scheduled %s from zip %s", zf.FileInfo().Name(), inpath)
-				nrScheduled++
-			case zwr := <-out:
-				expectedResults--
-				glog.Warningf("breaking out of the zip loop before all files are scheduled: %s", inpath)
-				if zwr.err != nil {
-					perr = zwr.err
-					break
-				}
-				compressedSize += zwr.compressedSize
-				nrProcessed += zwr.nrProcessed
-			}
+		zfs = make([]zipF, len(zr.File))
+		for i, zf := range zr.File {
+			zfs[i] = zipF(zf)
 		}
+	}
+
+	glog.V(4).Infof("zip entries %d: %s", len(zfs), inpath)
 
-		close(in)
+	in := make(chan zipF)
+	out := make(chan zipWorkResult)
 
-		if perr != nil {
-			glog.Errorf("zip error %s: %v", inpath, perr)
-			return 0, perr
+	numWorkers := w.pm.NumWorkers()
+
+	for i := 0; i < numWorkers; i++ {
+		zw := &zipWorker{
+			index:        i,
+			inpath:       inpath,
+			w:            w,
+			in:           in,
+			out:          out,
+			hh:           newHashes(),
+			md5crcBuffer: make([]byte, md5.Size+crc32.Size+8),
 		}
+		go zw.Work()
+	}
 
-		glog.V(4).Infof("reading results from zip %s", inpath)
+	var perr error
+	var nrProcessed int
+	var nrScheduled int
 
-		for i := 0; i < expectedResults; i++ {
-			zwr := <-out
+	expectedResults := numWorkers
+
+	for _, zf := range zfs {
+		select {
+		case in <- zf:
+			glog.V(4).Infof("scheduled %s from zip %s", zf.FileInfo().Name(), inpath)
+			nrScheduled++
+		case zwr := <-out:
+			expectedResults--
+			glog.Warningf("breaking out of the zip loop before all files are scheduled: %s", inpath)
 			if zwr.err != nil {
 				perr = zwr.err
 				break
@@ -558,19 +926,51 @@ func (w *archiveWorker) archiveZip(inpath string, size int64, addZipItself int)
 			compressedSize += zwr.compressedSize
 			nrProcessed += zwr.nrProcessed
 		}
+	}
+
+	close(in)
+
+	if perr != nil {
+		glog.Errorf("zip error %s: %v", inpath, perr)
+		return 0, perr
+	}
 
-		if nrProcessed != len(zfs) || nrScheduled != len(zfs) {
-			glog.Warningf("scheduled/processed fewer zip entries: scheduled %d, processed %d, expected %d: %s",
-				nrScheduled, nrProcessed, len(zfs), inpath)
+	glog.V(4).Infof("reading results from zip %s", inpath)
+
+	for i := 0; i < expectedResults; i++ {
+		zwr := <-out
+		if zwr.err != nil {
+			perr = zwr.err
+			break
 		}
+		compressedSize += zwr.compressedSize
+		nrProcessed += zwr.nrProcessed
+	}
+
+	if nrProcessed != len(zfs) || nrScheduled != len(zfs) {
+		glog.Warningf("scheduled/processed fewer zip entries: scheduled %d, processed %d, expected %d: %s",
+			nrScheduled, nrProcessed, len(zfs), inpath)
+	}
+
+	glog.V(4).Infof("scheduled %d, processed %d, expected %d: %s", nrScheduled, nrProcessed, len(zfs), inpath)
+	glog.V(4).Infof("finished archiving contents of zip %s", inpath)
+
+	if perr != nil {
+		glog.Errorf("zip error %s: %v", inpath, perr)
+		return 0, perr
+	}
+	return compressedSize, nil
+}
 
-		glog.V(4).Infof("scheduled %d, processed %d, expected %d: %s", nrScheduled, nrProcessed, len(zfs), inpath)
-		glog.V(4).Infof("finished archiving contents of zip %s", inpath)
+func (w *archiveWorker) archiveZipContents(inpath string, size int64, addZipItself int) (int64, error) {
+	var compressedSize int64
 
-		if perr != nil {
-			glog.Errorf("zip error %s: %v", inpath, perr)
-			return 0, perr
+	if addZipItself <= 1 {
+		cs, err := w.archiveZipEntries(inpath)
+		if err != nil {
+			return 0, err
 		}
+		compressedSize += cs
 	}
 
 	if addZipItself >= 1 {
@@ -596,11 +996,10 @@ func (w *archiveWorker) archive7Zip(inpath string, size int64, addZipItself int)
 		}
 
 		for index, zf := range zr.Entries {
+			index := index
 			glog.V(4).Infof("archiving 7zip %s: file %s ", inpath, zf.Path)
 
-			cs, err := w.archive(func() (io.ReadCloser, error) {
-				return zr.GetFileReader(index)
-			}, zf.Path, filepath.Join(inpath, zf.Path), int64(zf.Size), w.hh, w.md5crcBuffer)
+			cs, err := w.archive(func() (io.ReadCloser, error) { return zr.GetFileReader(index) }, zf.Path, filepath.Join(inpath, zf.Path), int64(zf.Size), w.hh, w.md5crcBuffer)
 
 			if err != nil {
 				glog.Errorf("7zip error %s: %v", inpath, err)
@@ -693,45 +1092,7 @@ func (w *archiveWorker) archiveRom(inpath string, size int64) (int64, error) {
 		filepath.Base(inpath), inpath, size, w.hh, w.md5crcBuffer)
 }
 
-func writeResumeLogEntry(comps []string, depot *Depot, resumeLogWriter *bufio.Writer) {
-	nonEmptyComps := []string{}
-
-	for _, comp := range comps {
-		comp = strings.TrimSpace(comp)
-		if len(comp) > 0 {
-			nonEmptyComps = append(nonEmptyComps, comp)
-		}
-	}
-	sort.Strings(nonEmptyComps)
-
-	for _, ncomp := range nonEmptyComps {
-		fmt.Fprintf(resumeLogWriter, "%s %x\n", ncomp, sha1.Sum([]byte(ncomp)))
-	}
-	depot.writeSizes()
-}
-
-func loopObserver(numWorkers int, soFar chan *completed,
-	depot *Depot, resumeLogWriter *bufio.Writer) {
-	ticker := time.NewTicker(time.Minute)
-	comps := make([]string, numWorkers)
-
-	for {
-		select {
-		case comp := <-soFar:
-			if comp.workerIndex == -1 {
-				writeResumeLogEntry(comps, depot, resumeLogWriter)
-				break
-			}
-			comps[comp.workerIndex] = comp.path
-		case <-ticker.C:
-			writeResumeLogEntry(comps, depot, resumeLogWriter)
-		}
-	}
-
-	ticker.Stop()
-}
-
-func archive(outpath string, r io.Reader, extra []byte) (int64, error) {
+func archive(outpath string, r io.Reader, extra []byte, fsync bool) (int64, error) {
 	br := bufio.NewReader(r)
 
 	err := os.MkdirAll(filepath.Dir(outpath), 0777)
@@ -744,6 +1105,24 @@ func archive(outpath string, r io.Reader, extra []byte) (int64, error) {
 		return 0, err
 	}
 
+	n, err := writeGZ(outfile, br, extra, fsync)
+	cerr := outfile.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// a truncated file would pass for the rom being in the depot
+		rerr := os.Remove(outpath)
+		if rerr != nil {
+			glog.Errorf("error removing %s: %v", outpath, rerr)
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// writeGZ gzips r into outfile and returns the number of bytes written to it.
+func writeGZ(outfile *os.File, r io.Reader, extra []byte, fsync bool) (int64, error) {
 	cw := &countWriter{
 		w: outfile,
 	}
@@ -759,7 +1138,7 @@ func archive(outpath string, r io.Reader, extra []byte) (int64, error) {
 		zipWriter.Header.Extra = extra
 	}
 
-	_, err = io.Copy(zipWriter, br)
+	_, err := io.Copy(zipWriter, r)
 	if err != nil {
 		return 0, err
 	}
@@ -769,12 +1148,17 @@ func archive(outpath string, r io.Reader, extra []byte) (int64, error) {
 		return 0, err
 	}
 
-	bufout.Flush()
-
-	err = outfile.Close()
+	err = bufout.Flush()
 	if err != nil {
 		return 0, err
 	}
 
+	if fsync {
+		err = outfile.Sync()
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	return cw.count, nil
 }
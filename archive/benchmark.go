@@ -0,0 +1,204 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/uwedeportivo/romba/util"
+)
+
+// benchmarkBlockSize is the size of the random block the synthetic files repeat.
+// It is larger than the deflate window, so the files don't compress.
+const benchmarkBlockSize = 1 << 20
+
+// BenchmarkResult holds the throughput measured by Benchmark.
+type BenchmarkResult struct {
+	NumFiles  int
+	FileSize  int64
+	HashTime  time.Duration
+	WriteTime time.Duration
+	ReadTime  time.Duration
+}
+
+func throughput(numBytes int64, d time.Duration) string {
+	if d <= 0 {
+		return "n/a"
+	}
+	return humanize.IBytes(uint64(float64(numBytes)/d.Seconds())) + "/s"
+}
+
+func (br *BenchmarkResult) String() string {
+	total := int64(br.NumFiles) * br.FileSize
+	return fmt.Sprintf("benchmarked %d files of %s\nhashing: %s in %v\nwriting: %s in %v\nreading: %s in %v\n",
+		br.NumFiles, humanize.IBytes(uint64(br.FileSize)),
+		throughput(total, br.HashTime), br.HashTime,
+		throughput(total, br.WriteTime), br.WriteTime,
+		throughput(total, br.ReadTime), br.ReadTime)
+}
+
+// benchmarkReader returns the content of synthetic file index: the index followed
+// by the random block repeated up to size bytes.
+func benchmarkReader(index int, size int64, block []byte) io.Reader {
+	prefix := make([]byte, 8)
+	util.Int64ToBytes(int64(index), prefix)
+
+	blocks := make([]io.Reader, 0, size/int64(len(block))+2)
+	blocks = append(blocks, bytes.NewReader(prefix))
+	for n := int64(0); n < size; n += int64(len(block)) {
+		blocks = append(blocks, bytes.NewReader(block))
+	}
+	return io.LimitReader(io.MultiReader(blocks...), size)
+}
+
+// runBenchmarkPhase calls f for every file index using numWorkers goroutines and
+// returns the elapsed time and the first error.
+func runBenchmarkPhase(numFiles, numWorkers int, f func(index int) error) (time.Duration, error) {
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var perr error
+
+	start := time.Now()
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				err := f(index)
+				if err != nil {
+					mutex.Lock()
+					if perr == nil {
+						perr = err
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < numFiles; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	return time.Since(start), perr
+}
+
+// Benchmark measures hashing, depot write and depot read throughput with numFiles
+// synthetic files of fileSize random bytes, processed by numWorkers workers. The
+// files are hashed and stored like archive does and read back like build does,
+// into a scratch depot root created below dir and removed afterwards.
+func Benchmark(dir string, numFiles int, fileSize int64, numWorkers int, fsync bool) (*BenchmarkResult, error) {
+	if numFiles <= 0 || fileSize <= 0 || numWorkers <= 0 {
+		return nil, fmt.Errorf("number of files, file size and number of workers need to be positive")
+	}
+
+	root, err := ioutil.TempDir(dir, "romba_benchmark")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(root)
+
+	blockSize := int64(benchmarkBlockSize)
+	if fileSize < blockSize {
+		blockSize = fileSize
+	}
+	block := make([]byte, blockSize)
+	rand.New(rand.NewSource(time.Now().UnixNano())).Read(block)
+
+	br := &BenchmarkResult{
+		NumFiles: numFiles,
+		FileSize: fileSize,
+	}
+
+	hashes := make([]*Hashes, numFiles)
+	br.HashTime, err = runBenchmarkPhase(numFiles, numWorkers, func(index int) error {
+		hh, err := hashesForReader(benchmarkReader(index, fileSize, block))
+		if err != nil {
+			return err
+		}
+		hashes[index] = hh
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	br.WriteTime, err = runBenchmarkPhase(numFiles, numWorkers, func(index int) error {
+		hh := hashes[index]
+		md5crcBuffer := make([]byte, md5.Size+crc32.Size+8)
+		copy(md5crcBuffer[0:md5.Size], hh.Md5)
+		copy(md5crcBuffer[md5.Size:md5.Size+crc32.Size], hh.Crc)
+		util.Int64ToBytes(fileSize, md5crcBuffer[md5.Size+crc32.Size:])
+
+		outpath := pathFromSha1HexEncoding(root, hex.EncodeToString(hh.Sha1), gzipSuffix)
+		_, err := archive(outpath, benchmarkReader(index, fileSize, block), md5crcBuffer, fsync)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	br.ReadTime, err = runBenchmarkPhase(numFiles, numWorkers, func(index int) error {
+		rompath := pathFromSha1HexEncoding(root, hex.EncodeToString(hashes[index].Sha1), gzipSuffix)
+		r, err := openGzipReadCloser(rompath)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		n, err := io.Copy(ioutil.Discard, r)
+		if err != nil {
+			return err
+		}
+		if n != fileSize {
+			return fmt.Errorf("read back %d bytes from %s, expected %d", n, rompath, fileSize)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return br, nil
+}
@@ -35,6 +35,7 @@ import (
 	"encoding/hex"
 	"github.com/uwedeportivo/romba/worker"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -45,41 +46,56 @@ import (
 	"github.com/uwedeportivo/romba/config"
 	"github.com/uwedeportivo/romba/dedup"
 	"github.com/uwedeportivo/romba/types"
-	"github.com/uwedeportivo/torrentzip"
 )
 
 type gameBuilder struct {
-	depot    *Depot
-	datPath  string
-	fixDat   *types.Dat
-	mutex    *sync.Mutex
-	wc       chan *types.Game
-	erc      chan error
-	closeC   chan bool
-	index    int
-	deduper  dedup.Deduper
-	sha1Tree int
+	depot   *Depot
+	datPath string
+	fixDat  *types.Dat
+	mutex   *sync.Mutex
+	wc      chan *types.Game
+	erc     chan error
+	closeC  chan bool
+	index   int
+	deduper dedup.Deduper
+	opts    *BuildOptions
 }
 
 func (gb *gameBuilder) work() {
 	glog.V(4).Infof("starting subworker %d", gb.index)
 	for game := range gb.wc {
 		gamePath := filepath.Join(gb.datPath, game.Name)
-		if gb.sha1Tree > 0 {
+		if gb.opts.Sha1Tree != nil {
 			gamePath = gb.datPath
 		}
-		fixGame, foundRom, err := gb.depot.buildGame(game, gamePath, gb.fixDat.UnzipGames, gb.deduper, gb.sha1Tree)
+		fixGame, foundRom, err := gb.depot.buildGame(game, gamePath, gb.fixDat.UnzipGames, gb.deduper, gb.opts)
 		if err != nil {
 			glog.Errorf("error processing %s: %v", gamePath, err)
 			gb.erc <- err
 			break
 		}
+		if gb.opts.SamplesDir != "" && len(game.Samples) > 0 {
+			missing, err := gatherSamples(game, gb.opts.SamplesDir, gb.datPath)
+			if err != nil {
+				glog.Errorf("error gathering samples of %s: %v", gamePath, err)
+				gb.erc <- err
+				break
+			}
+			if len(missing) > 0 {
+				if fixGame == nil {
+					fixGame = new(types.Game)
+					fixGame.CopyHeader(game)
+				}
+				fixGame.SampleOf = game.SampleOf
+				fixGame.Samples = missing
+			}
+		}
 		if fixGame != nil {
 			gb.mutex.Lock()
 			gb.fixDat.Games = append(gb.fixDat.Games, fixGame)
 			gb.mutex.Unlock()
 		}
-		if !foundRom && gb.sha1Tree == 0 {
+		if !foundRom && gb.opts.Sha1Tree == nil {
 			if gb.fixDat.UnzipGames {
 				err := os.RemoveAll(gamePath)
 				if err != nil && !os.IsNotExist(err) {
@@ -88,9 +104,9 @@ func (gb *gameBuilder) work() {
 					break
 				}
 			} else {
-				err := os.Remove(gamePath + zipSuffix)
+				err := os.Remove(gamePath + gameSuffix(gb.opts.Format))
 				if err != nil && !os.IsNotExist(err) {
-					glog.Errorf("error removing %s: %v", gamePath+zipSuffix, err)
+					glog.Errorf("error removing %s: %v", gamePath+gameSuffix(gb.opts.Format), err)
 					gb.erc <- err
 					break
 				}
@@ -102,15 +118,67 @@ func (gb *gameBuilder) work() {
 	return
 }
 
+// DefaultSha1TreeDepth is the number of directory levels of the depot's sha1 tree.
+const DefaultSha1TreeDepth = 4
+
+// Sha1Tree is the layout of a build that copies the roms of the games into a
+// sha1 tree like the depot's instead of building the games.
+type Sha1Tree struct {
+	// Depth is the number of directory levels above each rom, each level named
+	// after the next two hex digits of its sha1.
+	Depth int
+	// KeepGzip copies the gzip files of the depot instead of decompressing them.
+	KeepGzip bool
+}
+
+// Sha1TreeFromLegacy returns the layout selected by the value of the deprecated
+// -sha1Tree build flag: none for 0, gzip files for 1, decompressed roms above 1,
+// with the depot's depth.
+func Sha1TreeFromLegacy(v int) *Sha1Tree {
+	if v <= 0 {
+		return nil
+	}
+	return &Sha1Tree{
+		Depth:    DefaultSha1TreeDepth,
+		KeepGzip: v == 1,
+	}
+}
+
+// BuildOptions are the settings of a build beyond the ones every build needs.
+type BuildOptions struct {
+	// Sha1Tree copies the roms into a sha1 tree instead of building the games, if not nil.
+	Sha1Tree *Sha1Tree
+	// Format is the format of the built games, zip if empty.
+	Format string
+	// ZipCompression is the compression of game zips, torrentzip if nil.
+	ZipCompression *ZipCompression
+	// ScratchDir is where games are staged, the configured tmp dir if empty.
+	ScratchDir string
+	// SamplesDir is where the samples of the games are gathered from, if not empty.
+	SamplesDir string
+	// MatchKey selects the hashes roms are looked up by, sha1 if empty. Fixdats
+	// list the roms with all the hashes of the DAT.
+	MatchKey dedup.MatchKey
+}
+
+// BuildDat builds the games of dat below outpath.
 func (depot *Depot) BuildDat(dat *types.Dat, outpath string, numSubworkers int, deduper dedup.Deduper,
-	unzipAllGames bool, sha1Tree int) (bool, error) {
+	unzipAllGames bool, opts *BuildOptions) (bool, error) {
+
+	bopts := BuildOptions{}
+	if opts != nil {
+		bopts = *opts
+	}
+	if bopts.ScratchDir == "" {
+		bopts.ScratchDir = config.GlobalConfig.General.TmpDir
+	}
 
 	datPath := filepath.Join(outpath, dat.Name)
-	if sha1Tree > 0 {
+	if bopts.Sha1Tree != nil {
 		datPath = outpath
 	}
 
-	if sha1Tree == 0 {
+	if bopts.Sha1Tree == nil {
 		err := os.Mkdir(datPath, 0777)
 		if err != nil {
 			return false, err
@@ -140,7 +208,7 @@ func (depot *Depot) BuildDat(dat *types.Dat, outpath string, numSubworkers int,
 		gb.index = i
 		gb.deduper = deduper
 		gb.closeC = closeC
-		gb.sha1Tree = sha1Tree
+		gb.opts = &bopts
 
 		go gb.work()
 	}
@@ -259,13 +327,21 @@ func cpGZUncompressed(srcName, dstName string) error {
 }
 
 func (depot *Depot) buildGame(game *types.Game, gamePath string,
-	unzipGame bool, deduper dedup.Deduper, sha1Tree int) (*types.Game, bool, error) {
+	unzipGame bool, deduper dedup.Deduper, opts *BuildOptions) (*types.Game, bool, error) {
+
+	var gameTorrent gameZipWriter
+	var gameFile *os.File
+
+	zipPath := gamePath + zipSuffix
+	partialPath := zipPath + partialSuffix
 
-	var gameTorrent *torrentzip.Writer
+	// roms of games built as torrent7z are staged unzipped in romsDir first
+	romsDir := gamePath
+	stageGame := false
 
 	glog.V(4).Infof("building game %s with path %s", game.Name, gamePath)
 
-	if sha1Tree == 0 {
+	if opts.Sha1Tree == nil {
 		if unzipGame {
 			err := os.Mkdir(gamePath, 0777)
 			if err != nil {
@@ -283,27 +359,44 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 				}
 			}
 
-			gameFile, err := os.Create(gamePath + zipSuffix)
+			if opts.Format == BuildFormatT7z {
+				stagingDir, err := ioutil.TempDir(opts.ScratchDir, "romba_t7z")
+				if err != nil {
+					glog.Errorf("error creating staging dir for %s: %v", gamePath+sevenzipSuffix, err)
+					return nil, false, err
+				}
+				defer os.RemoveAll(stagingDir)
+
+				romsDir = stagingDir
+				stageGame = true
+			}
+		}
+
+		if !unzipGame && !stageGame {
+			err := discardPartialZip(partialPath)
 			if err != nil {
-				glog.Errorf("error creating zip file %s: %v", gamePath+zipSuffix, err)
 				return nil, false, err
 			}
-			defer func() {
-				err := gameFile.Close()
-				if err != nil {
-					glog.Errorf("error, failed to close %s: %v", gamePath+zipSuffix, err)
-				}
-			}()
 
-			gameTorrent, err = torrentzip.NewWriterWithTemp(gameFile, config.GlobalConfig.General.TmpDir)
+			gameFile, err = os.Create(partialPath)
 			if err != nil {
-				glog.Errorf("error writing to torrentzip file %s: %v", gamePath+zipSuffix, err)
+				glog.Errorf("error creating zip file %s: %v", partialPath, err)
+				return nil, false, err
+			}
+
+			gameTorrent, err = newGameZipWriter(gameFile, opts.ScratchDir, opts.ZipCompression)
+			if err != nil {
+				glog.Errorf("error writing to zip file %s: %v", partialPath, err)
+				gameFile.Close()
+				os.Remove(partialPath)
 				return nil, false, err
 			}
 			defer func() {
-				err := gameTorrent.Close()
-				if err != nil {
-					glog.Errorf("error, failed to close %s: %v", gamePath+zipSuffix, err)
+				// still set only if building the game failed
+				if gameTorrent != nil {
+					gameTorrent.Close()
+					gameFile.Close()
+					os.Remove(partialPath)
 				}
 			}()
 		}
@@ -313,7 +406,9 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 
 	foundRom := false
 
-	for _, rom := range game.Roms {
+	for _, dr := range game.Roms {
+		rom := dedup.KeyRom(dr, opts.MatchKey)
+
 		croms, err := depot.RomDB.CompleteRom(rom)
 		if err != nil {
 			glog.Errorf("error completing rom %s: %v", rom.Name, err)
@@ -331,7 +426,7 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 				fixGame.Description = game.Description
 			}
 
-			fixGame.Roms = append(fixGame.Roms, rom)
+			fixGame.Roms = append(fixGame.Roms, dr)
 			continue
 		}
 
@@ -350,7 +445,7 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 			return nil, false, err
 		}
 
-		if sha1Tree > 0 {
+		if opts.Sha1Tree != nil {
 			hexStr := hex.EncodeToString(rom.Sha1)
 			exists, rompath, err := depot.RomInDepot(hexStr)
 			if err != nil {
@@ -365,11 +460,11 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 				}
 			} else {
 				var destPath string
-				if sha1Tree == 1 {
-					destPath = pathFromSha1HexEncoding(gamePath, hexStr, gzipSuffix)
+				if opts.Sha1Tree.KeepGzip {
+					destPath = sha1TreePath(gamePath, hexStr, gzipSuffix, opts.Sha1Tree.Depth)
 					err = worker.Cp(rompath, destPath)
 				} else {
-					destPath = pathFromSha1HexEncoding(gamePath, hexStr, "")
+					destPath = sha1TreePath(gamePath, hexStr, "", opts.Sha1Tree.Depth)
 					err = cpGZUncompressed(rompath, destPath)
 				}
 				if err != nil {
@@ -398,7 +493,7 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 				fixGame.Description = game.Description
 			}
 
-			fixGame.Roms = append(fixGame.Roms, rom)
+			fixGame.Roms = append(fixGame.Roms, dr)
 			continue
 		}
 
@@ -412,8 +507,8 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 
 		var dstWriter io.WriteCloser
 
-		if unzipGame {
-			romPath := filepath.Join(gamePath, rom.Name)
+		if unzipGame || stageGame {
+			romPath := filepath.Join(romsDir, rom.Name)
 			if strings.ContainsRune(rom.Name, filepath.Separator) {
 				err := os.MkdirAll(filepath.Dir(romPath), 0777)
 				if err != nil {
@@ -458,5 +553,120 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 			return nil, false, err
 		}
 	}
-	return fixGame, foundRom, nil
+
+	foundDisk, err := depot.buildDisks(game, gamePath, opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if gameTorrent != nil {
+		gt := gameTorrent
+		gameTorrent = nil
+
+		err := finishPartialZip(gt, gameFile, partialPath, zipPath, foundRom)
+		if err != nil {
+			glog.Errorf("error finishing torrentzip file %s: %v", zipPath, err)
+			return nil, false, err
+		}
+	}
+
+	if stageGame && foundRom {
+		err := torrent7z(gamePath+sevenzipSuffix, romsDir)
+		if err != nil {
+			glog.Errorf("error creating torrent7z file %s: %v", gamePath+sevenzipSuffix, err)
+			return nil, false, err
+		}
+	}
+	return fixGame, foundRom || foundDisk, nil
+}
+
+// buildDisks copies the CHDs of the disks of game found in the depot into the dir
+// named like the game, where MAME looks for them. Missing disks are only logged.
+func (depot *Depot) buildDisks(game *types.Game, gamePath string, opts *BuildOptions) (bool, error) {
+	foundDisk := false
+
+	for _, disk := range game.Disks {
+		if !disk.Dumped() {
+			continue
+		}
+
+		hexStr := hex.EncodeToString(disk.Sha1)
+		exists, diskpath, err := depot.RomInDepot(hexStr)
+		if err != nil {
+			glog.Errorf("error opening disk %s from depot: %v", disk.Name, err)
+			return false, err
+		}
+
+		if !exists {
+			if glog.V(2) {
+				glog.Warningf("game %s has missing disk %s (sha1 %s)", game.Name, disk.Name, hexStr)
+			}
+			continue
+		}
+
+		var destPath string
+		if opts.Sha1Tree != nil {
+			if opts.Sha1Tree.KeepGzip {
+				destPath = sha1TreePath(gamePath, hexStr, gzipSuffix, opts.Sha1Tree.Depth)
+				err = worker.Cp(diskpath, destPath)
+			} else {
+				destPath = sha1TreePath(gamePath, hexStr, "", opts.Sha1Tree.Depth)
+				err = cpGZUncompressed(diskpath, destPath)
+			}
+		} else {
+			destPath = filepath.Join(gamePath, disk.Name)
+			if strings.ToLower(filepath.Ext(destPath)) != chdSuffix {
+				destPath += chdSuffix
+			}
+			err = cpGZUncompressed(diskpath, destPath)
+		}
+		if err != nil {
+			glog.Errorf("error copying disk %s from depot to %s: %v", diskpath, destPath, err)
+			return false, err
+		}
+		foundDisk = true
+	}
+	return foundDisk, nil
+}
+
+// discardPartialZip removes a game zip or torrent7z file left half assembled by an
+// interrupted build.
+func discardPartialZip(partialPath string) error {
+	err := os.Remove(partialPath)
+	if err == nil {
+		glog.Warningf("discarded partially built %s, rebuilding it", partialPath)
+		return nil
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// finishPartialZip completes the torrentzip assembled in partialPath and renames
+// it to zipPath. Without any roms found there is no game zip and the partial
+// file is removed.
+func finishPartialZip(gt gameZipWriter, gameFile *os.File, partialPath, zipPath string, foundRom bool) error {
+	err := gt.Close()
+	cerr := gameFile.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	if err != nil || !foundRom {
+		rerr := os.Remove(partialPath)
+		if err == nil && rerr != nil && !os.IsNotExist(rerr) {
+			err = rerr
+		}
+		return err
+	}
+
+	return os.Rename(partialPath, zipPath)
+}
+
+func gameSuffix(format string) string {
+	if format == BuildFormatT7z {
+		return sevenzipSuffix
+	}
+	return zipSuffix
 }
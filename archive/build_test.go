@@ -0,0 +1,237 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/dedup"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestBuildGameDiscardsPartialZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_partial")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	outDir := filepath.Join(dir, "out")
+	for _, d := range []string{depotDir, srcDir, outDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(srcDir, "empty.bin"), nil, 0666)
+	if err != nil {
+		t.Fatalf("failed to write empty file: %v", err)
+	}
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true, nil)
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	dat, _, err := parser.ParseDat(strings.NewReader(emptyRomDatText), "testing/empty.dat")
+	if err != nil {
+		t.Fatalf("failed to parse dat: %v", err)
+	}
+
+	gamePath := filepath.Join(outDir, "game")
+	partialPath := gamePath + zipSuffix + partialSuffix
+
+	// leftover of an interrupted build
+	err = ioutil.WriteFile(partialPath, []byte("truncated"), 0666)
+	if err != nil {
+		t.Fatalf("failed to write partial zip: %v", err)
+	}
+
+	_, foundRom, err := depot.buildGame(dat.Games[0], gamePath, false, dedup.NewMemoryDeduper(dedup.MatchKeySha1),
+		&BuildOptions{Format: BuildFormatZip, ScratchDir: dir})
+	if err != nil {
+		t.Fatalf("failed to build game: %v", err)
+	}
+	if !foundRom {
+		t.Fatalf("expected rom found in depot")
+	}
+
+	if _, err = os.Stat(partialPath); !os.IsNotExist(err) {
+		t.Fatalf("expected partial zip %s to be gone, got %v", partialPath, err)
+	}
+
+	zr, err := zip.OpenReader(gamePath + zipSuffix)
+	if err != nil {
+		t.Fatalf("failed to open built game: %v", err)
+	}
+	defer zr.Close()
+
+	if len(zr.File) != 1 || zr.File[0].Name != "empty.bin" {
+		t.Fatalf("expected built game with one rom")
+	}
+}
+
+func TestSha1TreePath(t *testing.T) {
+	hexStr := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+	for _, tc := range []struct {
+		depth int
+		want  string
+	}{
+		{0, filepath.Join("root", hexStr+".gz")},
+		{2, filepath.Join("root", "da", "39", hexStr+".gz")},
+		{DefaultSha1TreeDepth, filepath.Join("root", "da", "39", "a3", "ee", hexStr+".gz")},
+	} {
+		if got := sha1TreePath("root", hexStr, ".gz", tc.depth); got != tc.want {
+			t.Errorf("depth %d: got %s, want %s", tc.depth, got, tc.want)
+		}
+	}
+
+	if st := Sha1TreeFromLegacy(0); st != nil {
+		t.Errorf("legacy 0: got %+v, want nil", st)
+	}
+	if st := Sha1TreeFromLegacy(1); st == nil || !st.KeepGzip || st.Depth != DefaultSha1TreeDepth {
+		t.Errorf("legacy 1: got %+v", st)
+	}
+	if st := Sha1TreeFromLegacy(2); st == nil || st.KeepGzip || st.Depth != DefaultSha1TreeDepth {
+		t.Errorf("legacy 2: got %+v", st)
+	}
+}
+
+const fixDatMatchKeyText = `clrmamepro (
+	name "fixcrc"
+	description "fixcrc"
+)
+
+game (
+	name "game"
+	description "game"
+	rom ( name "a.bin" size 8 crc 0a1b2c3d md5 0123456789abcdef0123456789abcdef sha1 1111111111111111111111111111111111111111 )
+)
+`
+
+func TestFixDatMatchKeyCrc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_fixcrc")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	err = os.MkdirAll(depotDir, 0777)
+	if err != nil {
+		t.Fatalf("failed to create dir %s: %v", depotDir, err)
+	}
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	builds := map[string]func(dat *types.Dat, outDir string) error{
+		"fixdat": func(dat *types.Dat, outDir string) error {
+			_, err := depot.FixDat(dat, outDir, 1, dedup.NewMemoryDeduper(dedup.MatchKeyCrc),
+				dedup.MatchKeyCrc, false)
+			return err
+		},
+		"build": func(dat *types.Dat, outDir string) error {
+			_, err := depot.BuildDat(dat, outDir, 1, dedup.NewMemoryDeduper(dedup.MatchKeyCrc), false,
+				&BuildOptions{Format: BuildFormatZip, ScratchDir: dir, MatchKey: dedup.MatchKeyCrc})
+			return err
+		},
+	}
+
+	for name, build := range builds {
+		outDir := filepath.Join(dir, name)
+		err = os.MkdirAll(outDir, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", outDir, err)
+		}
+
+		dat, _, err := parser.ParseDat(strings.NewReader(fixDatMatchKeyText), "testing/fixcrc.dat")
+		if err != nil {
+			t.Fatalf("failed to parse dat: %v", err)
+		}
+
+		err = build(dat, outDir)
+		if err != nil {
+			t.Fatalf("%s: failed to build dat: %v", name, err)
+		}
+
+		fixPaths, err := filepath.Glob(filepath.Join(outDir, fixPrefix+"*"))
+		if err != nil || len(fixPaths) != 1 {
+			t.Fatalf("%s: expected one fixdat, got %v: %v", name, fixPaths, err)
+		}
+
+		fixDat, _, err := parser.Parse(fixPaths[0])
+		if err != nil {
+			t.Fatalf("%s: failed to parse fixdat: %v", name, err)
+		}
+		if len(fixDat.Games) != 1 || len(fixDat.Games[0].Roms) != 1 {
+			t.Fatalf("%s: expected fixdat with one rom, got %s", name, types.PrintDat(fixDat))
+		}
+
+		// roms are looked up by crc, but the fixdat keeps all their hashes
+		rom := fixDat.Games[0].Roms[0]
+		if hex.EncodeToString(rom.Sha1) != "1111111111111111111111111111111111111111" ||
+			hex.EncodeToString(rom.Md5) != "0123456789abcdef0123456789abcdef" ||
+			hex.EncodeToString(rom.Crc) != "0a1b2c3d" {
+			t.Fatalf("%s: expected fixdat rom with all hashes, got %s", name, types.PrintDat(fixDat))
+		}
+	}
+}
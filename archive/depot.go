@@ -31,11 +31,13 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package archive
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -45,7 +47,6 @@ import (
 	"github.com/golang/glog"
 	"github.com/klauspost/compress/gzip"
 	"github.com/uwedeportivo/romba/worker"
-	"github.com/willf/bloom"
 
 	"github.com/dgraph-io/ristretto"
 	"github.com/uwedeportivo/romba/db"
@@ -61,6 +62,8 @@ type Depot struct {
 	// where in the depot to reserve the next space
 	// when archiving
 	start int
+	// leave flushing stored files to the OS
+	noFsync bool
 }
 
 type cacheValue struct {
@@ -93,7 +96,12 @@ func NewDepot(roots []string, maxSize []int64, romDB db.RomDB) (*Depot, error) {
 
 		glog.Infof("initialize bloomfilter for %s", root)
 
-		bf := bloom.NewWithEstimates(20000000, 0.1)
+		bp, err := establishBloomParams(root)
+		if err != nil {
+			return nil, err
+		}
+
+		bf := bp.newFilter()
 		err = loadBloomFilter(root, bf)
 		if err != nil {
 			return nil, err
@@ -120,6 +128,14 @@ func NewDepot(roots []string, maxSize []int64, romDB db.RomDB) (*Depot, error) {
 	return depot, nil
 }
 
+// DisableFsync stops the depot from fsyncing stored files and the size and bloom
+// filter files of its roots, leaving it to the OS to flush them. This speeds up
+// ingest, but files written shortly before a crash or power loss may be lost or
+// truncated and need an fsck.
+func (depot *Depot) DisableFsync() {
+	depot.noFsync = true
+}
+
 func (depot *Depot) RomInDepot(sha1Hex string) (bool, string, error) {
 	return depot.romInDepot(sha1Hex, false)
 }
@@ -226,19 +242,20 @@ func (depot *Depot) SHA1InDepot(sha1Hex string) (bool, *Hashes, string, int64, e
 	return false, nil, "", 0, nil
 }
 
-type zeroLengthReadCloser struct{}
+// emptyGZ is a valid gzip stream of zero-length content. It is handed out for
+// zero-length roms so callers can treat them like any other depot file.
+var emptyGZ []byte
 
-func (zlrc *zeroLengthReadCloser) Read(p []byte) (int, error) {
-	return 0, io.EOF
-}
-
-func (zlrc *zeroLengthReadCloser) Close() error {
-	return nil
+func init() {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Close()
+	emptyGZ = buf.Bytes()
 }
 
 func (depot *Depot) OpenRomGZ(rom *types.Rom) (io.ReadCloser, error) {
 	if rom.Size == 0 {
-		return new(zeroLengthReadCloser), nil
+		return ioutil.NopCloser(bytes.NewReader(emptyGZ)), nil
 	}
 
 	if rom.Sha1 == nil {
@@ -304,7 +321,7 @@ func (depot *Depot) PopulateBloom(path string) {
 					}
 				}
 				resumePath := filepath.Join(dr.path, "resumebloom-"+sha1Hex)
-				err = writeBloomFilter(resumePath, dr.bf)
+				err = writeBloomFilter(resumePath, dr.bf, !depot.noFsync)
 				if err != nil {
 					glog.Errorf("failed to write resume path %s for populating bloom filter: %v", resumePath, err)
 				}
@@ -314,6 +331,27 @@ func (depot *Depot) PopulateBloom(path string) {
 	}
 }
 
+// PopulateBloomFromIndex adds every sha1 of the DB index to the bloom filters of
+// all roots without walking the depot. The index doesn't know which root holds
+// a rom, so every root gets every sha1. Returns the number of sha1s added.
+func (depot *Depot) PopulateBloomFromIndex() (int, error) {
+	var numAdded int
+
+	err := depot.RomDB.ForEachRom(func(rom *types.Rom) error {
+		sha1Hex := []byte(hex.EncodeToString(rom.Sha1))
+
+		for _, dr := range depot.roots {
+			dr.Lock()
+			dr.bf.Add(sha1Hex)
+			dr.numBfAdded++
+			dr.Unlock()
+		}
+		numAdded++
+		return nil
+	})
+	return numAdded, err
+}
+
 func (depot *Depot) ClearBloomFilters() error {
 	depot.lock.Lock()
 	defer depot.lock.Unlock()
@@ -399,7 +437,7 @@ func (depot *Depot) SaveBloomFilters() error {
 			}
 		}
 
-		err = writeBloomFilterWithBackup(dr.path, dr.bf)
+		err = writeBloomFilterWithBackup(dr.path, dr.bf, !depot.noFsync)
 		if err != nil {
 			dr.Unlock()
 			return err
@@ -410,6 +448,184 @@ func (depot *Depot) SaveBloomFilters() error {
 	return nil
 }
 
+// PurgeRom deletes the depot file for sha1Hex from whichever root holds it and
+// returns the rom as recorded in the file's gzip header together with the deleted path.
+// Returns a nil rom if no root holds the file.
+func (depot *Depot) PurgeRom(sha1Hex string) (*types.Rom, string, error) {
+	for idx, dr := range depot.roots {
+		rompath := pathFromSha1HexEncoding(dr.path, sha1Hex, gzipSuffix)
+		fi, err := os.Stat(rompath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, "", err
+		}
+
+		rom, err := RomFromGZDepotFile(rompath)
+		if err != nil {
+			return nil, "", err
+		}
+
+		hh, _, err := HashesFromGZHeader(rompath, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		if hh != nil {
+			rom.Crc = hh.Crc
+			rom.Md5 = hh.Md5
+			rom.Size = hh.Size
+		} else {
+			glog.Warningf("rom %s has missing gzip md5 or crc header", rompath)
+		}
+
+		err = os.Remove(rompath)
+		if err != nil {
+			return nil, "", err
+		}
+
+		depot.cache.Del(sha1Hex)
+		depot.adjustSize(idx, -fi.Size(), "")
+		depot.writeSizes()
+
+		return rom, rompath, nil
+	}
+	return nil, "", nil
+}
+
+type RootPresence struct {
+	Root       string
+	Path       string
+	BloomReady bool
+	BloomHit   bool
+	Exists     bool
+}
+
+// WhereIs reports for every depot root whether its bloom filter claims sha1Hex
+// and whether the file is actually present.
+func (depot *Depot) WhereIs(sha1Hex string) ([]*RootPresence, error) {
+	var rps []*RootPresence
+	for _, dr := range depot.roots {
+		rp := &RootPresence{
+			Root: dr.path,
+			Path: pathFromSha1HexEncoding(dr.path, sha1Hex, gzipSuffix),
+		}
+
+		dr.Lock()
+		rp.BloomReady = dr.bloomReady
+		rp.BloomHit = dr.bloomReady && dr.bf.Test([]byte(sha1Hex))
+		dr.Unlock()
+
+		exists, err := PathExists(rp.Path)
+		if err != nil {
+			return nil, err
+		}
+		rp.Exists = exists
+
+		rps = append(rps, rp)
+	}
+	return rps, nil
+}
+
+type RootStats struct {
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	MaxSize    int64  `json:"maxSize"`
+	FreeSpace  int64  `json:"freeSpace"`
+	BloomReady bool   `json:"bloomReady"`
+	NumBfAdded int64  `json:"numBfAdded"`
+}
+
+// RootStats reports the cached size and bloom state of every depot root together
+// with the free space of its filesystem (-1 if unavailable). It doesn't walk any files.
+func (depot *Depot) RootStats() []*RootStats {
+	var rss []*RootStats
+	for _, dr := range depot.roots {
+		dr.Lock()
+		rs := &RootStats{
+			Path:       dr.path,
+			Size:       dr.size,
+			MaxSize:    dr.maxSize,
+			BloomReady: dr.bloomReady,
+			NumBfAdded: dr.numBfAdded,
+		}
+		dr.Unlock()
+
+		free, err := freeSpace(dr.path)
+		if err != nil {
+			glog.Warningf("failed to get free space of %s: %v", dr.path, err)
+			free = -1
+		}
+		rs.FreeSpace = free
+
+		rss = append(rss, rs)
+	}
+	return rss
+}
+
+// roomLeft returns how many more bytes the depot roots that aren't full yet can
+// take, each limited by its maxSize. The roots on one filesystem together are
+// limited by its free space.
+func (depot *Depot) roomLeft() int64 {
+	depot.lock.Lock()
+	start := depot.start
+	depot.lock.Unlock()
+
+	type fsRoom struct {
+		left int64
+		free int64
+	}
+	filesystems := make(map[uint64]*fsRoom)
+
+	var room int64
+	for _, dr := range depot.roots[start:] {
+		dr.Lock()
+		left := dr.maxSize - dr.size
+		dr.Unlock()
+
+		if left <= 0 {
+			continue
+		}
+
+		fsID, err := filesystemID(dr.path)
+		var free int64
+		if err == nil {
+			free, err = freeSpace(dr.path)
+		}
+		if err != nil {
+			glog.Warningf("failed to get free space of %s: %v", dr.path, err)
+			room += left
+			continue
+		}
+
+		fr := filesystems[fsID]
+		if fr == nil {
+			fr = &fsRoom{free: free}
+			filesystems[fsID] = fr
+		}
+		fr.left += left
+	}
+
+	for _, fr := range filesystems {
+		if fr.free < fr.left {
+			room += fr.free
+		} else {
+			room += fr.left
+		}
+	}
+	return room
+}
+
+// checkRoom fails if the depot roots have less room left than numBytes.
+func (depot *Depot) checkRoom(numBytes int64) error {
+	room := depot.roomLeft()
+	if numBytes > room {
+		return fmt.Errorf("not enough room in the depot: %s to add but only %s left",
+			humanize.IBytes(uint64(numBytes)), humanize.IBytes(uint64(room)))
+	}
+	return nil
+}
+
 func (depot *Depot) DebugBloom(sha1Hex string) []string {
 	var rs []string
 	for _, dr := range depot.roots {
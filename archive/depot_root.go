@@ -1,14 +1,97 @@
 package archive
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
 
 	"github.com/golang/glog"
+	"github.com/uwedeportivo/romba/config"
 	"github.com/willf/bloom"
 )
 
+// bloom filters of roots created before the sizing was configurable used these
+const (
+	defaultBloomCapacity = 20000000
+	defaultBloomFp       = 0.1
+)
+
+// bloomParams are the estimates the bloom filter of a root is sized with.
+type bloomParams struct {
+	capacity uint
+	fp       float64
+}
+
+func (bp bloomParams) newFilter() *bloom.BloomFilter {
+	return bloom.NewWithEstimates(bp.capacity, bp.fp)
+}
+
+// configuredBloomParams returns the bloom section of the config, falling back
+// to the defaults for unset or invalid values.
+func configuredBloomParams() bloomParams {
+	bp := bloomParams{
+		capacity: defaultBloomCapacity,
+		fp:       defaultBloomFp,
+	}
+
+	if config.GlobalConfig != nil {
+		if config.GlobalConfig.Bloom.Capacity > 0 {
+			bp.capacity = config.GlobalConfig.Bloom.Capacity
+		}
+		if config.GlobalConfig.Bloom.Fp > 0 && config.GlobalConfig.Bloom.Fp < 1 {
+			bp.fp = config.GlobalConfig.Bloom.Fp
+		}
+	}
+	return bp
+}
+
+// establishBloomParams returns the bloom params persisted in root. The first
+// time it persists the configured ones, or the defaults if root already has a
+// bloom filter, so a root keeps its sizing when the config changes later.
+func establishBloomParams(root string) (bloomParams, error) {
+	bpPath := filepath.Join(root, bloomParamsFilename)
+
+	bs, err := ioutil.ReadFile(bpPath)
+	if err == nil {
+		var bp bloomParams
+		_, err = fmt.Sscan(string(bs), &bp.capacity, &bp.fp)
+		if err != nil {
+			return bloomParams{}, fmt.Errorf("failed to parse bloom params %s: %v", bpPath, err)
+		}
+
+		cbp := configuredBloomParams()
+		if bp != cbp {
+			glog.Warningf("bloom filter of %s is sized for capacity %d and fp %g, ignoring configured capacity %d and fp %g",
+				root, bp.capacity, bp.fp, cbp.capacity, cbp.fp)
+		}
+		return bp, nil
+	}
+	if !os.IsNotExist(err) {
+		return bloomParams{}, err
+	}
+
+	bfExists, err := PathExists(filepath.Join(root, bloomFilterFilename))
+	if err != nil {
+		return bloomParams{}, err
+	}
+
+	bp := configuredBloomParams()
+	if bfExists {
+		bp = bloomParams{
+			capacity: defaultBloomCapacity,
+			fp:       defaultBloomFp,
+		}
+	}
+
+	err = ioutil.WriteFile(bpPath, []byte(fmt.Sprintf("%d %g\n", bp.capacity, bp.fp)), 0666)
+	if err != nil {
+		return bloomParams{}, err
+	}
+	return bp, nil
+}
+
 type depotRoot struct {
 	sync.Mutex
 
@@ -20,6 +103,7 @@ type depotRoot struct {
 	maxSize    int64
 
 	numBfAdded int64
+	manifest   *os.File
 }
 
 func loadBloomFilter(root string, bf *bloom.BloomFilter) error {
@@ -43,7 +127,7 @@ func loadBloomFilter(root string, bf *bloom.BloomFilter) error {
 	return err
 }
 
-func writeBloomFilter(path string, bf *bloom.BloomFilter) error {
+func writeBloomFilter(path string, bf *bloom.BloomFilter, fsync bool) error {
 	file, err := os.Create(path)
 	if err != nil {
 		return err
@@ -51,10 +135,16 @@ func writeBloomFilter(path string, bf *bloom.BloomFilter) error {
 	defer file.Close()
 
 	_, err = bf.WriteTo(file)
-	return err
+	if err != nil {
+		return err
+	}
+	if fsync {
+		return file.Sync()
+	}
+	return nil
 }
 
-func writeBloomFilterWithBackup(root string, bf *bloom.BloomFilter) error {
+func writeBloomFilterWithBackup(root string, bf *bloom.BloomFilter, fsync bool) error {
 	bfFilePath := filepath.Join(root, bloomFilterFilename)
 
 	exists, err := PathExists(bfFilePath)
@@ -71,21 +161,14 @@ func writeBloomFilterWithBackup(root string, bf *bloom.BloomFilter) error {
 		}
 	}
 
-	file, err := os.Create(bfFilePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	_, err = bf.WriteTo(file)
-	return err
+	return writeBloomFilter(bfFilePath, bf, fsync)
 }
 
 func (depot *Depot) writeSizes() {
 	for _, dr := range depot.roots {
 		dr.Lock()
 		if dr.touched {
-			err := writeSizeFile(dr.path, dr.size)
+			err := writeSizeFile(dr.path, dr.size, !depot.noFsync)
 			if err != nil {
 				glog.Errorf("failed to write size file into %s: %v\n", dr.path, err)
 			} else {
@@ -93,7 +176,7 @@ func (depot *Depot) writeSizes() {
 			}
 
 			if dr.bloomReady {
-				err = writeBloomFilterWithBackup(dr.path, dr.bf)
+				err = writeBloomFilterWithBackup(dr.path, dr.bf, !depot.noFsync)
 				if err != nil {
 					dr.touched = true
 					glog.Errorf("failed to write bloomfilter into %s: %v\n", dr.path, err)
@@ -119,5 +202,44 @@ func (depot *Depot) adjustSize(index int, delta int64, sha1Hex string) {
 		dr.bf.Add([]byte(sha1Hex))
 	}
 
+	if sha1Hex != "" {
+		dr.appendManifest(sha1Hex)
+	}
+
 	dr.touched = true
 }
+
+// FlushRoot marks the depot root at path as touched and writes its size file
+// and bloom filter right away instead of waiting for the next flush, e.g. before
+// backing up the root. It reports whether the bloom filter got written, which it
+// isn't while the bloom filter of the root is still being loaded.
+func (depot *Depot) FlushRoot(path string) (bool, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, dr := range depot.roots {
+		if dr.path != absPath {
+			continue
+		}
+
+		dr.Lock()
+		dr.touched = true
+		dr.Unlock()
+
+		depot.writeSizes()
+
+		// writeSizes leaves the root touched if writing failed
+		dr.Lock()
+		touched := dr.touched
+		bloomWritten := dr.bloomReady
+		dr.Unlock()
+
+		if touched {
+			return false, fmt.Errorf("failed to write size file or bloom filter of %s, see the log for details", dr.path)
+		}
+		return bloomWritten, nil
+	}
+	return false, fmt.Errorf("%s is not a depot root", path)
+}
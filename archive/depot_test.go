@@ -0,0 +1,991 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestRootStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_rootstats")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestDepotGZ(t, dir, []byte("romba root stats test content"))
+
+	depot, err := NewDepot([]string{dir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	rss := depot.RootStats()
+	if len(rss) != 1 {
+		t.Fatalf("expected stats for 1 root, got %d", len(rss))
+	}
+
+	st := rss[0]
+	if st.Path != dir || st.MaxSize != 1<<30 || st.Size <= 0 || !st.BloomReady {
+		t.Fatalf("unexpected root stats %+v", st)
+	}
+	if st.FreeSpace <= 0 {
+		t.Fatalf("expected free space of %s, got %d", dir, st.FreeSpace)
+	}
+}
+
+func TestReserveRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_reserve")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	roots := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	for _, root := range roots {
+		err = os.MkdirAll(root, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", root, err)
+		}
+	}
+
+	depot, err := NewDepot(roots, []int64{100, 50}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	for _, tc := range []struct {
+		size int64
+		root int
+	}{
+		{60, 0},
+		{40, 0},
+		{50, 1},
+	} {
+		root, err := depot.reserveRoot(tc.size)
+		if err != nil {
+			t.Fatalf("failed to reserve %d bytes: %v", tc.size, err)
+		}
+		if root != tc.root {
+			t.Fatalf("expected %d bytes in root %d, got root %d", tc.size, tc.root, root)
+		}
+	}
+
+	_, err = depot.reserveRoot(1)
+	if err != errAllRootsFull {
+		t.Fatalf("expected errAllRootsFull, got %v", err)
+	}
+
+	for i, dr := range depot.roots {
+		if dr.size != dr.maxSize {
+			t.Fatalf("expected root %d to be filled up to %d, got %d", i, dr.maxSize, dr.size)
+		}
+	}
+}
+
+func TestArchiveRootsFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_rootsfull")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	for _, d := range []string{depotDir, srcDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	// random content doesn't compress, so only one file fits
+	rnd := rand.New(rand.NewSource(42))
+	for _, name := range []string{"a.bin", "b.bin"} {
+		content := make([]byte, 1000)
+		rnd.Read(content)
+		err = ioutil.WriteFile(filepath.Join(srcDir, name), content, 0666)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	maxSize := compressedSizeBound(1000) + 100
+	depot, err := NewDepot([]string{depotDir}, []int64{maxSize}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	reportPath := filepath.Join(dir, "report.json")
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true,
+		&ArchiveOptions{MaxDepth: -1, ReportOut: reportPath})
+	if err == nil {
+		t.Fatalf("expected archive to fail for the file that doesn't fit")
+	}
+
+	bs, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+
+	var ir IngestReport
+	err = json.Unmarshal(bs, &ir)
+	if err != nil {
+		t.Fatalf("failed to decode report %s: %v", string(bs), err)
+	}
+
+	if ir.FilesAdded != 1 {
+		t.Fatalf("expected 1 file added, got report %s", string(bs))
+	}
+
+	st := depot.RootStats()[0]
+	if st.Size <= 0 || st.Size > maxSize {
+		t.Fatalf("expected root size within (0, %d], got %d", maxSize, st.Size)
+	}
+}
+
+func TestArchiveDepotWriters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_writers")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	for _, d := range []string{depotDir, srcDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	sha1s := writeWritersTestSources(t, srcDir)
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 4, dir,
+		worker.NewProgressTracker(4), false, false, true,
+		&ArchiveOptions{MaxDepth: -1, NumWriters: 2})
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	for _, sha1Hex := range sha1s {
+		rompath := pathFromSha1HexEncoding(depotDir, sha1Hex, gzipSuffix)
+		if _, err = os.Stat(rompath); err != nil {
+			t.Fatalf("expected %s in depot: %v", rompath, err)
+		}
+	}
+}
+
+// maxOpenTracker records the most files open at the same time.
+type maxOpenTracker struct {
+	worker.ProgressTracker
+
+	mutex   sync.Mutex
+	open    int32
+	maxOpen int32
+}
+
+func (mt *maxOpenTracker) AddOpenFiles(delta int32) {
+	mt.mutex.Lock()
+	mt.open += delta
+	if mt.open > mt.maxOpen {
+		mt.maxOpen = mt.open
+	}
+	mt.mutex.Unlock()
+
+	mt.ProgressTracker.AddOpenFiles(delta)
+}
+
+func TestArchiveDepotWritersOneOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_writers")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	for _, d := range []string{depotDir, srcDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	sha1s := writeWritersTestSources(t, srcDir)
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	// a worker waiting for the writer while holding the only slot must not
+	// keep the writer from opening the sources of its roms
+	mt := &maxOpenTracker{ProgressTracker: worker.NewProgressTracker(2)}
+	done := make(chan error)
+	go func() {
+		_, err := depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 2, dir, mt, false, false, true,
+			&ArchiveOptions{MaxDepth: -1, MaxOpenFiles: 1, NumWriters: 1})
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("archive with one open file deadlocked")
+	}
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	if mt.maxOpen != 1 || mt.open != 0 {
+		t.Fatalf("expected at most 1 open file and none left open, got max %d and %d left", mt.maxOpen, mt.open)
+	}
+
+	for _, sha1Hex := range sha1s {
+		rompath := pathFromSha1HexEncoding(depotDir, sha1Hex, gzipSuffix)
+		if _, err = os.Stat(rompath); err != nil {
+			t.Fatalf("expected %s in depot: %v", rompath, err)
+		}
+	}
+}
+
+// writeWritersTestSources writes 20 plain files and a zip of 10 entries into
+// srcDir and returns the sha1s of the roms.
+func writeWritersTestSources(t *testing.T, srcDir string) []string {
+	rnd := rand.New(rand.NewSource(7))
+	var sha1s []string
+	for i := 0; i < 20; i++ {
+		content := make([]byte, 1000+i)
+		rnd.Read(content)
+		name := filepath.Join(srcDir, fmt.Sprintf("rom%02d.bin", i))
+		err := ioutil.WriteFile(name, content, 0666)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		sum := sha1.Sum(content)
+		sha1s = append(sha1s, hex.EncodeToString(sum[:]))
+	}
+
+	// the writers read zip entries after the worker is done with the zip
+	zipFile, err := os.Create(filepath.Join(srcDir, "roms.zip"))
+	if err != nil {
+		t.Fatalf("failed to create zip: %v", err)
+	}
+	zw := zip.NewWriter(zipFile)
+	for i := 0; i < 10; i++ {
+		content := make([]byte, 2000+i)
+		rnd.Read(content)
+		fw, err := zw.Create(fmt.Sprintf("entry%02d.bin", i))
+		if err != nil {
+			t.Fatalf("failed to create zip entry: %v", err)
+		}
+		_, err = fw.Write(content)
+		if err != nil {
+			t.Fatalf("failed to write zip entry: %v", err)
+		}
+		sum := sha1.Sum(content)
+		sha1s = append(sha1s, hex.EncodeToString(sum[:]))
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatalf("failed to close zip: %v", err)
+	}
+	err = zipFile.Close()
+	if err != nil {
+		t.Fatalf("failed to close zip file: %v", err)
+	}
+	return sha1s
+}
+
+func TestArchiveNotEnoughRoom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot_room")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	for _, d := range []string{depotDir, srcDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	content := bytes.Repeat([]byte("romba"), 1000)
+	err = ioutil.WriteFile(filepath.Join(srcDir, "rom.bin"), content, 0666)
+	if err != nil {
+		t.Fatalf("failed to write rom: %v", err)
+	}
+	sum := sha1.Sum(content)
+	romPath := pathFromSha1HexEncoding(depotDir, hex.EncodeToString(sum[:]), gzipSuffix)
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1000}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	checkRoom := &ArchiveOptions{MaxDepth: -1, CheckRoom: true}
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true, checkRoom)
+	if err == nil || !strings.Contains(err.Error(), "not enough room in the depot") {
+		t.Fatalf("expected archive into a full depot to fail the room check, got %v", err)
+	}
+
+	if depot.roomLeft() != 1000 {
+		t.Fatalf("expected 1000 bytes left in depot, got %d", depot.roomLeft())
+	}
+	if _, err = os.Stat(romPath); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing written to the depot, stat of %s: %v", romPath, err)
+	}
+
+	// put the rom into the depot, so that another run has nothing to write
+	depot, err = NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true, nil)
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	depot, err = NewDepot([]string{depotDir}, []int64{1000}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true, checkRoom)
+	if err == nil || !strings.Contains(err.Error(), "not enough room in the depot") {
+		t.Fatalf("expected the room check to count roms already in the depot, got %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true, nil)
+	if err != nil {
+		t.Fatalf("expected no room check without -checkRoom: %v", err)
+	}
+}
+
+func TestRoomLeftSharedFilesystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "depot_room")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		t.Skipf("no free space available: %v", err)
+	}
+
+	var roots []string
+	for _, name := range []string{"root1", "root2"} {
+		root := filepath.Join(dir, name)
+		err = os.MkdirAll(root, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", root, err)
+		}
+		roots = append(roots, root)
+	}
+
+	depot, err := NewDepot(roots, []int64{1 << 60, 1 << 60}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	// both roots are on the filesystem of dir, its free space counts once
+	room := depot.roomLeft()
+	if room > free+free/2 {
+		t.Fatalf("expected about %d bytes left in depot, got %d", free, room)
+	}
+}
+
+// noLookupDB fails every call archive makes on the DB.
+type noLookupDB struct {
+	db.NoOpDB
+}
+
+var errNoLookup = errors.New("unexpected DB access")
+
+func (nl *noLookupDB) IndexRom(rom *types.Rom) error {
+	return errNoLookup
+}
+
+func (nl *noLookupDB) IndexRomName(sha1 []byte, path string) error {
+	return errNoLookup
+}
+
+func (nl *noLookupDB) IsRomReferencedByDats(rom *types.Rom) (bool, error) {
+	return false, errNoLookup
+}
+
+func (nl *noLookupDB) IndexZip(sha1 []byte) error {
+	return errNoLookup
+}
+
+func (nl *noLookupDB) IsZipSeen(sha1 []byte) (bool, error) {
+	return false, errNoLookup
+}
+
+func TestArchiveNoDBDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_nodb")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir1 := filepath.Join(dir, "src1")
+	srcDir2 := filepath.Join(dir, "src2")
+	for _, d := range []string{depotDir, srcDir1, srcDir2} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	var sha1s []string
+	for i, name := range []string{"src1/a.bin", "src1/b.bin", "src2/c.bin"} {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 1000)
+		err = ioutil.WriteFile(filepath.Join(dir, name), content, 0666)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		sum := sha1.Sum(content)
+		sha1s = append(sha1s, hex.EncodeToString(sum[:]))
+	}
+	// b.bin again under another name
+	err = ioutil.WriteFile(filepath.Join(srcDir2, "b copy.bin"), bytes.Repeat([]byte{'b'}, 1000), 0666)
+	if err != nil {
+		t.Fatalf("failed to write b copy.bin: %v", err)
+	}
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir1}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true, nil)
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	// overwritten if archive stores b.bin again
+	bPath := pathFromSha1HexEncoding(depotDir, sha1s[1], gzipSuffix)
+	err = ioutil.WriteFile(bPath, []byte("marker"), 0666)
+	if err != nil {
+		t.Fatalf("failed to write marker: %v", err)
+	}
+
+	// a new depot, so the second archive can't dedup from the cache of the first
+	depot, err = NewDepot([]string{depotDir}, []int64{1 << 30}, new(noLookupDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir2}, "", 0, 0, 0, true, 1, dir,
+		worker.NewProgressTracker(1), false, false, true,
+		&ArchiveOptions{MaxDepth: -1, TrackZipHashes: true, RecordNames: true})
+	if err != nil {
+		t.Fatalf("failed to archive with no-db: %v", err)
+	}
+
+	if _, err = os.Stat(pathFromSha1HexEncoding(depotDir, sha1s[2], gzipSuffix)); err != nil {
+		t.Fatalf("expected c.bin in depot: %v", err)
+	}
+
+	marker, err := ioutil.ReadFile(bPath)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", bPath, err)
+	}
+	if string(marker) != "marker" {
+		t.Fatalf("expected b.bin to be skipped as already in the depot")
+	}
+}
+
+// romNamesDB is a DB index recording the names archive records for roms.
+type romNamesDB struct {
+	db.NoOpDB
+
+	mutex sync.Mutex
+	names map[string][]string
+}
+
+func (rn *romNamesDB) IndexRomName(sha1 []byte, path string) error {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+
+	key := hex.EncodeToString(sha1)
+	rn.names[key] = append(rn.names[key], path)
+	return nil
+}
+
+func TestArchiveRecordNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_record_names")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir1 := filepath.Join(dir, "src1")
+	srcDir2 := filepath.Join(dir, "src2")
+	for _, d := range []string{depotDir, srcDir1, srcDir2} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	var sha1s []string
+	for i, name := range []string{"src1/a.bin", "src2/b.bin"} {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 1000)
+		err = ioutil.WriteFile(filepath.Join(dir, name), content, 0666)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		sum := sha1.Sum(content)
+		sha1s = append(sha1s, hex.EncodeToString(sum[:]))
+	}
+
+	rdb := &romNamesDB{names: make(map[string][]string)}
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, rdb)
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir1}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, false,
+		&ArchiveOptions{MaxDepth: -1, RecordNames: true})
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir2}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, false, nil)
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	aPath := filepath.Join(srcDir1, "a.bin")
+	names := rdb.names[sha1s[0]]
+	if len(names) != 1 || names[0] != aPath {
+		t.Fatalf("expected name %s recorded for a.bin, got %v", aPath, names)
+	}
+
+	if names := rdb.names[sha1s[1]]; len(names) != 0 {
+		t.Fatalf("expected no name recorded for b.bin without RecordNames, got %v", names)
+	}
+}
+
+// neededRomsDB is a DB index needing the roms with the sha1s in needed and
+// recording archived zips.
+type neededRomsDB struct {
+	db.NoOpDB
+
+	mutex  sync.Mutex
+	needed map[string]bool
+	zips   map[string]bool
+}
+
+func (nr *neededRomsDB) IsRomReferencedByDats(rom *types.Rom) (bool, error) {
+	return nr.needed[hex.EncodeToString(rom.Sha1)], nil
+}
+
+func (nr *neededRomsDB) IndexZip(sha1 []byte) error {
+	nr.mutex.Lock()
+	defer nr.mutex.Unlock()
+
+	nr.zips[string(sha1)] = true
+	return nil
+}
+
+func (nr *neededRomsDB) IsZipSeen(sha1 []byte) (bool, error) {
+	nr.mutex.Lock()
+	defer nr.mutex.Unlock()
+
+	return nr.zips[string(sha1)], nil
+}
+
+func TestArchiveTrackZipHashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_zip_hashes")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	for _, d := range []string{depotDir, srcDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	zipPath := filepath.Join(srcDir, "roms.zip")
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("failed to create zip: %v", err)
+	}
+	zw := zip.NewWriter(zipFile)
+	var sha1s []string
+	for i := 0; i < 2; i++ {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 1000)
+		fw, err := zw.Create(fmt.Sprintf("entry%d.bin", i))
+		if err != nil {
+			t.Fatalf("failed to create zip entry: %v", err)
+		}
+		_, err = fw.Write(content)
+		if err != nil {
+			t.Fatalf("failed to write zip entry: %v", err)
+		}
+		sum := sha1.Sum(content)
+		sha1s = append(sha1s, hex.EncodeToString(sum[:]))
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatalf("failed to close zip: %v", err)
+	}
+	err = zipFile.Close()
+	if err != nil {
+		t.Fatalf("failed to close zip file: %v", err)
+	}
+
+	zipSha1, err := sha1ForFile(zipPath)
+	if err != nil {
+		t.Fatalf("failed to hash zip: %v", err)
+	}
+
+	nr := &neededRomsDB{
+		needed: map[string]bool{sha1s[0]: true},
+		zips:   make(map[string]bool),
+	}
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, nr)
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	archiveNeeded := func() {
+		_, err := depot.Archive([]string{srcDir}, "", 0, 0, 0, true, 1, dir,
+			worker.NewProgressTracker(1), false, false, false,
+			&ArchiveOptions{MaxDepth: -1, TrackZipHashes: true, NumWriters: 1})
+		if err != nil {
+			t.Fatalf("failed to archive: %v", err)
+		}
+	}
+
+	archiveNeeded()
+	if seen, _ := nr.IsZipSeen(zipSha1); seen {
+		t.Fatalf("expected zip with a rom skipped as not needed not to be recorded")
+	}
+
+	nr.needed[sha1s[1]] = true
+	archiveNeeded()
+	if seen, _ := nr.IsZipSeen(zipSha1); !seen {
+		t.Fatalf("expected zip with all roms stored to be recorded")
+	}
+	for _, sha1Hex := range sha1s {
+		if _, err = os.Stat(pathFromSha1HexEncoding(depotDir, sha1Hex, gzipSuffix)); err != nil {
+			t.Fatalf("expected %s in depot: %v", sha1Hex, err)
+		}
+	}
+
+	// a failed depot write keeps the zip from being recorded too
+	pf := &pendingFile{comp: &completed{}, processing: true}
+	pf.addWrite()
+	pf.writeDone(errors.New("write failed"))
+	if pf.stored() {
+		t.Fatalf("expected file with a failed write not to count as stored")
+	}
+}
+
+// indexedRomsDB is a DB index holding just roms.
+type indexedRomsDB struct {
+	db.NoOpDB
+	roms []*types.Rom
+}
+
+func (ir *indexedRomsDB) ForEachRom(romF func(rom *types.Rom) error) error {
+	for _, rom := range ir.roms {
+		err := romF(rom)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPopulateBloomFromIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_bloomindex")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	roots := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	for _, root := range roots {
+		err = os.MkdirAll(root, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", root, err)
+		}
+	}
+
+	var sha1s []string
+	romDB := new(indexedRomsDB)
+	for i := 0; i < 3; i++ {
+		sum := sha1.Sum([]byte{byte(i)})
+		romDB.roms = append(romDB.roms, &types.Rom{Sha1: sum[:], Size: -1})
+		sha1s = append(sha1s, hex.EncodeToString(sum[:]))
+	}
+
+	depot, err := NewDepot(roots, []int64{1 << 30, 1 << 30}, romDB)
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	err = depot.ClearBloomFilters()
+	if err != nil {
+		t.Fatalf("failed to clear bloom filters: %v", err)
+	}
+
+	numAdded, err := depot.PopulateBloomFromIndex()
+	if err != nil {
+		t.Fatalf("failed to populate bloom from index: %v", err)
+	}
+	if numAdded != len(sha1s) {
+		t.Fatalf("expected %d sha1s from index, got %d", len(sha1s), numAdded)
+	}
+
+	err = depot.SaveBloomFilters()
+	if err != nil {
+		t.Fatalf("failed to save bloom filters: %v", err)
+	}
+
+	for _, sha1Hex := range sha1s {
+		if hits := depot.DebugBloom(sha1Hex); len(hits) != len(roots) {
+			t.Fatalf("expected %s in the bloom filters of all roots, got %v", sha1Hex, hits)
+		}
+	}
+
+	other := sha1.Sum([]byte("not indexed"))
+	if hits := depot.DebugBloom(hex.EncodeToString(other[:])); len(hits) != 0 {
+		t.Fatalf("expected no bloom hits for a sha1 not in the index, got %v", hits)
+	}
+}
+
+func TestEstablishBloomParams(t *testing.T) {
+	oldConfig := config.GlobalConfig
+	defer func() { config.GlobalConfig = oldConfig }()
+
+	config.GlobalConfig = new(config.Config)
+	config.GlobalConfig.Bloom.Capacity = 1000
+	config.GlobalConfig.Bloom.Fp = 0.01
+
+	root, err := ioutil.TempDir("", "romba_bloom_params")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	bp, err := establishBloomParams(root)
+	if err != nil {
+		t.Fatalf("failed to establish bloom params: %v", err)
+	}
+	if bp.capacity != 1000 || bp.fp != 0.01 {
+		t.Fatalf("expected configured bloom params, got %+v", bp)
+	}
+
+	config.GlobalConfig.Bloom.Capacity = 5000
+	bp, err = establishBloomParams(root)
+	if err != nil {
+		t.Fatalf("failed to establish bloom params: %v", err)
+	}
+	if bp.capacity != 1000 || bp.fp != 0.01 {
+		t.Fatalf("expected persisted bloom params, got %+v", bp)
+	}
+
+	oldRoot, err := ioutil.TempDir("", "romba_bloom_params")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(oldRoot)
+
+	err = ioutil.WriteFile(filepath.Join(oldRoot, bloomFilterFilename), nil, 0666)
+	if err != nil {
+		t.Fatalf("cannot write bloom filter: %v", err)
+	}
+
+	bp, err = establishBloomParams(oldRoot)
+	if err != nil {
+		t.Fatalf("failed to establish bloom params: %v", err)
+	}
+	if bp.capacity != defaultBloomCapacity || bp.fp != defaultBloomFp {
+		t.Fatalf("expected default bloom params for existing filter, got %+v", bp)
+	}
+}
+
+func TestFlushRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "romba_flush_root")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	depot, err := NewDepot([]string{root}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	depot.roots[0].size = 4242
+
+	bloomWritten, err := depot.FlushRoot(root)
+	if err != nil {
+		t.Fatalf("failed to flush root: %v", err)
+	}
+	if !bloomWritten {
+		t.Fatalf("expected bloom filter reported written")
+	}
+
+	size, err := readSize(root)
+	if err != nil {
+		t.Fatalf("failed to read size file: %v", err)
+	}
+	if size != 4242 {
+		t.Fatalf("expected flushed size 4242, got %d", size)
+	}
+
+	exists, err := PathExists(filepath.Join(root, bloomFilterFilename))
+	if err != nil || !exists {
+		t.Fatalf("expected bloom filter written, got %v", err)
+	}
+
+	// a bloom filter that is still loading isn't written
+	err = os.Remove(filepath.Join(root, bloomFilterFilename))
+	if err != nil {
+		t.Fatalf("failed to remove bloom filter: %v", err)
+	}
+	depot.roots[0].bloomReady = false
+	depot.roots[0].size = 4343
+
+	bloomWritten, err = depot.FlushRoot(root)
+	if err != nil {
+		t.Fatalf("failed to flush root: %v", err)
+	}
+	if bloomWritten {
+		t.Fatalf("expected bloom filter reported not written while loading")
+	}
+
+	size, err = readSize(root)
+	if err != nil {
+		t.Fatalf("failed to read size file: %v", err)
+	}
+	if size != 4343 {
+		t.Fatalf("expected flushed size 4343, got %d", size)
+	}
+
+	exists, err = PathExists(filepath.Join(root, bloomFilterFilename))
+	if err != nil || exists {
+		t.Fatalf("expected no bloom filter written while loading, got %v", err)
+	}
+
+	_, err = depot.FlushRoot(filepath.Join(root, "nope"))
+	if err == nil {
+		t.Fatalf("expected error flushing a path that is not a depot root")
+	}
+}
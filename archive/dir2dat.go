@@ -32,62 +32,230 @@ package archive
 
 import (
 	"bufio"
+	"bytes"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/golang/glog"
 
 	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
 )
 
 type romWalker struct {
 	dat        *types.Dat
 	sourcePath string
+	basename   bool
+	lowercase  bool
+	stripExt   bool
 }
 
-func (rw *romWalker) visit(path string, f os.FileInfo, err error) error {
-	if f == nil || f.Name() == ".DS_Store" {
-		return nil
+// names returns the game and rom name for the file at relPath, the path relative
+// to the source directory.
+func (rw *romWalker) names(relPath string) (string, string) {
+	romName := relPath
+	if rw.basename {
+		romName = filepath.Base(romName)
 	}
-	if f.IsDir() {
-		return nil
+	if rw.lowercase {
+		romName = strings.ToLower(romName)
 	}
 
+	gameName := romName
+	if rw.stripExt {
+		gameName = stripExt(gameName)
+	}
+	return gameName, romName
+}
+
+// game hashes the file at path and returns the game holding it as its only rom.
+func (rw *romWalker) game(path string, size int64) (*types.Game, error) {
 	hh, err := HashesForFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	romName, err := filepath.Rel(rw.sourcePath, path)
+	relPath, err := filepath.Rel(rw.sourcePath, path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	gameName, romName := rw.names(relPath)
+
 	rom := new(types.Rom)
 	rom.Name = romName
-	rom.Size = f.Size()
+	rom.Size = size
 	rom.Crc = hh.Crc
 	rom.Md5 = hh.Md5
 	rom.Sha1 = hh.Sha1
 
 	game := new(types.Game)
-	game.Name = romName
+	game.Name = gameName
 
 	game.Roms = append(game.Roms, rom)
+	return game, nil
+}
+
+func (rw *romWalker) visit(path string, f os.FileInfo, err error) error {
+	if f == nil || f.Name() == ".DS_Store" {
+		return nil
+	}
+	if f.IsDir() {
+		return nil
+	}
+
+	game, err := rw.game(path, f.Size())
+	if err != nil {
+		return err
+	}
 
 	rw.dat.Games = append(rw.dat.Games, game)
 	return nil
 }
 
-func Dir2Dat(dat *types.Dat, srcpath, outpath string) error {
+type dir2datWorker struct {
+	pm *dir2datGru
+}
+
+type dir2datGru struct {
+	rw         *romWalker
+	numWorkers int
+	pt         worker.ProgressTracker
+
+	mutex sync.Mutex
+	games types.GameSlice
+	err   error
+}
+
+// Process hashes the file at path into a game. The first error stops the run
+// and is returned by walkParallel.
+func (w *dir2datWorker) Process(path string, size int64) error {
+	game, err := w.pm.rw.game(path, size)
+	if err != nil {
+		w.pm.mutex.Lock()
+		if w.pm.err == nil {
+			w.pm.err = err
+		}
+		w.pm.mutex.Unlock()
+		return worker.StopProcessing.Wrap(err)
+	}
+
+	w.pm.mutex.Lock()
+	w.pm.games = append(w.pm.games, game)
+	w.pm.mutex.Unlock()
+	return nil
+}
+
+func (w *dir2datWorker) Close() error {
+	return nil
+}
+
+func (pm *dir2datGru) Accept(path string) bool {
+	return filepath.Base(path) != ".DS_Store"
+}
+
+func (pm *dir2datGru) NewWorker(workerIndex int) worker.Worker {
+	return &dir2datWorker{
+		pm: pm,
+	}
+}
+
+func (pm *dir2datGru) CalculateWork() bool {
+	return true
+}
+
+func (pm *dir2datGru) NeedsSizeInfo() bool {
+	return true
+}
+
+func (pm *dir2datGru) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *dir2datGru) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *dir2datGru) FinishUp() error {
+	return nil
+}
+
+func (pm *dir2datGru) Start() error {
+	return nil
+}
+
+func (pm *dir2datGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+
+// sortGames orders games by name, and games with equal names by rom name and
+// sha1, so that the DAT doesn't depend on the order the workers finished in.
+func sortGames(games types.GameSlice) {
+	sort.Slice(games, func(i, j int) bool {
+		gi, gj := games[i], games[j]
+		if gi.Name != gj.Name {
+			return gi.Name < gj.Name
+		}
+		ri, rj := gi.Roms[0], gj.Roms[0]
+		if ri.Name != rj.Name {
+			return ri.Name < rj.Name
+		}
+		return bytes.Compare(ri.Sha1, rj.Sha1) < 0
+	})
+}
+
+// walkParallel hashes the files below rw.sourcePath on numWorkers workers and
+// adds their games to rw.dat sorted by name. It stops on the first file that
+// fails to hash, like the sequential walk.
+func (rw *romWalker) walkParallel(numWorkers int) error {
+	pm := &dir2datGru{
+		rw:         rw,
+		numWorkers: numWorkers,
+		pt:         worker.NewProgressTracker(numWorkers),
+	}
+
+	_, err := worker.Work("dir2dat", []string{rw.sourcePath}, pm)
+	if err != nil {
+		return err
+	}
+	if pm.err != nil {
+		return pm.err
+	}
+
+	sortGames(pm.games)
+	rw.dat.Games = append(rw.dat.Games, pm.games...)
+	return nil
+}
+
+// Dir2Dat composes a DAT for the files in srcpath and writes it to outpath.
+// Rom and game names are the file paths relative to srcpath, reduced to the
+// file name if basename is set and lowercased if lowercase is set.
+// If stripExt is set, game names have their extension removed.
+// With numWorkers > 1 the files are hashed concurrently and the games are sorted
+// by name, otherwise they are in the order of the directory walk.
+func Dir2Dat(dat *types.Dat, srcpath, outpath string, basename, lowercase, stripExt bool, numWorkers int) error {
 	glog.Infof("composing DAT from source %s into output %s", srcpath, outpath)
 
+	// the workers get absolute paths
+	srcpath, err := filepath.Abs(srcpath)
+	if err != nil {
+		return err
+	}
+
 	rw := &romWalker{
 		dat:        dat,
 		sourcePath: srcpath,
+		basename:   basename,
+		lowercase:  lowercase,
+		stripExt:   stripExt,
 	}
 
-	err := filepath.Walk(srcpath, rw.visit)
+	if numWorkers > 1 {
+		err = rw.walkParallel(numWorkers)
+	} else {
+		err = filepath.Walk(srcpath, rw.visit)
+	}
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,188 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestRomWalkerNames(t *testing.T) {
+	relPath := filepath.Join("Some Dir", "Game Name.BIN")
+
+	testCases := []struct {
+		rw       romWalker
+		gameName string
+		romName  string
+	}{
+		{romWalker{}, relPath, relPath},
+		{romWalker{basename: true}, "Game Name.BIN", "Game Name.BIN"},
+		{romWalker{lowercase: true}, filepath.Join("some dir", "game name.bin"), filepath.Join("some dir", "game name.bin")},
+		{romWalker{stripExt: true}, filepath.Join("Some Dir", "Game Name"), relPath},
+		{romWalker{basename: true, lowercase: true, stripExt: true}, "game name", "game name.bin"},
+	}
+
+	for i, tc := range testCases {
+		gameName, romName := tc.rw.names(relPath)
+		if gameName != tc.gameName || romName != tc.romName {
+			t.Fatalf("case %d: expected game %q rom %q, got game %q rom %q", i, tc.gameName, tc.romName,
+				gameName, romName)
+		}
+	}
+}
+
+func TestDir2DatWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dir2dat")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(srcDir, fmt.Sprintf("dir%d", i%3), fmt.Sprintf("rom%02d.bin", i))
+		err = os.MkdirAll(filepath.Dir(path), 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		err = ioutil.WriteFile(path, []byte(fmt.Sprintf("content %d", i)), 0666)
+		if err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	compose := func(numWorkers int, basename bool) []byte {
+		outpath := filepath.Join(dir, fmt.Sprintf("out-%d-%v.dat", numWorkers, basename))
+		err := Dir2Dat(&types.Dat{Name: "test"}, srcDir, outpath, basename, false, false, numWorkers)
+		if err != nil {
+			t.Fatalf("dir2dat with %d workers failed: %v", numWorkers, err)
+		}
+		bs, err := ioutil.ReadFile(outpath)
+		if err != nil {
+			t.Fatalf("failed to read dat: %v", err)
+		}
+		return bs
+	}
+
+	for _, basename := range []bool{false, true} {
+		serial := compose(1, basename)
+		parallel := compose(4, basename)
+
+		if !bytes.Equal(parallel, compose(4, basename)) {
+			t.Fatalf("dir2dat with workers isn't reproducible")
+		}
+
+		serialDat, _, err := parser.ParseDat(bytes.NewReader(serial), "serial.dat")
+		if err != nil {
+			t.Fatalf("failed to parse dat: %v", err)
+		}
+		parallelDat, _, err := parser.ParseDat(bytes.NewReader(parallel), "parallel.dat")
+		if err != nil {
+			t.Fatalf("failed to parse dat: %v", err)
+		}
+
+		if len(parallelDat.Games) != 20 {
+			t.Fatalf("expected 20 games, got %d", len(parallelDat.Games))
+		}
+		for i := 1; i < len(parallelDat.Games); i++ {
+			if parallelDat.Games[i-1].Name > parallelDat.Games[i].Name {
+				t.Fatalf("games not sorted by name: %s before %s", parallelDat.Games[i-1].Name,
+					parallelDat.Games[i].Name)
+			}
+		}
+
+		serialDat.Path = parallelDat.Path
+		serialDat.Normalize()
+		parallelDat.Normalize()
+		if !serialDat.Equals(parallelDat) {
+			t.Fatalf("dir2dat with workers differs from serial dir2dat")
+		}
+	}
+}
+
+func TestDir2DatStopsOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dir2dat")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+	badDir := config.GlobalConfig.General.BadDir
+	defer func() {
+		config.GlobalConfig.General.BadDir = badDir
+	}()
+	config.GlobalConfig.General.BadDir = filepath.Join(dir, "bad")
+
+	srcDir := filepath.Join(dir, "src")
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(srcDir, fmt.Sprintf("rom%02d.bin", i))
+		err = os.MkdirAll(filepath.Dir(path), 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		err = ioutil.WriteFile(path, []byte(fmt.Sprintf("content %d", i)), 0666)
+		if err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	// the walk doesn't follow symlinks, so this is a file that fails to hash
+	err = os.Symlink(dir, filepath.Join(srcDir, "dir.bin"))
+	if err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	for _, numWorkers := range []int{1, 4} {
+		outpath := filepath.Join(dir, fmt.Sprintf("out-%d.dat", numWorkers))
+		err = Dir2Dat(&types.Dat{Name: "test"}, srcDir, outpath, false, false, false, numWorkers)
+		if err == nil {
+			t.Fatalf("expected dir2dat with %d workers to fail", numWorkers)
+		}
+		if _, err = os.Stat(outpath); !os.IsNotExist(err) {
+			t.Fatalf("expected no dat written by dir2dat with %d workers, stat: %v", numWorkers, err)
+		}
+	}
+
+	if _, err = os.Stat(config.GlobalConfig.General.BadDir); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing copied into the bad dir, stat: %v", err)
+	}
+}
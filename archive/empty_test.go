@@ -0,0 +1,140 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/dedup"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+const emptyRomDatText = `
+clrmamepro (
+	name "empty"
+	description "empty"
+)
+
+game (
+	name "game"
+	description "game"
+	rom ( name "empty.bin" size 0 crc 00000000 md5 d41d8cd98f00b204e9800998ecf8427e sha1 da39a3ee5e6b4b0d3255bfef95601890afd80709 )
+)
+`
+
+func TestZeroByteRom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_empty")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	outDir := filepath.Join(dir, "out")
+	for _, d := range []string{depotDir, srcDir, outDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(srcDir, "empty.bin"), nil, 0666)
+	if err != nil {
+		t.Fatalf("failed to write empty file: %v", err)
+	}
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true, nil)
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	emptySha1 := sha1.Sum(nil)
+	sha1Hex := hex.EncodeToString(emptySha1[:])
+
+	inDepot, hh, _, size, err := depot.SHA1InDepot(sha1Hex)
+	if err != nil {
+		t.Fatalf("failed to look up empty rom: %v", err)
+	}
+	if !inDepot {
+		t.Fatalf("expected empty rom in depot")
+	}
+	if size != 0 || hh.Crc == nil {
+		t.Fatalf("expected empty rom with size 0 and crc, got size %d crc %v", size, hh.Crc)
+	}
+
+	dat, _, err := parser.ParseDat(strings.NewReader(emptyRomDatText), "testing/empty.dat")
+	if err != nil {
+		t.Fatalf("failed to parse dat with empty rom: %v", err)
+	}
+	if len(dat.Games) != 1 || len(dat.Games[0].Roms) != 1 {
+		t.Fatalf("expected dat with one game and one rom")
+	}
+
+	incomplete, err := depot.BuildDat(dat, outDir, 1, dedup.NewMemoryDeduper(dedup.MatchKeySha1), false,
+		&BuildOptions{Format: BuildFormatZip, ScratchDir: dir})
+	if err != nil {
+		t.Fatalf("failed to build dat: %v", err)
+	}
+	if incomplete {
+		t.Fatalf("expected complete build")
+	}
+
+	zr, err := zip.OpenReader(filepath.Join(outDir, "empty", "game.zip"))
+	if err != nil {
+		t.Fatalf("failed to open built game: %v", err)
+	}
+	defer zr.Close()
+
+	if len(zr.File) != 1 || zr.File[0].Name != "empty.bin" || zr.File[0].UncompressedSize64 != 0 {
+		t.Fatalf("expected built game with one empty rom")
+	}
+}
@@ -52,6 +52,7 @@ type fixdatBuilder struct {
 	closeC    chan bool
 	index     int
 	deduper   dedup.Deduper
+	matchKey  dedup.MatchKey
 	bloomOnly bool
 }
 
@@ -59,7 +60,7 @@ func (gb *fixdatBuilder) work() {
 	glog.V(4).Infof("starting subworker %d", gb.index)
 	for game := range gb.wc {
 		gamePath := filepath.Join(gb.datPath, game.Name)
-		fixGame, err := gb.depot.fixdatGame(game, gamePath, gb.fixDat.UnzipGames, gb.deduper, gb.bloomOnly)
+		fixGame, err := gb.depot.fixdatGame(game, gamePath, gb.fixDat.UnzipGames, gb.deduper, gb.matchKey, gb.bloomOnly)
 		if err != nil {
 			glog.Errorf("error processing %s: %v", gamePath, err)
 			gb.erc <- err
@@ -76,8 +77,11 @@ func (gb *fixdatBuilder) work() {
 	return
 }
 
+// FixDat writes the fixdat of the roms of dat missing from the depot into outpath.
+// The roms are looked up by the hashes matchKey selects, the fixdat lists them with
+// all the hashes of the DAT.
 func (depot *Depot) FixDat(dat *types.Dat, outpath string,
-	numSubworkers int, deduper dedup.Deduper, bloomOnly bool) (bool, error) {
+	numSubworkers int, deduper dedup.Deduper, matchKey dedup.MatchKey, bloomOnly bool) (bool, error) {
 	datPath := filepath.Join(outpath, dat.Name)
 
 	fixDat := new(types.Dat)
@@ -102,6 +106,7 @@ func (depot *Depot) FixDat(dat *types.Dat, outpath string,
 		gb.fixDat = fixDat
 		gb.index = i
 		gb.deduper = deduper
+		gb.matchKey = matchKey
 		gb.closeC = closeC
 		gb.bloomOnly = bloomOnly
 		go gb.work()
@@ -165,11 +170,13 @@ endLoop2:
 }
 
 func (depot *Depot) fixdatGame(game *types.Game, gamePath string,
-	unzipGame bool, deduper dedup.Deduper, bloomOnly bool) (*types.Game, error) {
+	unzipGame bool, deduper dedup.Deduper, matchKey dedup.MatchKey, bloomOnly bool) (*types.Game, error) {
 
 	var fixGame *types.Game
 
-	for _, rom := range game.Roms {
+	for _, dr := range game.Roms {
+		rom := dedup.KeyRom(dr, matchKey)
+
 		croms, err := depot.RomDB.CompleteRom(rom)
 		if err != nil {
 			glog.Errorf("error completing rom %s: %v", rom.Name, err)
@@ -188,7 +195,7 @@ func (depot *Depot) fixdatGame(game *types.Game, gamePath string,
 					fixGame.Description = game.Description
 				}
 
-				fixGame.Roms = append(fixGame.Roms, rom)
+				fixGame.Roms = append(fixGame.Roms, dr)
 			}
 			continue
 		}
@@ -223,7 +230,7 @@ func (depot *Depot) fixdatGame(game *types.Game, gamePath string,
 					fixGame.Description = game.Description
 				}
 
-				fixGame.Roms = append(fixGame.Roms, rom)
+				fixGame.Roms = append(fixGame.Roms, dr)
 			}
 			continue
 		}
@@ -0,0 +1,333 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type fsckStatus int
+
+const (
+	fsckOK fsckStatus = iota
+	// gzip stream ends early or decompresses to fewer bytes than recorded at archive time
+	fsckTruncated
+	// gzip stream is complete but its content doesn't match its sha1 or checksums
+	fsckCorrupt
+	// more gzip members follow the first one, archive only ever writes one
+	fsckMultiMember
+)
+
+func (s fsckStatus) String() string {
+	switch s {
+	case fsckTruncated:
+		return "truncated"
+	case fsckCorrupt:
+		return "corrupt"
+	case fsckMultiMember:
+		return "multimember"
+	}
+	return "ok"
+}
+
+type fsckWorker struct {
+	depot *Depot
+	index int
+	pm    *fsckGru
+}
+
+type fsckGru struct {
+	depot          *Depot
+	numWorkers     int
+	pt             worker.ProgressTracker
+	quarantineDir  string
+	hashBufferSize int
+
+	mutex          sync.Mutex
+	numTruncated   int
+	numCorrupt     int
+	numMultiMember int
+}
+
+// checkDepotGZ reads the depot file at inpath completely and compares it against the sha1
+// in its name and the size recorded in its gzip header. Only the first gzip member is
+// decompressed, a depot file with another member after it is reported as multi-member.
+// A CHD is named after the sha1 in its header, its content is checked against the md5
+// and crc recorded in the gzip header instead.
+func checkDepotGZ(inpath string, bufSize int) (fsckStatus, error) {
+	rom, err := RomFromGZDepotFile(inpath)
+	if err != nil {
+		return fsckOK, err
+	}
+
+	file, err := os.Open(inpath)
+	if err != nil {
+		return fsckOK, err
+	}
+	defer file.Close()
+
+	br := bufio.NewReaderSize(file, bufSize)
+	gzr, err := gzip.NewReader(br)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fsckTruncated, nil
+		}
+		if err == gzip.ErrHeader {
+			return fsckCorrupt, nil
+		}
+		return fsckOK, err
+	}
+	defer gzr.Close()
+
+	// br is a flate.Reader, so gzr doesn't read past the end of the first member
+	gzr.Multistream(false)
+
+	h := sha1.New()
+	hMd5 := md5.New()
+	hCrc := crc32.NewIEEE()
+	cw := &countWriter{
+		w: io.MultiWriter(h, hMd5, hCrc),
+	}
+	// CHDs are named after the sha1 in their header
+	hdr := &headWriter{max: chdHeaderMax}
+
+	_, err = io.CopyBuffer(io.MultiWriter(cw, hdr), gzr, make([]byte, bufSize))
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fsckTruncated, nil
+		}
+		if _, ok := err.(flate.CorruptInputError); ok || err == gzip.ErrChecksum {
+			return fsckCorrupt, nil
+		}
+		return fsckOK, err
+	}
+
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return fsckOK, err
+	}
+	if len(magic) > 0 {
+		if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			return fsckMultiMember, nil
+		}
+		return fsckCorrupt, nil
+	}
+
+	var hh *Hashes
+	extra := gzr.Header.Extra
+	if len(extra) == md5.Size+crc32.Size+8 {
+		hh = HashesFromMd5crcBuffer(extra)
+		if hh.Size != cw.count {
+			return fsckTruncated, nil
+		}
+	}
+
+	if !bytes.Equal(rom.Sha1, h.Sum(nil)) {
+		// the header sha1 of a CHD isn't checked against its data, so without
+		// the recorded md5 and crc of its content a CHD can't be verified
+		if hh == nil || !bytes.Equal(hh.Md5, hMd5.Sum(nil)) || !bytes.Equal(hh.Crc, hCrc.Sum(nil)) {
+			return fsckCorrupt, nil
+		}
+		identity, err := chdSha1(bytes.NewReader(hdr.buf))
+		if err != nil || !bytes.Equal(rom.Sha1, identity) {
+			return fsckCorrupt, nil
+		}
+	}
+	return fsckOK, nil
+}
+
+// headWriter keeps the first max bytes written to it.
+type headWriter struct {
+	buf []byte
+	max int
+}
+
+func (hw *headWriter) Write(p []byte) (int, error) {
+	if n := hw.max - len(hw.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		hw.buf = append(hw.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+func (depot *Depot) Fsck(quarantineDir string, numWorkers int, workDepot string, hashBufferSize int,
+	useManifest bool, pt worker.ProgressTracker) (string, error) {
+	pm := new(fsckGru)
+	pm.depot = depot
+	pm.pt = pt
+	pm.numWorkers = numWorkers
+	pm.hashBufferSize = HashBufferSize(hashBufferSize)
+
+	if quarantineDir != "" {
+		absQuarantineDir, err := filepath.Abs(quarantineDir)
+		if err != nil {
+			return "", err
+		}
+
+		err = os.MkdirAll(absQuarantineDir, 0777)
+		if err != nil {
+			return "", err
+		}
+		pm.quarantineDir = absQuarantineDir
+	}
+
+	wds := make([]string, len(depot.roots))
+	for i, dr := range depot.roots {
+		wds[i] = dr.path
+	}
+	if len(workDepot) > 0 {
+		wds = []string{workDepot}
+	}
+
+	var endMsg string
+	var err error
+
+	if useManifest && len(workDepot) == 0 {
+		if !depot.HasManifests() {
+			return "", errNoManifests
+		}
+		endMsg, err = worker.WorkPathIterator("fsck depot", depot.newManifestIterator(), pm)
+	} else {
+		endMsg, err = worker.Work("fsck depot", wds, pm)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return endMsg + fmt.Sprintf("number of truncated gzip files: %d\nnumber of corrupt gzip files: %d\n"+
+		"number of multi-member gzip files: %d\n", pm.numTruncated, pm.numCorrupt, pm.numMultiMember), nil
+}
+
+func (pm *fsckGru) Accept(path string) bool {
+	return filepath.Ext(path) == gzipSuffix
+}
+
+func (pm *fsckGru) CalculateWork() bool {
+	return true
+}
+
+func (pm *fsckGru) NeedsSizeInfo() bool {
+	return true
+}
+
+func (pm *fsckGru) NewWorker(workerIndex int) worker.Worker {
+	return &fsckWorker{
+		depot: pm.depot,
+		index: workerIndex,
+		pm:    pm,
+	}
+}
+
+func (pm *fsckGru) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *fsckGru) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *fsckGru) FinishUp() error {
+	pm.depot.writeSizes()
+	return nil
+}
+
+func (pm *fsckGru) Start() error {
+	return nil
+}
+
+func (pm *fsckGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+
+func (w *fsckWorker) Process(inpath string, size int64) error {
+	status, err := checkDepotGZ(inpath, w.pm.hashBufferSize)
+	if err != nil {
+		return err
+	}
+
+	if status == fsckOK {
+		return nil
+	}
+
+	w.pm.mutex.Lock()
+	switch status {
+	case fsckTruncated:
+		w.pm.numTruncated++
+	case fsckMultiMember:
+		w.pm.numMultiMember++
+	default:
+		w.pm.numCorrupt++
+	}
+	w.pm.mutex.Unlock()
+
+	glog.Errorf("fsck: %s gzip file %s", status, inpath)
+
+	if w.pm.quarantineDir == "" {
+		return nil
+	}
+
+	destPath := filepath.Join(w.pm.quarantineDir, status.String(), filepath.Base(inpath))
+	glog.Infof("fsck: quarantining %s, moving to %s", inpath, destPath)
+	err = worker.Mv(inpath, destPath)
+	if err != nil {
+		return err
+	}
+
+	sha1Hex := strings.TrimSuffix(filepath.Base(inpath), gzipSuffix)
+	w.pm.depot.cache.Del(sha1Hex)
+
+	for i, depotRoot := range w.pm.depot.roots {
+		if strings.HasPrefix(inpath, depotRoot.path) {
+			w.pm.depot.adjustSize(i, -size, "")
+			break
+		}
+	}
+	return nil
+}
+
+func (w *fsckWorker) Close() error {
+	return nil
+}
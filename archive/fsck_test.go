@@ -0,0 +1,180 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/util"
+)
+
+func writeTestDepotGZ(t *testing.T, dir string, content []byte) string {
+	h := sha1.Sum(content)
+	sha1Hex := hex.EncodeToString(h[:])
+
+	outpath := pathFromSha1HexEncoding(dir, sha1Hex, gzipSuffix)
+
+	md5crcBuffer := make([]byte, md5.Size+crc32.Size+8)
+	util.Int64ToBytes(int64(len(content)), md5crcBuffer[md5.Size+crc32.Size:])
+
+	_, err := archive(outpath, bytes.NewReader(content), md5crcBuffer, false)
+	if err != nil {
+		t.Fatalf("failed to archive test content: %v", err)
+	}
+	return outpath
+}
+
+func TestCheckDepotGZ(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_fsck")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("romba fsck test content "), 4096)
+
+	okPath := writeTestDepotGZ(t, filepath.Join(dir, "ok"), content)
+	status, err := checkDepotGZ(okPath, DefaultHashBufferSize)
+	if err != nil {
+		t.Fatalf("checkDepotGZ failed: %v", err)
+	}
+	if status != fsckOK {
+		t.Fatalf("expected ok, got %v", status)
+	}
+
+	truncPath := writeTestDepotGZ(t, filepath.Join(dir, "trunc"), content)
+	fi, err := os.Stat(truncPath)
+	if err != nil {
+		t.Fatalf("failed to stat: %v", err)
+	}
+	err = os.Truncate(truncPath, fi.Size()/2)
+	if err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	status, err = checkDepotGZ(truncPath, DefaultHashBufferSize)
+	if err != nil {
+		t.Fatalf("checkDepotGZ failed: %v", err)
+	}
+	if status != fsckTruncated {
+		t.Fatalf("expected truncated, got %v", status)
+	}
+
+	wrongPath := writeTestDepotGZ(t, filepath.Join(dir, "wrong"), content)
+	otherPath := writeTestDepotGZ(t, filepath.Join(dir, "other"), append(content, 'x'))
+	err = os.Rename(otherPath, wrongPath)
+	if err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+	status, err = checkDepotGZ(wrongPath, DefaultHashBufferSize)
+	if err != nil {
+		t.Fatalf("checkDepotGZ failed: %v", err)
+	}
+	if status != fsckCorrupt {
+		t.Fatalf("expected corrupt, got %v", status)
+	}
+
+	multiPath := writeTestDepotGZ(t, filepath.Join(dir, "multi"), content)
+	secondPath := writeTestDepotGZ(t, filepath.Join(dir, "second"), []byte("second member"))
+	second, err := ioutil.ReadFile(secondPath)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	f, err := os.OpenFile(multiPath, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	_, err = f.Write(second)
+	if err != nil {
+		t.Fatalf("failed to append second gzip member: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	status, err = checkDepotGZ(multiPath, DefaultHashBufferSize)
+	if err != nil {
+		t.Fatalf("checkDepotGZ failed: %v", err)
+	}
+	if status != fsckMultiMember {
+		t.Fatalf("expected multimember, got %v", status)
+	}
+}
+
+func TestQuickSizeCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_quick")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("romba quick size check "), 1024)
+	inpath := writeTestDepotGZ(t, dir, content)
+
+	isize, err := GZFooterSize(inpath)
+	if err != nil {
+		t.Fatalf("GZFooterSize failed: %v", err)
+	}
+	if int64(isize) != int64(len(content)) {
+		t.Fatalf("expected footer size %d, got %d", len(content), isize)
+	}
+
+	ok, _, err := QuickSizeCheck(inpath, int64(len(content)))
+	if err != nil {
+		t.Fatalf("QuickSizeCheck failed: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected size check to pass")
+	}
+
+	ok, found, err := QuickSizeCheck(inpath, int64(len(content))+1)
+	if err != nil {
+		t.Fatalf("QuickSizeCheck failed: %v", err)
+	}
+	if ok || found != int64(len(content)) {
+		t.Fatalf("expected size mismatch with found size %d, got ok=%v found=%d", len(content), ok, found)
+	}
+
+	ok, found, err = QuickSizeCheck(inpath, int64(len(content))+maxISize+1)
+	if err != nil {
+		t.Fatalf("QuickSizeCheck failed: %v", err)
+	}
+	if ok || found != int64(len(content)) {
+		t.Fatalf("expected full decompression to find size %d, got ok=%v found=%d", len(content), ok, found)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const benchHashFileSize = 64 * 1024 * 1024
+
+func writeBenchHashFile(b *testing.B) (string, func()) {
+	dir, err := ioutil.TempDir("", "romba_hash")
+	if err != nil {
+		b.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	content := make([]byte, benchHashFileSize)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	path := filepath.Join(dir, "large.bin")
+	err = ioutil.WriteFile(path, content, 0666)
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatalf("failed to write bench file: %v", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func benchmarkHashFile(b *testing.B, bufSize int) {
+	path, cleanup := writeBenchHashFile(b)
+	defer cleanup()
+
+	b.SetBytes(benchHashFileSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		file, err := os.Open(path)
+		if err != nil {
+			b.Fatalf("failed to open bench file: %v", err)
+		}
+
+		hh := newHashes()
+		err = hh.forReaderSize(file, bufSize)
+		file.Close()
+		if err != nil {
+			b.Fatalf("failed to hash bench file: %v", err)
+		}
+	}
+}
+
+func BenchmarkHashFile4K(b *testing.B) { benchmarkHashFile(b, 4*1024) }
+
+func BenchmarkHashFile64K(b *testing.B) { benchmarkHashFile(b, 64*1024) }
+
+func BenchmarkHashFile1M(b *testing.B) { benchmarkHashFile(b, 1024*1024) }
+
+func TestHashBufferSizesAgree(t *testing.T) {
+	content := bytes.Repeat([]byte("romba hash buffer test "), 100000)
+
+	small := newHashes()
+	err := small.forReaderSize(bytes.NewReader(content), 16)
+	if err != nil {
+		t.Fatalf("failed to hash with small buffer: %v", err)
+	}
+
+	large := newHashes()
+	err = large.forReaderSize(bytes.NewReader(content), 0)
+	if err != nil {
+		t.Fatalf("failed to hash with default buffer: %v", err)
+	}
+
+	if !bytes.Equal(small.Sha1, large.Sha1) || !bytes.Equal(small.Md5, large.Md5) ||
+		!bytes.Equal(small.Crc, large.Crc) || small.Size != large.Size {
+		t.Fatalf("hashes differ between buffer sizes")
+	}
+}
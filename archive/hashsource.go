@@ -0,0 +1,151 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// HashSource computes the identity SHA1 of a file, the SHA1 that DAT entries use to refer to it.
+type HashSource interface {
+	IdentitySha1(path string) ([]byte, error)
+}
+
+// ContentHashSource identifies a file by the SHA1 of its content. This is the identity of roms.
+type ContentHashSource struct{}
+
+func (ContentHashSource) IdentitySha1(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := sha1.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// CHDHashSource identifies a CHD file by the SHA1 recorded in its header, which covers the
+// uncompressed data and the metadata. This is the SHA1 of disk entries in DATs.
+type CHDHashSource struct{}
+
+const (
+	chdSuffix    = ".chd"
+	chdTag       = "MComprHD"
+	chdHeaderMax = 124
+)
+
+// chdSha1Offsets maps CHD header versions to the offset of the combined data and metadata SHA1.
+var chdSha1Offsets = map[uint32]int{
+	3: 80,
+	4: 48,
+	5: 84,
+}
+
+func (CHDHashSource) IdentitySha1(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return chdSha1(file)
+}
+
+func chdSha1(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, chdHeaderMax)
+	n, err := io.ReadFull(r, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	hdr = hdr[:n]
+
+	if len(hdr) < 16 || !bytes.Equal(hdr[:len(chdTag)], []byte(chdTag)) {
+		return nil, fmt.Errorf("not a chd file")
+	}
+
+	version := binary.BigEndian.Uint32(hdr[12:])
+	offset, ok := chdSha1Offsets[version]
+	if !ok {
+		return nil, fmt.Errorf("unsupported chd version %d", version)
+	}
+
+	if len(hdr) < offset+sha1.Size {
+		return nil, fmt.Errorf("truncated chd v%d header", version)
+	}
+
+	sha1Bytes := make([]byte, sha1.Size)
+	copy(sha1Bytes, hdr[offset:offset+sha1.Size])
+	return sha1Bytes, nil
+}
+
+// HashSourceFor returns the hash source that identifies the file at path.
+func HashSourceFor(path string) HashSource {
+	if strings.ToLower(filepath.Ext(path)) == chdSuffix {
+		return CHDHashSource{}
+	}
+	return ContentHashSource{}
+}
+
+// readerIdentitySha1 returns the identity SHA1 of the file named name that ro opens
+// if it differs from the SHA1 of its content, nil otherwise. A file named like a CHD
+// without a CHD header is identified by its content.
+func readerIdentitySha1(name string, ro readerOpener) ([]byte, error) {
+	if _, ok := HashSourceFor(name).(CHDHashSource); !ok {
+		return nil, nil
+	}
+
+	r, err := ro()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	identity, err := chdSha1(r)
+	if err != nil {
+		glog.Warningf("identifying %s by its content: %v", name, err)
+		return nil, nil
+	}
+	return identity, nil
+}
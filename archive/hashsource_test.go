@@ -0,0 +1,227 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/dedup"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func testCHDHeader(version uint32, sha1Bytes []byte) []byte {
+	hdr := make([]byte, chdHeaderMax)
+	copy(hdr, chdTag)
+	binary.BigEndian.PutUint32(hdr[8:], chdHeaderMax)
+	binary.BigEndian.PutUint32(hdr[12:], version)
+	copy(hdr[chdSha1Offsets[version]:], sha1Bytes)
+	return hdr
+}
+
+func TestCHDHashSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_hashsource")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sha1Bytes := bytes.Repeat([]byte{0xab}, sha1.Size)
+
+	for _, version := range []uint32{3, 4, 5} {
+		path := filepath.Join(dir, "disk.chd")
+		content := append(testCHDHeader(version, sha1Bytes), []byte("compressed hunks")...)
+		err = ioutil.WriteFile(path, content, 0666)
+		if err != nil {
+			t.Fatalf("failed to write chd: %v", err)
+		}
+
+		hs := HashSourceFor(path)
+		if _, ok := hs.(CHDHashSource); !ok {
+			t.Fatalf("expected chd hash source for %s", path)
+		}
+
+		identity, err := hs.IdentitySha1(path)
+		if err != nil {
+			t.Fatalf("failed to get identity of chd v%d: %v", version, err)
+		}
+		if !bytes.Equal(identity, sha1Bytes) {
+			t.Fatalf("chd v%d: expected identity %x, got %x", version, sha1Bytes, identity)
+		}
+
+		contentSha1 := sha1.Sum(content)
+		identity, err = ContentHashSource{}.IdentitySha1(path)
+		if err != nil {
+			t.Fatalf("failed to get content identity: %v", err)
+		}
+		if !bytes.Equal(identity, contentSha1[:]) {
+			t.Fatalf("expected content identity %x, got %x", contentSha1, identity)
+		}
+	}
+
+	_, err = chdSha1(bytes.NewReader(testCHDHeader(2, nil)))
+	if err == nil {
+		t.Fatalf("expected unsupported chd version to fail")
+	}
+
+	_, err = chdSha1(bytes.NewReader([]byte("not a chd file at all")))
+	if err == nil {
+		t.Fatalf("expected non chd file to fail")
+	}
+
+	if _, ok := HashSourceFor("rom.bin").(ContentHashSource); !ok {
+		t.Fatalf("expected content hash source for rom.bin")
+	}
+}
+
+func TestArchiveCHD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_chd")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	outDir := filepath.Join(dir, "out")
+	for _, d := range []string{depotDir, srcDir, outDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	sha1Bytes := bytes.Repeat([]byte{0xcd}, sha1.Size)
+	content := append(testCHDHeader(5, sha1Bytes), []byte("compressed hunks")...)
+	err = ioutil.WriteFile(filepath.Join(srcDir, "disk.chd"), content, 0666)
+	if err != nil {
+		t.Fatalf("failed to write chd: %v", err)
+	}
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true, nil)
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	exists, diskpath, err := depot.RomInDepot(hex.EncodeToString(sha1Bytes))
+	if err != nil {
+		t.Fatalf("failed to look up chd: %v", err)
+	}
+	if !exists {
+		t.Fatalf("expected chd in depot under its header sha1")
+	}
+
+	contentSha1 := sha1.Sum(content)
+	exists, _, err = depot.RomInDepot(hex.EncodeToString(contentSha1[:]))
+	if err != nil {
+		t.Fatalf("failed to look up chd: %v", err)
+	}
+	if exists {
+		t.Fatalf("expected no chd in depot under its content sha1")
+	}
+
+	status, err := checkDepotGZ(diskpath, DefaultHashBufferSize)
+	if err != nil {
+		t.Fatalf("failed to check chd: %v", err)
+	}
+	if status != fsckOK {
+		t.Fatalf("expected archived chd to pass fsck, got %v", status)
+	}
+
+	game := &types.Game{
+		Name:  "game",
+		Disks: types.DiskSlice{{Name: "disk", Sha1: sha1Bytes}},
+	}
+	gamePath := filepath.Join(outDir, "game")
+
+	_, found, err := depot.buildGame(game, gamePath, false, dedup.NewMemoryDeduper(dedup.MatchKeySha1),
+		&BuildOptions{Format: BuildFormatZip, ScratchDir: dir})
+	if err != nil {
+		t.Fatalf("failed to build game: %v", err)
+	}
+	if !found {
+		t.Fatalf("expected disk found in depot")
+	}
+
+	built, err := ioutil.ReadFile(filepath.Join(gamePath, "disk.chd"))
+	if err != nil {
+		t.Fatalf("failed to read built disk: %v", err)
+	}
+	if !bytes.Equal(built, content) {
+		t.Fatalf("built disk differs from the archived chd")
+	}
+
+	// corrupt the data after the header, keeping the gzip header of the archived chd
+	gzr, err := openGzipReadCloser(diskpath)
+	if err != nil {
+		t.Fatalf("failed to open archived chd: %v", err)
+	}
+	extra := gzr.(*gzipReadCloser).zr.Header.Extra
+	gzr.Close()
+
+	corruptPath := filepath.Join(dir, "corrupt.gz")
+	corrupted := append(testCHDHeader(5, sha1Bytes), []byte("compressed hunkz")...)
+	_, err = archive(corruptPath, bytes.NewReader(corrupted), extra, false)
+	if err != nil {
+		t.Fatalf("failed to write corrupted chd: %v", err)
+	}
+	err = os.Rename(corruptPath, diskpath)
+	if err != nil {
+		t.Fatalf("failed to replace archived chd: %v", err)
+	}
+
+	status, err = checkDepotGZ(diskpath, DefaultHashBufferSize)
+	if err != nil {
+		t.Fatalf("failed to check chd: %v", err)
+	}
+	if status != fsckCorrupt {
+		t.Fatalf("expected chd with corrupted data to fail fsck, got %v", status)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"time"
+)
+
+// Types of the events handed to an ArchiveHook.
+const (
+	// EventRomAdded is fired for every rom stored in the depot.
+	EventRomAdded = "added"
+	// EventCheckpoint is fired whenever the resume log and the depot root sizes
+	// are written, about once a minute.
+	EventCheckpoint = "checkpoint"
+	// EventComplete is fired once the archive run is over, with or without error.
+	EventComplete = "complete"
+)
+
+// ArchiveEvent describes something that happened during an archive run.
+// Sha1, Path and Size are set for EventRomAdded, Report for the others.
+type ArchiveEvent struct {
+	Type   string        `json:"type"`
+	Time   time.Time     `json:"time"`
+	Sha1   string        `json:"sha1,omitempty"`
+	Path   string        `json:"path,omitempty"`
+	Size   int64         `json:"size,omitempty"`
+	Report *IngestReport `json:"report,omitempty"`
+}
+
+// ArchiveHook is called with the events of an archive run. It's called from
+// the archive workers, so it must be safe for concurrent use and should return
+// quickly, archiving waits for it.
+type ArchiveHook func(ev *ArchiveEvent)
+
+func (pm *archiveGru) fireRomAdded(sha1Hex, path string, size int64) {
+	if pm.hook == nil {
+		return
+	}
+
+	pm.hook(&ArchiveEvent{
+		Type: EventRomAdded,
+		Time: time.Now(),
+		Sha1: sha1Hex,
+		Path: path,
+		Size: size,
+	})
+}
+
+func (pm *archiveGru) fireReport(evType string, paths []string, start time.Time, runErr error) {
+	if pm.hook == nil {
+		return
+	}
+
+	pm.hook(&ArchiveEvent{
+		Type:   evType,
+		Time:   time.Now(),
+		Report: pm.report(paths, start, runErr),
+	})
+}
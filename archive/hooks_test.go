@@ -0,0 +1,121 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestArchiveHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_hook")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	for _, d := range []string{depotDir, srcDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	content := []byte("romba archive hook test content")
+	for _, name := range []string{"a.bin", "b.bin"} {
+		err = ioutil.WriteFile(filepath.Join(srcDir, name), content, 0666)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	var mutex sync.Mutex
+	var events []*ArchiveEvent
+	hook := func(ev *ArchiveEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, ev)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true,
+		&ArchiveOptions{MaxDepth: -1, Hook: hook})
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, ev := range events {
+		counts[ev.Type]++
+	}
+	if counts[EventRomAdded] != 1 || counts[EventComplete] != 1 {
+		t.Fatalf("expected one added and one complete event, got %v", counts)
+	}
+
+	sum := sha1.Sum(content)
+	for _, ev := range events {
+		switch ev.Type {
+		case EventRomAdded:
+			if ev.Sha1 != hex.EncodeToString(sum[:]) || ev.Size != int64(len(content)) ||
+				filepath.Dir(ev.Path) != srcDir {
+				t.Fatalf("unexpected added event %+v", ev)
+			}
+		case EventComplete:
+			if ev.Report == nil || ev.Report.FilesAdded != 1 || ev.Report.FilesSkippedPresent != 1 {
+				t.Fatalf("unexpected complete event %+v", ev)
+			}
+		}
+	}
+
+	if last := events[len(events)-1]; last.Type != EventComplete {
+		t.Fatalf("expected complete as last event, got %s", last.Type)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/karrick/godirwalk"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// A depot root manifest lists the sha1s of the files stored in the root, one per line.
+// Every write into the root appends a line, so a manifest can list the same sha1 more
+// than once and can list files that got removed since.
+
+var (
+	errCorruptManifest = errors.New("corrupt depot manifest")
+	errNoManifests     = errors.New("depot manifests are not enabled")
+)
+
+func isSha1Hex(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func readManifest(root string) ([]string, error) {
+	file, err := os.Open(filepath.Join(root, manifestFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sha1s []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !isSha1Hex(line) {
+			return nil, errCorruptManifest
+		}
+		sha1s = append(sha1s, line)
+	}
+	return sha1s, scanner.Err()
+}
+
+// rebuildManifest walks root and writes a fresh manifest for it.
+func rebuildManifest(root string) error {
+	tmpPath := filepath.Join(root, manifestFilename+".tmp")
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(file)
+
+	err = godirwalk.Walk(root, &godirwalk.Options{
+		Unsorted: true,
+		Callback: func(path string, de *godirwalk.Dirent) error {
+			if de.IsDir() {
+				return nil
+			}
+			name := de.Name()
+			if !strings.HasSuffix(name, gzipSuffix) {
+				return nil
+			}
+			sha1Hex := strings.TrimSuffix(name, gzipSuffix)
+			if !isSha1Hex(sha1Hex) {
+				return nil
+			}
+			_, err := fmt.Fprintln(bw, sha1Hex)
+			return err
+		},
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(root, manifestFilename))
+}
+
+// openManifest validates the manifest of dr, rebuilds it if it is missing or corrupt
+// and opens it for appending. Must be called with dr locked.
+func (dr *depotRoot) openManifest() error {
+	_, err := readManifest(dr.path)
+	if err != nil {
+		if !os.IsNotExist(err) && err != errCorruptManifest {
+			return err
+		}
+
+		glog.Infof("rebuilding manifest of depot root %s: %v", dr.path, err)
+		err = rebuildManifest(dr.path)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(filepath.Join(dr.path, manifestFilename), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	dr.manifest = file
+	return nil
+}
+
+// appendManifest records sha1Hex in the manifest of dr. Must be called with dr locked.
+func (dr *depotRoot) appendManifest(sha1Hex string) {
+	if dr.manifest == nil {
+		return
+	}
+
+	_, err := fmt.Fprintln(dr.manifest, sha1Hex)
+	if err != nil {
+		glog.Errorf("failed to append %s to manifest of depot root %s: %v", sha1Hex, dr.path, err)
+	}
+}
+
+// manifestSha1s returns the distinct sha1s listed in the manifest of dr, rebuilding
+// the manifest first if it is corrupt.
+func (dr *depotRoot) manifestSha1s() ([]string, error) {
+	dr.Lock()
+	defer dr.Unlock()
+
+	if dr.manifest == nil {
+		return nil, errNoManifests
+	}
+
+	sha1s, err := readManifest(dr.path)
+	if err == errCorruptManifest {
+		dr.manifest.Close()
+		dr.manifest = nil
+
+		err = dr.openManifest()
+		if err != nil {
+			return nil, err
+		}
+		sha1s, err = readManifest(dr.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(sha1s)
+
+	n := 0
+	for i, sha1Hex := range sha1s {
+		if i == 0 || sha1Hex != sha1s[n-1] {
+			sha1s[n] = sha1Hex
+			n++
+		}
+	}
+	return sha1s[:n], nil
+}
+
+// EnableManifests makes every depot root maintain a manifest of the sha1s stored in it.
+// Missing or corrupt manifests are rebuilt by walking the root.
+func (depot *Depot) EnableManifests() error {
+	for _, dr := range depot.roots {
+		dr.Lock()
+		err := dr.openManifest()
+		dr.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to open manifest of depot root %s: %v", dr.path, err)
+		}
+	}
+	return nil
+}
+
+// HasManifests returns true if the depot roots maintain manifests.
+func (depot *Depot) HasManifests() bool {
+	for _, dr := range depot.roots {
+		dr.Lock()
+		enabled := dr.manifest != nil
+		dr.Unlock()
+		if !enabled {
+			return false
+		}
+	}
+	return len(depot.roots) > 0
+}
+
+// PopulateBloomFromManifests adds the sha1s listed in the manifests to the bloom filters
+// of their roots without walking the depot. Returns the number of sha1s added.
+func (depot *Depot) PopulateBloomFromManifests() (int, error) {
+	var numAdded int
+
+	for _, dr := range depot.roots {
+		sha1s, err := dr.manifestSha1s()
+		if err != nil {
+			return numAdded, err
+		}
+
+		dr.Lock()
+		for _, sha1Hex := range sha1s {
+			dr.bf.Add([]byte(sha1Hex))
+		}
+		dr.numBfAdded += int64(len(sha1s))
+		dr.Unlock()
+
+		numAdded += len(sha1s)
+	}
+	return numAdded, nil
+}
+
+// manifestIterator yields the paths of the depot files listed in the root manifests.
+// Listed files that don't exist anymore are skipped.
+type manifestIterator struct {
+	depot      *Depot
+	rootCursor int
+	sha1s      []string
+	cursor     int
+}
+
+func (depot *Depot) newManifestIterator() *manifestIterator {
+	return &manifestIterator{
+		depot: depot,
+	}
+}
+
+func (mi *manifestIterator) Next() (worker.ResumePath, bool, error) {
+	for mi.cursor >= len(mi.sha1s) {
+		if mi.rootCursor >= len(mi.depot.roots) {
+			return worker.ResumePath{}, false, nil
+		}
+
+		sha1s, err := mi.depot.roots[mi.rootCursor].manifestSha1s()
+		if err != nil {
+			return worker.ResumePath{}, false, err
+		}
+		mi.sha1s = sha1s
+		mi.cursor = 0
+		mi.rootCursor++
+	}
+
+	rompath := pathFromSha1HexEncoding(mi.depot.roots[mi.rootCursor-1].path, mi.sha1s[mi.cursor], gzipSuffix)
+	mi.cursor++
+
+	exists, err := PathExists(rompath)
+	if err != nil {
+		return worker.ResumePath{}, false, err
+	}
+	if !exists {
+		return worker.ResumePath{}, true, nil
+	}
+	return worker.ResumePath{Path: rompath}, true, nil
+}
+
+func (mi *manifestIterator) Reset() {
+	mi.rootCursor = 0
+	mi.sha1s = nil
+	mi.cursor = 0
+}
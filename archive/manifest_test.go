@@ -0,0 +1,135 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_manifest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pathA := writeTestDepotGZ(t, dir, []byte("romba manifest test content a"))
+	pathB := writeTestDepotGZ(t, dir, []byte("romba manifest test content b"))
+
+	depot, err := NewDepot([]string{dir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	if depot.HasManifests() {
+		t.Fatalf("expected no manifests before enabling them")
+	}
+
+	err = depot.EnableManifests()
+	if err != nil {
+		t.Fatalf("failed to enable manifests: %v", err)
+	}
+
+	sha1s, err := depot.roots[0].manifestSha1s()
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if len(sha1s) != 2 {
+		t.Fatalf("expected rebuilt manifest to list 2 sha1s, got %d", len(sha1s))
+	}
+
+	// a write appends to the manifest, duplicates are listed once
+	pathC := writeTestDepotGZ(t, dir, []byte("romba manifest test content c"))
+	sha1C := strings.TrimSuffix(filepath.Base(pathC), gzipSuffix)
+	depot.adjustSize(0, 10, sha1C)
+	depot.adjustSize(0, 10, sha1C)
+
+	sha1s, err = depot.roots[0].manifestSha1s()
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if len(sha1s) != 3 {
+		t.Fatalf("expected manifest to list 3 sha1s, got %d", len(sha1s))
+	}
+
+	// removed files are skipped by the iterator
+	err = os.Remove(pathB)
+	if err != nil {
+		t.Fatalf("failed to remove %s: %v", pathB, err)
+	}
+
+	var paths []string
+	mi := depot.newManifestIterator()
+	for rp, goOn, err := mi.Next(); goOn; rp, goOn, err = mi.Next() {
+		if err != nil {
+			t.Fatalf("manifest iterator failed: %v", err)
+		}
+		if rp.Path != "" {
+			paths = append(paths, rp.Path)
+		}
+	}
+	if len(paths) != 2 {
+		t.Fatalf("expected iterator to yield 2 paths, got %v", paths)
+	}
+	for _, p := range paths {
+		if p != pathA && p != pathC {
+			t.Fatalf("unexpected path %s from iterator", p)
+		}
+	}
+
+	// a corrupt manifest gets rebuilt
+	err = ioutil.WriteFile(filepath.Join(dir, manifestFilename), []byte("garbage\n"), 0666)
+	if err != nil {
+		t.Fatalf("failed to corrupt manifest: %v", err)
+	}
+
+	err = depot.ClearBloomFilters()
+	if err != nil {
+		t.Fatalf("failed to clear bloom filters: %v", err)
+	}
+
+	numAdded, err := depot.PopulateBloomFromManifests()
+	if err != nil {
+		t.Fatalf("failed to populate bloom from manifests: %v", err)
+	}
+	if numAdded != 2 {
+		t.Fatalf("expected 2 sha1s from rebuilt manifest, got %d", numAdded)
+	}
+	if !depot.roots[0].bf.Test([]byte(sha1C)) {
+		t.Fatalf("expected bloom filter to contain %s", sha1C)
+	}
+}
@@ -31,13 +31,12 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package archive
 
 import (
-	"bufio"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
 	"hash/crc32"
-	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -49,6 +48,7 @@ type mergeWorker struct {
 	hh           *Hashes
 	md5crcBuffer []byte
 	index        int
+	seq          int
 	pm           *mergeGru
 }
 
@@ -58,21 +58,40 @@ type mergeGru struct {
 	numWorkers      int
 	pt              worker.ProgressTracker
 	soFar           chan *completed
-	resumeLogFile   *os.File
-	resumeLogWriter *bufio.Writer
+	observerDone    chan bool
+	resumeLog       *resumeLogWriter
 	onlyneeded      bool
 	skipInitialScan bool
+	rateLimiter     *worker.RateLimiter
+	checkRoom       bool
+	verifySource    bool
+
+	mutex         sync.Mutex
+	numUnverified int
+}
+
+// MergeOptions are the settings of a merge run beyond the ones every run needs.
+type MergeOptions struct {
+	// RateLimit limits the bytes read per second, 0 for no limit.
+	RateLimit int64
+	// CheckRoom calls off the merge if the depot doesn't have room for the scanned files.
+	CheckRoom bool
+	// VerifySource rehashes the source files and skips the ones not matching their names.
+	VerifySource bool
 }
 
 func (depot *Depot) Merge(paths []string, resumePath string, onlyneeded bool, numWorkers int,
-	logDir string, pt worker.ProgressTracker, skipInitialScan bool) (string, error) {
+	logDir string, pt worker.ProgressTracker, skipInitialScan bool, opts *MergeOptions) (string, error) {
+
+	if opts == nil {
+		opts = new(MergeOptions)
+	}
 
 	resumeLogPath := filepath.Join(logDir, fmt.Sprintf("merge-resume-%s.log", time.Now().Format(ResumeDateFormat)))
-	resumeLogFile, err := os.Create(resumeLogPath)
+	resumeLog, err := newResumeLogWriter(resumeLogPath)
 	if err != nil {
 		return "", err
 	}
-	resumeLogWriter := bufio.NewWriter(resumeLogFile)
 
 	resumePoint := ""
 	if len(resumePath) > 0 {
@@ -90,14 +109,21 @@ func (depot *Depot) Merge(paths []string, resumePath string, onlyneeded bool, nu
 	pm.pt = pt
 	pm.numWorkers = numWorkers
 	pm.soFar = make(chan *completed)
-	pm.resumeLogWriter = resumeLogWriter
-	pm.resumeLogFile = resumeLogFile
+	pm.observerDone = make(chan bool)
+	pm.resumeLog = resumeLog
 	pm.onlyneeded = onlyneeded
 	pm.skipInitialScan = skipInitialScan
+	pm.rateLimiter = worker.NewRateLimiter(opts.RateLimit)
+	pm.checkRoom = opts.CheckRoom
+	pm.verifySource = opts.VerifySource
 
-	go loopObserver(pm.numWorkers, pm.soFar, pm.depot, pm.resumeLogWriter)
+	go loopObserver(pm.numWorkers, pm.soFar, pm.observerDone, pm.depot, pm.resumeLog, nil)
 
-	return worker.Work("merge roms", paths, pm)
+	endMsg, err := worker.Work("merge roms", paths, pm)
+	if err == nil && opts.VerifySource {
+		endMsg += fmt.Sprintf("number of source files failing verification: %d\n", pm.numUnverified)
+	}
+	return endMsg, err
 }
 
 func (pm *mergeGru) Accept(path string) bool {
@@ -142,32 +168,46 @@ func (pm *mergeGru) FinishUp() error {
 	pm.soFar <- &completed{
 		workerIndex: -1,
 	}
+	<-pm.observerDone
 
 	pm.depot.writeSizes()
-	pm.resumeLogWriter.Flush()
 
-	return pm.resumeLogFile.Close()
+	return pm.resumeLog.close()
 }
 
 func (pm *mergeGru) Start() error {
 	return nil
 }
 
+// CheckScanned calls off the merge with checkRoom set if the scanned gzip files
+// don't fit into the depot, counting them whether or not they're already in it.
+func (pm *mergeGru) CheckScanned(numFiles int, numBytes int64) error {
+	if !pm.checkRoom {
+		return nil
+	}
+	return pm.depot.checkRoom(numBytes)
+}
+
 func (pm *mergeGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
 
 func (w *mergeWorker) Process(path string, size int64) error {
 	var err error
 
 	err = w.mergeGzip(path, size)
+
+	status := resumeStatusDone
 	if err != nil {
-		return err
+		status = resumeStatusFailed
 	}
 
 	w.pm.soFar <- &completed{
 		path:        path,
+		status:      status,
 		workerIndex: w.index,
+		seq:         w.seq,
 	}
-	return nil
+	w.seq++
+	return err
 }
 
 func (w *mergeWorker) Close() error {
@@ -212,6 +252,21 @@ func (w *mergeWorker) mergeGzip(path string, size int64) error {
 		}
 	}
 
+	if w.pm.verifySource {
+		status, err := checkDepotGZ(path, DefaultHashBufferSize)
+		if err != nil {
+			return err
+		}
+		if status != fsckOK {
+			glog.Errorf("merge: skipping %s gzip file %s", status, path)
+
+			w.pm.mutex.Lock()
+			w.pm.numUnverified++
+			w.pm.mutex.Unlock()
+			return nil
+		}
+	}
+
 	err = w.depot.RomDB.IndexRom(rom)
 	if err != nil {
 		return err
@@ -224,11 +279,16 @@ func (w *mergeWorker) mergeGzip(path string, size int64) error {
 
 	outpath := pathFromSha1HexEncoding(w.depot.roots[root].path, sha1Hex, gzipSuffix)
 
-	err = worker.Cp(path, outpath)
+	err = worker.CpLimited(path, outpath, w.pm.rateLimiter)
+	if err == nil && !w.depot.noFsync {
+		err = syncFile(outpath)
+	}
 	if err != nil {
+		w.depot.adjustSize(root, -size, "")
 		return err
 	}
 
-	w.depot.adjustSize(root, size, sha1Hex)
+	// reserveRoot already accounted for size
+	w.depot.adjustSize(root, 0, sha1Hex)
 	return nil
 }
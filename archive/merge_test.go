@@ -0,0 +1,98 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestMergeVerifySource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_merge")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	srcDir := filepath.Join(dir, "src")
+	depotDir := filepath.Join(dir, "depot")
+	err = os.MkdirAll(depotDir, 0777)
+	if err != nil {
+		t.Fatalf("failed to create depot dir: %v", err)
+	}
+
+	content := bytes.Repeat([]byte("romba merge test content "), 1024)
+	goodPath := writeTestDepotGZ(t, srcDir, content)
+
+	// a source file whose content doesn't match the sha1 in its name
+	badPath := writeTestDepotGZ(t, srcDir, append(content, 'x'))
+	otherPath := writeTestDepotGZ(t, filepath.Join(dir, "other"), append(content, 'y'))
+	err = os.Rename(otherPath, badPath)
+	if err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	endMsg, err := depot.Merge([]string{srcDir}, "", false, 1, dir, worker.NewProgressTracker(1), false,
+		&MergeOptions{VerifySource: true})
+	if err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+
+	if !strings.Contains(endMsg, "number of source files failing verification: 1") {
+		t.Fatalf("expected one file failing verification, got %s", endMsg)
+	}
+
+	for _, srcPath := range []string{goodPath, badPath} {
+		sha1Hex := strings.TrimSuffix(filepath.Base(srcPath), gzipSuffix)
+		_, err = os.Stat(pathFromSha1HexEncoding(depotDir, sha1Hex, gzipSuffix))
+		merged := err == nil
+		if merged != (srcPath == goodPath) {
+			t.Fatalf("expected only the verified file to be merged, %s merged: %v", srcPath, merged)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"github.com/golang/glog"
+)
+
+// PruneStats holds the number of empty directories removed below a depot root.
+type PruneStats struct {
+	Root    string
+	Removed int
+}
+
+// PruneEmptyDirs removes the directories below every depot root that contain no files,
+// deepest first, so that parents emptied along the way go too. The roots themselves
+// and the size, bloom and manifest files stored in them are never touched.
+func (depot *Depot) PruneEmptyDirs() ([]*PruneStats, error) {
+	var pss []*PruneStats
+	for _, dr := range depot.roots {
+		removed, err := deleteEmptyFoldersImpl(dr.path, 0)
+		if err != nil {
+			return pss, err
+		}
+		glog.Infof("removed %d empty directories from depot root %s", removed, dr.path)
+		pss = append(pss, &PruneStats{
+			Root:    dr.path,
+			Removed: removed,
+		})
+	}
+	return pss, nil
+}
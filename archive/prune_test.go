@@ -0,0 +1,99 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+)
+
+func TestPruneEmptyDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keptPath := writeTestDepotGZ(t, dir, []byte("kept rom"))
+
+	// sha1 derived directories never contain a z, so this tree is all leftovers
+	emptyPath := filepath.Join(dir, "zz", "zz", "zz", "zz")
+	err = os.MkdirAll(emptyPath, 0777)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", emptyPath, err)
+	}
+
+	sizePath := filepath.Join(dir, sizeFilename)
+	err = ioutil.WriteFile(sizePath, []byte("0"), 0666)
+	if err != nil {
+		t.Fatalf("failed to write %s: %v", sizePath, err)
+	}
+
+	depot, err := NewDepot([]string{dir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	pss, err := depot.PruneEmptyDirs()
+	if err != nil {
+		t.Fatalf("failed to prune empty dirs: %v", err)
+	}
+
+	if len(pss) != 1 || pss[0].Root != dir {
+		t.Fatalf("expected stats for root %s, got %v", dir, pss)
+	}
+
+	if pss[0].Removed != 4 {
+		t.Fatalf("expected 4 removed dirs, got %d", pss[0].Removed)
+	}
+
+	for _, path := range []string{keptPath, sizePath, dir} {
+		exists, err := PathExists(path)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %v", path, err)
+		}
+		if !exists {
+			t.Fatalf("expected %s to survive pruning", path)
+		}
+	}
+
+	exists, err := PathExists(filepath.Join(dir, "zz"))
+	if err != nil {
+		t.Fatalf("failed to stat leftover dir: %v", err)
+	}
+	if exists {
+		t.Fatalf("expected leftover dirs to be pruned")
+	}
+}
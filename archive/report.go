@@ -0,0 +1,138 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// IngestReport summarizes an archive run. File counts include the files inside
+// zip, gzip and 7z archives.
+type IngestReport struct {
+	Paths                 []string  `json:"paths"`
+	Start                 time.Time `json:"start"`
+	End                   time.Time `json:"end"`
+	FilesScanned          int32     `json:"filesScanned"`
+	BytesScanned          int64     `json:"bytesScanned"`
+	FilesAdded            int64     `json:"filesAdded"`
+	FilesSkippedPresent   int64     `json:"filesSkippedPresent"`
+	FilesSkippedNotNeeded int64     `json:"filesSkippedNotNeeded"`
+	FilesSkippedExtension int64     `json:"filesSkippedExtension"`
+	FilesSkippedSize      int64     `json:"filesSkippedSize"`
+	BytesAdded            int64     `json:"bytesAdded"`
+	CompressedBytesAdded  int64     `json:"compressedBytesAdded"`
+	Errors                int32     `json:"errors"`
+	VerifyMismatches      int       `json:"verifyMismatches"`
+	Error                 string    `json:"error,omitempty"`
+}
+
+type ingestCounters struct {
+	filesAdded            int64
+	filesSkippedPresent   int64
+	filesSkippedNotNeeded int64
+	filesSkippedExtension int64
+	filesSkippedSize      int64
+	bytesAdded            int64
+	compressedBytesAdded  int64
+}
+
+func (pm *archiveGru) countAdded(size, compressedSize int64) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.counters.filesAdded++
+	pm.counters.bytesAdded += size
+	pm.counters.compressedBytesAdded += compressedSize
+}
+
+func (pm *archiveGru) countSkipped(present bool) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if present {
+		pm.counters.filesSkippedPresent++
+	} else {
+		pm.counters.filesSkippedNotNeeded++
+	}
+}
+
+func (pm *archiveGru) countSkippedExtension() {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.counters.filesSkippedExtension++
+}
+
+func (pm *archiveGru) countSkippedSize() {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.counters.filesSkippedSize++
+}
+
+// report collects the counters of the archive run into an IngestReport.
+func (pm *archiveGru) report(paths []string, start time.Time, runErr error) *IngestReport {
+	p := pm.pt.GetProgress()
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	ir := &IngestReport{
+		Paths:                 paths,
+		Start:                 start,
+		End:                   time.Now(),
+		FilesScanned:          p.FilesSoFar,
+		BytesScanned:          p.BytesSoFar,
+		FilesAdded:            pm.counters.filesAdded,
+		FilesSkippedPresent:   pm.counters.filesSkippedPresent,
+		FilesSkippedNotNeeded: pm.counters.filesSkippedNotNeeded,
+		FilesSkippedExtension: pm.counters.filesSkippedExtension,
+		FilesSkippedSize:      pm.counters.filesSkippedSize,
+		BytesAdded:            pm.counters.bytesAdded,
+		CompressedBytesAdded:  pm.counters.compressedBytesAdded,
+		Errors:                p.ErrorFiles,
+		VerifyMismatches:      pm.numMismatches,
+	}
+	if runErr != nil {
+		ir.Error = runErr.Error()
+	}
+	return ir
+}
+
+func writeIngestReport(path string, ir *IngestReport) error {
+	bs, err := json.MarshalIndent(ir, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(bs, '\n'), 0666)
+}
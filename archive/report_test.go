@@ -0,0 +1,116 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestIngestReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_report")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	for _, d := range []string{depotDir, srcDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	content := []byte("romba ingest report test content")
+	for _, name := range []string{"a.bin", "b.bin", "readme.nfo", "NOTES.TXT"} {
+		err = ioutil.WriteFile(filepath.Join(srcDir, name), content, 0666)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	// one byte over -maxFileSize
+	err = ioutil.WriteFile(filepath.Join(srcDir, "big.bin"), append(content, '!'), 0666)
+	if err != nil {
+		t.Fatalf("failed to write big.bin: %v", err)
+	}
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	reportPath := filepath.Join(dir, "report.json")
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true,
+		&ArchiveOptions{MaxDepth: -1, ReportOut: reportPath, MaxFileSize: int64(len(content))})
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	bs, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+
+	var ir IngestReport
+	err = json.Unmarshal(bs, &ir)
+	if err != nil {
+		t.Fatalf("failed to decode report %s: %v", string(bs), err)
+	}
+
+	if ir.FilesScanned != 3 || ir.FilesAdded != 1 || ir.FilesSkippedPresent != 1 || ir.FilesSkippedNotNeeded != 0 {
+		t.Fatalf("unexpected file counts in report %s", string(bs))
+	}
+	if ir.FilesSkippedExtension != 2 {
+		t.Fatalf("expected 2 files skipped by extension in report %s", string(bs))
+	}
+	if ir.FilesSkippedSize != 1 {
+		t.Fatalf("expected 1 file skipped by size in report %s", string(bs))
+	}
+	if ir.BytesAdded != int64(len(content)) || ir.CompressedBytesAdded <= 0 || ir.Errors != 0 {
+		t.Fatalf("unexpected byte counts in report %s", string(bs))
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Resume logs record how far the workers of an archive or merge job got, so an
+// interrupted job can skip the paths it already processed. Every line reads
+//
+//	<status> <timestamp> <hash or -> <path> <sha1 of everything before it>
+//
+// The trailing sha1 lets the reader drop a last line that was only partially
+// written when romba crashed. Lines of older logs consisting of just the path
+// and its sha1 are read as done entries without timestamp.
+
+const (
+	resumeStatusDone   = "done"
+	resumeStatusFailed = "failed"
+
+	resumeTimeFormat = time.RFC3339
+	resumeNoHash     = "-"
+)
+
+type resumeEntry struct {
+	Path   string
+	Status string
+	Time   time.Time
+	Hash   string
+}
+
+func (e *resumeEntry) line() string {
+	hash := e.Hash
+	if hash == "" {
+		hash = resumeNoHash
+	}
+	body := fmt.Sprintf("%s %s %s %s", e.Status, e.Time.Format(resumeTimeFormat), hash, e.Path)
+	return fmt.Sprintf("%s %x\n", body, sha1.Sum([]byte(body)))
+}
+
+// parseResumeLine returns nil if the line is not a complete resume log entry.
+func parseResumeLine(line string) *resumeEntry {
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) <= 41 || line[len(line)-41] != ' ' {
+		return nil
+	}
+
+	body := line[:len(line)-41]
+	if fmt.Sprintf("%x", sha1.Sum([]byte(body))) != line[len(line)-40:] {
+		return nil
+	}
+
+	fields := strings.SplitN(body, " ", 4)
+	if len(fields) == 4 {
+		ts, err := time.Parse(resumeTimeFormat, fields[1])
+		if err == nil {
+			e := &resumeEntry{
+				Status: fields[0],
+				Time:   ts,
+				Path:   fields[3],
+			}
+			if fields[2] != resumeNoHash {
+				e.Hash = fields[2]
+			}
+			return e
+		}
+	}
+
+	return &resumeEntry{
+		Path:   body,
+		Status: resumeStatusDone,
+	}
+}
+
+// readResumeLog returns the complete entries of the resume log in path, skipping
+// garbled lines.
+func readResumeLog(path string) ([]*resumeEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*resumeEntry
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if e := parseResumeLine(line); e != nil {
+			entries = append(entries, e)
+		} else if strings.TrimSpace(line) != "" {
+			glog.Warningf("skipping incomplete line in resume log %s", path)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// resumeLogWriter appends entries to a resume log. Every write is flushed, so a
+// crash loses at most the line being written.
+type resumeLogWriter struct {
+	mutex sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+}
+
+func newResumeLogWriter(path string) (*resumeLogWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &resumeLogWriter{
+		file: file,
+		w:    bufio.NewWriter(file),
+	}, nil
+}
+
+func (rw *resumeLogWriter) write(entries ...*resumeEntry) error {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	for _, e := range entries {
+		_, err := rw.w.WriteString(e.line())
+		if err != nil {
+			return err
+		}
+	}
+	return rw.w.Flush()
+}
+
+func (rw *resumeLogWriter) close() error {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	err := rw.w.Flush()
+	cerr := rw.file.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// extractResumePoint returns the path to resume from, the smallest of the paths
+// last logged by each of the numWorkers workers.
+func extractResumePoint(resumePath string, numWorkers int) (string, error) {
+	entries, err := readResumeLog(resumePath)
+	if err != nil {
+		return "", err
+	}
+
+	if len(entries) == 0 {
+		return "", fmt.Errorf("could not extract a resume point from %s, file seems empty", resumePath)
+	}
+
+	if len(entries) < numWorkers {
+		glog.Warningf("extracting resume point from %s: expected %d lines, got %d, cannot resume", resumePath, numWorkers, len(entries))
+		return "", nil
+	}
+
+	lines := make([]string, 0, numWorkers)
+	for _, e := range entries[len(entries)-numWorkers:] {
+		if len(e.Path) > 0 {
+			lines = append(lines, e.Path)
+		}
+	}
+
+	if len(lines) == 0 {
+		return "", nil
+	}
+
+	sort.Strings(lines)
+	return lines[0], nil
+}
+
+type completed struct {
+	path        string
+	status      string
+	workerIndex int
+	// seq numbers the files of a worker in the order it started them
+	seq int
+}
+
+func writeResumeLogEntry(comps []*completed, depot *Depot, rlw *resumeLogWriter) {
+	now := time.Now()
+	entries := []*resumeEntry{}
+
+	for _, comp := range comps {
+		if comp == nil {
+			continue
+		}
+		path := strings.TrimSpace(comp.path)
+		if len(path) > 0 {
+			entries = append(entries, &resumeEntry{
+				Path:   path,
+				Status: comp.status,
+				Time:   now,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	err := rlw.write(entries...)
+	if err != nil {
+		glog.Errorf("error writing resume log: %v", err)
+	}
+	depot.writeSizes()
+}
+
+// loopObserver logs the paths completed by the workers every minute until it
+// sees a completion with worker index -1, calling checkpoint, if not nil, after
+// every log entry. It closes done when it returns. Files of a worker can complete
+// out of order, a path is only logged once all files the worker started before
+// it have completed as well.
+func loopObserver(numWorkers int, soFar chan *completed, done chan bool,
+	depot *Depot, rlw *resumeLogWriter, checkpoint func()) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	defer close(done)
+
+	comps := make([]*completed, numWorkers)
+	nextSeqs := make([]int, numWorkers)
+	early := make([]map[int]*completed, numWorkers)
+
+	for {
+		select {
+		case comp := <-soFar:
+			if comp.workerIndex == -1 {
+				writeResumeLogEntry(comps, depot, rlw)
+				if checkpoint != nil {
+					checkpoint()
+				}
+				return
+			}
+			wi := comp.workerIndex
+			if comp.seq != nextSeqs[wi] {
+				if early[wi] == nil {
+					early[wi] = make(map[int]*completed)
+				}
+				early[wi][comp.seq] = comp
+				continue
+			}
+			for comp != nil {
+				comps[wi] = comp
+				nextSeqs[wi]++
+				comp = early[wi][nextSeqs[wi]]
+				delete(early[wi], nextSeqs[wi])
+			}
+		case <-ticker.C:
+			writeResumeLogEntry(comps, depot, rlw)
+			if checkpoint != nil {
+				checkpoint()
+			}
+		}
+	}
+}
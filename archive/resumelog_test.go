@@ -0,0 +1,164 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uwedeportivo/romba/db"
+)
+
+func TestResumeLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_resumelog_test")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "archive-resume.log")
+	rlw, err := newResumeLogWriter(logPath)
+	if err != nil {
+		t.Fatalf("cannot create resume log: %v", err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	written := []*resumeEntry{
+		{Path: "/roms/a b/1.bin", Status: resumeStatusDone, Time: now},
+		{Path: "/roms/c/2.bin", Status: resumeStatusFailed, Time: now, Hash: "deadbeef"},
+		{Path: "/roms/c/3.bin", Status: resumeStatusDone, Time: now},
+	}
+
+	if err = rlw.write(written...); err != nil {
+		t.Fatalf("cannot write resume log: %v", err)
+	}
+	if err = rlw.close(); err != nil {
+		t.Fatalf("cannot close resume log: %v", err)
+	}
+
+	// simulate a crash in the middle of writing a line
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("cannot open resume log: %v", err)
+	}
+	line := (&resumeEntry{Path: "/roms/d/4.bin", Status: resumeStatusDone, Time: now}).line()
+	if _, err = f.WriteString(line[:len(line)-10]); err != nil {
+		t.Fatalf("cannot write resume log: %v", err)
+	}
+	f.Close()
+
+	entries, err := readResumeLog(logPath)
+	if err != nil {
+		t.Fatalf("cannot read resume log: %v", err)
+	}
+
+	if len(entries) != len(written) {
+		t.Fatalf("expected %d entries, got %d", len(written), len(entries))
+	}
+	for i, e := range entries {
+		w := written[i]
+		if e.Path != w.Path || e.Status != w.Status || !e.Time.Equal(w.Time) || e.Hash != w.Hash {
+			t.Fatalf("entry %d: expected %+v, got %+v", i, w, e)
+		}
+	}
+
+	point, err := extractResumePoint(logPath, 2)
+	if err != nil {
+		t.Fatalf("cannot extract resume point: %v", err)
+	}
+	if point != "/roms/c/2.bin" {
+		t.Fatalf("expected resume point /roms/c/2.bin, got %s", point)
+	}
+}
+
+func TestParseResumeLineLegacy(t *testing.T) {
+	path := "/roms/old style/1.bin"
+	e := parseResumeLine(fmt.Sprintf("%s %x\n", path, sha1.Sum([]byte(path))))
+	if e == nil || e.Path != path || e.Status != resumeStatusDone {
+		t.Fatalf("expected legacy line parsed as done entry for %s, got %+v", path, e)
+	}
+
+	if e = parseResumeLine(path + " 0123456789012345678901234567890123456789"); e != nil {
+		t.Fatalf("expected line with bad checksum to be rejected, got %+v", e)
+	}
+}
+
+func TestLoopObserverOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_observer_test")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	depot, err := NewDepot([]string{dir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("cannot create depot: %v", err)
+	}
+
+	logPath := filepath.Join(dir, "archive-resume.log")
+	rlw, err := newResumeLogWriter(logPath)
+	if err != nil {
+		t.Fatalf("cannot create resume log: %v", err)
+	}
+
+	soFar := make(chan *completed)
+	done := make(chan bool)
+	go loopObserver(1, soFar, done, depot, rlw, nil)
+
+	// files of a worker complete out of order once their roms are written
+	for _, comp := range []*completed{
+		{path: "/roms/2.bin", status: resumeStatusDone, seq: 1},
+		{path: "/roms/3.bin", status: resumeStatusDone, seq: 2},
+		{path: "/roms/1.bin", status: resumeStatusDone, seq: 0},
+		{path: "/roms/5.bin", status: resumeStatusDone, seq: 4},
+		{workerIndex: -1},
+	} {
+		soFar <- comp
+	}
+	<-done
+
+	if err = rlw.close(); err != nil {
+		t.Fatalf("cannot close resume log: %v", err)
+	}
+
+	entries, err := readResumeLog(logPath)
+	if err != nil {
+		t.Fatalf("cannot read resume log: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "/roms/3.bin" {
+		t.Fatalf("expected resume log with /roms/3.bin, got %+v", entries)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const defaultWriteRetryBackoff = 500 * time.Millisecond
+
+// writeRetrier retries depot writes that failed with a transient I/O error,
+// doubling the wait between attempts.
+type writeRetrier struct {
+	retries int
+	backoff time.Duration
+}
+
+func newWriteRetrier(retries int, backoffMillis int) *writeRetrier {
+	backoff := time.Duration(backoffMillis) * time.Millisecond
+	if backoff <= 0 {
+		backoff = defaultWriteRetryBackoff
+	}
+	return &writeRetrier{
+		retries: retries,
+		backoff: backoff,
+	}
+}
+
+func (wr *writeRetrier) do(path string, f func() error) error {
+	backoff := wr.backoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > wr.retries || !isTransientWriteError(err) {
+			return err
+		}
+		glog.Warningf("writing %s failed (attempt %d of %d), retrying in %v: %v", path, attempt,
+			wr.retries+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func isTransientWriteError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+
+	switch errno {
+	case syscall.EIO, syscall.EAGAIN, syscall.EINTR, syscall.EBUSY, syscall.ETIMEDOUT,
+		syscall.ESTALE, syscall.ECONNRESET:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type failingWriter struct {
+	failures int
+	err      error
+	written  []byte
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if fw.failures > 0 {
+		fw.failures--
+		return 0, fw.err
+	}
+	fw.written = append(fw.written, p...)
+	return len(p), nil
+}
+
+func TestWriteRetrierRecovers(t *testing.T) {
+	fw := &failingWriter{
+		failures: 2,
+		err:      &os.PathError{Op: "write", Path: "depot", Err: syscall.EIO},
+	}
+	wr := &writeRetrier{retries: 3, backoff: time.Millisecond}
+
+	attempts := 0
+	err := wr.do("depot", func() error {
+		attempts++
+		_, err := fw.Write([]byte("rom"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("expected write to succeed after retries, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+	if string(fw.written) != "rom" {
+		t.Fatalf("expected rom to be written, got %q", string(fw.written))
+	}
+}
+
+func TestWriteRetrierGivesUp(t *testing.T) {
+	fw := &failingWriter{
+		failures: 5,
+		err:      &os.PathError{Op: "write", Path: "depot", Err: syscall.EIO},
+	}
+	wr := &writeRetrier{retries: 2, backoff: time.Millisecond}
+
+	attempts := 0
+	err := wr.do("depot", func() error {
+		attempts++
+		_, err := fw.Write([]byte("rom"))
+		return err
+	})
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expected EIO after exhausting retries, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestWriteRetrierSkipsPermanentErrors(t *testing.T) {
+	fw := &failingWriter{
+		failures: 1,
+		err:      &os.PathError{Op: "write", Path: "depot", Err: syscall.ENOSPC},
+	}
+	wr := &writeRetrier{retries: 3, backoff: time.Millisecond}
+
+	attempts := 0
+	err := wr.do("depot", func() error {
+		attempts++
+		_, err := fw.Write([]byte("rom"))
+		return err
+	})
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected ENOSPC, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+type failingReader struct {
+	err error
+}
+
+func (fr failingReader) Read(p []byte) (int, error) {
+	return 0, fr.err
+}
+
+func TestArchiveRemovesFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_failed_write")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	outpath := filepath.Join(dir, "rom.gz")
+	r := io.MultiReader(strings.NewReader("partial rom"),
+		failingReader{&os.PathError{Op: "read", Path: "src", Err: syscall.EIO}})
+
+	_, err = archive(outpath, r, nil, false)
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expected EIO, got %v", err)
+	}
+	if _, err = os.Stat(outpath); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", outpath, err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/torrentzip/czip"
+)
+
+const (
+	samplesFolder = "samples"
+	sampleSuffix  = ".wav"
+)
+
+// sampleFileNames returns the file names a sample may be stored under. MAME
+// lists samples without the .wav suffix.
+func sampleFileNames(name string) []string {
+	if filepath.Ext(name) == "" {
+		return []string{name + sampleSuffix, name}
+	}
+	return []string{name}
+}
+
+// gatherSamples copies the samples of game from samplesDir into the folder of
+// its sample set below outpath/samples. A sample set is either a folder or a
+// zip file named after the set. It returns the samples that were not found.
+func gatherSamples(game *types.Game, samplesDir, outpath string) (types.SampleSlice, error) {
+	set := game.SampleSet()
+	setDir := filepath.Join(samplesDir, set)
+	dstDir := filepath.Join(outpath, samplesFolder, set)
+
+	var zipFiles map[string]*czip.File
+
+	zipPath := setDir + zipSuffix
+	exists, err := PathExists(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		zr, err := czip.OpenReader(zipPath)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+
+		zipFiles = make(map[string]*czip.File)
+		for _, zf := range zr.File {
+			zipFiles[zf.Name] = zf
+		}
+	}
+
+	var missing types.SampleSlice
+
+	for _, sample := range game.Samples {
+		found := false
+		for _, name := range sampleFileNames(sample.Name) {
+			srcPath := filepath.Join(setDir, name)
+			exists, err := PathExists(srcPath)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				err = copySample(dstDir, name, func() (io.ReadCloser, error) { return os.Open(srcPath) })
+				if err != nil {
+					return nil, err
+				}
+				found = true
+				break
+			}
+
+			if zf, ok := zipFiles[name]; ok {
+				err = copySample(dstDir, name, zf.Open)
+				if err != nil {
+					return nil, err
+				}
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			glog.V(4).Infof("sample %s of set %s not found in %s", sample.Name, set, samplesDir)
+			missing = append(missing, sample)
+		}
+	}
+	return missing, nil
+}
+
+// copySample writes the sample into dstDir. Games sharing a sample set are built
+// concurrently, so the sample is written to a temp file and renamed into place.
+func copySample(dstDir, name string, open func() (io.ReadCloser, error)) error {
+	dstPath := filepath.Join(dstDir, name)
+	exists, err := PathExists(dstPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	err = os.MkdirAll(dstDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	src, err := open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := ioutil.TempFile(dstDir, "romba_sample")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+
+	err = dst.Close()
+	if err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	return os.Rename(dst.Name(), dstPath)
+}
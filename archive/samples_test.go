@@ -0,0 +1,118 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestGatherSamples(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_samples_test")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	samplesDir := filepath.Join(dir, "samples")
+	outDir := filepath.Join(dir, "out")
+
+	err = os.MkdirAll(filepath.Join(samplesDir, "invaders"), 0777)
+	if err != nil {
+		t.Fatalf("cannot create sample set dir: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(samplesDir, "invaders", "0.wav"), []byte("zero"), 0666)
+	if err != nil {
+		t.Fatalf("cannot write sample: %v", err)
+	}
+
+	zf, err := os.Create(filepath.Join(samplesDir, "galaxian.zip"))
+	if err != nil {
+		t.Fatalf("cannot create sample zip: %v", err)
+	}
+	zw := zip.NewWriter(zf)
+	w, err := zw.Create("fire.wav")
+	if err != nil {
+		t.Fatalf("cannot add sample to zip: %v", err)
+	}
+	_, err = w.Write([]byte("fire"))
+	if err != nil {
+		t.Fatalf("cannot write sample to zip: %v", err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatalf("cannot close sample zip: %v", err)
+	}
+	if err = zf.Close(); err != nil {
+		t.Fatalf("cannot close sample zip: %v", err)
+	}
+
+	invaders := &types.Game{
+		Name:     "sinvader",
+		SampleOf: "invaders",
+		Samples:  types.SampleSlice{{Name: "0"}, {Name: "1"}},
+	}
+
+	missing, err := gatherSamples(invaders, samplesDir, outDir)
+	if err != nil {
+		t.Fatalf("gathering samples failed: %v", err)
+	}
+	if len(missing) != 1 || missing[0].Name != "1" {
+		t.Fatalf("expected sample 1 missing, got %d missing", len(missing))
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(outDir, samplesFolder, "invaders", "0.wav"))
+	if err != nil || string(bs) != "zero" {
+		t.Fatalf("expected sample 0.wav copied from folder, got %q: %v", bs, err)
+	}
+
+	galaxian := &types.Game{
+		Name:    "galaxian",
+		Samples: types.SampleSlice{{Name: "fire.wav"}},
+	}
+
+	missing, err = gatherSamples(galaxian, samplesDir, outDir)
+	if err != nil {
+		t.Fatalf("gathering samples failed: %v", err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("expected no missing samples, got %d", len(missing))
+	}
+
+	bs, err = ioutil.ReadFile(filepath.Join(outDir, samplesFolder, "galaxian", "fire.wav"))
+	if err != nil || string(bs) != "fire" {
+		t.Fatalf("expected sample fire.wav copied from zip, got %q: %v", bs, err)
+	}
+}
@@ -46,6 +46,8 @@ const (
 	backupSizeFilename        = ".romba_size.backup"
 	bloomFilterFilename       = ".romba_bloom_filter"
 	backupBloomFilterFilename = ".romba_bloom_filter.backup"
+	manifestFilename          = ".romba_manifest"
+	bloomParamsFilename       = ".romba_bloom_params"
 )
 
 type ByteSize float64
@@ -86,7 +88,7 @@ func (b ByteSize) String() string {
 	return fmt.Sprintf("%.2fB", b)
 }
 
-func writeSizeFile(root string, size int64) error {
+func writeSizeFile(root string, size int64, fsync bool) error {
 	sizeFilePath := filepath.Join(root, sizeFilename)
 
 	exists, err := PathExists(sizeFilePath)
@@ -110,9 +112,15 @@ func writeSizeFile(root string, size int64) error {
 	defer file.Close()
 
 	bw := bufio.NewWriter(file)
-	defer bw.Flush()
 
 	bw.WriteString(strconv.FormatInt(size, 10))
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	if fsync {
+		return file.Sync()
+	}
 	return nil
 }
 
@@ -168,7 +176,7 @@ func establishSize(root string) (int64, error) {
 			return 0, err
 		}
 
-		err = writeSizeFile(root, size)
+		err = writeSizeFile(root, size, true)
 		if err != nil {
 			return 0, err
 		}
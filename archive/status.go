@@ -0,0 +1,218 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// HaveMiss splits the roms of the given DAT into those present in the depot and
+// those missing from it. Either of the returned DATs is nil if it has no games.
+func (depot *Depot) HaveMiss(dat *types.Dat) (*types.Dat, *types.Dat, error) {
+	haveDat := new(types.Dat)
+	haveDat.CopyHeader(dat)
+	haveDat.Name = havePrefix + dat.Name
+
+	missDat := new(types.Dat)
+	missDat.CopyHeader(dat)
+	missDat.Name = missPrefix + dat.Name
+
+	for _, game := range dat.Games {
+		var haveGame, missGame *types.Game
+
+		for _, rom := range game.Roms {
+			exists, err := depot.statusRomInDepot(rom)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if exists {
+				if haveGame == nil {
+					haveGame = new(types.Game)
+					haveGame.CopyHeader(game)
+					haveDat.Games = append(haveDat.Games, haveGame)
+				}
+				haveGame.Roms = append(haveGame.Roms, rom)
+			} else {
+				if missGame == nil {
+					missGame = new(types.Game)
+					missGame.CopyHeader(game)
+					missDat.Games = append(missDat.Games, missGame)
+				}
+				missGame.Roms = append(missGame.Roms, rom)
+			}
+		}
+	}
+
+	if len(haveDat.Games) == 0 {
+		haveDat = nil
+	}
+	if len(missDat.Games) == 0 {
+		missDat = nil
+	}
+	return haveDat, missDat, nil
+}
+
+// statusRomInDepot completes the hashes of rom from the index and reports
+// whether it is in the depot.
+func (depot *Depot) statusRomInDepot(rom *types.Rom) (bool, error) {
+	_, err := depot.RomDB.CompleteRom(rom)
+	if err != nil {
+		return false, err
+	}
+
+	if rom.Sha1 == nil {
+		return false, nil
+	}
+
+	exists, _, err := depot.RomInDepot(hex.EncodeToString(rom.Sha1))
+	return exists, err
+}
+
+// Completeness of a game in the depot.
+const (
+	GameComplete = "complete"
+	GamePartial  = "partial"
+	GameMissing  = "missing"
+)
+
+// GameStatus tells how complete a game of a DAT is in the depot. MissingRoms
+// lists the names of the missing roms of partial games.
+type GameStatus struct {
+	Name        string   `json:"name"`
+	Status      string   `json:"status"`
+	MissingRoms []string `json:"missingRoms,omitempty"`
+}
+
+// GameStatuses classifies every game of the given DAT as complete, partial or
+// missing depending on which of its roms are in the depot. The statuses are in
+// the order of the games of the DAT, so games sharing a name get a status each.
+// Games without roms are complete.
+func (depot *Depot) GameStatuses(dat *types.Dat) ([]*GameStatus, error) {
+	gss := make([]*GameStatus, 0, len(dat.Games))
+	for _, g := range dat.Games {
+		gs := &GameStatus{
+			Name:   g.Name,
+			Status: GameComplete,
+		}
+
+		numHave := 0
+		for _, r := range g.Roms {
+			exists, err := depot.statusRomInDepot(r)
+			if err != nil {
+				return nil, err
+			}
+
+			if exists {
+				numHave++
+			} else {
+				gs.MissingRoms = append(gs.MissingRoms, r.Name)
+			}
+		}
+
+		if len(gs.MissingRoms) > 0 {
+			if numHave > 0 {
+				gs.Status = GamePartial
+			} else {
+				gs.Status = GameMissing
+				gs.MissingRoms = nil
+			}
+		}
+		gss = append(gss, gs)
+	}
+	return gss, nil
+}
+
+// WriteHaveMiss writes the have and miss DATs for the given DAT into outpath.
+// It returns the number of roms present and missing.
+func (depot *Depot) WriteHaveMiss(dat *types.Dat, outpath string) (int, int, error) {
+	haveDat, missDat, err := depot.HaveMiss(dat)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	basename := strings.TrimSuffix(dat.Filename(), filepath.Ext(dat.Filename()))
+
+	err = writeDatFile(haveDat, filepath.Join(outpath, havePrefix+basename+datSuffix))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = writeDatFile(missDat, filepath.Join(outpath, missPrefix+basename+datSuffix))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return countRoms(haveDat), countRoms(missDat), nil
+}
+
+func countRoms(dat *types.Dat) int {
+	if dat == nil {
+		return 0
+	}
+
+	n := 0
+	for _, g := range dat.Games {
+		n += len(g.Roms)
+	}
+	return n
+}
+
+func writeDatFile(dat *types.Dat, path string) error {
+	if dat == nil {
+		return nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	bw := bufio.NewWriter(file)
+
+	err = types.ComposeCompliantDat(dat, bw)
+	if err != nil {
+		return err
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
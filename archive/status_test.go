@@ -0,0 +1,241 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+const haveMissDatTemplate = `
+clrmamepro (
+	name "status"
+	description "status"
+)
+
+game (
+	name "complete"
+	description "complete"
+	rom ( name "a.bin" size 8 sha1 %x )
+)
+
+game (
+	name "partial"
+	description "partial"
+	rom ( name "b.bin" size 8 sha1 %x )
+	rom ( name "c.bin" size 8 sha1 %x )
+)
+`
+
+func TestWriteHaveMiss(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_status")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	outDir := filepath.Join(dir, "out")
+	for _, d := range []string{depotDir, outDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	a := []byte("romA....")
+	b := []byte("romB....")
+	c := []byte("romC....")
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	for _, content := range [][]byte{a, b} {
+		rompath := writeTestDepotGZ(t, depotDir, content)
+		depot.roots[0].bf.Add([]byte(strings.TrimSuffix(filepath.Base(rompath), gzipSuffix)))
+	}
+
+	datText := fmt.Sprintf(haveMissDatTemplate, sha1.Sum(a), sha1.Sum(b), sha1.Sum(c))
+	dat, _, err := parser.ParseDat(strings.NewReader(datText), "testing/status.dat")
+	if err != nil {
+		t.Fatalf("failed to parse dat: %v", err)
+	}
+
+	numHave, numMiss, err := depot.WriteHaveMiss(dat, outDir)
+	if err != nil {
+		t.Fatalf("failed to write have/miss dats: %v", err)
+	}
+	if numHave != 2 || numMiss != 1 {
+		t.Fatalf("expected 2 present and 1 missing rom, got %d and %d", numHave, numMiss)
+	}
+
+	haveDat, _, err := parser.Parse(filepath.Join(outDir, "have-status.dat"))
+	if err != nil {
+		t.Fatalf("failed to parse have dat: %v", err)
+	}
+	if len(haveDat.Games) != 2 {
+		t.Fatalf("expected 2 games in have dat, got %d", len(haveDat.Games))
+	}
+	if haveDat.Name != "have-status" {
+		t.Fatalf("expected have dat named have-status, got %s", haveDat.Name)
+	}
+
+	missDat, _, err := parser.Parse(filepath.Join(outDir, "miss-status.dat"))
+	if err != nil {
+		t.Fatalf("failed to parse miss dat: %v", err)
+	}
+	if len(missDat.Games) != 1 || missDat.Games[0].Name != "partial" ||
+		len(missDat.Games[0].Roms) != 1 || missDat.Games[0].Roms[0].Name != "c.bin" {
+		t.Fatalf("unexpected miss dat %s", types.PrintDat(missDat))
+	}
+	if missDat.Name != "miss-status" {
+		t.Fatalf("expected miss dat named miss-status, got %s", missDat.Name)
+	}
+}
+
+const gameStatusesDatTemplate = `
+clrmamepro (
+	name "statuses"
+	description "statuses"
+)
+
+game (
+	name "complete"
+	description "complete"
+	rom ( name "a.bin" size 8 sha1 %x )
+)
+
+game (
+	name "partial"
+	description "partial"
+	rom ( name "b.bin" size 8 sha1 %x )
+	rom ( name "c.bin" size 8 sha1 %x )
+)
+
+game (
+	name "twice"
+	description "twice"
+	rom ( name "a.bin" size 8 sha1 %x )
+)
+
+game (
+	name "twice"
+	description "twice"
+	rom ( name "c.bin" size 8 sha1 %x )
+)
+`
+
+func TestGameStatuses(t *testing.T) {
+	depotDir, err := ioutil.TempDir("", "romba_statuses")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(depotDir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	a := []byte("romA....")
+	b := []byte("romB....")
+	c := []byte("romC....")
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	for _, content := range [][]byte{a, b} {
+		rompath := writeTestDepotGZ(t, depotDir, content)
+		depot.roots[0].bf.Add([]byte(strings.TrimSuffix(filepath.Base(rompath), gzipSuffix)))
+	}
+
+	datText := fmt.Sprintf(gameStatusesDatTemplate, sha1.Sum(a), sha1.Sum(b), sha1.Sum(c), sha1.Sum(a), sha1.Sum(c))
+	dat, _, err := parser.ParseDat(strings.NewReader(datText), "testing/statuses.dat")
+	if err != nil {
+		t.Fatalf("failed to parse dat: %v", err)
+	}
+
+	gss, err := depot.GameStatuses(dat)
+	if err != nil {
+		t.Fatalf("failed to get game statuses: %v", err)
+	}
+
+	if len(gss) != len(dat.Games) {
+		t.Fatalf("expected %d game statuses, got %d", len(dat.Games), len(gss))
+	}
+
+	// the two games named twice get a status each
+	numTwice := map[string]int{}
+	for i, gs := range gss {
+		g := dat.Games[i]
+		if gs.Name != g.Name {
+			t.Fatalf("expected status %d for game %s, got %s", i, g.Name, gs.Name)
+		}
+
+		switch {
+		case g.Name == "complete":
+			if gs.Status != GameComplete {
+				t.Fatalf("expected game complete to be complete, got %s", gs.Status)
+			}
+		case g.Name == "partial":
+			if gs.Status != GamePartial || len(gs.MissingRoms) != 1 || gs.MissingRoms[0] != "c.bin" {
+				t.Fatalf("expected game partial to miss c.bin, got %s %v", gs.Status, gs.MissingRoms)
+			}
+		case g.Name == "twice":
+			numTwice[gs.Status]++
+		}
+
+		if gs.Status != GamePartial && len(gs.MissingRoms) != 0 {
+			t.Fatalf("expected missing roms only for partial games, got %v for %s", gs.MissingRoms, gs.Name)
+		}
+	}
+
+	if numTwice[GameComplete] != 1 || numTwice[GameMissing] != 1 {
+		t.Fatalf("expected one complete and one missing game named twice, got %v", numTwice)
+	}
+}
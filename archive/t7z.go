@@ -0,0 +1,120 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// BuildFormatZip builds games as torrentzip files
+	BuildFormatZip = "zip"
+	// BuildFormatT7z builds games as torrent7z files
+	BuildFormatT7z = "t7z"
+
+	t7zBin = "t7z"
+)
+
+// CheckBuildFormat verifies that format is a known build format and that
+// any external tools it needs are available.
+func CheckBuildFormat(format string) error {
+	switch format {
+	case BuildFormatZip:
+		return nil
+	case BuildFormatT7z:
+		if _, err := exec.LookPath(t7zBin); err != nil {
+			return fmt.Errorf("build format %s needs the %s binary in PATH: %v", format, t7zBin, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown build format %s, expected %s or %s", format, BuildFormatZip, BuildFormatT7z)
+}
+
+// torrent7z creates the torrent7z file outpath from the files in srcDir.
+// The t7z tool takes care of the canonical entry ordering and compression
+// settings, so the output is reproducible. The file is built under a partial
+// name and renamed once t7z succeeded, so that neither an old file at outpath
+// nor a failed run ends up in it.
+func torrent7z(outpath, srcDir string) error {
+	var files []string
+
+	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return nil
+	}
+
+	sort.Strings(files)
+
+	// t7z adds to an existing archive instead of replacing it
+	partialPath := outpath + partialSuffix
+	err = discardPartialZip(partialPath)
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"a", partialPath}, files...)
+	cmd := exec.Command(t7zBin, args...)
+	cmd.Dir = srcDir
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		glog.Errorf("%s failed creating %s: %s", t7zBin, outpath, out)
+		rerr := os.Remove(partialPath)
+		if rerr != nil && !os.IsNotExist(rerr) {
+			glog.Errorf("error removing %s: %v", partialPath, rerr)
+		}
+		return fmt.Errorf("failed to create torrent7z file %s: %v", outpath, err)
+	}
+	return os.Rename(partialPath, outpath)
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckBuildFormat(t *testing.T) {
+	if err := CheckBuildFormat(BuildFormatZip); err != nil {
+		t.Fatalf("expected zip format to be accepted: %v", err)
+	}
+	if err := CheckBuildFormat("rar"); err == nil {
+		t.Fatalf("expected unknown format to be rejected")
+	}
+
+	_, lerr := exec.LookPath(t7zBin)
+	err := CheckBuildFormat(BuildFormatT7z)
+	if (err == nil) != (lerr == nil) {
+		t.Fatalf("expected t7z format accepted only with %s in PATH, got %v", t7zBin, err)
+	}
+}
+
+func TestTorrent7z(t *testing.T) {
+	if _, err := exec.LookPath(t7zBin); err != nil {
+		t.Skipf("%s not in PATH", t7zBin)
+	}
+
+	dir, err := ioutil.TempDir("", "romba_t7z")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	err = os.MkdirAll(filepath.Join(srcDir, "sub"), 0777)
+	if err != nil {
+		t.Fatalf("failed to create src dir: %v", err)
+	}
+	for _, name := range []string{"b.bin", "a.bin", filepath.Join("sub", "c.bin")} {
+		err = ioutil.WriteFile(filepath.Join(srcDir, name), []byte("romba t7z test "+name), 0666)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	var outs [][]byte
+	for _, name := range []string{"game1.7z", "game2.7z"} {
+		outpath := filepath.Join(dir, name)
+		err = torrent7z(outpath, srcDir)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", outpath, err)
+		}
+
+		bs, err := ioutil.ReadFile(outpath)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", outpath, err)
+		}
+		if !bytes.HasPrefix(bs, []byte("7z\xbc\xaf\x27\x1c")) {
+			t.Fatalf("%s is not a 7z file", outpath)
+		}
+		outs = append(outs, bs)
+	}
+
+	if !bytes.Equal(outs[0], outs[1]) {
+		t.Fatalf("expected torrent7z files of the same roms to be identical")
+	}
+
+	emptyDir := filepath.Join(dir, "empty")
+	err = os.MkdirAll(emptyDir, 0777)
+	if err != nil {
+		t.Fatalf("failed to create empty dir: %v", err)
+	}
+	outpath := filepath.Join(dir, "empty.7z")
+	err = torrent7z(outpath, emptyDir)
+	if err != nil {
+		t.Fatalf("failed to build empty game: %v", err)
+	}
+	if _, err = os.Stat(outpath); !os.IsNotExist(err) {
+		t.Fatalf("expected no torrent7z file without roms, got %v", err)
+	}
+}
+
+// fakeT7z puts a t7z script running script into PATH until the returned func is called.
+func fakeT7z(t *testing.T, dir, script string) func() {
+	binDir := filepath.Join(dir, "bin")
+	err := os.MkdirAll(binDir, 0777)
+	if err != nil {
+		t.Fatalf("failed to create bin dir: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(binDir, t7zBin), []byte("#!/bin/sh\n"+script+"\n"), 0777)
+	if err != nil {
+		t.Fatalf("failed to write fake %s: %v", t7zBin, err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+	}
+}
+
+func TestTorrent7zPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_t7z")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	err = os.MkdirAll(srcDir, 0777)
+	if err != nil {
+		t.Fatalf("failed to create src dir: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(srcDir, "a.bin"), []byte("romba t7z test"), 0666)
+	if err != nil {
+		t.Fatalf("failed to write a.bin: %v", err)
+	}
+
+	outpath := filepath.Join(dir, "game.7z")
+	for path, content := range map[string]string{outpath: "stale\n", outpath + partialSuffix: "partial\n"} {
+		err = ioutil.WriteFile(path, []byte(content), 0666)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+
+	// like t7z, the fake adds to an existing archive
+	restore := fakeT7z(t, dir, `echo built >> "$2"`)
+	err = torrent7z(outpath, srcDir)
+	restore()
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", outpath, err)
+	}
+
+	bs, err := ioutil.ReadFile(outpath)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", outpath, err)
+	}
+	if string(bs) != "built\n" {
+		t.Fatalf("expected a fresh %s, got %q", outpath, bs)
+	}
+	if _, err = os.Stat(outpath + partialSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected no partial file left, got %v", err)
+	}
+
+	err = os.Remove(outpath)
+	if err != nil {
+		t.Fatalf("failed to remove %s: %v", outpath, err)
+	}
+
+	restore = fakeT7z(t, dir, `echo partial >> "$2"; exit 1`)
+	err = torrent7z(outpath, srcDir)
+	restore()
+	if err == nil {
+		t.Fatalf("expected failing %s to fail the build", t7zBin)
+	}
+	for _, path := range []string{outpath, outpath + partialSuffix} {
+		if _, err = os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected no %s after a failed run, got %v", path, err)
+		}
+	}
+}
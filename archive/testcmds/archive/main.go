@@ -111,7 +111,7 @@ func main() {
 
 	msg, err := depot.Archive(flag.Args(), *resume, 1, 1, 1,
 		false, 1, ".",
-		worker.NewProgressTracker(1), false, false, true)
+		worker.NewProgressTracker(1), false, false, true, nil)
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "archiving failed: %s %v\n", msg, err)
@@ -0,0 +1,202 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	tzCommentPrefix = "TORRENTZIPPED-"
+	tzCommentLen    = len(tzCommentPrefix) + 2*crc32.Size
+	tzModTime       = 48128
+	tzModDate       = 8600
+	tzFlags         = 2
+
+	zipDirectoryEndLen         = 22
+	zipDirectoryEndSignature   = 0x06054b50
+	zipDirectory64LocLen       = 20
+	zipDirectory64LocSignature = 0x07064b50
+	zipDirectory64EndSignature = 0x06064b50
+	zip64ExtraID               = 0x0001
+	zipUint16Max               = (1 << 16) - 1
+	zipUint32Max               = (1 << 32) - 1
+)
+
+// CheckTorrentZip checks the zip file at path against the torrentzip spec and returns
+// a description of each violation found. A conformant file yields no violations.
+func CheckTorrentZip(path string) ([]string, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		if err == zip.ErrFormat || err == zip.ErrAlgorithm {
+			return []string{fmt.Sprintf("not a readable zip file: %v", err)}, nil
+		}
+		return nil, err
+	}
+	defer zr.Close()
+
+	var violations []string
+
+	prevName := ""
+	for k, zf := range zr.File {
+		name := strings.ToLower(zf.Name)
+		if k > 0 && name < prevName {
+			violations = append(violations, fmt.Sprintf("entry %s is out of order", zf.Name))
+		}
+		prevName = name
+
+		if zf.Method != zip.Deflate {
+			violations = append(violations, fmt.Sprintf("entry %s has compression method %d, expected deflate",
+				zf.Name, zf.Method))
+		}
+		if zf.Flags != tzFlags {
+			violations = append(violations, fmt.Sprintf("entry %s has flags %#x, expected %#x",
+				zf.Name, zf.Flags, tzFlags))
+		}
+		if zf.ModifiedTime != tzModTime || zf.ModifiedDate != tzModDate {
+			violations = append(violations, fmt.Sprintf("entry %s has a non torrentzip timestamp", zf.Name))
+		}
+		if zf.CreatorVersion>>8 != 0 {
+			violations = append(violations, fmt.Sprintf("entry %s has creator os %d, expected FAT",
+				zf.Name, zf.CreatorVersion>>8))
+		}
+		if zf.Comment != "" {
+			violations = append(violations, fmt.Sprintf("entry %s has a comment", zf.Name))
+		}
+		if len(zf.Extra) > 0 && !isZip64Extra(zf.Extra) {
+			violations = append(violations, fmt.Sprintf("entry %s has extra fields", zf.Name))
+		}
+	}
+
+	if len(zr.Comment) != tzCommentLen || !strings.HasPrefix(zr.Comment, tzCommentPrefix) {
+		violations = append(violations, fmt.Sprintf("zip comment %q is not a torrentzip comment", zr.Comment))
+		return violations, nil
+	}
+
+	dirCrc, err := centralDirectoryCrc(path)
+	if err != nil {
+		violations = append(violations, fmt.Sprintf("failed to read central directory: %v", err))
+		return violations, nil
+	}
+
+	expectedComment := tzCommentPrefix + strings.ToUpper(hex.EncodeToString(dirCrc))
+	if zr.Comment != expectedComment {
+		violations = append(violations, fmt.Sprintf("zip comment %s doesn't match central directory crc, expected %s",
+			zr.Comment, expectedComment))
+	}
+	return violations, nil
+}
+
+// isZip64Extra reports whether extra holds just a zip64 extended information field,
+// the only extra field torrentzip writes.
+func isZip64Extra(extra []byte) bool {
+	return len(extra) >= 4 && binary.LittleEndian.Uint16(extra) == zip64ExtraID &&
+		int(binary.LittleEndian.Uint16(extra[2:]))+4 == len(extra)
+}
+
+// centralDirectoryCrc computes the crc32 of the central directory of the zip file at path,
+// assuming the file ends with a torrentzip comment.
+func centralDirectoryCrc(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	endOffset := fi.Size() - int64(zipDirectoryEndLen+tzCommentLen)
+	if endOffset < 0 {
+		return nil, fmt.Errorf("file too short")
+	}
+
+	var end [zipDirectoryEndLen]byte
+	_, err = file.ReadAt(end[:], endOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(end[0:]) != zipDirectoryEndSignature {
+		return nil, fmt.Errorf("missing end of central directory record")
+	}
+
+	records := uint64(binary.LittleEndian.Uint16(end[10:]))
+	size := uint64(binary.LittleEndian.Uint32(end[12:]))
+	offset := uint64(binary.LittleEndian.Uint32(end[16:]))
+
+	if records == zipUint16Max || size == zipUint32Max || offset == zipUint32Max {
+		size, offset, err = readDirectory64End(file, endOffset)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h := crc32.NewIEEE()
+	_, err = io.Copy(h, io.NewSectionReader(file, int64(offset), int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func readDirectory64End(file *os.File, endOffset int64) (uint64, uint64, error) {
+	var loc [zipDirectory64LocLen]byte
+	_, err := file.ReadAt(loc[:], endOffset-zipDirectory64LocLen)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if binary.LittleEndian.Uint32(loc[0:]) != zipDirectory64LocSignature {
+		return 0, 0, fmt.Errorf("missing zip64 end of central directory locator")
+	}
+
+	var end64 [56]byte
+	_, err = file.ReadAt(end64[:], int64(binary.LittleEndian.Uint64(loc[8:])))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if binary.LittleEndian.Uint32(end64[0:]) != zipDirectory64EndSignature {
+		return 0, 0, fmt.Errorf("missing zip64 end of central directory record")
+	}
+
+	return binary.LittleEndian.Uint64(end64[40:]), binary.LittleEndian.Uint64(end64[48:]), nil
+}
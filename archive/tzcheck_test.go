@@ -0,0 +1,117 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/torrentzip"
+)
+
+func writeTestZip(t *testing.T, path string, zw gameZipWriter) {
+	for _, name := range []string{"b.bin", "A.bin", "c.bin"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("failed to create zip entry %s: %v", name, err)
+		}
+		_, err = io.WriteString(w, "romba torrentzip check "+name)
+		if err != nil {
+			t.Fatalf("failed to write zip entry %s: %v", name, err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatalf("failed to close zip %s: %v", path, err)
+	}
+}
+
+func TestCheckTorrentZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_tzcheck")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tzPath := filepath.Join(dir, "tz.zip")
+	tzFile, err := os.Create(tzPath)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", tzPath, err)
+	}
+	tzw, err := torrentzip.NewWriterWithTemp(tzFile, dir)
+	if err != nil {
+		t.Fatalf("failed to create torrentzip writer: %v", err)
+	}
+	writeTestZip(t, tzPath, tzw)
+	tzFile.Close()
+
+	violations, err := CheckTorrentZip(tzPath)
+	if err != nil {
+		t.Fatalf("failed to check %s: %v", tzPath, err)
+	}
+	if len(violations) > 0 {
+		t.Fatalf("expected torrentzip to conform, got %v", violations)
+	}
+
+	plainPath := filepath.Join(dir, "plain.zip")
+	plainFile, err := os.Create(plainPath)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", plainPath, err)
+	}
+	writeTestZip(t, plainPath, zip.NewWriter(plainFile))
+	plainFile.Close()
+
+	violations, err = CheckTorrentZip(plainPath)
+	if err != nil {
+		t.Fatalf("failed to check %s: %v", plainPath, err)
+	}
+	if len(violations) == 0 {
+		t.Fatalf("expected plain zip to not conform")
+	}
+
+	junkPath := filepath.Join(dir, "junk.zip")
+	err = ioutil.WriteFile(junkPath, []byte("not a zip file"), 0666)
+	if err != nil {
+		t.Fatalf("failed to write %s: %v", junkPath, err)
+	}
+
+	violations, err = CheckTorrentZip(junkPath)
+	if err != nil {
+		t.Fatalf("failed to check %s: %v", junkPath, err)
+	}
+	if len(violations) != 1 {
+		t.Fatalf("expected junk file to be reported as unreadable, got %v", violations)
+	}
+}
@@ -31,9 +31,9 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package archive
 
 import (
-	"bufio"
 	"crypto/md5"
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
 	"io"
 	"io/ioutil"
@@ -53,8 +53,26 @@ const (
 	sevenzipSuffix = ".7z"
 	datSuffix      = ".dat"
 	fixPrefix      = "fix-"
+	havePrefix     = "have-"
+	missPrefix     = "miss-"
+
+	// game zips are assembled under this suffix and renamed once complete, so
+	// an interrupted build never leaves a truncated zip behind
+	partialSuffix = ".tmp"
 )
 
+// DefaultHashBufferSize is the read buffer size used when hashing files and no
+// (or a non-positive) hash buffer size is configured.
+const DefaultHashBufferSize = 64 * 1024
+
+// HashBufferSize returns the given hash buffer size, or DefaultHashBufferSize if it isn't positive.
+func HashBufferSize(n int) int {
+	if n <= 0 {
+		return DefaultHashBufferSize
+	}
+	return n
+}
+
 type Hashes struct {
 	Crc  []byte
 	Md5  []byte
@@ -81,7 +99,11 @@ func (hh *Hashes) forFile(inpath string) error {
 }
 
 func (hh *Hashes) forReader(in io.Reader) error {
-	br := bufio.NewReader(in)
+	return hh.forReaderSize(in, DefaultHashBufferSize)
+}
+
+// forReaderSize hashes in reading it in chunks of bufSize bytes.
+func (hh *Hashes) forReaderSize(in io.Reader, bufSize int) error {
 
 	hSha1 := sha1.New()
 	hMd5 := md5.New()
@@ -92,7 +114,9 @@ func (hh *Hashes) forReader(in io.Reader) error {
 		w: w,
 	}
 
-	_, err := io.Copy(cw, br)
+	// hide any WriterTo of in so that the copy goes through buf
+	buf := make([]byte, HashBufferSize(bufSize))
+	_, err := io.CopyBuffer(cw, struct{ io.Reader }{in}, buf)
 	if err != nil {
 		return err
 	}
@@ -220,14 +244,19 @@ func sha1ForReader(in io.Reader) ([]byte, error) {
 }
 
 func pathFromSha1HexEncoding(root, hexStr, suffix string) string {
-	prefix := hexStr[0:8]
-	pieces := make([]string, 6)
+	return sha1TreePath(root, hexStr, suffix, DefaultSha1TreeDepth)
+}
+
+// sha1TreePath returns the path of the file named hexStr+suffix below root in a
+// sha1 tree with depth levels of directories named after two hex digits each.
+func sha1TreePath(root, hexStr, suffix string, depth int) string {
+	pieces := make([]string, depth+2)
 
 	pieces[0] = root
-	for i := 0; i < 4; i++ {
-		pieces[i+1] = prefix[2*i : 2*i+2]
+	for i := 0; i < depth; i++ {
+		pieces[i+1] = hexStr[2*i : 2*i+2]
 	}
-	pieces[5] = hexStr + suffix
+	pieces[depth+1] = hexStr + suffix
 
 	return filepath.Join(pieces...)
 }
@@ -254,6 +283,72 @@ func (w *countWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// maxISize is the largest uncompressed size the gzip ISIZE footer can hold
+// without wrapping around (ISIZE is the size modulo 2^32).
+const maxISize = 1<<32 - 1
+
+// GZFooterSize returns the uncompressed size stored in the ISIZE footer
+// (last 4 bytes) of the gzip file at inpath.
+func GZFooterSize(inpath string) (uint32, error) {
+	f, err := os.Open(inpath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if fi.Size() < 4 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	var buf [4]byte
+	_, err = f.ReadAt(buf[:], fi.Size()-4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(buf[:]), nil
+}
+
+// QuickSizeCheck compares the uncompressed size of the depot gzip file at inpath
+// with the expected size. For sizes that fit into 32 bits it only reads the gzip
+// footer; larger files are fully decompressed since ISIZE wraps around at 4GB.
+// Returns whether the sizes match and the size found.
+func QuickSizeCheck(inpath string, size int64) (bool, int64, error) {
+	if size >= 0 && size <= maxISize {
+		isize, err := GZFooterSize(inpath)
+		if err != nil {
+			return false, 0, err
+		}
+		return int64(isize) == size, int64(isize), nil
+	}
+
+	f, err := os.Open(inpath)
+	if err != nil {
+		return false, 0, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return false, 0, err
+	}
+	defer gzr.Close()
+
+	cw := &countWriter{
+		w: ioutil.Discard,
+	}
+
+	_, err = io.Copy(cw, gzr)
+	if err != nil {
+		return false, 0, err
+	}
+	return cw.count == size, cw.count, nil
+}
+
 func DeleteEmptyFolders(root string) error {
 	fi, err := os.Lstat(root)
 	if err != nil {
@@ -264,22 +359,27 @@ func DeleteEmptyFolders(root string) error {
 		return nil
 	}
 
-	return deleteEmptyFoldersImpl(root, 0)
+	_, err = deleteEmptyFoldersImpl(root, 0)
+	return err
 }
 
-func deleteEmptyFoldersImpl(root string, level int) error {
+// deleteEmptyFoldersImpl removes the empty folders below root bottom-up and
+// returns how many it removed. root itself is kept at level 0.
+func deleteEmptyFoldersImpl(root string, level int) (int, error) {
 	fis, err := ioutil.ReadDir(root)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	foundPlain := false
+	removed := 0
 
 	for _, sfi := range fis {
 		if sfi.IsDir() {
-			err = deleteEmptyFoldersImpl(filepath.Join(root, sfi.Name()), level+1)
+			n, err := deleteEmptyFoldersImpl(filepath.Join(root, sfi.Name()), level+1)
+			removed += n
 			if err != nil {
-				return err
+				return removed, err
 			}
 		} else {
 			foundPlain = true
@@ -289,15 +389,27 @@ func deleteEmptyFoldersImpl(root string, level int) error {
 	if !foundPlain && level > 0 {
 		fis, err = ioutil.ReadDir(root)
 		if err != nil {
-			return err
+			return removed, err
 		}
 
 		if len(fis) == 0 {
 			err = os.Remove(root)
 			if err != nil {
-				return err
+				return removed, err
 			}
+			removed++
 		}
 	}
-	return nil
+	return removed, nil
+}
+
+// syncFile flushes the contents of the file at path to stable storage.
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
 }
@@ -0,0 +1,109 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/klauspost/compress/gzip"
+)
+
+const verifyBufSize = 32 * 1024
+
+// contentEqualsGZ compares the content read from r byte-for-byte with the
+// decompressed content of the depot file at gzpath. A depot file that fails
+// to decompress counts as a mismatch.
+func contentEqualsGZ(r io.Reader, gzpath string) (bool, error) {
+	f, err := os.Open(gzpath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		glog.Warningf("failed to open depot file %s for verification: %v", gzpath, err)
+		return false, nil
+	}
+	defer gzr.Close()
+
+	srcBuf := make([]byte, verifyBufSize)
+	depotBuf := make([]byte, verifyBufSize)
+
+	for {
+		sn, serr := io.ReadFull(r, srcBuf)
+		if serr != nil && serr != io.EOF && serr != io.ErrUnexpectedEOF {
+			return false, serr
+		}
+
+		dn, derr := io.ReadFull(gzr, depotBuf)
+		if derr != nil && derr != io.EOF && derr != io.ErrUnexpectedEOF {
+			glog.Warningf("failed to decompress depot file %s for verification: %v", gzpath, derr)
+			return false, nil
+		}
+
+		if sn != dn || !bytes.Equal(srcBuf[:sn], depotBuf[:dn]) {
+			return false, nil
+		}
+
+		// equal counts mean either both readers filled their buffers or both ran out
+		if serr != nil {
+			return true, nil
+		}
+	}
+}
+
+// verifyExisting compares the source opened by ro with the depot copy at rompath
+// and records a mismatch if they differ.
+func (w *archiveWorker) verifyExisting(ro readerOpener, name, path, rompath string) error {
+	r, err := ro()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	same, err := contentEqualsGZ(r, rompath)
+	if err != nil {
+		return err
+	}
+
+	if !same {
+		glog.Errorf("verify mismatch: %s/%s differs from depot file %s", path, name, rompath)
+
+		w.pm.mutex.Lock()
+		w.pm.numMismatches++
+		w.pm.mutex.Unlock()
+	}
+	return nil
+}
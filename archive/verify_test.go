@@ -0,0 +1,74 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestContentEqualsGZ(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_verify")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("romba verify test content "), 8192)
+	gzpath := writeTestDepotGZ(t, dir, content)
+
+	modified := make([]byte, len(content))
+	copy(modified, content)
+	modified[len(modified)/2] ^= 0xff
+
+	testCases := []struct {
+		name     string
+		source   []byte
+		expected bool
+	}{
+		{"same", content, true},
+		{"modified", modified, false},
+		{"shorter", content[:len(content)-1], false},
+		{"longer", append(append([]byte{}, content...), 'x'), false},
+	}
+
+	for _, tc := range testCases {
+		same, err := contentEqualsGZ(bytes.NewReader(tc.source), gzpath)
+		if err != nil {
+			t.Fatalf("%s: contentEqualsGZ failed: %v", tc.name, err)
+		}
+		if same != tc.expected {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.expected, same)
+		}
+	}
+}
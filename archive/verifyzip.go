@@ -0,0 +1,177 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// MisnamedEntry is a zip entry whose content matches a rom of the game stored
+// under a different name.
+type MisnamedEntry struct {
+	Entry string `json:"entry"`
+	Rom   string `json:"rom"`
+}
+
+// ZipVerification is the result of checking a zip file against a DAT game.
+// Missing lists the roms of the game without a matching entry, Extra the
+// entries matching no rom. Complete is set if every rom is present under its
+// name and there are no extra entries.
+type ZipVerification struct {
+	Game     string           `json:"game"`
+	Matched  []string         `json:"matched,omitempty"`
+	Missing  []string         `json:"missing,omitempty"`
+	Extra    []string         `json:"extra,omitempty"`
+	Misnamed []*MisnamedEntry `json:"misnamed,omitempty"`
+	Complete bool             `json:"complete"`
+}
+
+type zipEntryHashes struct {
+	name string
+	hh   *Hashes
+	used bool
+}
+
+// romMatchesHashes compares the strongest hash rom declares. Roms with only a
+// crc need the size to match as well, empty roms without hashes only the size.
+func romMatchesHashes(rom *types.Rom, hh *Hashes) bool {
+	switch {
+	case rom.Sha1 != nil:
+		return bytes.Equal(rom.Sha1, hh.Sha1)
+	case rom.Md5 != nil:
+		return bytes.Equal(rom.Md5, hh.Md5)
+	case rom.Crc != nil:
+		return bytes.Equal(rom.Crc, hh.Crc) && rom.Size == hh.Size
+	}
+	return rom.Size == 0 && hh.Size == 0
+}
+
+func hashZipEntries(zipPath string) ([]*zipEntryHashes, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var entries []*zipEntryHashes
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		hh, err := hashesForReader(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s in %s: %v", zf.Name, zipPath, err)
+		}
+		hh.Size = int64(zf.UncompressedSize64)
+
+		entries = append(entries, &zipEntryHashes{
+			name: zf.Name,
+			hh:   hh,
+		})
+	}
+	return entries, nil
+}
+
+// VerifyZip hashes the entries of the zip file at zipPath and compares them
+// with the roms of game. Roms that aren't valid, like the ones marked nodump,
+// are not expected in the zip.
+func VerifyZip(zipPath string, game *types.Game) (*ZipVerification, error) {
+	entries, err := hashZipEntries(zipPath)
+	if err != nil {
+		return nil, err
+	}
+
+	zv := &ZipVerification{
+		Game: game.Name,
+	}
+
+	var unmatched []*types.Rom
+	for _, rom := range game.Roms {
+		if !rom.Valid() {
+			continue
+		}
+
+		found := false
+		for _, e := range entries {
+			if !e.used && e.name == rom.Name && romMatchesHashes(rom, e.hh) {
+				e.used = true
+				found = true
+				break
+			}
+		}
+
+		if found {
+			zv.Matched = append(zv.Matched, rom.Name)
+		} else {
+			unmatched = append(unmatched, rom)
+		}
+	}
+
+	// only look for renamed content once every exact match took its entry
+	for _, rom := range unmatched {
+		found := false
+		for _, e := range entries {
+			if !e.used && romMatchesHashes(rom, e.hh) {
+				e.used = true
+				found = true
+				zv.Misnamed = append(zv.Misnamed, &MisnamedEntry{
+					Entry: e.name,
+					Rom:   rom.Name,
+				})
+				break
+			}
+		}
+
+		if !found {
+			zv.Missing = append(zv.Missing, rom.Name)
+		}
+	}
+
+	for _, e := range entries {
+		if !e.used {
+			zv.Extra = append(zv.Extra, e.name)
+		}
+	}
+
+	zv.Complete = len(zv.Missing) == 0 && len(zv.Misnamed) == 0 && len(zv.Extra) == 0
+	return zv, nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestVerifyZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_verifyzip")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "game.zip")
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", zipPath, err)
+	}
+
+	// a.bin is stored as is, b.bin under another name, c.bin is absent and
+	// readme.txt isn't part of the game
+	zw := zip.NewWriter(zipFile)
+	for name, content := range map[string]string{
+		"a.bin":      "rom a",
+		"renamed.b":  "rom b",
+		"readme.txt": "not a rom",
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("failed to create zip entry %s: %v", name, err)
+		}
+		_, err = io.WriteString(w, content)
+		if err != nil {
+			t.Fatalf("failed to write zip entry %s: %v", name, err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+	err = zipFile.Close()
+	if err != nil {
+		t.Fatalf("failed to close %s: %v", zipPath, err)
+	}
+
+	testRom := func(name, content string) *types.Rom {
+		sum := sha1.Sum([]byte(content))
+		return &types.Rom{
+			Name: name,
+			Size: int64(len(content)),
+			Sha1: sum[:],
+		}
+	}
+
+	game := &types.Game{
+		Name: "game",
+		Roms: []*types.Rom{
+			testRom("a.bin", "rom a"),
+			testRom("b.bin", "rom b"),
+			testRom("c.bin", "rom c"),
+			{Name: "d.bin", Size: 16, Status: "nodump"},
+		},
+	}
+
+	zv, err := VerifyZip(zipPath, game)
+	if err != nil {
+		t.Fatalf("failed to verify zip: %v", err)
+	}
+
+	if zv.Complete {
+		t.Fatalf("expected incomplete set")
+	}
+	if !reflect.DeepEqual(zv.Matched, []string{"a.bin"}) {
+		t.Fatalf("unexpected matched roms %v", zv.Matched)
+	}
+	if !reflect.DeepEqual(zv.Missing, []string{"c.bin"}) {
+		t.Fatalf("unexpected missing roms %v", zv.Missing)
+	}
+	if !reflect.DeepEqual(zv.Extra, []string{"readme.txt"}) {
+		t.Fatalf("unexpected extra entries %v", zv.Extra)
+	}
+	if len(zv.Misnamed) != 1 || zv.Misnamed[0].Entry != "renamed.b" || zv.Misnamed[0].Rom != "b.bin" {
+		t.Fatalf("unexpected misnamed entries %v", zv.Misnamed)
+	}
+
+	game.Roms = game.Roms[:1]
+
+	zv, err = VerifyZip(zipPath, game)
+	if err != nil {
+		t.Fatalf("failed to verify zip: %v", err)
+	}
+	if zv.Complete || len(zv.Extra) != 2 {
+		t.Fatalf("expected extra entries to make the set incomplete, got %v", zv.Extra)
+	}
+}
@@ -0,0 +1,423 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/uwedeportivo/torrentzip"
+)
+
+const (
+	// DefaultZipLevel is the deflate level torrentzip mandates.
+	DefaultZipLevel = flate.BestCompression
+
+	zipMethodStore   = 0
+	zipMethodDeflate = 8
+	zipVersion20     = 20
+	zipVersion45     = 45
+	zipFileHeaderLen = 30
+	zipDirHeaderLen  = 46
+	zipDir64EndLen   = 56
+
+	zipFileHeaderSignature = 0x04034b50
+	zipDirHeaderSignature  = 0x02014b50
+
+	// general purpose flags for deflate with fast and super fast compression
+	zipFlagsFast      = 4
+	zipFlagsSuperFast = 6
+)
+
+// ZipCompression selects how build compresses the entries of game zips. A nil
+// ZipCompression builds regular torrentzips.
+type ZipCompression struct {
+	// Level is the deflate level from 1 to 9
+	Level int
+	// Store leaves the entries uncompressed
+	Store bool
+}
+
+// CheckZipCompression verifies the compression settings and returns nil if they
+// are the torrentzip defaults.
+func CheckZipCompression(level int, store bool) (*ZipCompression, error) {
+	if level < flate.BestSpeed || level > flate.BestCompression {
+		return nil, fmt.Errorf("zip level must be between %d and %d", flate.BestSpeed, flate.BestCompression)
+	}
+	if store && level != DefaultZipLevel {
+		return nil, fmt.Errorf("a zip level can't be used when storing entries")
+	}
+	if !store && level == DefaultZipLevel {
+		return nil, nil
+	}
+	return &ZipCompression{
+		Level: level,
+		Store: store,
+	}, nil
+}
+
+// gameZipWriter is implemented by torrentzip.Writer and levelZipWriter.
+type gameZipWriter interface {
+	Create(name string) (io.Writer, error)
+	Close() error
+}
+
+// newGameZipWriter returns a torrentzip.Writer for a nil zc and a
+// levelZipWriter otherwise.
+func newGameZipWriter(w io.Writer, tempDir string, zc *ZipCompression) (gameZipWriter, error) {
+	if zc == nil {
+		tw, err := torrentzip.NewWriterWithTemp(w, tempDir)
+		if err != nil {
+			return nil, err
+		}
+		return tw, nil
+	}
+
+	lw, err := newLevelZipWriter(w, tempDir, zc)
+	if err != nil {
+		return nil, err
+	}
+	return lw, nil
+}
+
+type levelZipEntry struct {
+	name       string
+	crc        uint32
+	compSize   uint64
+	size       uint64
+	dataOffset int64
+	offset     int64
+}
+
+func (ze *levelZipEntry) isZip64() bool {
+	return ze.compSize > zipUint32Max || ze.size > zipUint32Max
+}
+
+// levelZipWriter writes zips following the torrentzip rules for entry order,
+// timestamps and headers, but compresses the entries with the given
+// ZipCompression instead of zlib at level 9. The zip comment is left out since
+// the zips aren't torrentzips. Like torrentzip.Writer it collects the
+// compressed entries in a temp file and writes the zip on Close.
+type levelZipWriter struct {
+	zc      *ZipCompression
+	sink    io.Writer
+	tf      *os.File
+	bf      *bufio.Writer
+	tfCount *countWriter
+	entries []*levelZipEntry
+
+	// the entry being written
+	cur    *levelZipEntry
+	curCrc crcWriter
+	curRaw *countWriter
+	curW   io.WriteCloser
+}
+
+func newLevelZipWriter(w io.Writer, tempDir string, zc *ZipCompression) (*levelZipWriter, error) {
+	tf, err := ioutil.TempFile(tempDir, "romba_zip")
+	if err != nil {
+		return nil, err
+	}
+
+	lw := &levelZipWriter{
+		zc:   zc,
+		sink: w,
+		tf:   tf,
+		bf:   bufio.NewWriter(tf),
+	}
+	lw.tfCount = &countWriter{w: lw.bf}
+	return lw, nil
+}
+
+type crcWriter struct {
+	crc uint32
+}
+
+func (cw *crcWriter) Write(p []byte) (int, error) {
+	cw.crc = crc32.Update(cw.crc, crc32.IEEETable, p)
+	return len(p), nil
+}
+
+func (lw *levelZipWriter) Create(name string) (io.Writer, error) {
+	if err := lw.closeEntry(); err != nil {
+		return nil, err
+	}
+
+	lw.cur = &levelZipEntry{
+		name:       strings.Replace(name, string(os.PathSeparator), "/", -1),
+		dataOffset: lw.tfCount.count,
+	}
+	lw.curCrc = crcWriter{}
+
+	if lw.zc.Store {
+		lw.curW = nopWriterCloser{lw.tfCount}
+	} else {
+		fw, err := flate.NewWriter(lw.tfCount, lw.zc.Level)
+		if err != nil {
+			return nil, err
+		}
+		lw.curW = fw
+	}
+	lw.curRaw = &countWriter{w: io.MultiWriter(lw.curW, &lw.curCrc)}
+	return lw.curRaw, nil
+}
+
+func (lw *levelZipWriter) closeEntry() error {
+	if lw.cur == nil {
+		return nil
+	}
+	if err := lw.curW.Close(); err != nil {
+		return err
+	}
+
+	lw.cur.crc = lw.curCrc.crc
+	lw.cur.size = uint64(lw.curRaw.count)
+	lw.cur.compSize = uint64(lw.tfCount.count - lw.cur.dataOffset)
+	lw.entries = append(lw.entries, lw.cur)
+	lw.cur = nil
+	return nil
+}
+
+func (lw *levelZipWriter) method() uint16 {
+	if lw.zc.Store {
+		return zipMethodStore
+	}
+	return zipMethodDeflate
+}
+
+func (lw *levelZipWriter) flags() uint16 {
+	switch {
+	case lw.zc.Store:
+		return 0
+	case lw.zc.Level == flate.BestCompression:
+		return tzFlags
+	case lw.zc.Level == flate.BestSpeed:
+		return zipFlagsSuperFast
+	case lw.zc.Level == 2:
+		return zipFlagsFast
+	}
+	return 0
+}
+
+func (lw *levelZipWriter) Close() error {
+	defer os.Remove(lw.tf.Name())
+
+	err := lw.closeEntry()
+	if err == nil {
+		err = lw.bf.Flush()
+	}
+	if err != nil {
+		lw.tf.Close()
+		return err
+	}
+
+	err = lw.writeZip()
+	cerr := lw.tf.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (lw *levelZipWriter) writeZip() error {
+	sort.SliceStable(lw.entries, func(i, j int) bool {
+		return strings.ToLower(lw.entries[i].name) < strings.ToLower(lw.entries[j].name)
+	})
+
+	cw := &countWriter{w: lw.sink}
+
+	for _, ze := range lw.entries {
+		ze.offset = cw.count
+		if err := lw.writeHeader(cw, ze); err != nil {
+			return err
+		}
+		_, err := io.Copy(cw, io.NewSectionReader(lw.tf, ze.dataOffset, int64(ze.compSize)))
+		if err != nil {
+			return err
+		}
+	}
+
+	start := cw.count
+
+	for _, ze := range lw.entries {
+		if err := lw.writeCentralHeader(cw, ze); err != nil {
+			return err
+		}
+	}
+	end := cw.count
+
+	records := uint64(len(lw.entries))
+	size := uint64(end - start)
+	offset := uint64(start)
+
+	if records > zipUint16Max || size > zipUint32Max || offset > zipUint32Max {
+		var buf [zipDir64EndLen + zipDirectory64LocLen]byte
+		b := buf[:]
+
+		binary.LittleEndian.PutUint32(b[0:], zipDirectory64EndSignature)
+		binary.LittleEndian.PutUint64(b[4:], zipDir64EndLen-12)
+		binary.LittleEndian.PutUint16(b[12:], zipVersion45)
+		binary.LittleEndian.PutUint16(b[14:], zipVersion45)
+		binary.LittleEndian.PutUint64(b[24:], records)
+		binary.LittleEndian.PutUint64(b[32:], records)
+		binary.LittleEndian.PutUint64(b[40:], size)
+		binary.LittleEndian.PutUint64(b[48:], offset)
+
+		binary.LittleEndian.PutUint32(b[56:], zipDirectory64LocSignature)
+		binary.LittleEndian.PutUint64(b[64:], uint64(end))
+		binary.LittleEndian.PutUint32(b[72:], 1)
+
+		if _, err := cw.Write(buf[:]); err != nil {
+			return err
+		}
+
+		if records > zipUint16Max {
+			records = zipUint16Max
+		}
+		if size > zipUint32Max {
+			size = zipUint32Max
+		}
+		if offset > zipUint32Max {
+			offset = zipUint32Max
+		}
+	}
+
+	var buf [zipDirectoryEndLen]byte
+	b := buf[:]
+	binary.LittleEndian.PutUint32(b[0:], zipDirectoryEndSignature)
+	binary.LittleEndian.PutUint16(b[8:], uint16(records))
+	binary.LittleEndian.PutUint16(b[10:], uint16(records))
+	binary.LittleEndian.PutUint32(b[12:], uint32(size))
+	binary.LittleEndian.PutUint32(b[16:], uint32(offset))
+
+	_, err := cw.Write(buf[:])
+	return err
+}
+
+func (lw *levelZipWriter) writeHeader(w io.Writer, ze *levelZipEntry) error {
+	var extra []byte
+
+	var buf [zipFileHeaderLen]byte
+	b := buf[:]
+	binary.LittleEndian.PutUint32(b[0:], zipFileHeaderSignature)
+	binary.LittleEndian.PutUint16(b[4:], zipVersion20)
+	binary.LittleEndian.PutUint16(b[6:], lw.flags())
+	binary.LittleEndian.PutUint16(b[8:], lw.method())
+	binary.LittleEndian.PutUint16(b[10:], tzModTime)
+	binary.LittleEndian.PutUint16(b[12:], tzModDate)
+	binary.LittleEndian.PutUint32(b[14:], ze.crc)
+	if ze.isZip64() {
+		binary.LittleEndian.PutUint16(b[4:], zipVersion45)
+		binary.LittleEndian.PutUint32(b[18:], zipUint32Max)
+		binary.LittleEndian.PutUint32(b[22:], zipUint32Max)
+
+		extra = make([]byte, 20)
+		binary.LittleEndian.PutUint16(extra[0:], zip64ExtraID)
+		binary.LittleEndian.PutUint16(extra[2:], 16)
+		binary.LittleEndian.PutUint64(extra[4:], ze.size)
+		binary.LittleEndian.PutUint64(extra[12:], ze.compSize)
+	} else {
+		binary.LittleEndian.PutUint32(b[18:], uint32(ze.compSize))
+		binary.LittleEndian.PutUint32(b[22:], uint32(ze.size))
+	}
+	binary.LittleEndian.PutUint16(b[26:], uint16(len(ze.name)))
+	binary.LittleEndian.PutUint16(b[28:], uint16(len(extra)))
+
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, ze.name); err != nil {
+		return err
+	}
+	_, err := w.Write(extra)
+	return err
+}
+
+func (lw *levelZipWriter) writeCentralHeader(w io.Writer, ze *levelZipEntry) error {
+	var extra []byte
+
+	zip64 := ze.isZip64() || ze.offset > zipUint32Max
+
+	var buf [zipDirHeaderLen]byte
+	b := buf[:]
+	binary.LittleEndian.PutUint32(b[0:], zipDirHeaderSignature)
+	// b[4:6] creator version 0 is FAT
+	binary.LittleEndian.PutUint16(b[6:], zipVersion20)
+	binary.LittleEndian.PutUint16(b[8:], lw.flags())
+	binary.LittleEndian.PutUint16(b[10:], lw.method())
+	binary.LittleEndian.PutUint16(b[12:], tzModTime)
+	binary.LittleEndian.PutUint16(b[14:], tzModDate)
+	binary.LittleEndian.PutUint32(b[16:], ze.crc)
+	binary.LittleEndian.PutUint32(b[20:], uint32(min64(ze.compSize, zipUint32Max)))
+	binary.LittleEndian.PutUint32(b[24:], uint32(min64(ze.size, zipUint32Max)))
+	binary.LittleEndian.PutUint16(b[28:], uint16(len(ze.name)))
+	binary.LittleEndian.PutUint32(b[42:], uint32(min64(uint64(ze.offset), zipUint32Max)))
+
+	if zip64 {
+		binary.LittleEndian.PutUint16(b[6:], zipVersion45)
+
+		extra = make([]byte, 4, 28)
+		binary.LittleEndian.PutUint16(extra[0:], zip64ExtraID)
+		var v [8]byte
+		for _, n := range []uint64{ze.size, ze.compSize, uint64(ze.offset)} {
+			if n > zipUint32Max {
+				binary.LittleEndian.PutUint64(v[:], n)
+				extra = append(extra, v[:]...)
+			}
+		}
+		binary.LittleEndian.PutUint16(extra[2:], uint16(len(extra)-4))
+	}
+	binary.LittleEndian.PutUint16(b[30:], uint16(len(extra)))
+
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, ze.name); err != nil {
+		return err
+	}
+	_, err := w.Write(extra)
+	return err
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
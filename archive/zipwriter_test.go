@@ -0,0 +1,244 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/dedup"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func buildTestZip(t *testing.T, path string, zc *ZipCompression) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", path, err)
+	}
+	defer f.Close()
+
+	zw, err := newGameZipWriter(f, filepath.Dir(path), zc)
+	if err != nil {
+		t.Fatalf("failed to create zip writer: %v", err)
+	}
+	writeTestZip(t, path, zw)
+}
+
+func TestLevelZipWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_zipwriter")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name   string
+		zc     *ZipCompression
+		method uint16
+		// violations CheckTorrentZip reports per entry
+		violations int
+		comment    string
+	}{
+		{"default", nil, zip.Deflate, 0, "TORRENTZIPPED-"},
+		{"level9", &ZipCompression{Level: 9}, zip.Deflate, 0, ""},
+		{"level1", &ZipCompression{Level: 1}, zip.Deflate, 1, ""},
+		{"store", &ZipCompression{Level: DefaultZipLevel, Store: true}, zip.Store, 2, ""},
+	} {
+		path := filepath.Join(dir, tc.name+zipSuffix)
+		buildTestZip(t, path, tc.zc)
+
+		violations, err := CheckTorrentZip(path)
+		if err != nil {
+			t.Fatalf("%s: failed to check zip: %v", tc.name, err)
+		}
+		// plus one for the missing torrentzip comment
+		expected := 3 * tc.violations
+		if tc.zc != nil {
+			expected++
+		}
+		if len(violations) != expected {
+			t.Fatalf("%s: unexpected violations %v", tc.name, violations)
+		}
+
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatalf("%s: failed to open zip: %v", tc.name, err)
+		}
+		if !strings.HasPrefix(zr.Comment, tc.comment) || (tc.comment == "" && zr.Comment != "") {
+			t.Fatalf("%s: unexpected zip comment %q", tc.name, zr.Comment)
+		}
+
+		names := []string{"A.bin", "b.bin", "c.bin"}
+		if len(zr.File) != len(names) {
+			t.Fatalf("%s: expected %d entries, got %d", tc.name, len(names), len(zr.File))
+		}
+		for k, zf := range zr.File {
+			if zf.Name != names[k] || zf.Method != tc.method {
+				t.Fatalf("%s: unexpected entry %s with method %d", tc.name, zf.Name, zf.Method)
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				t.Fatalf("%s: failed to open entry %s: %v", tc.name, zf.Name, err)
+			}
+			bs, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("%s: failed to read entry %s: %v", tc.name, zf.Name, err)
+			}
+			if string(bs) != "romba torrentzip check "+zf.Name {
+				t.Fatalf("%s: unexpected content %q of entry %s", tc.name, bs, zf.Name)
+			}
+		}
+		zr.Close()
+	}
+}
+
+func TestCheckZipCompression(t *testing.T) {
+	zc, err := CheckZipCompression(DefaultZipLevel, false)
+	if err != nil || zc != nil {
+		t.Fatalf("expected torrentzip defaults, got %v, %v", zc, err)
+	}
+	if _, err = CheckZipCompression(0, false); err == nil {
+		t.Fatalf("expected error for level 0")
+	}
+	if _, err = CheckZipCompression(5, true); err == nil {
+		t.Fatalf("expected error for level with store")
+	}
+	zc, err = CheckZipCompression(DefaultZipLevel, true)
+	if err != nil || zc == nil || !zc.Store {
+		t.Fatalf("expected store compression, got %v, %v", zc, err)
+	}
+}
+
+func TestBuildDatZipCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_zipcompression")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	depotDir := filepath.Join(dir, "depot")
+	srcDir := filepath.Join(dir, "src")
+	outDir := filepath.Join(dir, "out")
+	for _, d := range []string{depotDir, srcDir, outDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	content := []byte("romba zip compression test")
+	err = ioutil.WriteFile(filepath.Join(srcDir, "rom.bin"), content, 0666)
+	if err != nil {
+		t.Fatalf("failed to write rom: %v", err)
+	}
+
+	depot, err := NewDepot([]string{depotDir}, []int64{1 << 30}, new(db.NoOpDB))
+	if err != nil {
+		t.Fatalf("failed to create depot: %v", err)
+	}
+
+	_, err = depot.Archive([]string{srcDir}, "", 0, 0, 0, false, 1, dir,
+		worker.NewProgressTracker(1), false, false, true, nil)
+	if err != nil {
+		t.Fatalf("failed to archive: %v", err)
+	}
+
+	datText := fmt.Sprintf(`clrmamepro (
+	name "stored"
+	description "stored"
+)
+
+game (
+	name "game"
+	description "game"
+	rom ( name "rom.bin" size %d sha1 %x )
+)
+`, len(content), sha1.Sum(content))
+
+	dat, _, err := parser.ParseDat(strings.NewReader(datText), "testing/stored.dat")
+	if err != nil {
+		t.Fatalf("failed to parse dat: %v", err)
+	}
+
+	incomplete, err := depot.BuildDat(dat, outDir, 1, dedup.NewMemoryDeduper(dedup.MatchKeySha1), false,
+		&BuildOptions{
+			Format:         BuildFormatZip,
+			ZipCompression: &ZipCompression{Level: DefaultZipLevel, Store: true},
+			ScratchDir:     dir,
+		})
+	if err != nil {
+		t.Fatalf("failed to build dat: %v", err)
+	}
+	if incomplete {
+		t.Fatalf("expected complete build")
+	}
+
+	zr, err := zip.OpenReader(filepath.Join(outDir, "stored", "game.zip"))
+	if err != nil {
+		t.Fatalf("failed to open built game: %v", err)
+	}
+	defer zr.Close()
+
+	if zr.Comment != "" {
+		t.Fatalf("expected no torrentzip comment, got %q", zr.Comment)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != "rom.bin" || zr.File[0].Method != zip.Store {
+		t.Fatalf("expected built game with one stored rom")
+	}
+
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatalf("failed to open rom: %v", err)
+	}
+	defer rc.Close()
+
+	bs, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read rom: %v", err)
+	}
+	if string(bs) != string(content) {
+		t.Fatalf("unexpected rom content %q", bs)
+	}
+}
@@ -31,8 +31,10 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strings"
@@ -44,6 +46,34 @@ type Reply struct {
 	Message string
 }
 
+// expandStdinInput replaces an -inputFile - flag with the whitespace separated
+// words read from in, since the server can't read the client's stdin.
+func expandStdinInput(args []string, in io.Reader) ([]string, error) {
+	var res []string
+	var fromStdin bool
+
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-inputFile=-" || (args[i] == "-inputFile" && i+1 < len(args) && args[i+1] == "-") {
+			if args[i] == "-inputFile" {
+				i++
+			}
+			fromStdin = true
+			continue
+		}
+		res = append(res, args[i])
+	}
+
+	if !fromStdin {
+		return args, nil
+	}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		res = append(res, strings.Fields(scanner.Text())...)
+	}
+	return res, scanner.Err()
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Fprintf(os.Stderr, "not enough arguments\n")
@@ -53,7 +83,13 @@ func main() {
 	serverStr := os.Args[1]
 
 	params := make(map[string]string)
-	params["cmdTxt"] = strings.Join(os.Args[2:], " ")
+	args, err := expandStdinInput(os.Args[2:], os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read stdin: %v\n", err)
+		os.Exit(1)
+	}
+
+	params["cmdTxt"] = strings.Join(args, " ")
 	params["cmdOrigin"] = "terminal"
 
 	buf, err := json2.EncodeClientRequest("RombaService.Execute", params)
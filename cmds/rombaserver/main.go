@@ -55,6 +55,7 @@ import (
 	"github.com/uwedeportivo/romba/archive"
 	"github.com/uwedeportivo/romba/config"
 	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/parser"
 	"github.com/uwedeportivo/romba/service"
 
 	_ "github.com/uwedeportivo/romba/db/clevel"
@@ -109,6 +110,7 @@ func main() {
 	flag.Parse()
 
 	cfg := new(config.Config)
+	cfg.Depot.Fsync = true
 
 	iniPath, err := findINI(*iniPath)
 	if err != nil {
@@ -143,10 +145,19 @@ func main() {
 			os.Exit(1)
 		}
 	}
-	cfg.Index.Dats, err = filepath.Abs(cfg.Index.Dats)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "reading romba ini failed: %v\n", err)
-		os.Exit(1)
+	for i, pv := range cfg.Index.Dats {
+		cfg.Index.Dats[i], err = filepath.Abs(pv)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading romba ini failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.Depot.Samples != "" {
+		cfg.Depot.Samples, err = filepath.Abs(cfg.Depot.Samples)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading romba ini failed: %v\n", err)
+			os.Exit(1)
+		}
 	}
 	cfg.Index.Db, err = filepath.Abs(cfg.Index.Db)
 	if err != nil {
@@ -164,6 +175,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cfg.Index.NamelessRoms != "" {
+		err = parser.SetNamelessRomPolicy(cfg.Index.NamelessRoms)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading romba ini failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	config.GlobalConfig = cfg
 
 	runtime.GOMAXPROCS(cfg.General.Cores)
@@ -172,6 +191,8 @@ func main() {
 	flag.Set("alsologtostderr", "true")
 	flag.Set("v", strconv.Itoa(cfg.General.Verbosity))
 
+	db.SetSizeIndex(cfg.Index.SizeIndex)
+
 	romDB, err := db.New(cfg.Index.Db)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "opening db failed: %v\n", err)
@@ -184,6 +205,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	if !cfg.Depot.Fsync {
+		depot.DisableFsync()
+	}
+
+	if cfg.Depot.Manifest {
+		err = depot.EnableManifests()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "opening depot manifests failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	rs := service.NewRombaService(romDB, depot, cfg)
 
 	go signalCatcher(rs)
@@ -194,6 +227,7 @@ func main() {
 	http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir(cfg.General.WebDir))))
 	http.Handle("/jsonrpc/", s)
 	http.Handle("/progress", websocket.Handler(rs.SendProgress))
+	http.Handle("/roms/", http.StripPrefix("/roms/", http.HandlerFunc(rs.ServeRom)))
 
 	fmt.Printf("starting romba server version %s at localhost:%d/romba.html\n", service.Version, cfg.Server.Port)
 
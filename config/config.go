@@ -39,16 +39,40 @@ type Config struct {
 		Workers   int
 		Verbosity int
 		Cores     int
+
+		HashBufferSize int
+		MaxOpenFiles   int
+		DepotWriters   int
 	}
 
 	Depot struct {
-		Root    []string
-		MaxSize []int64
+		Root              []string
+		MaxSize           []int64
+		WriteRetries      int
+		WriteRetryBackoff int
+		MergeRateLimit    int64
+		Manifest          bool
+		Fsync             bool
+		Samples           string
+	}
+
+	Archive struct {
+		SkipExtensions []string
+		Hook           string
+		HookEvents     []string
+	}
+
+	Bloom struct {
+		Capacity uint
+		Fp       float64
 	}
 
 	Index struct {
-		Db   string
-		Dats string
+		Db            string
+		Dats          []string
+		ReferenceOnly []string
+		NamelessRoms  string
+		SizeIndex     bool
 	}
 
 	Server struct {
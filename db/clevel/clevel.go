@@ -99,6 +99,37 @@ func (s *store) GetKeySuffixesFor(keyPrefix []byte) ([]byte, error) {
 	return suffixes, nil
 }
 
+func (s *store) GetKeySuffixesForMany(keyPrefixes [][]byte) ([][]byte, error) {
+	res := make([][]byte, len(keyPrefixes))
+
+	it := s.dbn.NewIterator(rOptions)
+	defer it.Close()
+
+	key := make([]byte, s.keySize)
+
+	for i, keyPrefix := range keyPrefixes {
+		n := len(keyPrefix)
+
+		for j := range key {
+			key[j] = 0
+		}
+		copy(key[:n], keyPrefix)
+
+		it.Seek(key)
+
+		for it.Valid() {
+			ik := it.Key()
+			if bytes.Equal(ik[:n], keyPrefix) {
+				res[i] = append(res[i], ik[n:]...)
+			} else {
+				break
+			}
+			it.Next()
+		}
+	}
+	return res, nil
+}
+
 func (s *store) Delete(key []byte) error {
 	return s.dbn.Delete(wOptions, key)
 }
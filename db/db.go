@@ -32,13 +32,17 @@ package db
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"github.com/uwedeportivo/romba/combine"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -51,10 +55,66 @@ import (
 const (
 	generationFilename = "romba-generation"
 	MaxBatchSize       = 10485760
+
+	// DATs of at least this size are parsed with parser.ParseParallel
+	parallelParseMinSize = 64 * 1024 * 1024
+)
+
+// IndexHashes selects which rom hash indexes a refresh maintains.
+type IndexHashes int
+
+const (
+	IndexCrc IndexHashes = 1 << iota
+	IndexMd5
+	IndexSha1
+
+	IndexAllHashes = IndexCrc | IndexMd5 | IndexSha1
 )
 
+// ParseIndexHashes parses a comma separated list of hash names like "sha1,crc".
+func ParseIndexHashes(s string) (IndexHashes, error) {
+	var ih IndexHashes
+
+	for _, name := range strings.Split(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "crc":
+			ih |= IndexCrc
+		case "md5":
+			ih |= IndexMd5
+		case "sha1":
+			ih |= IndexSha1
+		case "":
+		default:
+			return 0, fmt.Errorf("unknown hash type %s", name)
+		}
+	}
+
+	if ih == 0 {
+		return 0, fmt.Errorf("no hash types in %s", s)
+	}
+	return ih, nil
+}
+
+// StoreStats are the statistics of one store of the index.
+type StoreStats struct {
+	Name     string `json:"name"`
+	DiskSize int64  `json:"diskSize"`
+}
+
+// Stats are the statistics of the index. Orphaned DATs weren't found by the
+// latest refresh. DiskSize is the size of the files of all stores.
+type Stats struct {
+	Generation    int64         `json:"generation"`
+	NumDats       int           `json:"numDats"`
+	NumOrphanDats int           `json:"numOrphanedDats"`
+	DiskSize      int64         `json:"diskSize"`
+	SizeIndex     bool          `json:"sizeIndex"`
+	Stores        []*StoreStats `json:"stores"`
+}
+
 type RomBatch interface {
 	IndexRom(rom *types.Rom) error
+	IndexRomSource(rom *types.Rom, datPath string, source string) error
 	IndexDat(dat *types.Dat, sha1 []byte) error
 	Size() int64
 	Flush() error
@@ -63,27 +123,50 @@ type RomBatch interface {
 
 type RomDB interface {
 	StartBatch() RomBatch
+	StartBatchWithHashes(hashes IndexHashes) RomBatch
 	IndexRom(rom *types.Rom) error
+	DeleteRom(rom *types.Rom) error
+	IndexZip(sha1 []byte) error
+	IsZipSeen(sha1 []byte) (bool, error)
+	RomSources(sha1 []byte) ([]string, error)
+	IndexRomName(sha1 []byte, path string) error
+	RomNames(sha1 []byte) ([]string, error)
+	Snapshot(dir string) error
 	IndexDat(dat *types.Dat, sha1 []byte) error
 	OrphanDats() error
 	Flush()
 	Close() error
 	GetDat(sha1 []byte) (*types.Dat, error)
+	GetDatWithRoms(sha1 []byte) (*types.Dat, error)
+	ForEachDatGame(sha1 []byte, gameF func(game *types.Game) error) (*types.Dat, error)
+	UpdateDatHeader(sha1 []byte, name, description string) (*types.Dat, error)
 	IsRomReferencedByDats(rom *types.Rom) (bool, error)
 	DatsForRom(rom *types.Rom) ([]*types.Dat, error)
+	DatsForRoms(roms []*types.Rom) (map[string][]*types.Dat, error)
 	FilteredDatsForRom(rom *types.Rom, filter func(*types.Dat) bool) ([]*types.Dat, []*types.Dat, error)
 	CompleteRom(rom *types.Rom) ([]*types.Rom, error)
 	BeginDatRefresh() error
 	EndDatRefresh() error
 	PrintStats() string
+	Stats() (*Stats, error)
 	Generation() int64
+	SetGeneration(gen int64) error
 	DebugGet(key []byte, size int64) string
 	ResolveHash(key []byte) ([]byte, error)
 	ForEachDat(datF func(dat *types.Dat) error) error
+	ForEachDatWithSha1(datF func(sha1 []byte, dat *types.Dat) error) error
+	ForEachRom(romF func(rom *types.Rom) error) error
+	HasRomDatAssociation(rom *types.Rom, datSha1 []byte) (bool, error)
+	ForEachRomDatAssociation(assocF func(rom *types.Rom, datSha1 []byte) error) error
 	JoinCrcMd5(combiner combine.Combiner) error
 	NumRoms() int64
+	RomsOfSize(size int64) ([]*types.Rom, error)
+	IndexedSize(rom *types.Rom) (int64, error)
 }
 
+// ErrNoSizeIndex is returned by RomsOfSize if the DB has no size index.
+var ErrNoSizeIndex = errors.New("no size index, set sizeindex=true in the index section of romba.ini")
+
 var Factory func(path string) (RomDB, error)
 
 func FormatDuration(d time.Duration) string {
@@ -180,18 +263,47 @@ func (pw *refreshWorker) Process(path string, size int64) error {
 			return fmt.Errorf("failed to flush: %v", err)
 		}
 	}
-	dat, sha1Bytes, err := parser.Parse(path)
+	var dat *types.Dat
+	var sha1Bytes []byte
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	// a single huge DAT like a MAME -listxml would otherwise leave the other cores idle
+	if fi.Size() >= parallelParseMinSize {
+		dat, sha1Bytes, err = parser.ParseParallel(path, runtime.NumCPU())
+	} else {
+		dat, sha1Bytes, err = parser.Parse(path)
+	}
 	if err != nil {
 		return err
 	}
 
+	dat.ReferenceOnly = pw.pm.referenceDats.Matches(dat, sha1Bytes)
+
 	if pw.pm.missingSha1sWriter != nil && dat.MissingSha1s {
-		_, err = fmt.Fprintln(pw.pm.missingSha1sWriter, dat.Path)
+		err = pw.pm.writeSideFileEntry(pw.pm.missingSha1sWriter, dat.Path)
 		if err != nil {
 			return err
 		}
 	}
 
+	if pw.pm.encodingIssuesWriter != nil || pw.pm.transcode != nil {
+		numInvalid := checkDatEncoding(dat, pw.pm.transcode)
+		if numInvalid > 0 {
+			glog.Warningf("dat %s has %d names that are not valid UTF-8", dat.Path, numInvalid)
+
+			if pw.pm.encodingIssuesWriter != nil {
+				err = pw.pm.writeSideFileEntry(pw.pm.encodingIssuesWriter, dat.Path)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
 	return pw.romBatch.IndexDat(dat, sha1Bytes)
 }
 
@@ -202,10 +314,29 @@ func (pw *refreshWorker) Close() error {
 }
 
 type refreshGru struct {
-	romdb              RomDB
-	numWorkers         int
-	pt                 worker.ProgressTracker
-	missingSha1sWriter io.Writer
+	romdb                RomDB
+	numWorkers           int
+	pt                   worker.ProgressTracker
+	missingSha1sWriter   io.Writer
+	encodingIssuesWriter io.Writer
+	transcode            Transcoder
+	indexHashes          IndexHashes
+	maxDepth             int
+	referenceDats        *ReferenceDats
+
+	sideFileMutex sync.Mutex
+}
+
+func (pm *refreshGru) writeSideFileEntry(w io.Writer, datPath string) error {
+	pm.sideFileMutex.Lock()
+	defer pm.sideFileMutex.Unlock()
+
+	_, err := fmt.Fprintln(w, datPath)
+	return err
+}
+
+func (pm *refreshGru) MaxDepth() int {
+	return pm.maxDepth
 }
 
 func (pm *refreshGru) CalculateWork() bool {
@@ -217,13 +348,13 @@ func (pm *refreshGru) NeedsSizeInfo() bool {
 }
 
 func (pm *refreshGru) Accept(path string) bool {
-	ext := filepath.Ext(path)
+	ext := strings.ToLower(filepath.Ext(path))
 	return ext == ".dat" || ext == ".xml"
 }
 
 func (pm *refreshGru) NewWorker(workerIndex int) worker.Worker {
 	return &refreshWorker{
-		romBatch: pm.romdb.StartBatch(),
+		romBatch: pm.romdb.StartBatchWithHashes(pm.indexHashes),
 		pm:       pm,
 	}
 }
@@ -248,43 +379,67 @@ func (pm *refreshGru) Start() error {
 
 func (pm *refreshGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
 
-func Refresh(romdb RomDB, datsPath string, numWorkers int, pt worker.ProgressTracker, missingSha1s string) (string, error) {
+// createSideFile creates the file at path for refresh to list dat paths in.
+// The returned close function flushes and closes it.
+func createSideFile(path string) (io.Writer, func(), error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := bufio.NewWriter(file)
+
+	return buf, func() {
+		err := buf.Flush()
+		if err != nil {
+			glog.Errorf("error, failed to flush %s: %v", path, err)
+		}
+		err = file.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close %s: %v", path, err)
+		}
+	}, nil
+}
+
+// Refresh indexes the DATs found below datsPaths. DATs that were indexed before but
+// aren't found in any of the paths are left orphaned.
+func Refresh(romdb RomDB, datsPaths []string, numWorkers int, pt worker.ProgressTracker, missingSha1s string,
+	indexHashes IndexHashes, encodingIssues string, transcode Transcoder, maxDepth int,
+	referenceDats *ReferenceDats) (string, error) {
 	err := romdb.OrphanDats()
 	if err != nil {
 		return "", err
 	}
 
-	var missingSha1sWriter io.Writer
+	pm := &refreshGru{
+		romdb:         romdb,
+		numWorkers:    numWorkers,
+		pt:            pt,
+		transcode:     transcode,
+		indexHashes:   indexHashes,
+		maxDepth:      maxDepth,
+		referenceDats: referenceDats,
+	}
 
 	if missingSha1s != "" {
-		missingSha1sFile, err := os.Create(missingSha1s)
+		w, closeF, err := createSideFile(missingSha1s)
 		if err != nil {
 			return "", err
 		}
-		defer func() {
-			err := missingSha1sFile.Close()
-			if err != nil {
-				glog.Errorf("error, failed to close missing sha1 file %s: %v", missingSha1s, err)
-			}
-		}()
-
-		missingSha1sBuf := bufio.NewWriter(missingSha1sFile)
-		defer func() {
-			err := missingSha1sBuf.Flush()
-			if err != nil {
-				glog.Errorf("error, failed to flush missing sha1 file %s: %v", missingSha1s, err)
-			}
-		}()
+		defer closeF()
 
-		missingSha1sWriter = missingSha1sBuf
+		pm.missingSha1sWriter = w
 	}
 
-	pm := &refreshGru{
-		romdb:              romdb,
-		numWorkers:         numWorkers,
-		pt:                 pt,
-		missingSha1sWriter: missingSha1sWriter,
+	if encodingIssues != "" {
+		w, closeF, err := createSideFile(encodingIssues)
+		if err != nil {
+			return "", err
+		}
+		defer closeF()
+
+		pm.encodingIssuesWriter = w
 	}
 
-	return worker.Work("refresh dats", []string{datsPath}, pm)
+	return worker.Work("refresh dats", datsPaths, pm)
 }
@@ -31,13 +31,18 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package db_test
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"github.com/uwedeportivo/romba/db"
 	"github.com/uwedeportivo/romba/parser"
 	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 
@@ -135,3 +140,1374 @@ func TestDB(t *testing.T) {
 		t.Fatalf("failed to remove test db dir %s: %v", dbDir, err)
 	}
 }
+
+func TestIndexHashes(t *testing.T) {
+	ih, err := db.ParseIndexHashes("sha1, CRC")
+	if err != nil {
+		t.Fatalf("failed to parse index hashes: %v", err)
+	}
+	if ih != db.IndexSha1|db.IndexCrc {
+		t.Fatalf("expected sha1 and crc, got %d", ih)
+	}
+
+	_, err = db.ParseIndexHashes("sha256")
+	if err == nil {
+		t.Fatalf("expected error for unknown hash type")
+	}
+
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	batch := krdb.StartBatchWithHashes(db.IndexCrc)
+	err = batch.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+	err = batch.Close()
+	if err != nil {
+		t.Fatalf("failed to close batch: %v", err)
+	}
+
+	romSha1Bytes, err := hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+
+	dats, err := krdb.DatsForRom(&types.Rom{Sha1: romSha1Bytes})
+	if err != nil {
+		t.Fatalf("failed to retrieve dats for rom: %v", err)
+	}
+	if len(dats) != 0 {
+		t.Fatalf("expected no dats for rom sha1 with sha1 index disabled, got %d", len(dats))
+	}
+
+	romCrcBytes, err := hex.DecodeString("175a3f26")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+
+	dats, err = krdb.DatsForRom(&types.Rom{Crc: romCrcBytes, Size: 333744})
+	if err != nil {
+		t.Fatalf("failed to retrieve dats for rom: %v", err)
+	}
+	if len(dats) != 1 {
+		t.Fatalf("couldn't find dats for rom crc")
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	err = os.RemoveAll(dbDir)
+	if err != nil {
+		t.Fatalf("failed to remove test db dir %s: %v", dbDir, err)
+	}
+}
+
+func TestDeleteRom(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	rom := new(types.Rom)
+	rom.Name = "test rom"
+	rom.Size = 333744
+	rom.Crc, _ = hex.DecodeString("175a3f26")
+	rom.Md5, _ = hex.DecodeString("36ecf1371d3391c06c16f751431c932b")
+	rom.Sha1, _ = hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+
+	err = krdb.IndexRom(rom)
+	if err != nil {
+		t.Fatalf("failed to index rom: %v", err)
+	}
+
+	suffixes, err := krdb.ResolveHash(rom.Crc)
+	if err != nil {
+		t.Fatalf("failed to resolve crc: %v", err)
+	}
+	if len(suffixes) == 0 {
+		t.Fatalf("expected crc to resolve before delete")
+	}
+
+	err = krdb.DeleteRom(rom)
+	if err != nil {
+		t.Fatalf("failed to delete rom: %v", err)
+	}
+
+	for _, key := range [][]byte{rom.Crc, rom.Md5} {
+		suffixes, err = krdb.ResolveHash(key)
+		if err != nil {
+			t.Fatalf("failed to resolve hash: %v", err)
+		}
+		if len(suffixes) != 0 {
+			t.Fatalf("expected hash %s not to resolve after delete", hex.EncodeToString(key))
+		}
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	err = os.RemoveAll(dbDir)
+	if err != nil {
+		t.Fatalf("failed to remove test db dir %s: %v", dbDir, err)
+	}
+}
+
+func TestUpdateDatHeader(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	err = krdb.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+
+	udat, err := krdb.UpdateDatHeader(sha1Bytes, "Acorn Archimedes - Apps", "")
+	if err != nil {
+		t.Fatalf("failed to update dat header: %v", err)
+	}
+	if udat == nil {
+		t.Fatalf("expected updated dat")
+	}
+
+	sdat, err := krdb.GetDat(sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to get dat: %v", err)
+	}
+	if sdat.Name != "Acorn Archimedes - Apps" {
+		t.Fatalf("expected updated name, got %s", sdat.Name)
+	}
+	if sdat.Description != dat.Description {
+		t.Fatalf("expected unchanged description %s, got %s", dat.Description, sdat.Description)
+	}
+	if len(sdat.Games) != len(dat.Games) {
+		t.Fatalf("expected %d games, got %d", len(dat.Games), len(sdat.Games))
+	}
+
+	missing := make([]byte, len(sha1Bytes))
+	udat, err = krdb.UpdateDatHeader(missing, "foo", "")
+	if err != nil {
+		t.Fatalf("failed to update missing dat header: %v", err)
+	}
+	if udat != nil {
+		t.Fatalf("expected nil for missing dat")
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	err = os.RemoveAll(dbDir)
+	if err != nil {
+		t.Fatalf("failed to remove test db dir %s: %v", dbDir, err)
+	}
+}
+
+func TestGetDatWithRoms(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	err = krdb.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+
+	sdat, err := krdb.GetDatWithRoms(sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to get dat: %v", err)
+	}
+	if sdat == nil || !sdat.Equals(dat) {
+		t.Fatalf("expected dat with all games and roms")
+	}
+
+	var games types.GameSlice
+	hdr, err := krdb.ForEachDatGame(sha1Bytes, func(game *types.Game) error {
+		games = append(games, game)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to stream dat games: %v", err)
+	}
+	if hdr == nil || hdr.Name != dat.Name || len(hdr.Games) != 0 {
+		t.Fatalf("expected dat header without games")
+	}
+	if !games.Equals(dat.Games) {
+		t.Fatalf("expected streamed games to match the dat")
+	}
+
+	missing := make([]byte, len(sha1Bytes))
+	hdr, err = krdb.ForEachDatGame(missing, func(game *types.Game) error {
+		t.Fatalf("unexpected game %s for missing dat", game.Name)
+		return nil
+	})
+	if err != nil || hdr != nil {
+		t.Fatalf("expected nil for missing dat, got %v, %v", hdr, err)
+	}
+}
+
+func TestParseSourceEncoding(t *testing.T) {
+	transcode, err := db.ParseSourceEncoding("")
+	if err != nil {
+		t.Fatalf("failed to parse empty source encoding: %v", err)
+	}
+	if transcode != nil {
+		t.Fatalf("expected no transcoder for empty source encoding")
+	}
+
+	transcode, err = db.ParseSourceEncoding("Latin1")
+	if err != nil {
+		t.Fatalf("failed to parse latin1 source encoding: %v", err)
+	}
+	if got := transcode("Pok\xe9mon"); got != "Pok\u00e9mon" {
+		t.Fatalf("expected Pok\u00e9mon, got %q", got)
+	}
+
+	_, err = db.ParseSourceEncoding("shift-jis")
+	if err == nil {
+		t.Fatalf("expected error for unsupported source encoding")
+	}
+}
+
+func TestReferenceDats(t *testing.T) {
+	rd, err := db.ParseReferenceDats(nil)
+	if err != nil {
+		t.Fatalf("failed to parse empty reference dats: %v", err)
+	}
+	if rd.Matches(&types.Dat{Name: "foo"}, nil) {
+		t.Fatalf("expected nil reference dats to match nothing")
+	}
+
+	sha1Hex := "80353cb168dc5d7cc1dce57971f4ea2640a50ac4"
+	sha1Bytes, err := hex.DecodeString(sha1Hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rd, err = db.ParseReferenceDats([]string{strings.ToUpper(sha1Hex), "*(Reference)*"})
+	if err != nil {
+		t.Fatalf("failed to parse reference dats: %v", err)
+	}
+
+	if !rd.Matches(&types.Dat{Name: "foo"}, sha1Bytes) {
+		t.Fatalf("expected match by dat sha1")
+	}
+	if !rd.Matches(&types.Dat{Name: "Sega - Mega Drive (Reference)"}, nil) {
+		t.Fatalf("expected match by dat name")
+	}
+	if rd.Matches(&types.Dat{Name: "Sega - Mega Drive", Path: "/dats/Sega - Mega Drive.dat"}, nil) {
+		t.Fatalf("expected no match for regular dat")
+	}
+
+	_, err = db.ParseReferenceDats([]string{"[a-"})
+	if err == nil {
+		t.Fatalf("expected error for invalid pattern")
+	}
+}
+
+func TestRomNames(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	sha1Bytes, err := hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+	otherSha1Bytes, err := hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac5")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+
+	names, err := krdb.RomNames(sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to get rom names: %v", err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("expected no names before indexing, got %v", names)
+	}
+
+	paths := []string{"/in/a.bin", "/in/set.zip/a.bin", "/in/a.bin"}
+	for _, path := range paths {
+		err = krdb.IndexRomName(sha1Bytes, path)
+		if err != nil {
+			t.Fatalf("failed to index rom name: %v", err)
+		}
+	}
+	err = krdb.IndexRomName(otherSha1Bytes, "/in/b.bin")
+	if err != nil {
+		t.Fatalf("failed to index rom name: %v", err)
+	}
+
+	names, err = krdb.RomNames(sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to get rom names: %v", err)
+	}
+	if len(names) != 2 || strings.Join(names, "|") != "/in/a.bin|/in/set.zip/a.bin" &&
+		strings.Join(names, "|") != "/in/set.zip/a.bin|/in/a.bin" {
+		t.Fatalf("unexpected rom names %v", names)
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	err = os.RemoveAll(dbDir)
+	if err != nil {
+		t.Fatalf("failed to remove test db dir %s: %v", dbDir, err)
+	}
+}
+
+func TestIndexedSize(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	rom := new(types.Rom)
+	rom.Name = "test rom"
+	rom.Size = 333744
+	rom.Crc, _ = hex.DecodeString("175a3f26")
+	rom.Md5, _ = hex.DecodeString("36ecf1371d3391c06c16f751431c932b")
+	rom.Sha1, _ = hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+
+	err = krdb.IndexRom(rom)
+	if err != nil {
+		t.Fatalf("failed to index rom: %v", err)
+	}
+
+	for _, tc := range []struct {
+		crc, md5, sha1 string
+		size           int64
+	}{
+		{"175a3f26", "", "80353cb168dc5d7cc1dce57971f4ea2640a50ac4", 333744},
+		{"", "36ecf1371d3391c06c16f751431c932b", "80353cb168dc5d7cc1dce57971f4ea2640a50ac4", 333744},
+		{"175a3f26", "", "0000000000000000000000000000000000000001", -1},
+		{"", "", "80353cb168dc5d7cc1dce57971f4ea2640a50ac4", -1},
+	} {
+		r := new(types.Rom)
+		r.Crc, _ = hex.DecodeString(tc.crc)
+		r.Md5, _ = hex.DecodeString(tc.md5)
+		r.Sha1, _ = hex.DecodeString(tc.sha1)
+
+		size, err := krdb.IndexedSize(r)
+		if err != nil {
+			t.Fatalf("failed to get indexed size: %v", err)
+		}
+		if size != tc.size {
+			t.Fatalf("expected indexed size %d for crc %s md5 %s sha1 %s, got %d",
+				tc.size, tc.crc, tc.md5, tc.sha1, size)
+		}
+	}
+}
+
+func TestRomSource(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	rom := new(types.Rom)
+	rom.Name = "a.bin"
+	rom.Size = 10
+	rom.Crc, _ = hex.DecodeString("0a1b2c3d")
+	rom.Sha1, err = hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+
+	sources, err := krdb.RomSources(rom.Sha1)
+	if err != nil {
+		t.Fatalf("failed to get rom sources: %v", err)
+	}
+	if len(sources) != 0 {
+		t.Fatalf("expected no sources before import, got %v", sources)
+	}
+
+	imports := []struct {
+		datPath string
+		label   string
+		want    []string
+	}{
+		{"mame.dat", "mamedb", []string{"mamedb"}},
+		{"nointro.dat", "nointro", []string{"mamedb", "nointro"}},
+		{"mame.dat", "mamedb2", []string{"mamedb2", "nointro"}},
+	}
+
+	for _, imp := range imports {
+		batch := krdb.StartBatch()
+		err = batch.IndexRom(rom)
+		if err != nil {
+			t.Fatalf("failed to index rom: %v", err)
+		}
+		err = batch.IndexRomSource(rom, imp.datPath, imp.label)
+		if err != nil {
+			t.Fatalf("failed to index rom source: %v", err)
+		}
+		err = batch.Close()
+		if err != nil {
+			t.Fatalf("failed to close batch: %v", err)
+		}
+
+		sources, err = krdb.RomSources(rom.Sha1)
+		if err != nil {
+			t.Fatalf("failed to get rom sources: %v", err)
+		}
+		sort.Strings(sources)
+		if !reflect.DeepEqual(sources, imp.want) {
+			t.Fatalf("expected sources %v after importing %s, got %v", imp.want, imp.datPath, sources)
+		}
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	err = os.RemoveAll(dbDir)
+	if err != nil {
+		t.Fatalf("failed to remove test db dir %s: %v", dbDir, err)
+	}
+}
+
+func TestSetGeneration(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	err = krdb.SetGeneration(42)
+	if err != nil {
+		t.Fatalf("failed to set generation: %v", err)
+	}
+
+	if krdb.Generation() != 42 {
+		t.Fatalf("expected generation 42, got %d", krdb.Generation())
+	}
+
+	gen, err := db.ReadGenerationFile(dbDir)
+	if err != nil {
+		t.Fatalf("failed to read generation file: %v", err)
+	}
+	if gen != 42 {
+		t.Fatalf("expected generation file with 42, got %d", gen)
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	err = krdb.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+
+	err = krdb.OrphanDats()
+	if err != nil {
+		t.Fatalf("failed to orphan dats: %v", err)
+	}
+
+	st, err := krdb.Stats()
+	if err != nil {
+		t.Fatalf("failed to get db stats: %v", err)
+	}
+
+	if st.Generation != krdb.Generation() {
+		t.Fatalf("expected generation %d, got %d", krdb.Generation(), st.Generation)
+	}
+	if st.NumDats != 1 || st.NumOrphanDats != 1 {
+		t.Fatalf("expected 1 dat, orphaned, got %d dats and %d orphaned", st.NumDats, st.NumOrphanDats)
+	}
+	if st.SizeIndex {
+		t.Fatalf("expected no size index")
+	}
+
+	var diskSize int64
+	names := make(map[string]bool)
+	for _, s := range st.Stores {
+		names[s.Name] = true
+		diskSize += s.DiskSize
+	}
+	if !names["dats_db"] || !names["sha1_db"] || names["sizes_db"] {
+		t.Fatalf("unexpected stores %v", names)
+	}
+	if diskSize != st.DiskSize {
+		t.Fatalf("expected disk size %d as the sum of the stores, got %d", diskSize, st.DiskSize)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	err = os.Mkdir(filepath.Join(dbDir, "db"), 0777)
+	if err != nil {
+		t.Fatalf("cannot create test db dir: %v", err)
+	}
+
+	krdb, roms := bulkTestDB(t, filepath.Join(dbDir, "db"), 3, 10)
+
+	err = krdb.IndexRomName(roms[0].Sha1, "/in/a.bin")
+	if err != nil {
+		t.Fatalf("failed to index rom name: %v", err)
+	}
+
+	snapDir := filepath.Join(dbDir, "snap")
+	err = krdb.Snapshot(snapDir)
+	if err != nil {
+		t.Fatalf("failed to snapshot: %v", err)
+	}
+
+	err = krdb.Snapshot(snapDir)
+	if err == nil {
+		t.Fatalf("expected snapshot into an existing index to fail")
+	}
+
+	generation := krdb.Generation()
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	snapdb, err := db.New(snapDir)
+	if err != nil {
+		t.Fatalf("failed to open snapshot: %v", err)
+	}
+	defer snapdb.Close()
+
+	if snapdb.Generation() != generation {
+		t.Fatalf("expected snapshot generation %d, got %d", generation, snapdb.Generation())
+	}
+
+	for _, rom := range roms {
+		dats, err := snapdb.DatsForRom(rom)
+		if err != nil {
+			t.Fatalf("failed to get dats for rom: %v", err)
+		}
+		if len(dats) != 1 {
+			t.Fatalf("expected 1 dat for %s in snapshot, got %d", db.RomsKey(rom), len(dats))
+		}
+	}
+
+	names, err := snapdb.RomNames(roms[0].Sha1)
+	if err != nil {
+		t.Fatalf("failed to get rom names: %v", err)
+	}
+	if len(names) != 1 || names[0] != "/in/a.bin" {
+		t.Fatalf("unexpected rom names in snapshot %v", names)
+	}
+}
+
+func TestForEachRom(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	const datText = `clrmamepro (
+	name "foreachrom"
+	description "foreachrom"
+)
+
+game (
+	name "game"
+	description "game"
+	rom ( name "crc.bin" size 10 crc 0a1b2c3d sha1 1111111111111111111111111111111111111111 )
+	rom ( name "md5.bin" size 20 md5 0123456789abcdef0123456789abcdef sha1 2222222222222222222222222222222222222222 )
+	rom ( name "sha1.bin" sha1 3333333333333333333333333333333333333333 )
+	rom ( name "dup.bin" size 10 crc 0a1b2c3d md5 0123456789abcdef0123456789abcdee sha1 1111111111111111111111111111111111111111 )
+)
+`
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/foreachrom.dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	err = krdb.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+
+	archived := &types.Rom{Name: "archived.bin", Size: 30}
+	archived.Sha1, _ = hex.DecodeString("0000000000000000000000000000000000000004")
+	archived.Crc, _ = hex.DecodeString("01020304")
+	archived.Md5, _ = hex.DecodeString("00000000000000000000000000000004")
+	err = krdb.IndexRom(archived)
+	if err != nil {
+		t.Fatalf("failed to index rom: %v", err)
+	}
+
+	var got []string
+	err = krdb.ForEachRom(func(rom *types.Rom) error {
+		got = append(got, fmt.Sprintf("%s %d", hex.EncodeToString(rom.Sha1), rom.Size))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to iterate roms: %v", err)
+	}
+
+	expected := []string{
+		"0000000000000000000000000000000000000004 30",
+		"1111111111111111111111111111111111111111 10",
+		"2222222222222222222222222222222222222222 20",
+		"3333333333333333333333333333333333333333 -1",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected roms\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+
+	errStop := fmt.Errorf("stop")
+	n := 0
+	err = krdb.ForEachRom(func(rom *types.Rom) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Fatalf("expected iteration to stop after the first rom with its error, got %d roms and %v", n, err)
+	}
+}
+
+func TestZipSeen(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	zipSha1, err := hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+
+	seen, err := krdb.IsZipSeen(zipSha1)
+	if err != nil {
+		t.Fatalf("failed to check zip: %v", err)
+	}
+	if seen {
+		t.Fatalf("expected zip not to be seen before indexing")
+	}
+
+	err = krdb.IndexZip(zipSha1)
+	if err != nil {
+		t.Fatalf("failed to index zip: %v", err)
+	}
+
+	seen, err = krdb.IsZipSeen(zipSha1)
+	if err != nil {
+		t.Fatalf("failed to check zip: %v", err)
+	}
+	if !seen {
+		t.Fatalf("expected zip to be seen after indexing")
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	err = os.RemoveAll(dbDir)
+	if err != nil {
+		t.Fatalf("failed to remove test db dir %s: %v", dbDir, err)
+	}
+}
+
+func TestRomDatAssociation(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	err = krdb.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+
+	for _, g := range dat.Games {
+		for _, r := range g.Roms {
+			found, err := krdb.HasRomDatAssociation(r, sha1Bytes)
+			if err != nil {
+				t.Fatalf("failed to check rom association: %v", err)
+			}
+			if !found {
+				t.Fatalf("expected rom %s to be associated with test dat", r.Name)
+			}
+		}
+	}
+
+	otherSha1, err := hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+
+	found, err := krdb.HasRomDatAssociation(dat.Games[0].Roms[0], otherSha1)
+	if err != nil {
+		t.Fatalf("failed to check rom association: %v", err)
+	}
+	if found {
+		t.Fatalf("expected no association with unknown dat")
+	}
+
+	numDats := 0
+	err = krdb.ForEachDatWithSha1(func(datSha1 []byte, dat *types.Dat) error {
+		if hex.EncodeToString(datSha1) != hex.EncodeToString(sha1Bytes) {
+			t.Fatalf("unexpected dat sha1 %s", hex.EncodeToString(datSha1))
+		}
+		numDats++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to iterate dats: %v", err)
+	}
+	if numDats != 1 {
+		t.Fatalf("expected 1 dat, got %d", numDats)
+	}
+
+	numAssocs := 0
+	err = krdb.ForEachRomDatAssociation(func(rom *types.Rom, datSha1 []byte) error {
+		if hex.EncodeToString(datSha1) != hex.EncodeToString(sha1Bytes) {
+			t.Fatalf("unexpected association with dat %s", hex.EncodeToString(datSha1))
+		}
+		found, err := krdb.HasRomDatAssociation(rom, datSha1)
+		if err != nil {
+			t.Fatalf("failed to check rom association: %v", err)
+		}
+		if !found {
+			t.Fatalf("expected walked association with key %s to exist", db.RomsKey(rom))
+		}
+		numAssocs++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to iterate rom associations: %v", err)
+	}
+	if numAssocs != 5 {
+		t.Fatalf("expected 5 rom associations (1 sha1, 2 md5, 2 crc), got %d", numAssocs)
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	err = os.RemoveAll(dbDir)
+	if err != nil {
+		t.Fatalf("failed to remove test db dir %s: %v", dbDir, err)
+	}
+}
+
+func TestRefreshMultipleDirs(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	datsDir, err := ioutil.TempDir("", "rombadats")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test dats: %v", err)
+	}
+	defer os.RemoveAll(datsDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	goneText := strings.Replace(datText, "Applications", "Games", 1)
+	goneDat, goneSha1, err := parser.ParseDat(strings.NewReader(goneText), "testing/gone")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+	err = krdb.IndexDat(goneDat, goneSha1)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+
+	var datsPaths []string
+	var sha1s [][]byte
+	for i, name := range []string{"No-Intro", "Redump"} {
+		dir := filepath.Join(datsDir, name)
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", dir, err)
+		}
+
+		text := strings.Replace(datText, "Applications", name, 1)
+		err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("test%d.dat", i)), []byte(text), 0666)
+		if err != nil {
+			t.Fatalf("failed to write test dat: %v", err)
+		}
+
+		_, sha1Bytes, err := parser.ParseDat(strings.NewReader(text), "testing/dat")
+		if err != nil {
+			t.Fatalf("failed to parse test dat: %v", err)
+		}
+
+		datsPaths = append(datsPaths, dir)
+		sha1s = append(sha1s, sha1Bytes)
+	}
+
+	_, err = db.Refresh(krdb, datsPaths, 2, worker.NewProgressTracker(2), "", db.IndexAllHashes, "", nil, -1, nil)
+	if err != nil {
+		t.Fatalf("failed to refresh dats: %v", err)
+	}
+
+	for i, sha1Bytes := range sha1s {
+		dat, err := krdb.GetDat(sha1Bytes)
+		if err != nil {
+			t.Fatalf("failed to get dat: %v", err)
+		}
+		if dat == nil {
+			t.Fatalf("expected dat from %s to be indexed", datsPaths[i])
+		}
+		if dat.Generation != krdb.Generation() {
+			t.Fatalf("expected dat from %s not to be orphaned", datsPaths[i])
+		}
+	}
+
+	dat, err := krdb.GetDat(goneSha1)
+	if err != nil {
+		t.Fatalf("failed to get dat: %v", err)
+	}
+	if dat.Generation == krdb.Generation() {
+		t.Fatalf("expected dat missing from all dirs to be orphaned")
+	}
+}
+
+func TestRefreshMixedCaseExtensions(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	datsDir, err := ioutil.TempDir("", "rombadats")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test dats: %v", err)
+	}
+	defer os.RemoveAll(datsDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	var sha1s [][]byte
+	for i, name := range []string{"upper.DAT", "mixed.Dat", "skipped.txt"} {
+		text := strings.Replace(datText, "Applications", fmt.Sprintf("Applications %d", i), 1)
+		err = ioutil.WriteFile(filepath.Join(datsDir, name), []byte(text), 0666)
+		if err != nil {
+			t.Fatalf("failed to write test dat: %v", err)
+		}
+
+		_, sha1Bytes, err := parser.ParseDat(strings.NewReader(text), "testing/dat")
+		if err != nil {
+			t.Fatalf("failed to parse test dat: %v", err)
+		}
+		sha1s = append(sha1s, sha1Bytes)
+	}
+
+	_, err = db.Refresh(krdb, []string{datsDir}, 2, worker.NewProgressTracker(2), "", db.IndexAllHashes, "", nil, -1, nil)
+	if err != nil {
+		t.Fatalf("failed to refresh dats: %v", err)
+	}
+
+	for i, sha1Bytes := range sha1s {
+		dat, err := krdb.GetDat(sha1Bytes)
+		if err != nil {
+			t.Fatalf("failed to get dat: %v", err)
+		}
+		if i < 2 && dat == nil {
+			t.Fatalf("expected dat %d with uppercase extension to be indexed", i)
+		}
+		if i == 2 && dat != nil {
+			t.Fatalf("expected .txt file not to be indexed")
+		}
+	}
+}
+
+func TestRefreshReformattedDat(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	datsDir, err := ioutil.TempDir("", "rombadats")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test dats: %v", err)
+	}
+	defer os.RemoveAll(datsDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	datPath := filepath.Join(datsDir, "test.dat")
+	reformatted := strings.Replace(strings.Replace(datText, "\t", "    ", -1), "C0llector", "C0llector et al.", 1)
+
+	var sha1s [][]byte
+	var logicalSha1s [][]byte
+	for _, text := range []string{datText, reformatted} {
+		err = ioutil.WriteFile(datPath, []byte(text), 0666)
+		if err != nil {
+			t.Fatalf("failed to write test dat: %v", err)
+		}
+
+		dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(text), "testing/dat")
+		if err != nil {
+			t.Fatalf("failed to parse test dat: %v", err)
+		}
+		sha1s = append(sha1s, sha1Bytes)
+		logicalSha1s = append(logicalSha1s, dat.ComputeLogicalSha1())
+
+		_, err = db.Refresh(krdb, []string{datsDir}, 1, worker.NewProgressTracker(1), "", db.IndexAllHashes, "", nil, -1, nil)
+		if err != nil {
+			t.Fatalf("failed to refresh dats: %v", err)
+		}
+	}
+
+	if bytes.Equal(sha1s[0], sha1s[1]) {
+		t.Fatalf("expected reformatted dat to have a different sha1")
+	}
+	if !bytes.Equal(logicalSha1s[0], logicalSha1s[1]) {
+		t.Fatalf("expected reformatted dat to have the same logical sha1")
+	}
+
+	dat, err := krdb.GetDat(sha1s[1])
+	if err != nil {
+		t.Fatalf("failed to get dat: %v", err)
+	}
+	if dat == nil || !bytes.Equal(dat.LogicalSha1, logicalSha1s[1]) {
+		t.Fatalf("expected reformatted dat indexed with its logical sha1")
+	}
+
+	dat, err = krdb.GetDat(sha1s[0])
+	if err != nil {
+		t.Fatalf("failed to get dat: %v", err)
+	}
+	if dat != nil {
+		t.Fatalf("expected entry of the original dat to be dropped instead of orphaned")
+	}
+}
+
+// bulkTestDB indexes numDats DATs of romsPerDat roms each, every rom with its
+// own sha1, and returns the roms.
+func bulkTestDB(tb testing.TB, dbDir string, numDats, romsPerDat int) (db.RomDB, []*types.Rom) {
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		tb.Fatalf("failed to open db: %v", err)
+	}
+
+	var roms []*types.Rom
+	for d := 0; d < numDats; d++ {
+		dat := &types.Dat{
+			Name:        fmt.Sprintf("dat%d", d),
+			Description: fmt.Sprintf("dat%d", d),
+			Path:        fmt.Sprintf("testing/dat%d.dat", d),
+		}
+		for i := 0; i < romsPerDat; i++ {
+			rom := &types.Rom{
+				Name: fmt.Sprintf("rom%d.bin", i),
+				Size: int64(i + 1),
+			}
+			rom.Sha1, _ = hex.DecodeString(fmt.Sprintf("%08x%032x", d, i))
+			dat.Games = append(dat.Games, &types.Game{
+				Name: fmt.Sprintf("game%d", i),
+				Roms: types.RomSlice{rom},
+			})
+			roms = append(roms, &types.Rom{Sha1: rom.Sha1, Size: -1})
+		}
+
+		datSha1, _ := hex.DecodeString(fmt.Sprintf("%040x", d+1))
+		err = krdb.IndexDat(dat, datSha1)
+		if err != nil {
+			tb.Fatalf("failed to index dat: %v", err)
+		}
+	}
+	return krdb, roms
+}
+
+func TestDatsForRoms(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, roms := bulkTestDB(t, dbDir, 5, 20)
+	defer krdb.Close()
+
+	unknown := &types.Rom{Size: -1}
+	unknown.Sha1, _ = hex.DecodeString(strings.Repeat("ff", 20))
+	roms = append(roms, unknown, roms[0])
+
+	res, err := krdb.DatsForRoms(roms)
+	if err != nil {
+		t.Fatalf("failed to get dats for roms: %v", err)
+	}
+
+	if len(res) != len(roms)-1 {
+		t.Fatalf("expected an entry per distinct rom, got %d", len(res))
+	}
+
+	for _, rom := range roms {
+		dats, err := krdb.DatsForRom(rom)
+		if err != nil {
+			t.Fatalf("failed to get dats for rom: %v", err)
+		}
+
+		bulkDats, ok := res[db.RomsKey(rom)]
+		if !ok {
+			t.Fatalf("missing entry for %s", db.RomsKey(rom))
+		}
+		if len(bulkDats) != len(dats) {
+			t.Fatalf("expected %d dats for %s, got %d", len(dats), db.RomsKey(rom), len(bulkDats))
+		}
+		for i := range dats {
+			if !bulkDats[i].Equals(dats[i]) {
+				t.Fatalf("dat differs for %s", db.RomsKey(rom))
+			}
+		}
+	}
+}
+
+// 100k roms, one per DAT game
+const benchNumDats, benchRomsPerDat = 1000, 100
+
+func BenchmarkDatsForRom(b *testing.B) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		b.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, roms := bulkTestDB(b, dbDir, benchNumDats, benchRomsPerDat)
+	defer krdb.Close()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, rom := range roms {
+			_, err := krdb.DatsForRom(rom)
+			if err != nil {
+				b.Fatalf("failed to get dats for rom: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkDatsForRoms(b *testing.B) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		b.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, roms := bulkTestDB(b, dbDir, benchNumDats, benchRomsPerDat)
+	defer krdb.Close()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := krdb.DatsForRoms(roms)
+		if err != nil {
+			b.Fatalf("failed to get dats for roms: %v", err)
+		}
+	}
+}
+
+func romsOfSize(t *testing.T, krdb db.RomDB, size int64) string {
+	roms, err := krdb.RomsOfSize(size)
+	if err != nil {
+		t.Fatalf("failed to get roms of size %d: %v", size, err)
+	}
+
+	var sha1s []string
+	for _, rom := range roms {
+		if rom.Size != size {
+			t.Fatalf("expected size %d, got %d", size, rom.Size)
+		}
+		sha1s = append(sha1s, hex.EncodeToString(rom.Sha1))
+	}
+	return strings.Join(sha1s, ",")
+}
+
+func TestRomsOfSize(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	_, err = krdb.RomsOfSize(10)
+	if err != db.ErrNoSizeIndex {
+		t.Fatalf("expected ErrNoSizeIndex without size index, got %v", err)
+	}
+
+	const datText = `clrmamepro (
+	name "romsofsize"
+	description "romsofsize"
+)
+
+game (
+	name "game"
+	description "game"
+	rom ( name "a.bin" size 10 crc 0a1b2c3d sha1 1111111111111111111111111111111111111111 )
+	rom ( name "b.bin" size 10 md5 0123456789abcdef0123456789abcdef sha1 2222222222222222222222222222222222222222 )
+	rom ( name "c.bin" size 20 crc 0a1b2c3e sha1 3333333333333333333333333333333333333333 )
+	rom ( name "nosize.bin" crc 0a1b2c3f sha1 4444444444444444444444444444444444444444 )
+	rom ( name "sha1only.bin" size 10 sha1 6666666666666666666666666666666666666666 )
+)
+`
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/romsofsize.dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	err = krdb.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	// reopening with the size index builds it from the existing mappings
+	db.SetSizeIndex(true)
+	defer db.SetSizeIndex(false)
+
+	krdb, err = db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to reopen db: %v", err)
+	}
+
+	archived := &types.Rom{Name: "archived.bin", Size: 20}
+	archived.Sha1, _ = hex.DecodeString("0000000000000000000000000000000000000005")
+	archived.Crc, _ = hex.DecodeString("01020304")
+	err = krdb.IndexRom(archived)
+	if err != nil {
+		t.Fatalf("failed to index rom: %v", err)
+	}
+
+	expected := map[int64]string{
+		10: "1111111111111111111111111111111111111111,2222222222222222222222222222222222222222," +
+			"6666666666666666666666666666666666666666",
+		20: "0000000000000000000000000000000000000005,3333333333333333333333333333333333333333",
+		0:  "",
+		30: "",
+	}
+	for size, want := range expected {
+		if got := romsOfSize(t, krdb, size); got != want {
+			t.Fatalf("roms of size %d: got %s, expected %s", size, got, want)
+		}
+	}
+
+	err = krdb.DeleteRom(archived)
+	if err != nil {
+		t.Fatalf("failed to delete rom: %v", err)
+	}
+	if got := romsOfSize(t, krdb, 20); got != "3333333333333333333333333333333333333333" {
+		t.Fatalf("roms of size 20 after delete: got %s", got)
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	// roms indexed with the size index off are picked up once it is back on
+	db.SetSizeIndex(false)
+	krdb, err = db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to reopen db: %v", err)
+	}
+
+	unindexed := &types.Rom{Name: "unindexed.bin", Size: 30}
+	unindexed.Sha1, _ = hex.DecodeString("0000000000000000000000000000000000000007")
+	unindexed.Crc, _ = hex.DecodeString("01020305")
+	err = krdb.IndexRom(unindexed)
+	if err != nil {
+		t.Fatalf("failed to index rom: %v", err)
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	db.SetSizeIndex(true)
+	krdb, err = db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to reopen db: %v", err)
+	}
+	defer krdb.Close()
+
+	if got := romsOfSize(t, krdb, 30); got != "0000000000000000000000000000000000000007" {
+		t.Fatalf("roms of size 30 after rebuild: got %s", got)
+	}
+	if got := romsOfSize(t, krdb, 20); got != "3333333333333333333333333333333333333333" {
+		t.Fatalf("roms of size 20 after rebuild: got %s", got)
+	}
+
+	// a rom still in a DAT stays in the size index when its mappings are deleted
+	inDat := &types.Rom{Name: "c.bin", Size: 20}
+	inDat.Sha1, _ = hex.DecodeString("3333333333333333333333333333333333333333")
+	inDat.Crc, _ = hex.DecodeString("0a1b2c3e")
+	err = krdb.DeleteRom(inDat)
+	if err != nil {
+		t.Fatalf("failed to delete rom: %v", err)
+	}
+	if got := romsOfSize(t, krdb, 20); got != "3333333333333333333333333333333333333333" {
+		t.Fatalf("roms of size 20 after deleting a rom of a dat: got %s", got)
+	}
+
+	// a refresh that doesn't find the DAT anymore drops its roms, except those
+	// still known by their crc or md5 mappings
+	datsDir := filepath.Join(dbDir, "nodats")
+	err = os.MkdirAll(datsDir, 0777)
+	if err != nil {
+		t.Fatalf("failed to create dats dir: %v", err)
+	}
+	_, err = db.Refresh(krdb, []string{datsDir}, 1, worker.NewProgressTracker(1), "", db.IndexAllHashes, "", nil, -1, nil)
+	if err != nil {
+		t.Fatalf("failed to refresh dats: %v", err)
+	}
+
+	expected = map[int64]string{
+		10: "1111111111111111111111111111111111111111,2222222222222222222222222222222222222222",
+		20: "",
+		30: "0000000000000000000000000000000000000007",
+	}
+	for size, want := range expected {
+		if got := romsOfSize(t, krdb, size); got != want {
+			t.Fatalf("roms of size %d after refresh: got %s, expected %s", size, got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// Transcoder converts a string that is not valid UTF-8 from some source encoding to UTF-8.
+type Transcoder func(s string) string
+
+// ParseSourceEncoding returns the transcoder for the named source encoding.
+// An empty name means no transcoding and returns a nil Transcoder.
+func ParseSourceEncoding(name string) (Transcoder, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "":
+		return nil, nil
+	case "latin1", "latin-1", "iso-8859-1", "iso8859-1":
+		return latin1ToUTF8, nil
+	}
+	return nil, fmt.Errorf("unsupported source encoding %s, only latin1 can be transcoded", name)
+}
+
+func latin1ToUTF8(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) * 2)
+
+	for i := 0; i < len(s); i++ {
+		sb.WriteRune(rune(s[i]))
+	}
+	return sb.String()
+}
+
+// checkDatEncoding counts the names and descriptions in dat that are not valid UTF-8.
+// If transcode is not nil, those strings are replaced by their transcoded version.
+func checkDatEncoding(dat *types.Dat, transcode Transcoder) int {
+	numInvalid := 0
+
+	check := func(s *string) {
+		if utf8.ValidString(*s) {
+			return
+		}
+		numInvalid++
+		if transcode != nil {
+			*s = transcode(*s)
+		}
+	}
+
+	check(&dat.Name)
+	check(&dat.Description)
+
+	for _, g := range dat.Games {
+		check(&g.Name)
+		check(&g.Description)
+
+		for _, r := range g.Roms {
+			check(&r.Name)
+		}
+	}
+	return numInvalid
+}
@@ -38,7 +38,11 @@ import (
 	"encoding/hex"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/uwedeportivo/romba/combine"
 
@@ -55,8 +59,27 @@ const (
 	sha1DBName    = "sha1_db"
 	crcsha1DBName = "crcsha1_db"
 	md5sha1DBName = "md5sha1_db"
+	zipsDBName    = "zips_db"
+	logicalDBName = "logical_db"
+	sourcesDBName = "sources_db"
+	namesDBName   = "names_db"
+	sizesDBName   = "sizes_db"
+
+	// sizesCompleteFilename marks a size index holding every rom of the DB. It
+	// goes away whenever the DB is opened without the size index.
+	sizesCompleteFilename = "sizes_db_complete"
 )
 
+// indexSizes turns on the index of rom sha1s by size, see SetSizeIndex.
+var indexSizes bool
+
+// SetSizeIndex turns the index of rom sha1s by size on or off for DBs opened
+// afterwards. Turning it on for an existing DB, or back on after the DB was
+// opened without it, builds the index when the DB is opened.
+func SetSizeIndex(enabled bool) {
+	indexSizes = enabled
+}
+
 var oneValue []byte
 
 func init() {
@@ -69,6 +92,9 @@ type KVStore interface {
 	Delete(key []byte) error
 	Get(key []byte) ([]byte, error)
 	GetKeySuffixesFor(keyPrefix []byte) ([]byte, error)
+	// GetKeySuffixesForMany is GetKeySuffixesFor for several prefixes sharing
+	// one iterator. Prefixes should be sorted for best performance.
+	GetKeySuffixesForMany(keyPrefixes [][]byte) ([][]byte, error)
 	Exists(key []byte) (bool, error)
 	Flush()
 	Size() int64
@@ -97,6 +123,11 @@ type kvStore struct {
 	sha1DB     KVStore
 	crcsha1DB  KVStore
 	md5sha1DB  KVStore
+	zipsDB     KVStore
+	logicalDB  KVStore
+	sourcesDB  KVStore
+	namesDB    KVStore
+	sizesDB    KVStore // nil without the size index
 	path       string
 }
 
@@ -108,7 +139,11 @@ type kvBatch struct {
 	sha1Batch    KVBatch
 	crcsha1Batch KVBatch
 	md5sha1Batch KVBatch
+	sourcesBatch KVBatch
+	sizesBatch   KVBatch
+	logicalBatch KVBatch
 	size         int64
+	hashes       IndexHashes
 }
 
 func openDb(pathPrefix string, keySize int) (KVStore, error) {
@@ -168,9 +203,224 @@ func NewKVStoreDB(path string) (RomDB, error) {
 	}
 	kvdb.md5sha1DB = db
 
+	glog.Infof("Loading Zips DB")
+	db, err = openDb(filepath.Join(path, zipsDBName), sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+	kvdb.zipsDB = db
+
+	glog.Infof("Loading Logical DAT SHA1 DB")
+	db, err = openDb(filepath.Join(path, logicalDBName), sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+	kvdb.logicalDB = db
+
+	glog.Infof("Loading Import Sources DB")
+	db, err = openDb(filepath.Join(path, sourcesDBName), 2*sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+	kvdb.sourcesDB = db
+
+	glog.Infof("Loading Ingested Names DB")
+	db, err = openDb(filepath.Join(path, namesDBName), 2*sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+	kvdb.namesDB = db
+
+	if indexSizes {
+		glog.Infof("Loading Sizes DB")
+		db, err = openDb(filepath.Join(path, sizesDBName), 8+sha1.Size)
+		if err != nil {
+			return nil, err
+		}
+		kvdb.sizesDB = db
+
+		err = kvdb.buildSizeIndex()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// roms indexed from now on are missing from the size index
+		err = os.Remove(filepath.Join(path, sizesCompleteFilename))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
 	return kvdb, nil
 }
 
+func romSizeKey(size int64, sha1Bytes []byte) []byte {
+	key := make([]byte, 8+sha1.Size)
+	util.Int64ToBytes(size, key)
+	copy(key[8:], sha1Bytes)
+	return key
+}
+
+// buildSizeIndex rebuilds the size index unless it is marked complete. The
+// roms of the DATs of the current generation and the crc and md5 mappings of
+// archived roms, which carry the size of every sha1 they map to, make up the
+// same roms IndexDat and IndexRom add to the index.
+func (kvdb *kvStore) buildSizeIndex() error {
+	completePath := filepath.Join(kvdb.path, sizesCompleteFilename)
+	_, err := os.Stat(completePath)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	glog.Infof("Building Sizes DB")
+
+	batch := kvdb.sizesDB.StartBatch()
+	var batchSize int
+
+	addToBatch := func(err error) error {
+		if err != nil {
+			return err
+		}
+		batchSize += 8 + sha1.Size
+		if batchSize >= MaxBatchSize {
+			err = kvdb.sizesDB.WriteBatch(batch)
+			if err != nil {
+				return err
+			}
+			batch.Clear()
+			batchSize = 0
+		}
+		return nil
+	}
+
+	err = kvdb.sizesDB.Iterate(func(key, value []byte) (bool, error) {
+		err := addToBatch(batch.Delete(key))
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	declare := func(size int64, sha1Bytes []byte) error {
+		if size <= 0 || sha1Bytes == nil {
+			return nil
+		}
+		return addToBatch(batch.Set(romSizeKey(size, sha1Bytes), oneValue))
+	}
+
+	err = kvdb.datsDB.Iterate(func(key, value []byte) (bool, error) {
+		var dat types.Dat
+		err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&dat)
+		if err != nil || dat.Generation != kvdb.generation {
+			return err == nil, err
+		}
+
+		_, err = decodeDatGames(value, func(game *types.Game) error {
+			for _, r := range game.Roms {
+				err := declare(r.Size, r.Sha1)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.crcsha1DB.Iterate(func(key, value []byte) (bool, error) {
+		err := declare(util.BytesToInt64(key[crc32.Size:crc32.Size+8]), key[crc32.Size+8:])
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.md5sha1DB.Iterate(func(key, value []byte) (bool, error) {
+		err := declare(util.BytesToInt64(key[md5.Size:md5.Size+8]), key[md5.Size+8:])
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.sizesDB.WriteBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(completePath)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// RomsOfSize returns the roms of the given size, with only their sha1 and size
+// set, in sha1 order. It fails if the DB was opened without the size index.
+func (kvdb *kvStore) RomsOfSize(size int64) ([]*types.Rom, error) {
+	if kvdb.sizesDB == nil {
+		return nil, ErrNoSizeIndex
+	}
+
+	sizeKey := make([]byte, 8)
+	util.Int64ToBytes(size, sizeKey)
+
+	suffixes, err := kvdb.sizesDB.GetKeySuffixesFor(sizeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var roms []*types.Rom
+	for i := 0; i+sha1.Size <= len(suffixes); i += sha1.Size {
+		rom := new(types.Rom)
+		rom.Sha1 = make([]byte, sha1.Size)
+		copy(rom.Sha1, suffixes[i:i+sha1.Size])
+		rom.Size = size
+		roms = append(roms, rom)
+	}
+	return roms, nil
+}
+
+// IndexedSize returns the size the crc -> sha1 or md5 -> sha1 mappings of the
+// index record for the sha1 of rom, looked up by the crc and md5 of rom. It
+// returns -1 if neither mapping has the sha1.
+func (kvdb *kvStore) IndexedSize(rom *types.Rom) (int64, error) {
+	if len(rom.Sha1) != sha1.Size {
+		return -1, nil
+	}
+
+	lookups := []struct {
+		store KVStore
+		hash  []byte
+		size  int
+	}{
+		{kvdb.crcsha1DB, rom.Crc, crc32.Size},
+		{kvdb.md5sha1DB, rom.Md5, md5.Size},
+	}
+
+	for _, l := range lookups {
+		if len(l.hash) != l.size {
+			continue
+		}
+
+		// suffixes are the sizes and sha1s the hash maps to
+		suffixes, err := l.store.GetKeySuffixesFor(l.hash)
+		if err != nil {
+			return -1, err
+		}
+
+		for i := 0; i+8+sha1.Size <= len(suffixes); i += 8 + sha1.Size {
+			if bytes.Equal(suffixes[i+8:i+8+sha1.Size], rom.Sha1) {
+				return util.BytesToInt64(suffixes[i : i+8]), nil
+			}
+		}
+	}
+	return -1, nil
+}
+
 func init() {
 	Factory = NewKVStoreDB
 }
@@ -184,6 +434,117 @@ func (kvdb *kvStore) IndexRom(rom *types.Rom) error {
 	return batch.Close()
 }
 
+// DeleteRom removes the crc -> sha1 and md5 -> sha1 mappings declared for rom
+// and, unless a DAT of the current generation still has it, its entry in the
+// size index. Associations of the rom sha1 with DATs are left alone since they
+// come from the DATs.
+func (kvdb *kvStore) DeleteRom(rom *types.Rom) error {
+	if rom.Sha1 == nil {
+		return fmt.Errorf("cannot delete rom %s from index because SHA1 is missing", rom.Name)
+	}
+
+	if rom.Crc != nil {
+		glog.V(4).Infof("deleting crc %s -> sha1 %s mapping", hex.EncodeToString(rom.Crc), hex.EncodeToString(rom.Sha1))
+		err := kvdb.crcsha1DB.Delete(rom.CrcWithSizeAndSha1Key(nil))
+		if err != nil {
+			return err
+		}
+	}
+	if rom.Md5 != nil {
+		glog.V(4).Infof("deleting md5 %s -> sha1 %s mapping", hex.EncodeToString(rom.Md5), hex.EncodeToString(rom.Sha1))
+		err := kvdb.md5sha1DB.Delete(rom.Md5WithSizeAndSha1Key(nil))
+		if err != nil {
+			return err
+		}
+	}
+	if kvdb.sizesDB != nil && rom.Size > 0 {
+		referenced, err := kvdb.IsRomReferencedByDats(&types.Rom{Sha1: rom.Sha1})
+		if err != nil {
+			return err
+		}
+		if !referenced {
+			err = kvdb.sizesDB.Delete(romSizeKey(rom.Size, rom.Sha1))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// IndexZip records the external sha1 of a zip file whose contents got archived.
+func (kvdb *kvStore) IndexZip(sha1Bytes []byte) error {
+	return kvdb.zipsDB.Set(sha1Bytes, oneValue)
+}
+
+// IsZipSeen reports whether a zip file with the given external sha1 was recorded by IndexZip.
+func (kvdb *kvStore) IsZipSeen(sha1Bytes []byte) (bool, error) {
+	return kvdb.zipsDB.Exists(sha1Bytes)
+}
+
+// RomSources returns the source labels the rom with the given sha1 was imported
+// with, one for each imported DAT that had the rom and a label.
+func (kvdb *kvStore) RomSources(sha1Bytes []byte) ([]string, error) {
+	suffixes, err := kvdb.sourcesDB.GetKeySuffixesFor(sha1Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []string
+	seen := make(map[string]bool)
+	key := make([]byte, 2*sha1.Size)
+	copy(key, sha1Bytes)
+
+	for i := 0; i+sha1.Size <= len(suffixes); i += sha1.Size {
+		copy(key[sha1.Size:], suffixes[i:i+sha1.Size])
+		v, err := kvdb.sourcesDB.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil && !seen[string(v)] {
+			seen[string(v)] = true
+			sources = append(sources, string(v))
+		}
+	}
+	return sources, nil
+}
+
+// IndexRomName records that the rom with the given sha1 was ingested from path.
+// Names are only ever added, so a rom keeps every path it was ingested from.
+func (kvdb *kvStore) IndexRomName(sha1Bytes []byte, path string) error {
+	pathSha1 := sha1.Sum([]byte(path))
+
+	key := make([]byte, 2*sha1.Size)
+	copy(key, sha1Bytes)
+	copy(key[sha1.Size:], pathSha1[:])
+
+	return kvdb.namesDB.Set(key, []byte(path))
+}
+
+// RomNames returns the paths recorded by IndexRomName for the rom with the given sha1.
+func (kvdb *kvStore) RomNames(sha1Bytes []byte) ([]string, error) {
+	suffixes, err := kvdb.namesDB.GetKeySuffixesFor(sha1Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	key := make([]byte, 2*sha1.Size)
+	copy(key, sha1Bytes)
+
+	for i := 0; i+sha1.Size <= len(suffixes); i += sha1.Size {
+		copy(key[sha1.Size:], suffixes[i:i+sha1.Size])
+		v, err := kvdb.namesDB.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			names = append(names, string(v))
+		}
+	}
+	return names, nil
+}
+
 func (kvdb *kvStore) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 	batch := kvdb.StartBatch()
 	err := batch.IndexDat(dat, sha1Bytes)
@@ -206,12 +567,47 @@ func (kvdb *kvStore) Generation() int64 {
 	return kvdb.generation
 }
 
-func decodeDat(dBytes []byte) (*types.Dat, error) {
-	if dBytes == nil {
-		return nil, nil
+// SetGeneration overwrites the generation counter, in memory and in the
+// generation file. DATs indexed in an older generation count as orphaned.
+func (kvdb *kvStore) SetGeneration(gen int64) error {
+	err := WriteGenerationFile(kvdb.path, gen)
+	if err != nil {
+		return err
 	}
-	buf := bytes.NewBuffer(dBytes)
-	datDecoder := gob.NewDecoder(buf)
+	kvdb.generation = gen
+	return nil
+}
+
+// encodeDat encodes the DAT header followed by one gob value per game, so the
+// games of huge DATs can be decoded one at a time.
+func encodeDat(dat *types.Dat) ([]byte, error) {
+	var buf bytes.Buffer
+
+	gobEncoder := gob.NewEncoder(&buf)
+
+	hdr := *dat
+	hdr.Games = nil
+
+	err := gobEncoder.Encode(&hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range dat.Games {
+		err = gobEncoder.Encode(g)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeDatGames decodes the DAT header and passes the games to gameF as they
+// are decoded. DATs stored by older versions are a single gob value with the
+// games as part of the header, those games are passed on after the header is
+// decoded and nothing else is read.
+func decodeDatGames(dBytes []byte, gameF func(game *types.Game) error) (*types.Dat, error) {
+	datDecoder := gob.NewDecoder(bytes.NewBuffer(dBytes))
 
 	var dat types.Dat
 
@@ -219,9 +615,56 @@ func decodeDat(dBytes []byte) (*types.Dat, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	if len(dat.Games) > 0 {
+		games := dat.Games
+		dat.Games = nil
+
+		for _, g := range games {
+			err = gameF(g)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &dat, nil
+	}
+
+	for {
+		g := new(types.Game)
+		err = datDecoder.Decode(g)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = gameF(g)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &dat, nil
 }
 
+func decodeDat(dBytes []byte) (*types.Dat, error) {
+	if dBytes == nil {
+		return nil, nil
+	}
+
+	var games types.GameSlice
+
+	dat, err := decodeDatGames(dBytes, func(game *types.Game) error {
+		games = append(games, game)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	dat.Games = games
+	return dat, nil
+}
+
 func (kvdb *kvStore) GetDat(sha1Bytes []byte) (*types.Dat, error) {
 	dBytes, err := kvdb.datsDB.Get(sha1Bytes)
 	if err != nil {
@@ -230,35 +673,57 @@ func (kvdb *kvStore) GetDat(sha1Bytes []byte) (*types.Dat, error) {
 	return decodeDat(dBytes)
 }
 
-func (kvdb *kvStore) IsRomReferencedByDats(rom *types.Rom) (bool, error) {
-	var dBytes []byte
+// GetDatWithRoms returns the DAT with the given sha1 with all its games and roms,
+// the same as GetDat does. The whole DAT is decoded into memory, which takes a
+// few hundred bytes per rom; use ForEachDatGame to walk huge DATs instead.
+// Returns nil if no DAT with that sha1 is indexed.
+func (kvdb *kvStore) GetDatWithRoms(sha1Bytes []byte) (*types.Dat, error) {
+	return kvdb.GetDat(sha1Bytes)
+}
 
-	if len(rom.Sha1) == sha1.Size {
-		bs, err := kvdb.sha1DB.GetKeySuffixesFor(rom.Sha1)
-		if err != nil {
-			return false, err
-		}
-		if bs != nil {
-			dBytes = append(dBytes, bs...)
-		}
+// ForEachDatGame passes the games of the DAT with the given sha1 to gameF one at a
+// time and returns the DAT header without games. Only the encoded DAT and the
+// current game are held in memory. Returns nil if no DAT with that sha1 is indexed.
+func (kvdb *kvStore) ForEachDatGame(sha1Bytes []byte, gameF func(game *types.Game) error) (*types.Dat, error) {
+	dBytes, err := kvdb.datsDB.Get(sha1Bytes)
+	if err != nil || dBytes == nil {
+		return nil, err
 	}
-	if len(rom.Md5) == md5.Size && rom.Size > 0 {
-		bs, err := kvdb.md5DB.GetKeySuffixesFor(rom.Md5WithSizeKey())
-		if err != nil {
-			return false, err
-		}
-		if bs != nil {
-			dBytes = append(dBytes, bs...)
-		}
+	return decodeDatGames(dBytes, gameF)
+}
+
+// UpdateDatHeader replaces the stored name and description of the DAT with the given sha1.
+// Empty values leave the corresponding field unchanged. Rom associations are not touched.
+// Returns nil if no DAT with that sha1 is indexed.
+func (kvdb *kvStore) UpdateDatHeader(sha1Bytes []byte, name, description string) (*types.Dat, error) {
+	dat, err := kvdb.GetDat(sha1Bytes)
+	if err != nil || dat == nil {
+		return nil, err
 	}
-	if len(rom.Crc) == crc32.Size && rom.Size > 0 {
-		bs, err := kvdb.crcDB.GetKeySuffixesFor(rom.CrcWithSizeKey())
-		if err != nil {
-			return false, err
-		}
-		if bs != nil {
-			dBytes = append(dBytes, bs...)
-		}
+
+	if name != "" {
+		dat.Name = name
+	}
+	if description != "" {
+		dat.Description = description
+	}
+
+	dBytes, err := encodeDat(dat)
+	if err != nil {
+		return nil, err
+	}
+
+	err = kvdb.datsDB.Set(sha1Bytes, dBytes)
+	if err != nil {
+		return nil, err
+	}
+	return dat, nil
+}
+
+func (kvdb *kvStore) IsRomReferencedByDats(rom *types.Rom) (bool, error) {
+	dBytes, err := kvdb.datSha1sForRom(rom)
+	if err != nil {
+		return false, err
 	}
 
 	if dBytes == nil {
@@ -282,13 +747,15 @@ func (kvdb *kvStore) IsRomReferencedByDats(rom *types.Rom) (bool, error) {
 	return false, nil
 }
 
-func (kvdb *kvStore) FilteredDatsForRom(rom *types.Rom, filter func(*types.Dat) bool) ([]*types.Dat, []*types.Dat, error) {
+// datSha1sForRom returns the concatenated sha1s of the DATs indexed for any of
+// the hashes of rom, possibly with repeats.
+func (kvdb *kvStore) datSha1sForRom(rom *types.Rom) ([]byte, error) {
 	var dBytes []byte
 
 	if len(rom.Sha1) == sha1.Size {
 		bs, err := kvdb.sha1DB.GetKeySuffixesFor(rom.Sha1)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		if bs != nil {
 			dBytes = append(dBytes, bs...)
@@ -297,7 +764,7 @@ func (kvdb *kvStore) FilteredDatsForRom(rom *types.Rom, filter func(*types.Dat)
 	if len(rom.Md5) == md5.Size && rom.Size > 0 {
 		bs, err := kvdb.md5DB.GetKeySuffixesFor(rom.Md5WithSizeKey())
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		if bs != nil {
 			dBytes = append(dBytes, bs...)
@@ -306,12 +773,20 @@ func (kvdb *kvStore) FilteredDatsForRom(rom *types.Rom, filter func(*types.Dat)
 	if len(rom.Crc) == crc32.Size && rom.Size > 0 {
 		bs, err := kvdb.crcDB.GetKeySuffixesFor(rom.CrcWithSizeKey())
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		if bs != nil {
 			dBytes = append(dBytes, bs...)
 		}
 	}
+	return dBytes, nil
+}
+
+func (kvdb *kvStore) FilteredDatsForRom(rom *types.Rom, filter func(*types.Dat) bool) ([]*types.Dat, []*types.Dat, error) {
+	dBytes, err := kvdb.datSha1sForRom(rom)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	if dBytes == nil {
 		return nil, nil, nil
@@ -353,6 +828,102 @@ func (kvdb *kvStore) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
 	return dats, err
 }
 
+// RomsKey is the key of rom in the result of DatsForRoms: the hex encoding of
+// its sha1, or of its md5 or crc if it has no sha1.
+func RomsKey(rom *types.Rom) string {
+	switch {
+	case rom.Sha1 != nil:
+		return hex.EncodeToString(rom.Sha1)
+	case rom.Md5 != nil:
+		return hex.EncodeToString(rom.Md5)
+	}
+	return hex.EncodeToString(rom.Crc)
+}
+
+// DatsForRoms is DatsForRom for many roms at once. The roms are looked up in
+// the order of their keys, so that the index is read sequentially, and every
+// DAT is read and decoded only once no matter how many of the roms it has.
+// Every rom gets an entry, nil if no current DAT has it.
+func (kvdb *kvStore) DatsForRoms(roms []*types.Rom) (map[string][]*types.Dat, error) {
+	type keyedRom struct {
+		key string
+		rom *types.Rom
+	}
+
+	sorted := make([]keyedRom, 0, len(roms))
+	for _, rom := range roms {
+		sorted = append(sorted, keyedRom{RomsKey(rom), rom})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].key < sorted[j].key
+	})
+
+	var sha1Prefixes [][]byte
+	for _, kr := range sorted {
+		if len(kr.rom.Sha1) == sha1.Size {
+			sha1Prefixes = append(sha1Prefixes, kr.rom.Sha1)
+		}
+	}
+
+	sha1Suffixes, err := kvdb.sha1DB.GetKeySuffixesForMany(sha1Prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	datsBySha1 := make(map[string]*types.Dat)
+	res := make(map[string][]*types.Dat, len(roms))
+
+	for _, kr := range sorted {
+		key := kr.key
+
+		var dBytes []byte
+		if len(kr.rom.Sha1) == sha1.Size {
+			dBytes = sha1Suffixes[0]
+			sha1Suffixes = sha1Suffixes[1:]
+		}
+
+		if _, done := res[key]; done {
+			continue
+		}
+
+		// the sha1 part of the index was read above, only md5 and crc remain
+		rest := *kr.rom
+		rest.Sha1 = nil
+		bs, err := kvdb.datSha1sForRom(&rest)
+		if err != nil {
+			return nil, err
+		}
+		dBytes = append(dBytes, bs...)
+
+		var dats []*types.Dat
+		seen := make(map[string]bool)
+
+		for i := 0; i < len(dBytes); i += sha1.Size {
+			sha1Key := string(dBytes[i : i+sha1.Size])
+
+			if seen[sha1Key] {
+				continue
+			}
+			seen[sha1Key] = true
+
+			dat, cached := datsBySha1[sha1Key]
+			if !cached {
+				dat, err = kvdb.GetDat([]byte(sha1Key))
+				if err != nil {
+					return nil, err
+				}
+				datsBySha1[sha1Key] = dat
+			}
+
+			if dat != nil && dat.Generation == kvdb.Generation() {
+				dats = append(dats, dat)
+			}
+		}
+		res[key] = dats
+	}
+	return res, nil
+}
+
 // CompleteRom completes the rom by adding missing hashes. If there are
 // additional roms that collide with the provided crc or md5, then these
 // additional roms are returned in the rom slice.
@@ -398,19 +969,113 @@ func (kvdb *kvStore) CompleteRom(rom *types.Rom) ([]*types.Rom, error) {
 		if len(dBytes) == sha1.Size {
 			return nil, nil
 		}
-		var croms []*types.Rom
-		for rb := dBytes[sha1.Size:]; len(rb) >= sha1.Size; rb = rb[sha1.Size:] {
-			croms = append(croms, &types.Rom{
-				Sha1: rb[:sha1.Size],
-				Md5:  rom.Md5,
-				Crc:  rom.Crc,
-				Name: rom.Name,
-				Size: rom.Size,
-			})
+		var croms []*types.Rom
+		for rb := dBytes[sha1.Size:]; len(rb) >= sha1.Size; rb = rb[sha1.Size:] {
+			croms = append(croms, &types.Rom{
+				Sha1: rb[:sha1.Size],
+				Md5:  rom.Md5,
+				Crc:  rom.Crc,
+				Name: rom.Name,
+				Size: rom.Size,
+			})
+		}
+		return croms, nil
+	}
+	return nil, nil
+}
+
+type namedStore struct {
+	name    string
+	store   KVStore
+	keySize int
+}
+
+// namedStores returns the stores of the index with the names of their dirs.
+func (kvdb *kvStore) namedStores() []namedStore {
+	stores := []namedStore{
+		{datsDBName, kvdb.datsDB, sha1.Size},
+		{crcDBName, kvdb.crcDB, crc32.Size + sha1.Size + 8},
+		{md5DBName, kvdb.md5DB, md5.Size + sha1.Size + 8},
+		{sha1DBName, kvdb.sha1DB, sha1.Size},
+		{crcsha1DBName, kvdb.crcsha1DB, crc32.Size + sha1.Size + 8},
+		{md5sha1DBName, kvdb.md5sha1DB, md5.Size + sha1.Size + 8},
+		{zipsDBName, kvdb.zipsDB, sha1.Size},
+		{logicalDBName, kvdb.logicalDB, sha1.Size},
+		{sourcesDBName, kvdb.sourcesDB, 2 * sha1.Size},
+		{namesDBName, kvdb.namesDB, 2 * sha1.Size},
+	}
+	if kvdb.sizesDB != nil {
+		stores = append(stores, namedStore{sizesDBName, kvdb.sizesDB, 8 + sha1.Size})
+	}
+	return stores
+}
+
+// Snapshot writes a copy of the index into dir. Every store is copied key by key
+// into a new store of the same name under dir, and the generation file is written
+// last, so a snapshot without one is incomplete. The copy is only consistent if
+// nothing writes to the index while it runs.
+func (kvdb *kvStore) Snapshot(dir string) error {
+	_, err := os.Stat(filepath.Join(dir, generationFilename))
+	if err == nil {
+		return fmt.Errorf("%s already holds an index", dir)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	kvdb.Flush()
+
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range kvdb.namedStores() {
+		glog.Infof("snapshotting %s", s.name)
+		err = copyStore(s.store, filepath.Join(dir, s.name), s.keySize)
+		if err != nil {
+			return err
+		}
+	}
+
+	return WriteGenerationFile(dir, kvdb.Generation())
+}
+
+// copyStore copies all entries of src into a new store at pathPrefix.
+func copyStore(src KVStore, pathPrefix string, keySize int) error {
+	dst, err := openDb(pathPrefix, keySize)
+	if err != nil {
+		return err
+	}
+
+	batch := dst.StartBatch()
+	var size int
+
+	err = src.Iterate(func(key, value []byte) (bool, error) {
+		err := batch.Set(key, value)
+		if err != nil {
+			return false, err
+		}
+		size += len(key) + len(value)
+		if size >= MaxBatchSize {
+			err = dst.WriteBatch(batch)
+			if err != nil {
+				return false, err
+			}
+			batch.Clear()
+			size = 0
 		}
-		return croms, nil
+		return true, nil
+	})
+	if err == nil {
+		err = dst.WriteBatch(batch)
 	}
-	return nil, nil
+
+	cerr := dst.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
 }
 
 func (kvdb *kvStore) Flush() {
@@ -420,6 +1085,13 @@ func (kvdb *kvStore) Flush() {
 	kvdb.sha1DB.Flush()
 	kvdb.crcsha1DB.Flush()
 	kvdb.md5sha1DB.Flush()
+	kvdb.zipsDB.Flush()
+	kvdb.logicalDB.Flush()
+	kvdb.sourcesDB.Flush()
+	kvdb.namesDB.Flush()
+	if kvdb.sizesDB != nil {
+		kvdb.sizesDB.Flush()
+	}
 }
 
 func (kvdb *kvStore) Close() error {
@@ -454,6 +1126,30 @@ func (kvdb *kvStore) Close() error {
 	if err != nil {
 		return err
 	}
+
+	err = kvdb.zipsDB.Close()
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.logicalDB.Close()
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.sourcesDB.Close()
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.namesDB.Close()
+	if err != nil {
+		return err
+	}
+
+	if kvdb.sizesDB != nil {
+		return kvdb.sizesDB.Close()
+	}
 	return nil
 }
 
@@ -470,16 +1166,106 @@ func (kvdb *kvStore) PrintStats() string {
 	fmt.Fprintf(buf, "sha1DB stats: %s\n", kvdb.sha1DB.PrintStats())
 	fmt.Fprintf(buf, "crcsha1DB stats: %s\n", kvdb.crcsha1DB.PrintStats())
 	fmt.Fprintf(buf, "md5sha1DB stats: %s\n", kvdb.md5sha1DB.PrintStats())
+	fmt.Fprintf(buf, "zipsDB stats: %s\n", kvdb.zipsDB.PrintStats())
+	fmt.Fprintf(buf, "logicalDB stats: %s\n", kvdb.logicalDB.PrintStats())
+	fmt.Fprintf(buf, "sourcesDB stats: %s\n", kvdb.sourcesDB.PrintStats())
+	fmt.Fprintf(buf, "namesDB stats: %s\n", kvdb.namesDB.PrintStats())
+	if kvdb.sizesDB != nil {
+		fmt.Fprintf(buf, "sizesDB stats: %s\n", kvdb.sizesDB.PrintStats())
+	}
 
 	return buf.String()
 }
 
+// EndDatRefresh finishes a refresh. The size index is rebuilt, so that roms only
+// found in DATs that are gone or orphaned by the refresh leave it.
+// Stats counts the DATs of the index and sums up the sizes of the files of its
+// stores. Only the headers of the DATs are decoded.
+func (kvdb *kvStore) Stats() (*Stats, error) {
+	st := &Stats{
+		Generation: kvdb.generation,
+		SizeIndex:  kvdb.sizesDB != nil,
+	}
+
+	err := kvdb.datsDB.Iterate(func(key, value []byte) (bool, error) {
+		var dat types.Dat
+		err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&dat)
+		if err != nil {
+			return false, err
+		}
+
+		st.NumDats++
+		if dat.Generation != kvdb.generation {
+			st.NumOrphanDats++
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range kvdb.namedStores() {
+		size, err := dirSize(filepath.Join(kvdb.path, s.name))
+		if err != nil {
+			return nil, err
+		}
+
+		st.Stores = append(st.Stores, &StoreStats{
+			Name:     s.name,
+			DiskSize: size,
+		})
+		st.DiskSize += size
+	}
+	return st, nil
+}
+
+// dirSize returns the size of the regular files below dir, 0 if it doesn't exist.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
 func (kvdb *kvStore) EndDatRefresh() error {
-	return kvdb.datsDB.EndRefresh()
+	err := kvdb.datsDB.EndRefresh()
+	if err != nil {
+		return err
+	}
+
+	if kvdb.sizesDB == nil {
+		return nil
+	}
+
+	err = os.Remove(filepath.Join(kvdb.path, sizesCompleteFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return kvdb.buildSizeIndex()
 }
 
 func (kvdb *kvStore) StartBatch() RomBatch {
+	return kvdb.StartBatchWithHashes(IndexAllHashes)
+}
+
+func (kvdb *kvStore) StartBatchWithHashes(hashes IndexHashes) RomBatch {
+	var sizesBatch KVBatch
+	if kvdb.sizesDB != nil {
+		sizesBatch = kvdb.sizesDB.StartBatch()
+	}
+
 	return &kvBatch{
+		hashes:       hashes,
 		db:           kvdb,
 		datsBatch:    kvdb.datsDB.StartBatch(),
 		crcBatch:     kvdb.crcDB.StartBatch(),
@@ -487,6 +1273,9 @@ func (kvdb *kvStore) StartBatch() RomBatch {
 		sha1Batch:    kvdb.sha1DB.StartBatch(),
 		crcsha1Batch: kvdb.crcsha1DB.StartBatch(),
 		md5sha1Batch: kvdb.md5sha1DB.StartBatch(),
+		sourcesBatch: kvdb.sourcesDB.StartBatch(),
+		sizesBatch:   sizesBatch,
+		logicalBatch: kvdb.logicalDB.StartBatch(),
 	}
 }
 
@@ -531,6 +1320,26 @@ func (kvb *kvBatch) Flush() error {
 	}
 	kvb.md5sha1Batch.Clear()
 
+	err = kvb.db.sourcesDB.WriteBatch(kvb.sourcesBatch)
+	if err != nil {
+		return err
+	}
+	kvb.sourcesBatch.Clear()
+
+	err = kvb.db.logicalDB.WriteBatch(kvb.logicalBatch)
+	if err != nil {
+		return err
+	}
+	kvb.logicalBatch.Clear()
+
+	if kvb.sizesBatch != nil {
+		err = kvb.db.sizesDB.WriteBatch(kvb.sizesBatch)
+		if err != nil {
+			return err
+		}
+		kvb.sizesBatch.Clear()
+	}
+
 	kvb.size = 0
 	return nil
 }
@@ -561,6 +1370,11 @@ func (kvb *kvBatch) IndexRom(rom *types.Rom) error {
 			}
 			kvb.size += int64(sha1.Size)
 		}
+
+		err := kvb.indexSize(rom)
+		if err != nil {
+			return err
+		}
 	} else {
 		glog.V(4).Infof("indexing rom %s with missing SHA1", rom.Name)
 	}
@@ -568,6 +1382,70 @@ func (kvb *kvBatch) IndexRom(rom *types.Rom) error {
 	return nil
 }
 
+// indexSize adds the sha1 of rom to the size index, if there is one. Roms
+// without a size are left out, DATs without sizes give their roms size 0.
+func (kvb *kvBatch) indexSize(rom *types.Rom) error {
+	if kvb.sizesBatch == nil || rom.Sha1 == nil || rom.Size <= 0 {
+		return nil
+	}
+
+	err := kvb.sizesBatch.Set(romSizeKey(rom.Size, rom.Sha1), oneValue)
+	if err != nil {
+		return err
+	}
+	kvb.size += int64(8 + sha1.Size)
+	return nil
+}
+
+// IndexRomSource tags the associations of rom with the label of the import
+// of the DAT at datPath they came from. The label is kept per rom and DAT, so
+// importing the rom from another DAT adds its label, while importing the same
+// DAT again replaces it.
+func (kvb *kvBatch) IndexRomSource(rom *types.Rom, datPath string, source string) error {
+	if rom.Sha1 == nil || source == "" {
+		return nil
+	}
+
+	datSha1 := sha1.Sum([]byte(datPath))
+
+	key := make([]byte, 2*sha1.Size)
+	copy(key, rom.Sha1)
+	copy(key[sha1.Size:], datSha1[:])
+
+	err := kvb.sourcesBatch.Set(key, []byte(source))
+	if err != nil {
+		return err
+	}
+	kvb.size += int64(len(key) + len(source))
+	return nil
+}
+
+// dropReformattedDat deletes the index entry of the DAT with the same logical
+// sha1 as dat if it wasn't refreshed in the current generation. That DAT file
+// got reformatted into dat, so its entry would only end up orphaned. Its rom
+// index entries stay, lookups skip DATs that are gone.
+func (kvb *kvBatch) dropReformattedDat(dat *types.Dat, sha1Bytes []byte) error {
+	oldSha1, err := kvb.db.logicalDB.Get(dat.LogicalSha1)
+	if err != nil {
+		return err
+	}
+	if len(oldSha1) != sha1.Size || bytes.Equal(oldSha1, sha1Bytes) {
+		return nil
+	}
+
+	oldDat, err := kvb.db.GetDat(oldSha1)
+	if err != nil {
+		return err
+	}
+	if oldDat == nil || oldDat.Generation == kvb.db.generation || !bytes.Equal(oldDat.LogicalSha1, dat.LogicalSha1) {
+		return nil
+	}
+
+	glog.Infof("dat %s is a reformatted copy of dat %s with sha1 %s, dropping the old entry", dat.Path,
+		oldDat.Path, hex.EncodeToString(oldSha1))
+	return kvb.datsBatch.Delete(oldSha1)
+}
+
 func (kvb *kvBatch) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 	glog.V(4).Infof("indexing dat %s", dat.Name)
 
@@ -576,11 +1454,9 @@ func (kvb *kvBatch) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 	}
 
 	dat.Generation = kvb.db.generation
+	dat.LogicalSha1 = dat.ComputeLogicalSha1()
 
-	var buf bytes.Buffer
-
-	gobEncoder := gob.NewEncoder(&buf)
-	err := gobEncoder.Encode(dat)
+	dBytes, err := encodeDat(dat)
 	if err != nil {
 		return err
 	}
@@ -590,14 +1466,32 @@ func (kvb *kvBatch) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 		return fmt.Errorf("failed to lookup sha1 indexing dats: %v", err)
 	}
 
-	kvb.datsBatch.Set(sha1Bytes, buf.Bytes())
-	kvb.size += int64(sha1.Size + buf.Len())
+	kvb.datsBatch.Set(sha1Bytes, dBytes)
+	kvb.size += int64(sha1.Size + len(dBytes))
+
+	if !exists {
+		err = kvb.dropReformattedDat(dat, sha1Bytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = kvb.logicalBatch.Set(dat.LogicalSha1, sha1Bytes)
+	if err != nil {
+		return err
+	}
+	kvb.size += int64(2 * sha1.Size)
 
 	if !exists {
 		for _, g := range dat.Games {
 			glog.V(4).Infof("indexing game %s", g.Name)
 			for _, r := range g.Roms {
-				if r.Sha1 != nil {
+				err = kvb.indexSize(r)
+				if err != nil {
+					return err
+				}
+
+				if r.Sha1 != nil && kvb.hashes&IndexSha1 != 0 {
 					err = kvb.sha1Batch.Set(r.Sha1Sha1Key(sha1Bytes), oneValue)
 					if err != nil {
 						return err
@@ -605,7 +1499,7 @@ func (kvb *kvBatch) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 					kvb.size += int64(sha1.Size)
 				}
 
-				if r.Md5 != nil {
+				if r.Md5 != nil && kvb.hashes&IndexMd5 != 0 {
 					err = kvb.md5Batch.Set(r.Md5WithSizeAndSha1Key(sha1Bytes), oneValue)
 					if err != nil {
 						return err
@@ -622,7 +1516,7 @@ func (kvb *kvBatch) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 					}
 				}
 
-				if r.Crc != nil {
+				if r.Crc != nil && kvb.hashes&IndexCrc != 0 {
 					err = kvb.crcBatch.Set(r.CrcWithSizeAndSha1Key(sha1Bytes), oneValue)
 					if err != nil {
 						return err
@@ -745,6 +1639,192 @@ func (kvdb *kvStore) ForEachDat(datF func(dat *types.Dat) error) error {
 	})
 }
 
+func (kvdb *kvStore) ForEachDatWithSha1(datF func(sha1Bytes []byte, dat *types.Dat) error) error {
+	return kvdb.datsDB.Iterate(func(key, value []byte) (bool, error) {
+		dat, err := decodeDat(value)
+		if err != nil {
+			return false, err
+		}
+		err = datF(key, dat)
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// ForEachRom calls romF with every sha1 in the index, in sha1 order, as a rom
+// with only Sha1 and Size set. Size is -1 for sha1s that are only known from
+// DATs without sizes. The sha1s are collected in a scratch store next to the
+// index rather than in memory. An error returned by romF stops the iteration
+// and is returned.
+func (kvdb *kvStore) ForEachRom(romF func(rom *types.Rom) error) error {
+	scratchDir, err := ioutil.TempDir(kvdb.path, "romba_roms")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratchDir)
+
+	roms, err := openDb(filepath.Join(scratchDir, "roms_db"), sha1.Size)
+	if err != nil {
+		return err
+	}
+	defer roms.Close()
+
+	batch := roms.StartBatch()
+	var batchSize int
+
+	declare := func(sha1Bytes []byte, size int64) error {
+		value := make([]byte, 8)
+		util.Int64ToBytes(size, value)
+
+		err := batch.Set(sha1Bytes, value)
+		if err != nil {
+			return err
+		}
+		batchSize += sha1.Size + 8
+		if batchSize >= MaxBatchSize {
+			err = roms.WriteBatch(batch)
+			if err != nil {
+				return err
+			}
+			batch.Clear()
+			batchSize = 0
+		}
+		return nil
+	}
+
+	// crc and md5 mappings carry the size, a sha1 has the same one in both
+	err = kvdb.crcsha1DB.Iterate(func(key, value []byte) (bool, error) {
+		err := declare(key[crc32.Size+8:], util.BytesToInt64(key[crc32.Size:crc32.Size+8]))
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.md5sha1DB.Iterate(func(key, value []byte) (bool, error) {
+		err := declare(key[md5.Size+8:], util.BytesToInt64(key[md5.Size:md5.Size+8]))
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = roms.WriteBatch(batch)
+	if err != nil {
+		return err
+	}
+	batch.Clear()
+	batchSize = 0
+
+	// sha1s only referenced by DATs without a crc or md5 have no known size
+	var lastSha1 []byte
+	err = kvdb.sha1DB.Iterate(func(key, value []byte) (bool, error) {
+		romSha1 := key[:sha1.Size]
+		if bytes.Equal(romSha1, lastSha1) {
+			return true, nil
+		}
+		lastSha1 = append(lastSha1[:0], romSha1...)
+
+		exists, err := roms.Exists(romSha1)
+		if err != nil || exists {
+			return err == nil, err
+		}
+		err = declare(romSha1, -1)
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = roms.WriteBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	return roms.Iterate(func(key, value []byte) (bool, error) {
+		rom := new(types.Rom)
+		rom.Sha1 = make([]byte, sha1.Size)
+		copy(rom.Sha1, key)
+		rom.Size = util.BytesToInt64(value)
+
+		err := romF(rom)
+		return err == nil, err
+	})
+}
+
+// HasRomDatAssociation reports whether the index associates rom with the dat with sha1 datSha1
+// through any of the rom's hashes.
+func (kvdb *kvStore) HasRomDatAssociation(rom *types.Rom, datSha1 []byte) (bool, error) {
+	if rom.Sha1 != nil {
+		exists, err := kvdb.sha1DB.Exists(rom.Sha1Sha1Key(datSha1))
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	if rom.Md5 != nil {
+		exists, err := kvdb.md5DB.Exists(rom.Md5WithSizeAndSha1Key(datSha1))
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	if rom.Crc != nil {
+		exists, err := kvdb.crcDB.Exists(rom.CrcWithSizeAndSha1Key(datSha1))
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// ForEachRomDatAssociation calls assocF with every rom to DAT association in
+// the sha1, md5 and crc indexes. The rom has only the hash of the index the
+// association was found in set, plus Size for md5 and crc. An error returned
+// by assocF stops the iteration and is returned.
+func (kvdb *kvStore) ForEachRomDatAssociation(assocF func(rom *types.Rom, datSha1 []byte) error) error {
+	err := kvdb.sha1DB.Iterate(func(key, value []byte) (bool, error) {
+		rom := new(types.Rom)
+		rom.Sha1 = key[:sha1.Size]
+
+		err := assocF(rom, key[sha1.Size:])
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.md5DB.Iterate(func(key, value []byte) (bool, error) {
+		rom := new(types.Rom)
+		rom.Md5 = key[:md5.Size]
+		rom.Size = util.BytesToInt64(key[md5.Size : md5.Size+8])
+
+		err := assocF(rom, key[md5.Size+8:])
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return kvdb.crcDB.Iterate(func(key, value []byte) (bool, error) {
+		rom := new(types.Rom)
+		rom.Crc = key[:crc32.Size]
+		rom.Size = util.BytesToInt64(key[crc32.Size : crc32.Size+8])
+
+		err := assocF(rom, key[crc32.Size+8:])
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
 func (kvdb *kvStore) JoinCrcMd5(combiner combine.Combiner) error {
 	glog.V(4).Infof("leveldb combiner processing crc mappings")
 	err := kvdb.crcsha1DB.Iterate(func(key, value []byte) (bool, error) {
@@ -0,0 +1,93 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestDecodeDatSingleValue(t *testing.T) {
+	dat := &types.Dat{
+		Name: "old",
+		Games: types.GameSlice{
+			{Name: "a", Roms: types.RomSlice{{Name: "a.bin", Size: 1, Sha1: []byte{1}}}},
+			{Name: "b", Roms: types.RomSlice{{Name: "b.bin", Size: 2, Sha1: []byte{2}}}},
+		},
+	}
+
+	// DATs stored by older versions are one gob value including the games
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(dat)
+	if err != nil {
+		t.Fatalf("failed to encode dat: %v", err)
+	}
+
+	ddat, err := decodeDat(buf.Bytes())
+	if err != nil {
+		t.Fatalf("failed to decode dat: %v", err)
+	}
+	if !ddat.Equals(dat) || !ddat.Games.Equals(dat.Games) {
+		t.Fatalf("expected decoded dat to match")
+	}
+
+	var games types.GameSlice
+	hdr, err := decodeDatGames(buf.Bytes(), func(game *types.Game) error {
+		games = append(games, game)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to decode dat games: %v", err)
+	}
+	if hdr.Name != dat.Name || len(hdr.Games) != 0 || !games.Equals(dat.Games) {
+		t.Fatalf("expected header and games of the single value dat")
+	}
+
+	dBytes, err := encodeDat(dat)
+	if err != nil {
+		t.Fatalf("failed to encode dat: %v", err)
+	}
+
+	numGames := 0
+	hdr, err = decodeDatGames(dBytes, func(game *types.Game) error {
+		numGames++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to decode dat games: %v", err)
+	}
+	if hdr.Name != dat.Name || len(hdr.Games) != 0 || numGames != len(dat.Games) {
+		t.Fatalf("expected header and %d games, got %d", len(dat.Games), numGames)
+	}
+}
@@ -43,6 +43,34 @@ func (noop *NoOpDB) IndexRom(rom *types.Rom) error {
 	return nil
 }
 
+func (noop *NoOpDB) DeleteRom(rom *types.Rom) error {
+	return nil
+}
+
+func (noop *NoOpDB) IndexZip(sha1 []byte) error {
+	return nil
+}
+
+func (noop *NoOpDB) IsZipSeen(sha1 []byte) (bool, error) {
+	return false, nil
+}
+
+func (noop *NoOpDB) RomSources(sha1 []byte) ([]string, error) {
+	return nil, nil
+}
+
+func (noop *NoOpDB) IndexRomName(sha1 []byte, path string) error {
+	return nil
+}
+
+func (noop *NoOpDB) RomNames(sha1 []byte) ([]string, error) {
+	return nil, nil
+}
+
+func (noop *NoOpDB) Snapshot(dir string) error {
+	return nil
+}
+
 func (noop *NoOpDB) IndexDat(dat *types.Dat, sha1 []byte) error {
 	return nil
 }
@@ -59,10 +87,26 @@ func (noop *NoOpDB) GetDat(sha1 []byte) (*types.Dat, error) {
 	return nil, nil
 }
 
+func (noop *NoOpDB) GetDatWithRoms(sha1 []byte) (*types.Dat, error) {
+	return nil, nil
+}
+
+func (noop *NoOpDB) ForEachDatGame(sha1 []byte, gameF func(game *types.Game) error) (*types.Dat, error) {
+	return nil, nil
+}
+
+func (noop *NoOpDB) UpdateDatHeader(sha1 []byte, name, description string) (*types.Dat, error) {
+	return nil, nil
+}
+
 func (noop *NoOpDB) DatsForRom(rom *types.Rom) ([]*types.Dat, error) {
 	return nil, nil
 }
 
+func (noop *NoOpDB) DatsForRoms(roms []*types.Rom) (map[string][]*types.Dat, error) {
+	return make(map[string][]*types.Dat), nil
+}
+
 func (noop *NoOpDB) IsRomReferencedByDats(rom *types.Rom) (bool, error) {
 	return false, nil
 }
@@ -75,6 +119,10 @@ func (noop *NoOpDB) StartBatch() RomBatch {
 	return new(NoOpBatch)
 }
 
+func (noop *NoOpDB) StartBatchWithHashes(hashes IndexHashes) RomBatch {
+	return new(NoOpBatch)
+}
+
 func (noop *NoOpBatch) Flush() error {
 	return nil
 }
@@ -87,6 +135,10 @@ func (noop *NoOpBatch) IndexRom(rom *types.Rom) error {
 	return nil
 }
 
+func (noop *NoOpBatch) IndexRomSource(rom *types.Rom, datPath string, source string) error {
+	return nil
+}
+
 func (noop *NoOpBatch) IndexDat(dat *types.Dat, sha1 []byte) error {
 	return nil
 }
@@ -107,10 +159,34 @@ func (noop *NoOpDB) ForEachDat(datF func(dat *types.Dat) error) error {
 	return nil
 }
 
+func (noop *NoOpDB) ForEachRom(romF func(rom *types.Rom) error) error {
+	return nil
+}
+
+func (noop *NoOpDB) ForEachDatWithSha1(datF func(sha1 []byte, dat *types.Dat) error) error {
+	return nil
+}
+
+func (noop *NoOpDB) HasRomDatAssociation(rom *types.Rom, datSha1 []byte) (bool, error) {
+	return false, nil
+}
+
+func (noop *NoOpDB) ForEachRomDatAssociation(assocF func(rom *types.Rom, datSha1 []byte) error) error {
+	return nil
+}
+
 func (noop *NoOpDB) JoinCrcMd5(combiner combine.Combiner) error {
 	return nil
 }
 
+func (noop *NoOpDB) RomsOfSize(size int64) ([]*types.Rom, error) {
+	return nil, nil
+}
+
+func (noop *NoOpDB) IndexedSize(rom *types.Rom) (int64, error) {
+	return -1, nil
+}
+
 func (noop *NoOpDB) NumRoms() int64 {
 	return 0
 }
@@ -131,4 +207,8 @@ func (noop *NoOpDB) Flush() {}
 
 func (noop *NoOpDB) Generation() int64 { return 0 }
 
+func (noop *NoOpDB) SetGeneration(gen int64) error { return nil }
+
 func (noop *NoOpDB) PrintStats() string { return "" }
+
+func (noop *NoOpDB) Stats() (*Stats, error) { return new(Stats), nil }
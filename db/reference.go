@@ -0,0 +1,103 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// ReferenceDats decides which DATs are indexed for hash provenance only. Roms of
+// reference-only DATs are still resolved by lookups but are not counted as
+// required in completeness reports.
+type ReferenceDats struct {
+	sha1s    map[string]bool
+	patterns []string
+}
+
+// ParseReferenceDats builds a ReferenceDats from a list of DAT SHA1s and
+// name patterns. A pattern is matched with filepath.Match against the DAT
+// name and the DAT file name. Returns nil if patterns is empty.
+func ParseReferenceDats(patterns []string) (*ReferenceDats, error) {
+	var rd *ReferenceDats
+
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if rd == nil {
+			rd = &ReferenceDats{
+				sha1s: make(map[string]bool),
+			}
+		}
+
+		if len(p) == 2*20 {
+			if _, err := hex.DecodeString(p); err == nil {
+				rd.sha1s[strings.ToLower(p)] = true
+				continue
+			}
+		}
+
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid reference dat pattern %s: %v", p, err)
+		}
+		rd.patterns = append(rd.patterns, p)
+	}
+	return rd, nil
+}
+
+// Matches returns true if the DAT with the given SHA1 is reference-only.
+// A nil ReferenceDats matches nothing.
+func (rd *ReferenceDats) Matches(dat *types.Dat, sha1Bytes []byte) bool {
+	if rd == nil {
+		return false
+	}
+
+	if rd.sha1s[hex.EncodeToString(sha1Bytes)] {
+		return true
+	}
+
+	for _, p := range rd.patterns {
+		if ok, _ := filepath.Match(p, dat.Name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, dat.Filename()); ok {
+			return true
+		}
+	}
+	return false
+}
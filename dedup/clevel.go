@@ -53,6 +53,7 @@ type dbDeduper struct {
 	md5DB    *levigo.DB
 	sha1DB   *levigo.DB
 	tempPath string
+	mode     MatchKey
 }
 
 func openDb(path string) (*levigo.DB, error) {
@@ -70,7 +71,7 @@ func openDb(path string) (*levigo.DB, error) {
 	return dbn, nil
 }
 
-func NewLevelDBDeduper() (Deduper, error) {
+func NewLevelDBDeduper(mode MatchKey) (Deduper, error) {
 	tempPath, err := ioutil.TempDir(config.GlobalConfig.General.TmpDir, "romba_dedup")
 	if err != nil {
 		return nil, err
@@ -99,11 +100,14 @@ func NewLevelDBDeduper() (Deduper, error) {
 	dbd.sha1DB = dbn
 
 	dbd.tempPath = tempPath
+	dbd.mode = mode
 
 	return dbd, nil
 }
 
 func (dbd *dbDeduper) Declare(r *types.Rom) error {
+	r = KeyRom(r, dbd.mode)
+
 	if len(r.Crc) > 0 {
 		err := dbd.crcDB.Put(wo, r.CrcWithSizeKey(), trueVal)
 		if err != nil {
@@ -128,6 +132,8 @@ func (dbd *dbDeduper) Declare(r *types.Rom) error {
 }
 
 func (dbd *dbDeduper) Seen(r *types.Rom) (bool, error) {
+	r = KeyRom(r, dbd.mode)
+
 	if len(r.Sha1) > 0 {
 		val, err := dbd.sha1DB.Get(ro, r.Sha1)
 		if err != nil {
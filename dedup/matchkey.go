@@ -0,0 +1,71 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dedup
+
+import (
+	"fmt"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// MatchKey selects which hashes decide whether two roms are the same rom.
+type MatchKey string
+
+const (
+	// MatchKeySha1 matches roms by SHA1, falling back to MD5+size and CRC+size when SHA1 is absent.
+	MatchKeySha1 MatchKey = "sha1"
+	// MatchKeyCrc matches roms by CRC+size only, ignoring SHA1 and MD5.
+	MatchKeyCrc MatchKey = "crc"
+)
+
+func ParseMatchKey(s string) (MatchKey, error) {
+	switch MatchKey(s) {
+	case "", MatchKeySha1:
+		return MatchKeySha1, nil
+	case MatchKeyCrc:
+		return MatchKeyCrc, nil
+	}
+	return "", fmt.Errorf("unknown match key %q, expected %s or %s", s, MatchKeySha1, MatchKeyCrc)
+}
+
+// KeyRom returns a rom holding only those hashes of r that take part in matching under
+// mode, so that lookups of it by its remaining hashes use the same key. In crc mode
+// it is a copy of r, r itself keeps all its hashes.
+func KeyRom(r *types.Rom, mode MatchKey) *types.Rom {
+	if mode != MatchKeyCrc {
+		return r
+	}
+	return &types.Rom{
+		Name: r.Name,
+		Size: r.Size,
+		Crc:  r.Crc,
+	}
+}
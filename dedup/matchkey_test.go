@@ -0,0 +1,100 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dedup
+
+import (
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestMatchKeyCrc(t *testing.T) {
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	a := &types.Rom{
+		Name: "a.bin",
+		Size: 1024,
+		Crc:  []byte{0x12, 0x34, 0x56, 0x78},
+		Sha1: []byte("aaaaaaaaaaaaaaaaaaaa"),
+	}
+	b := &types.Rom{
+		Name: "b.bin",
+		Size: 1024,
+		Crc:  []byte{0x12, 0x34, 0x56, 0x78},
+		Sha1: []byte("bbbbbbbbbbbbbbbbbbbb"),
+	}
+
+	for _, tc := range []struct {
+		mode MatchKey
+		seen bool
+	}{
+		{MatchKeySha1, false},
+		{MatchKeyCrc, true},
+	} {
+		md, err := NewLevelDBDeduper(tc.mode)
+		if err != nil {
+			t.Fatalf("failed to create deduper: %v", err)
+		}
+		defer md.Close()
+
+		err = md.Declare(a)
+		if err != nil {
+			t.Fatalf("failed to declare rom: %v", err)
+		}
+
+		seen, err := md.Seen(b)
+		if err != nil {
+			t.Fatalf("failed to check rom: %v", err)
+		}
+		if seen != tc.seen {
+			t.Fatalf("match key %s: expected seen %v, got %v", tc.mode, tc.seen, seen)
+		}
+	}
+
+	kb := KeyRom(b, MatchKeyCrc)
+	if kb.Sha1 != nil || kb.Crc == nil || kb.Size != 1024 {
+		t.Fatalf("expected crc keyed rom to keep only crc and size, got %+v", kb)
+	}
+	if b.Sha1 == nil {
+		t.Fatalf("expected keying to leave the rom alone")
+	}
+	if KeyRom(b, MatchKeySha1) != b {
+		t.Fatalf("expected sha1 keyed rom to be the rom itself")
+	}
+
+	_, err := ParseMatchKey("md5")
+	if err == nil {
+		t.Fatalf("expected unknown match key to fail")
+	}
+}
@@ -40,15 +40,17 @@ type memoryDeduper struct {
 	crcs  map[string]bool
 	md5s  map[string]bool
 	sha1s map[string]bool
+	mode  MatchKey
 
 	mutex sync.Mutex
 }
 
-func NewMemoryDeduper() Deduper {
+func NewMemoryDeduper(mode MatchKey) Deduper {
 	return &memoryDeduper{
 		crcs:  make(map[string]bool),
 		md5s:  make(map[string]bool),
 		sha1s: make(map[string]bool),
+		mode:  mode,
 	}
 }
 
@@ -56,6 +58,8 @@ func (md *memoryDeduper) Declare(r *types.Rom) error {
 	md.mutex.Lock()
 	defer md.mutex.Unlock()
 
+	r = KeyRom(r, md.mode)
+
 	if len(r.Crc) > 0 {
 		md.crcs[string(r.CrcWithSizeKey())] = true
 	}
@@ -74,6 +78,8 @@ func (md *memoryDeduper) Seen(r *types.Rom) (bool, error) {
 	md.mutex.Lock()
 	defer md.mutex.Unlock()
 
+	r = KeyRom(r, md.mode)
+
 	if len(r.Sha1) > 0 && md.sha1s[string(r.Sha1)] {
 		return true, nil
 	}
@@ -0,0 +1,204 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// handledKeywords lists the keywords the parser reads, per block they appear in.
+// The empty block is the top level of the DAT. Blocks without an entry are skipped
+// by the parser as a whole.
+var handledKeywords = map[string][]string{
+	"":           {"clrmamepro", "game", "resource"},
+	"clrmamepro": {"name", "description", "forcezipping", "forcepacking"},
+	"game":       {"name", "description", "sampleof", "sample", "rom", "size"},
+	"resource":   {"name", "description", "sampleof", "sample", "rom", "size"},
+	"rom":        {"name", "flags", "merge", "size", "md5", "crc", "sha1"},
+}
+
+// KeywordCount is a keyword the parser ignores, the block it was found in and the
+// number of times it was found there.
+type KeywordCount struct {
+	Block   string
+	Keyword string
+	Count   int
+}
+
+func isHandled(block, keyword string) bool {
+	for _, hk := range handledKeywords[block] {
+		if hk == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+// UnhandledKeywords reads the clrmamepro DAT at path and returns the keywords in
+// it the parser ignores, ordered by decreasing count. The content of an ignored
+// block is not looked at, only the keyword naming the block is reported. Top level
+// keywords have an empty Block. XML DATs are not supported.
+func UnhandledKeywords(path string) ([]KeywordCount, error) {
+	isXML, err := isXML(path)
+	if err != nil {
+		return nil, err
+	}
+	if isXML {
+		return nil, fmt.Errorf("%s is an XML DAT, only clrmamepro DATs are supported", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close file %s: %v", path, err)
+		}
+	}()
+
+	return unhandledKeywords(path, file)
+}
+
+func unhandledKeywords(name string, rd io.Reader) ([]KeywordCount, error) {
+	l, err := lex(name, rd)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[KeywordCount]int)
+	blocks := []string{""}
+
+	var pending *item
+	next := func() item {
+		if pending != nil {
+			i := *pending
+			pending = nil
+			return i
+		}
+		return l.nextItem()
+	}
+
+	for {
+		i := next()
+
+		switch i.typ {
+		case itemError:
+			return nil, fmt.Errorf("%s:%d: %s", name, l.lineNumber(), i.val)
+		case itemEOF:
+			if len(blocks) > 1 {
+				return nil, fmt.Errorf("%s:%d: unexpected end of input", name, l.lineNumber())
+			}
+			return sortKeywordCounts(counts), nil
+		case itemCloseBrace:
+			if len(blocks) > 1 {
+				blocks = blocks[:len(blocks)-1]
+			}
+			continue
+		case itemOpenBrace:
+			// a block without a keyword, nothing to report
+			err = skipBlock(name, l)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case itemQuotedString:
+			// a value where a keyword was expected, not a keyword
+			continue
+		}
+
+		block := blocks[len(blocks)-1]
+		handled := isHandled(block, i.val)
+		if !handled {
+			counts[KeywordCount{Block: block, Keyword: i.val}]++
+		}
+
+		vi := next()
+		switch vi.typ {
+		case itemOpenBrace:
+			if _, ok := handledKeywords[i.val]; handled && ok {
+				blocks = append(blocks, i.val)
+			} else {
+				err = skipBlock(name, l)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case itemError, itemEOF, itemCloseBrace:
+			// the keyword has no value, let the loop deal with the item
+			pending = &vi
+		}
+	}
+}
+
+// skipBlock consumes the items up to and including the close brace of the block
+// whose open brace was just read.
+func skipBlock(name string, l *lexer) error {
+	depth := 1
+	for depth > 0 {
+		i := l.nextItem()
+		switch i.typ {
+		case itemError:
+			return fmt.Errorf("%s:%d: %s", name, l.lineNumber(), i.val)
+		case itemEOF:
+			return fmt.Errorf("%s:%d: unexpected end of input", name, l.lineNumber())
+		case itemOpenBrace:
+			depth++
+		case itemCloseBrace:
+			depth--
+		}
+	}
+	return nil
+}
+
+func sortKeywordCounts(counts map[KeywordCount]int) []KeywordCount {
+	kcs := make([]KeywordCount, 0, len(counts))
+	for kc, n := range counts {
+		kc.Count = n
+		kcs = append(kcs, kc)
+	}
+	sort.Slice(kcs, func(i, j int) bool {
+		if kcs[i].Count != kcs[j].Count {
+			return kcs[i].Count > kcs[j].Count
+		}
+		if kcs[i].Block != kcs[j].Block {
+			return kcs[i].Block < kcs[j].Block
+		}
+		return kcs[i].Keyword < kcs[j].Keyword
+	})
+	return kcs
+}
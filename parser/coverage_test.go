@@ -0,0 +1,80 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnhandledKeywords(t *testing.T) {
+	dat := `clrmamepro (
+	name "test"
+	version 20240101
+)
+
+emulator (
+	name "foo"
+)
+
+game (
+	name "a"
+	year 1984
+	biosset ( name "default" description "default" )
+	rom ( name a.bin size 4 crc 0a1b2c3d status baddump )
+	rom ( name b.bin size 4 crc 0a1b2c3e status nodump )
+	archive ( name "a" )
+)
+`
+
+	kcs, err := unhandledKeywords("coverage.dat", strings.NewReader(dat))
+	if err != nil {
+		t.Fatalf("failed to read keywords: %v", err)
+	}
+
+	expected := []KeywordCount{
+		{Block: "rom", Keyword: "status", Count: 2},
+		{Block: "", Keyword: "emulator", Count: 1},
+		{Block: "clrmamepro", Keyword: "version", Count: 1},
+		{Block: "game", Keyword: "archive", Count: 1},
+		{Block: "game", Keyword: "biosset", Count: 1},
+		{Block: "game", Keyword: "year", Count: 1},
+	}
+	if !reflect.DeepEqual(kcs, expected) {
+		t.Fatalf("got %v, expected %v", kcs, expected)
+	}
+
+	_, err = unhandledKeywords("broken.dat", strings.NewReader("game ( name \"a\" biosset ( name x )\n"))
+	if err == nil {
+		t.Fatalf("expected error for unterminated block")
+	}
+}
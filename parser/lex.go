@@ -62,6 +62,9 @@ const (
 	itemClrMamePro
 	itemForceZipping
 	itemForcePacking
+	itemSampleOf
+	itemSample
+	itemMerge
 )
 
 var itemTypePrettyPrint = map[itemType]string{
@@ -102,6 +105,7 @@ func (i item) String() string {
 
 var key = map[string]itemType{
 	"game":         itemGame,
+	"resource":     itemGame, // BIOS sets in old clrmamepro DATs, structured like games
 	"name":         itemName,
 	"flags":        itemFlags,
 	"description":  itemDescription,
@@ -116,6 +120,9 @@ var key = map[string]itemType{
 	"clrmamepro":   itemClrMamePro,
 	"forcezipping": itemForceZipping,
 	"forcepacking": itemForcePacking,
+	"sampleof":     itemSampleOf,
+	"sample":       itemSample,
+	"merge":        itemMerge,
 }
 
 // isSpace reports whether r is a space character.
@@ -260,12 +267,44 @@ func (l *lexer) nextItem() item {
 	panic("not reached")
 }
 
+// newlineReader translates \r\n and lone \r line endings into \n, so that
+// the lexer only has to deal with one kind of line terminator.
+type newlineReader struct {
+	r      io.Reader
+	skipLF bool // last byte was a \r, drop a following \n
+}
+
+func (nr *newlineReader) Read(buf []byte) (int, error) {
+	for {
+		n, err := nr.r.Read(buf)
+		j := 0
+		for _, b := range buf[:n] {
+			if nr.skipLF {
+				nr.skipLF = false
+				if b == '\n' {
+					continue
+				}
+			}
+			if b == '\r' {
+				b = '\n'
+				nr.skipLF = true
+			}
+			buf[j] = b
+			j++
+		}
+		// a read of just the \n of a \r\n split across reads yields nothing, read on
+		if j > 0 || n == 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
 // lex creates a new scanner for the input string.
 func lex(name string, rd io.Reader) (*lexer, error) {
 	l := &lexer{
 		tk:    make([]rune, 0, 2048),
 		name:  name,
-		br:    bufio.NewReader(rd),
+		br:    bufio.NewReader(&newlineReader{r: rd}),
 		state: lexDefault,
 		items: make(chan item, 2), // Two items of buffering is sufficient for all state functions
 	}
@@ -280,6 +319,60 @@ func lex(name string, rd io.Reader) (*lexer, error) {
 	return l, nil
 }
 
+// Token is an item of the lexer, as reported by LexTokens.
+type Token struct {
+	Type  string
+	Value string
+	Line  int
+}
+
+// typeName names keywords by their text instead of their item number. Keywords
+// sharing an item type, like game and resource, are named by the first in
+// alphabetical order.
+func (i itemType) typeName() string {
+	name := ""
+	for k, t := range key {
+		if t == i && (name == "" || k < name) {
+			name = k
+		}
+	}
+	if name != "" {
+		return "keyword " + name
+	}
+	return i.String()
+}
+
+// LexTokens runs the lexer over the DAT read from rd and calls tokenF with every
+// item up to the EOF item. It stops at the first error item and returns it as
+// an error, after passing it to tokenF. Line is the line the lexer was on when
+// it emitted the item. This is a debugging aid, the parser doesn't use it.
+func LexTokens(name string, rd io.Reader, tokenF func(tk Token) error) error {
+	l, err := lex(name, rd)
+	if err != nil {
+		return err
+	}
+
+	for {
+		i := l.nextItem()
+
+		err = tokenF(Token{
+			Type:  i.typ.typeName(),
+			Value: i.val,
+			Line:  l.lineNumber(),
+		})
+		if err != nil {
+			return err
+		}
+
+		switch i.typ {
+		case itemEOF:
+			return nil
+		case itemError:
+			return fmt.Errorf("%s:%d: %s", name, l.lineNumber(), i.val)
+		}
+	}
+}
+
 // state functions
 
 // lexQuote scans a quoted string.
@@ -32,6 +32,7 @@ package parser
 
 import (
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -68,3 +69,36 @@ func TestLexerGoesThroughBOM(t *testing.T) {
 		t.Logf("token typ: %s, token val: %s", i.typ, i.val)
 	}
 }
+
+func TestLexTokens(t *testing.T) {
+	dat := "game (\n\tname \"a\"\n\trom ( name a.bin size 4 crc 0a1b2c3d )\n)\n"
+
+	var tks []Token
+	err := LexTokens("tokens.dat", strings.NewReader(dat), func(tk Token) error {
+		tks = append(tks, tk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to lex: %v", err)
+	}
+
+	if len(tks) != 15 {
+		t.Fatalf("expected 15 tokens, got %d: %v", len(tks), tks)
+	}
+	if tks[0].Type != "keyword game" || tks[0].Line != 1 {
+		t.Fatalf("unexpected first token %v", tks[0])
+	}
+	if tks[3].Type != "quoted string" || tks[3].Value != "\"a\"" || tks[3].Line != 2 {
+		t.Fatalf("unexpected name token %v", tks[3])
+	}
+	if tks[len(tks)-1].Type != "EOF" {
+		t.Fatalf("expected EOF last, got %v", tks[len(tks)-1])
+	}
+
+	err = LexTokens("broken.dat", strings.NewReader("game ( name \"unterminated\n"), func(tk Token) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("expected error for unterminated quote")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// NamelessRomPolicy decides what happens to roms a DAT declares without a name.
+// Built games need a file name for every rom.
+type NamelessRomPolicy string
+
+const (
+	// NamelessRomSynthesize names the rom after its hash, <sha1>.bin
+	NamelessRomSynthesize NamelessRomPolicy = "synthesize"
+	// NamelessRomSkip drops the rom with a warning
+	NamelessRomSkip NamelessRomPolicy = "skip"
+	// NamelessRomError fails parsing the DAT
+	NamelessRomError NamelessRomPolicy = "error"
+)
+
+const namelessRomSuffix = ".bin"
+
+var namelessRomPolicy = NamelessRomSynthesize
+
+// SetNamelessRomPolicy sets the policy applied to roms without a name in all
+// DATs parsed afterwards.
+func SetNamelessRomPolicy(policy string) error {
+	switch p := NamelessRomPolicy(policy); p {
+	case NamelessRomSynthesize, NamelessRomSkip, NamelessRomError:
+		namelessRomPolicy = p
+		return nil
+	default:
+		return fmt.Errorf("unknown policy %q for roms without name, expected %s, %s or %s",
+			policy, NamelessRomSynthesize, NamelessRomSkip, NamelessRomError)
+	}
+}
+
+// namelessRomName returns <hash>.bin using the strongest hash of the rom, or
+// the empty string if the rom has no hashes at all.
+func namelessRomName(r *types.Rom) string {
+	for _, h := range [][]byte{r.Sha1, r.Md5, r.Crc} {
+		if len(h) > 0 {
+			return hex.EncodeToString(h) + namelessRomSuffix
+		}
+	}
+	return ""
+}
+
+func fixNamelessRomSlice(g *types.Game, roms types.RomSlice) (types.RomSlice, error) {
+	fixed := roms[:0]
+
+	for _, r := range roms {
+		if r.Name == "" {
+			if namelessRomName(r) == "" {
+				// software list continuation entries have neither name nor hashes
+				continue
+			}
+
+			switch namelessRomPolicy {
+			case NamelessRomError:
+				return nil, fmt.Errorf("rom without name in game %s", g.Name)
+			case NamelessRomSynthesize:
+				r.Name = namelessRomName(r)
+			}
+
+			if r.Name == "" {
+				glog.Warningf("skipping rom without name in game %s", g.Name)
+				continue
+			}
+		}
+		fixed = append(fixed, r)
+	}
+	return fixed, nil
+}
+
+// fixNamelessRoms applies the nameless rom policy to the roms of g.
+func fixNamelessRoms(g *types.Game) error {
+	var err error
+
+	g.Roms, err = fixNamelessRomSlice(g, g.Roms)
+	if err != nil {
+		return err
+	}
+	g.Parts, err = fixNamelessRomSlice(g, g.Parts)
+	if err != nil {
+		return err
+	}
+	g.Regions, err = fixNamelessRomSlice(g, g.Regions)
+	return err
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// parallelXmlRoots are the XML DAT flavors ParseXmlParallel decodes in parallel,
+// with the game elements below their root.
+var parallelXmlRoots = map[string]map[string]bool{
+	logiqxRoot: {"game": true, "machine": true, "software": true},
+	mameRoot:   {"game": true, "machine": true},
+}
+
+// recordingReader keeps the bytes read through it from stream offset base on,
+// so that the raw bytes of an element can be cut out after the decoder passed it.
+type recordingReader struct {
+	ir   io.Reader
+	buf  []byte
+	base int64
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.ir.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+// drop forgets the recorded bytes before stream offset off.
+func (r *recordingReader) drop(off int64) {
+	n := copy(r.buf, r.buf[off-r.base:])
+	r.buf = r.buf[:n]
+	r.base = off
+}
+
+// bytes returns a copy of the recorded bytes between the stream offsets start and end.
+func (r *recordingReader) bytes(start, end int64) []byte {
+	raw := make([]byte, end-start)
+	copy(raw, r.buf[start-r.base:end-r.base])
+	return raw
+}
+
+// xmlGameElem is a game element split off the XML stream and decoded by a worker.
+type xmlGameElem struct {
+	kind string
+	line int
+	raw  []byte
+	g    *types.Game
+	err  error
+}
+
+func (e *xmlGameElem) decode() {
+	e.g = new(types.Game)
+	e.err = xml.Unmarshal(e.raw, e.g)
+	e.raw = nil
+	if e.err != nil {
+		return
+	}
+
+	fixGameHashes(e.g)
+	e.err = fixNamelessRoms(e.g)
+}
+
+// ParseXmlParallel is like ParseXml, but for DATs with a datafile or mame root
+// the game elements are decoded by numWorkers goroutines. Only splitting the
+// elements off the stream is sequential, so huge single DATs like a MAME
+// -listxml keep more than one core busy. Other XML flavors are decoded
+// sequentially. The returned sha1 covers the same bytes as the one of ParseXml.
+func ParseXmlParallel(r io.Reader, path string, numWorkers int) (*types.Dat, []byte, error) {
+	br := bufio.NewReader(r)
+
+	hr := hashingReader{
+		ir: br,
+		h:  sha1.New(),
+	}
+
+	lr := &lineCountingReader{
+		ir: hr,
+	}
+
+	rr := &recordingReader{
+		ir: lr,
+	}
+
+	decoder := xml.NewDecoder(rr)
+
+	parseError := func(line int, err error) error {
+		derrStr := fmt.Sprintf("error in file %s on line %d: %v", path, line, err)
+		return XMLParseError.NewWith(derrStr, setErrorFilePath(path), setErrorLineNumber(line))
+	}
+
+	root, err := xmlDatRoot(decoder)
+	if err != nil {
+		return nil, nil, parseError(lr.line, err)
+	}
+
+	var d *types.Dat
+
+	kinds, ok := parallelXmlRoots[root.Name.Local]
+	if ok {
+		d, err = decodeXmlGamesParallel(decoder, root, kinds, rr, lr, numWorkers, parseError)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		d, err = decodeXmlDatRoot(decoder, root, path)
+		if err != nil {
+			return nil, nil, parseError(lr.line, err)
+		}
+
+		for _, gs := range []types.GameSlice{d.Games, d.Software, d.Machines} {
+			for _, g := range gs {
+				fixGameHashes(g)
+
+				err = fixNamelessRoms(g)
+				if err != nil {
+					return nil, nil, parseError(lr.line, err)
+				}
+			}
+		}
+	}
+
+	d.Normalize()
+	d.Path = path
+	return d, hr.h.Sum(nil), nil
+}
+
+// decodeXmlGamesParallel decodes the children of root. Elements in kinds are cut
+// out of the stream and handed to numWorkers goroutines, the header is decoded
+// right away and everything else is skipped. Games keep their order in the DAT.
+func decodeXmlGamesParallel(decoder *xml.Decoder, root xml.StartElement, kinds map[string]bool,
+	rr *recordingReader, lr *lineCountingReader, numWorkers int,
+	parseError func(line int, err error) error) (*types.Dat, error) {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	elemc := make(chan *xmlGameElem)
+	var wg sync.WaitGroup
+
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range elemc {
+				e.decode()
+			}
+		}()
+	}
+
+	var hdr *xmlDatHeader
+	var elems []*xmlGameElem
+
+	err := func() error {
+		for {
+			start := decoder.InputOffset()
+			rr.drop(start)
+
+			t, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+
+			switch se := t.(type) {
+			case xml.EndElement:
+				// the decoder checks that it matches root
+				return nil
+			case xml.StartElement:
+				switch {
+				case se.Name.Local == "header" && root.Name.Local == logiqxRoot:
+					hdr = new(xmlDatHeader)
+					err = decoder.DecodeElement(hdr, &se)
+					if err != nil {
+						return err
+					}
+				case kinds[se.Name.Local]:
+					line := lr.line
+					err = decoder.Skip()
+					if err != nil {
+						return err
+					}
+
+					e := &xmlGameElem{
+						kind: se.Name.Local,
+						line: line,
+						raw:  rr.bytes(start, decoder.InputOffset()),
+					}
+					elems = append(elems, e)
+					elemc <- e
+				default:
+					err = decoder.Skip()
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}()
+
+	close(elemc)
+	wg.Wait()
+
+	if err != nil {
+		return nil, parseError(lr.line, err)
+	}
+
+	d := new(types.Dat)
+	if hdr != nil {
+		hdr.copyTo(d)
+	}
+	if root.Name.Local == mameRoot {
+		for _, attr := range root.Attr {
+			if attr.Name.Local == "build" {
+				d.Version = attr.Value
+			}
+		}
+	}
+
+	for _, e := range elems {
+		if e.err != nil {
+			return nil, parseError(e.line, e.err)
+		}
+
+		switch e.kind {
+		case "game":
+			d.Games = append(d.Games, e.g)
+		case "machine":
+			d.Machines = append(d.Machines, e.g)
+		case "software":
+			d.Software = append(d.Software, e.g)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestParseXmlParallel(t *testing.T) {
+	paths := []string{
+		"testdata/example.xml",
+		"testdata/mame.xml",
+		"testdata/softwarelist.xml",
+		"testdata/softwarelists.xml",
+	}
+
+	for _, path := range paths {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		dat, datSha1, err := ParseXml(bytes.NewReader(bs), path)
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", path, err)
+		}
+
+		for _, numWorkers := range []int{1, 4} {
+			pdat, pdatSha1, err := ParseXmlParallel(bytes.NewReader(bs), path, numWorkers)
+			if err != nil {
+				t.Fatalf("error parsing %s in parallel: %v", path, err)
+			}
+
+			if !bytes.Equal(pdatSha1, datSha1) {
+				t.Fatalf("%s: expected sha1 %x, got %x", path, datSha1, pdatSha1)
+			}
+			if dat.Version != pdat.Version || !bytes.Equal(types.PrintDat(dat), types.PrintDat(pdat)) {
+				t.Fatalf("%s: parallel parse differs, expected\n%s\ngot\n%s", path,
+					types.PrintDat(dat), types.PrintDat(pdat))
+			}
+		}
+	}
+}
+
+func TestParseXmlTrailingData(t *testing.T) {
+	bs, err := ioutil.ReadFile("testdata/mame.xml")
+	if err != nil {
+		t.Fatalf("failed to read testdata/mame.xml: %v", err)
+	}
+	bs = append(bs, bytes.Repeat([]byte("\n"), 1<<16)...)
+	fileSha1 := sha1.Sum(bs)
+
+	_, datSha1, err := ParseXml(bytes.NewReader(bs), "testdata/mame.xml")
+	if err != nil {
+		t.Fatalf("error parsing testdata/mame.xml: %v", err)
+	}
+	if bytes.Equal(datSha1, fileSha1[:]) {
+		t.Fatalf("expected sha1 to stop near the end of the root element")
+	}
+
+	_, pdatSha1, err := ParseXmlParallel(bytes.NewReader(bs), "testdata/mame.xml", 4)
+	if err != nil {
+		t.Fatalf("error parsing testdata/mame.xml in parallel: %v", err)
+	}
+	if !bytes.Equal(pdatSha1, datSha1) {
+		t.Fatalf("expected sha1 %x, got %x", datSha1, pdatSha1)
+	}
+}
+
+func TestParseXmlParallelError(t *testing.T) {
+	text := `<?xml version="1.0"?>
+<mame build="0.200">
+	<machine name="a">
+		<rom name="a.bin" size="4" crc="8bd69e52"/>
+	</machine>
+	<machine name="b">
+		<rom name="b.bin" size="4" crc="8bd69e52"/>
+</mame>
+`
+
+	_, _, err := ParseXmlParallel(strings.NewReader(text), "testing/broken.xml", 2)
+	if err == nil {
+		t.Fatalf("expected error parsing broken xml")
+	}
+}
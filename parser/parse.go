@@ -32,13 +32,16 @@ package parser
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -58,6 +61,10 @@ type parser struct {
 	ll *lexer
 	d  *types.Dat
 	pl ParseListener
+
+	multi      bool
+	seenHeader bool
+	dats       []*types.Dat
 }
 
 var (
@@ -106,11 +113,43 @@ func (p *parser) consumeStringValue() (string, error) {
 	}
 }
 
+// stringValue2Int parses a decimal integer. Hex values with a 0x prefix and sizes
+// with a K, M or G suffix (1024 based) are accepted as well.
 func stringValue2Int(input string) (int64, error) {
 	if input == "-" {
 		return 0, nil
 	}
-	return strconv.ParseInt(input, 10, 64)
+
+	v, err := strconv.ParseInt(input, 10, 64)
+	if err == nil || len(input) < 2 {
+		return v, err
+	}
+
+	lower := strings.ToLower(input)
+	if strings.HasPrefix(lower, "0x") {
+		return strconv.ParseInt(lower[2:], 16, 64)
+	}
+
+	var shift uint
+	switch lower[len(lower)-1] {
+	case 'k':
+		shift = 10
+	case 'm':
+		shift = 20
+	case 'g':
+		shift = 30
+	default:
+		return 0, err
+	}
+
+	n, nerr := strconv.ParseInt(lower[:len(lower)-1], 10, 64)
+	if nerr != nil || n < 0 {
+		return 0, err
+	}
+	if n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size value %s out of range", input)
+	}
+	return n << shift, nil
 }
 
 func stringValue2Bool(input string) (bool, error) {
@@ -279,6 +318,29 @@ func (p *parser) gameStmt() (*types.Game, error) {
 			if err != nil {
 				return nil, err
 			}
+		case i.typ == itemSampleOf:
+			g.SampleOf, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemSample:
+			name, err := p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+			g.Samples = append(g.Samples, &types.Sample{Name: name})
+		case i.typ == itemSize:
+			// nonstandard, some DATs give the total size of the game
+			sv, err := p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+			size, err := stringValue2Int(sv)
+			if err != nil || size < 0 {
+				glog.V(2).Infof("ignoring game size %s of game %s", sv, g.Name)
+				size = 0
+			}
+			g.Size = types.GameSize(size)
 		case i.typ == itemRom:
 			r, err := p.romStmt()
 			if err != nil {
@@ -301,6 +363,11 @@ func (p *parser) gameStmt() (*types.Game, error) {
 	if i.typ == itemError {
 		return nil, lexError(i)
 	}
+
+	err = fixNamelessRoms(g)
+	if err != nil {
+		return nil, err
+	}
 	return g, nil
 }
 
@@ -325,6 +392,11 @@ func (p *parser) romStmt() (*types.Rom, error) {
 			if err != nil {
 				return nil, err
 			}
+		case i.typ == itemMerge:
+			r.Merge, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
 		case i.typ == itemSize:
 			r.Size, err = p.consumeIntegerValue()
 			if err != nil {
@@ -366,6 +438,17 @@ func (p *parser) parse() error {
 	for i = p.ll.nextItem(); i.typ != itemEOF && i.typ != itemError; i = p.ll.nextItem() {
 		switch {
 		case i.typ == itemClrMamePro:
+			if p.seenHeader {
+				if !p.multi {
+					return fmt.Errorf("found more than one clrmamepro header, use ParseMulti for concatenated DATs")
+				}
+				p.dats = append(p.dats, p.d)
+				p.d = &types.Dat{
+					Path: p.d.Path,
+				}
+			}
+			p.seenHeader = true
+
 			err := p.datStmt()
 			if err != nil {
 				return err
@@ -467,6 +550,39 @@ func ParseDat(r io.Reader, path string) (*types.Dat, []byte, error) {
 	return p.d, hr.h.Sum(nil), nil
 }
 
+// ParseMulti parses a DAT that may be a concatenation of several DATs, each starting
+// with its own clrmamepro header. Games are assigned to the most recently seen header.
+func ParseMulti(r io.Reader, path string) ([]*types.Dat, []byte, error) {
+	hr := hashingReader{
+		ir: r,
+		h:  sha1.New(),
+	}
+
+	ll, err := lex("dat - "+path, hr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p := &parser{
+		ll:    ll,
+		d:     &types.Dat{},
+		multi: true,
+	}
+
+	p.d.Path = path
+	err = p.parse()
+	if err != nil {
+		derrStr := fmt.Sprintf("error in file %s on line %d: %v", path, p.ll.lineNumber(), err)
+		derr := ParseError.NewWith(derrStr, setErrorFilePath(path), setErrorLineNumber(p.ll.lineNumber()))
+		return nil, nil, derr
+	}
+	p.dats = append(p.dats, p.d)
+	for _, d := range p.dats {
+		d.Normalize()
+	}
+	return p.dats, hr.h.Sum(nil), nil
+}
+
 type hashingReader struct {
 	ir io.Reader
 	h  hash.Hash
@@ -480,19 +596,21 @@ func (r hashingReader) Read(buf []byte) (int, error) {
 	return n, err
 }
 
+// lineCountingReader counts the lines read so far. \r\n and lone \r count as
+// one line terminator, like \n.
 type lineCountingReader struct {
-	ir   io.Reader
-	line int
+	ir     io.Reader
+	line   int
+	lastCR bool
 }
 
-func (r lineCountingReader) Read(buf []byte) (int, error) {
+func (r *lineCountingReader) Read(buf []byte) (int, error) {
 	n, err := r.ir.Read(buf)
-	if err == nil {
-		for _, b := range buf[:n] {
-			if b == '\n' {
-				r.line++
-			}
+	for _, b := range buf[:n] {
+		if b == '\r' || (b == '\n' && !r.lastCR) {
+			r.line++
 		}
+		r.lastCR = b == '\r'
 	}
 	return n, err
 }
@@ -509,8 +627,27 @@ func isXML(path string) (bool, error) {
 		}
 	}()
 
+	return isXMLReader(file)
+}
+
+func isXMLFS(fsys fs.FS, path string) (bool, error) {
+	file, err := fsys.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close file %s: %v", path, err)
+		}
+	}()
+
+	return isXMLReader(file)
+}
+
+func isXMLReader(r io.Reader) (bool, error) {
 	lr := io.LimitedReader{
-		R: file,
+		R: r,
 		N: 21,
 	}
 
@@ -547,6 +684,55 @@ func Parse(path string) (*types.Dat, []byte, error) {
 	return ParseDat(file, path)
 }
 
+// ParseParallel is like Parse but decodes the games of XML DATs on numWorkers
+// goroutines, see ParseXmlParallel.
+func ParseParallel(path string, numWorkers int) (*types.Dat, []byte, error) {
+	isXML, err := isXML(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close file %s: %v", path, err)
+		}
+	}()
+
+	if isXML {
+		return ParseXmlParallel(file, path, numWorkers)
+	}
+	return ParseDat(file, path)
+}
+
+// ParseFS is like Parse but reads the DAT at path from fsys instead of the OS filesystem.
+func ParseFS(fsys fs.FS, path string) (*types.Dat, []byte, error) {
+	isXML, err := isXMLFS(fsys, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := fsys.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close file %s: %v", path, err)
+		}
+	}()
+
+	if isXML {
+		return ParseXml(file, path)
+	}
+	return ParseDat(file, path)
+}
+
 func ParseWithListener(path string, pl ParseListener) ([]byte, error) {
 	isXML, err := isXML(path)
 	if err != nil {
@@ -570,43 +756,177 @@ func ParseWithListener(path string, pl ParseListener) ([]byte, error) {
 	return ParseDatWithListener(file, path, pl)
 }
 
+// ParseReaderWithListener is like ParseWithListener but reads the DAT from r,
+// for DATs that aren't plain files, like decompressed ones. path is only used
+// in error messages and as the DAT path.
+func ParseReaderWithListener(r io.Reader, path string, pl ParseListener) ([]byte, error) {
+	br := bufio.NewReader(r)
+
+	// a short peek just means a DAT shorter than the xml prefix
+	snippet, err := br.Peek(len(xmlPrefixWithBOM))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	isXML, err := isXMLReader(bytes.NewReader(snippet))
+	if err != nil {
+		return nil, err
+	}
+
+	if isXML {
+		return ParseXmlWithListener(br, path, pl)
+	}
+	return ParseDatWithListener(br, path, pl)
+}
+
+func fixHash(h []byte) []byte {
+	if len(h) == 0 {
+		return nil
+	}
+	v, err := hex.DecodeString(string(h))
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
 func fixHashes(rom *types.Rom) {
-	if rom.Crc != nil {
-		strV := string(rom.Crc)
-		if strV != "" {
-			v, err := hex.DecodeString(string(rom.Crc))
-			if err != nil {
-				rom.Crc = nil
-			}
-			rom.Crc = v
-		} else {
-			rom.Crc = nil
-		}
+	rom.Crc = fixHash(rom.Crc)
+	rom.Md5 = fixHash(rom.Md5)
+	rom.Sha1 = fixHash(rom.Sha1)
+}
+
+func fixDiskHashes(disk *types.Disk) {
+	disk.Md5 = fixHash(disk.Md5)
+	disk.Sha1 = fixHash(disk.Sha1)
+}
+
+func fixGameHashes(g *types.Game) {
+	for _, rom := range g.Roms {
+		fixHashes(rom)
 	}
-	if rom.Md5 != nil {
-		strV := string(rom.Md5)
-		if strV != "" {
-			v, err := hex.DecodeString(string(rom.Md5))
-			if err != nil {
-				rom.Md5 = nil
-			}
-			rom.Md5 = v
-		} else {
-			rom.Md5 = nil
+	for _, rom := range g.Parts {
+		fixHashes(rom)
+	}
+	for _, rom := range g.Regions {
+		fixHashes(rom)
+	}
+	for _, disk := range g.Disks {
+		fixDiskHashes(disk)
+	}
+	for _, disk := range g.DiskParts {
+		fixDiskHashes(disk)
+	}
+}
+
+// Root elements of the supported XML DAT flavors.
+const (
+	logiqxRoot        = "datafile"
+	mameRoot          = "mame"
+	softwareListRoot  = "softwarelist"
+	softwareListsRoot = "softwarelists"
+)
+
+type xmlDatafile struct {
+	Header   xmlDatHeader    `xml:"header"`
+	Games    types.GameSlice `xml:"game"`
+	Machines types.GameSlice `xml:"machine"`
+	Software types.GameSlice `xml:"software"`
+}
+
+type xmlMame struct {
+	Build    string          `xml:"build,attr"`
+	Games    types.GameSlice `xml:"game"`
+	Machines types.GameSlice `xml:"machine"`
+}
+
+type xmlSoftwareList struct {
+	Name        string          `xml:"name,attr"`
+	Description string          `xml:"description,attr"`
+	Software    types.GameSlice `xml:"software"`
+}
+
+type xmlSoftwareLists struct {
+	Lists []*xmlSoftwareList `xml:"softwarelist"`
+}
+
+// xmlDatRoot skips to the root element of the XML DAT and returns it.
+func xmlDatRoot(decoder *xml.Decoder) (xml.StartElement, error) {
+	for {
+		t, err := decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			return se, nil
 		}
 	}
-	if rom.Sha1 != nil {
-		strV := string(rom.Sha1)
-		if strV != "" {
-			v, err := hex.DecodeString(string(rom.Sha1))
-			if err != nil {
-				rom.Sha1 = nil
+}
+
+// decodeXmlDat looks at the root element of the XML DAT and decodes it with the
+// struct mapping for that flavor.
+func decodeXmlDat(decoder *xml.Decoder, path string) (*types.Dat, error) {
+	root, err := xmlDatRoot(decoder)
+	if err != nil {
+		return nil, err
+	}
+	return decodeXmlDatRoot(decoder, root, path)
+}
+
+// decodeXmlDatRoot decodes the XML DAT below root, which has been read already.
+func decodeXmlDatRoot(decoder *xml.Decoder, root xml.StartElement, path string) (*types.Dat, error) {
+	d := new(types.Dat)
+
+	switch root.Name.Local {
+	case logiqxRoot:
+		var df xmlDatafile
+		err := decoder.DecodeElement(&df, &root)
+		if err != nil {
+			return nil, err
+		}
+		df.Header.copyTo(d)
+		d.Games = df.Games
+		d.Machines = df.Machines
+		d.Software = df.Software
+	case mameRoot:
+		var m xmlMame
+		err := decoder.DecodeElement(&m, &root)
+		if err != nil {
+			return nil, err
+		}
+		d.Version = m.Build
+		d.Games = m.Games
+		d.Machines = m.Machines
+	case softwareListRoot:
+		var sl xmlSoftwareList
+		err := decoder.DecodeElement(&sl, &root)
+		if err != nil {
+			return nil, err
+		}
+		d.SLName = sl.Name
+		d.SLDescription = sl.Description
+		d.Software = sl.Software
+	case softwareListsRoot:
+		var sls xmlSoftwareLists
+		err := decoder.DecodeElement(&sls, &root)
+		if err != nil {
+			return nil, err
+		}
+		// software of different lists lives in a folder per list
+		for _, sl := range sls.Lists {
+			for _, g := range sl.Software {
+				g.Name = sl.Name + "/" + g.Name
 			}
-			rom.Sha1 = v
-		} else {
-			rom.Sha1 = nil
+			d.Software = append(d.Software, sl.Software...)
+		}
+	default:
+		glog.Warningf("unknown root element %s in xml dat %s, decoding it as a generic dat", root.Name.Local, path)
+		err := decoder.DecodeElement(d, &root)
+		if err != nil {
+			return nil, err
 		}
 	}
+	return d, nil
 }
 
 func ParseXml(r io.Reader, path string) (*types.Dat, []byte, error) {
@@ -617,53 +937,29 @@ func ParseXml(r io.Reader, path string) (*types.Dat, []byte, error) {
 		h:  sha1.New(),
 	}
 
-	lr := lineCountingReader{
+	lr := &lineCountingReader{
 		ir: hr,
 	}
 
-	d := new(types.Dat)
 	decoder := xml.NewDecoder(lr)
 
-	err := decoder.Decode(d)
+	d, err := decodeXmlDat(decoder, path)
 	if err != nil {
 		derrStr := fmt.Sprintf("error in file %s on line %d: %v", path, lr.line, err)
 		derr := XMLParseError.NewWith(derrStr, setErrorFilePath(path), setErrorLineNumber(lr.line))
 		return nil, nil, derr
 	}
 
-	for _, g := range d.Games {
-		for _, rom := range g.Roms {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Parts {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Regions {
-			fixHashes(rom)
-		}
-	}
-
-	for _, g := range d.Software {
-		for _, rom := range g.Roms {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Parts {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Regions {
-			fixHashes(rom)
-		}
-	}
+	for _, gs := range []types.GameSlice{d.Games, d.Software, d.Machines} {
+		for _, g := range gs {
+			fixGameHashes(g)
 
-	for _, g := range d.Machines {
-		for _, rom := range g.Roms {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Parts {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Regions {
-			fixHashes(rom)
+			err = fixNamelessRoms(g)
+			if err != nil {
+				derrStr := fmt.Sprintf("error in file %s: %v", path, err)
+				derr := XMLParseError.NewWith(derrStr, setErrorFilePath(path))
+				return nil, nil, derr
+			}
 		}
 	}
 
@@ -676,6 +972,30 @@ type xmlDatHeader struct {
 	Name        string            `xml:"name"`
 	Description string            `xml:"description"`
 	Clr         *types.Clrmamepro `xml:"clrmamepro"`
+	Rv          *types.Romvault   `xml:"romvault"`
+	ID          string            `xml:"id"`
+	Category    string            `xml:"category"`
+	Version     string            `xml:"version"`
+	Date        string            `xml:"date"`
+	Author      string            `xml:"author"`
+	Homepage    string            `xml:"homepage"`
+	URL         string            `xml:"url"`
+	Comment     string            `xml:"comment"`
+}
+
+func (hdr *xmlDatHeader) copyTo(d *types.Dat) {
+	d.Name = hdr.Name
+	d.Description = hdr.Description
+	d.Clr = hdr.Clr
+	d.Rv = hdr.Rv
+	d.ID = hdr.ID
+	d.Category = hdr.Category
+	d.Version = hdr.Version
+	d.Date = hdr.Date
+	d.Author = hdr.Author
+	d.Homepage = hdr.Homepage
+	d.URL = hdr.URL
+	d.Comment = hdr.Comment
 }
 
 func ParseXmlWithListener(r io.Reader, path string, pl ParseListener) ([]byte, error) {
@@ -686,7 +1006,7 @@ func ParseXmlWithListener(r io.Reader, path string, pl ParseListener) ([]byte, e
 		h:  sha1.New(),
 	}
 
-	lr := lineCountingReader{
+	lr := &lineCountingReader{
 		ir: hr,
 	}
 
@@ -721,9 +1041,7 @@ func ParseXmlWithListener(r io.Reader, path string, pl ParseListener) ([]byte, e
 					return nil, derr
 				}
 
-				d.Name = hdr.Name
-				d.Description = hdr.Description
-				d.Clr = hdr.Clr
+				hdr.copyTo(d)
 
 				d.Normalize()
 
@@ -741,14 +1059,13 @@ func ParseXmlWithListener(r io.Reader, path string, pl ParseListener) ([]byte, e
 					derr := XMLParseError.NewWith(derrStr, setErrorFilePath(path), setErrorLineNumber(lr.line))
 					return nil, derr
 				}
-				for _, rom := range g.Roms {
-					fixHashes(rom)
-				}
-				for _, rom := range g.Parts {
-					fixHashes(rom)
-				}
-				for _, rom := range g.Regions {
-					fixHashes(rom)
+				fixGameHashes(g)
+
+				err = fixNamelessRoms(g)
+				if err != nil {
+					derrStr := fmt.Sprintf("error in file %s on line %d: %v", path, lr.line, err)
+					derr := XMLParseError.NewWith(derrStr, setErrorFilePath(path), setErrorLineNumber(lr.line))
+					return nil, derr
 				}
 				g.Normalize()
 
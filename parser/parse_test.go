@@ -31,10 +31,14 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package parser
 
 import (
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"sort"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 
 	"github.com/uwedeportivo/romba/types"
 )
@@ -46,6 +50,30 @@ func TestParserDatGoesThrough(t *testing.T) {
 	}
 }
 
+func TestParseResourceDat(t *testing.T) {
+	dat, _, err := Parse("testdata/resource.dat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	if len(dat.Games) != 2 {
+		t.Fatalf("expected the resource and the game, got %d games", len(dat.Games))
+	}
+
+	var bios *types.Game
+	for _, g := range dat.Games {
+		if g.Name == "neogeo" {
+			bios = g
+		}
+	}
+	if bios == nil {
+		t.Fatalf("resource neogeo missing from parsed dat")
+	}
+	if bios.Description != "Neo-Geo BIOS" || len(bios.Roms) != 2 {
+		t.Fatalf("expected resource with 2 roms, got %+v", bios)
+	}
+}
+
 func TestParserXmlGoesThrough(t *testing.T) {
 	_, _, err := Parse("testdata/example.xml")
 	if err != nil {
@@ -53,6 +81,78 @@ func TestParserXmlGoesThrough(t *testing.T) {
 	}
 }
 
+func TestParseXmlRoots(t *testing.T) {
+	testCases := []struct {
+		path      string
+		name      string
+		version   string
+		gameNames []string
+	}{
+		{"testdata/example.xml", "AgeMame Artwork", "0.134", nil},
+		{"testdata/mame.xml", "", "0.250 (mame0250)", []string{"10yard", "kof98"}},
+		{"testdata/softwarelist.xml", "snes", "", []string{"megaman7p"}},
+		{"testdata/softwarelists.xml", "", "", []string{"a2600/ae", "snes/megaman7p"}},
+	}
+
+	for _, tc := range testCases {
+		dat, _, err := Parse(tc.path)
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", tc.path, err)
+		}
+
+		if dat.Name != tc.name {
+			t.Fatalf("%s: expected name %q, got %q", tc.path, tc.name, dat.Name)
+		}
+		if dat.Version != tc.version {
+			t.Fatalf("%s: expected version %q, got %q", tc.path, tc.version, dat.Version)
+		}
+		if tc.gameNames == nil {
+			continue
+		}
+		if len(dat.Games) != len(tc.gameNames) {
+			t.Fatalf("%s: expected %d games, got %d", tc.path, len(tc.gameNames), len(dat.Games))
+		}
+		for k, g := range dat.Games {
+			if g.Name != tc.gameNames[k] {
+				t.Fatalf("%s: expected game %s, got %s", tc.path, tc.gameNames[k], g.Name)
+			}
+			if len(g.Roms) == 0 {
+				t.Fatalf("%s: expected roms in game %s", tc.path, g.Name)
+			}
+		}
+	}
+}
+
+func TestStringValue2Int(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected int64
+		ok       bool
+	}{
+		{"8388608", 8388608, true},
+		{"0x800000", 8388608, true},
+		{"0X800000", 8388608, true},
+		{"4M", 4 * 1024 * 1024, true},
+		{"512k", 512 * 1024, true},
+		{"1G", 1024 * 1024 * 1024, true},
+		{"-", 0, true},
+		{"4T", 0, false},
+		{"M", 0, false},
+		{"0xzz", 0, false},
+		{"99999999999G", 0, false},
+	}
+
+	for _, tc := range testCases {
+		v, err := stringValue2Int(tc.input)
+		if tc.ok != (err == nil) {
+			t.Fatalf("stringValue2Int(%s): expected ok = %v, got error %v", tc.input, tc.ok, err)
+		}
+		if tc.ok && v != tc.expected {
+			t.Fatalf("stringValue2Int(%s): expected %d, got %d", tc.input, tc.expected, v)
+		}
+	}
+}
+
 const datText = `
 clrmamepro (
 	name "Acorn Archimedes - Applications"
@@ -123,6 +223,68 @@ func TestParseDat(t *testing.T) {
 	}
 }
 
+var lineEndings = []string{"\r\n", "\r"}
+
+func TestParseDatLineEndings(t *testing.T) {
+	golden, _, err := ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	for _, le := range lineEndings {
+		text := strings.Replace(datText, "\n", le, -1)
+
+		dat, _, err := ParseDat(iotest.OneByteReader(strings.NewReader(text)), "testing/dat")
+		if err != nil {
+			t.Fatalf("error parsing test data with line ending %q: %v", le, err)
+		}
+
+		if !golden.Equals(dat) {
+			fmt.Printf("golden=%s\n", string(types.PrintDat(golden)))
+			fmt.Printf("dat=%s\n", string(types.PrintDat(dat)))
+			t.Fatalf("dat with line ending %q differs from dat with \\n", le)
+		}
+	}
+}
+
+func TestParseDatLineEndingsErrorLine(t *testing.T) {
+	brokenText := strings.Replace(datText, "\tversion 2008-10-11", "\tversion \"2008-10-11", 1)
+
+	_, _, err := ParseDat(strings.NewReader(brokenText), "testing/dat")
+	if err == nil {
+		t.Fatalf("expected error parsing broken dat")
+	}
+	golden := ErrorLineNumber(err)
+
+	for _, le := range lineEndings {
+		text := strings.Replace(brokenText, "\n", le, -1)
+
+		_, _, err := ParseDat(strings.NewReader(text), "testing/dat")
+		if err == nil {
+			t.Fatalf("expected error parsing broken dat with line ending %q", le)
+		}
+		if ErrorLineNumber(err) != golden {
+			t.Fatalf("expected error on line %d with line ending %q, got line %d", golden, le,
+				ErrorLineNumber(err))
+		}
+	}
+}
+
+func TestLineCountingReader(t *testing.T) {
+	for _, le := range append(lineEndings, "\n") {
+		text := strings.Join([]string{"a", "b", "", "c", "d"}, le)
+
+		lr := &lineCountingReader{ir: iotest.OneByteReader(strings.NewReader(text))}
+		_, err := ioutil.ReadAll(lr)
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if lr.line != 4 {
+			t.Fatalf("expected 4 lines with line ending %q, got %d", le, lr.line)
+		}
+	}
+}
+
 func TestParseDatWithListener(t *testing.T) {
 	xpl := new(parseListener)
 	_, err := ParseDatWithListener(strings.NewReader(datText), "testing/dat", xpl)
@@ -450,6 +612,115 @@ func TestParseRomNoHashXml(t *testing.T) {
 	}
 }
 
+const xmlNodumpDisk = `
+<?xml version="1.0"?>
+<mame build="0.185 (mame0185)" debug="no" mameconfig="10">
+	<machine name="kinst" sourcefile="kinst.cpp">
+		<description>Killer Instinct (v1.5d)</description>
+		<rom name="ki-l15d.u98" size="524288" crc="7b65ca3d" sha1="607394d4ba1a71d7a8d4ac0d2bbc8ad1a9faa6e9" region="user1" offset="0"/>
+		<disk name="kinst" sha1="81d833236e994528d1482979261401b198d1ca53" region="ata:0:hdd:image" index="0" writable="no" status="baddump"/>
+		<disk name="kinst2" region="ata:1:hdd:image" index="1" writable="no" status="nodump"/>
+	</machine>
+</mame>
+`
+
+func TestParseNodumpDiskXml(t *testing.T) {
+	dat, _, err := ParseXml(strings.NewReader(xmlNodumpDisk), "testing/xml")
+
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	g := dat.Games[0]
+
+	if len(g.Roms) != 1 {
+		t.Fatalf("expected 1 rom, got %d", len(g.Roms))
+	}
+
+	if len(g.Disks) != 2 {
+		t.Fatalf("expected 2 disks, got %d", len(g.Disks))
+	}
+
+	bad := g.Disks[0]
+	if bad.Status != "baddump" || !bad.Dumped() || hex.EncodeToString(bad.Sha1) != "81d833236e994528d1482979261401b198d1ca53" {
+		t.Fatalf("unexpected baddump disk %+v", bad)
+	}
+
+	nodump := g.Disks[1]
+	if nodump.Status != "nodump" || nodump.Dumped() || nodump.Sha1 != nil || nodump.Md5 != nil {
+		t.Fatalf("unexpected nodump disk %+v", nodump)
+	}
+}
+
+const xmlNoIntroHeader = `<?xml version="1.0"?>
+<!DOCTYPE datafile PUBLIC "-//Logiqx//DTD ROM Management Datafile//EN" "http://www.logiqx.com/Dats/datafile.dtd">
+<datafile>
+	<header>
+		<id>45</id>
+		<name>Nintendo - Nintendo Entertainment System (Headered)</name>
+		<description>Nintendo - Nintendo Entertainment System (Headered)</description>
+		<version>20230924-123802</version>
+		<date>2023-09-24 12:38:02</date>
+		<author>aci68, Arctic Circle System, C. V. Reynolds, Hiccup, kazumi213, Tauwasser</author>
+		<homepage>No-Intro</homepage>
+		<url>https://www.no-intro.org</url>
+		<comment>headered dat</comment>
+		<clrmamepro header="No-Intro_NES.xml"/>
+		<romvault header="No-Intro_NES.xml" forcepacking="fileonly"/>
+		<retool version="2.01.5" exclusions="none"/>
+	</header>
+	<game name="10-Yard Fight (USA, Europe)" id="0000">
+		<description>10-Yard Fight (USA, Europe)</description>
+		<rom name="10-Yard Fight (USA, Europe).nes" size="40976" crc="3d564757" md5="caf9e2c7ac0e0ee5de1b3b2b8de8e69b" sha1="016818bc0a2fe2b02e6a3ae5a1ab5d4e1ab4d3a4" status="verified" serial="NES-YC-USA"/>
+	</game>
+</datafile>
+`
+
+func checkNoIntroHeader(t *testing.T, dat *types.Dat) {
+	if dat.ID != "45" || dat.Version != "20230924-123802" || dat.Date != "2023-09-24 12:38:02" ||
+		dat.Homepage != "No-Intro" || dat.URL != "https://www.no-intro.org" || dat.Comment != "headered dat" ||
+		!strings.HasPrefix(dat.Author, "aci68") {
+		t.Fatalf("unexpected header fields %+v", dat)
+	}
+	if dat.Clr == nil || dat.Clr.Header != "No-Intro_NES.xml" {
+		t.Fatalf("expected clrmamepro header, got %+v", dat.Clr)
+	}
+	if dat.Rv == nil || dat.Rv.Header != "No-Intro_NES.xml" || dat.Rv.ForcePacking != "fileonly" {
+		t.Fatalf("expected romvault header, got %+v", dat.Rv)
+	}
+}
+
+func TestParseNoIntroHeaderXml(t *testing.T) {
+	dat, _, err := ParseXml(strings.NewReader(xmlNoIntroHeader), "testing/xml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	checkNoIntroHeader(t, dat)
+
+	if len(dat.Games) != 1 || len(dat.Games[0].Roms) != 1 {
+		t.Fatalf("expected 1 game with 1 rom")
+	}
+
+	xpl := new(parseListener)
+	_, err = ParseXmlWithListener(strings.NewReader(xmlNoIntroHeader), "testing/xml", xpl)
+	if err != nil {
+		t.Fatalf("error parsing test data with listener: %v", err)
+	}
+	checkNoIntroHeader(t, xpl.d)
+
+	exported := string(types.PrintCompliantDat(dat))
+	for _, field := range []string{`version "20230924-123802"`, `url "https://www.no-intro.org"`, `id "45"`} {
+		if !strings.Contains(exported, field) {
+			t.Fatalf("expected exported dat to contain %s, got %s", field, exported)
+		}
+	}
+
+	_, _, err = ParseDat(strings.NewReader(exported), "testing/dat")
+	if err != nil {
+		t.Fatalf("error parsing exported dat: %v", err)
+	}
+}
+
 type parseListener struct {
 	d *types.Dat
 }
@@ -564,3 +835,383 @@ func TestParseXmlWithListener(t *testing.T) {
 	}
 }
 
+
+const datConcatenatedText = `
+clrmamepro (
+	name "Acorn Archimedes - Applications"
+	description "Acorn Archimedes - Applications (TOSEC-v2008-10-11)"
+)
+
+game (
+	name "Acorn Archimedes RISC OS Application Suite v1.00 (19xx)(Acorn)(Disk 1 of 2)[a][Req RISC OS]"
+	description "Acorn Archimedes RISC OS Application Suite v1.00 (19xx)(Acorn)(Disk 1 of 2)[a][Req RISC OS]"
+	rom ( name "Acorn Archimedes RISC OS Application Suite v1.00 (19xx)(Acorn)(Disk 1 of 2)[a][Req RISC OS].adf" size 819200 crc e43166b9 md5 43ee6acc0c173048f47826307c0a262e )
+)
+
+clrmamepro (
+	name "Commodore C64 - Games"
+	description "Commodore C64 - Games (TOSEC-v2008-10-11)"
+)
+
+game (
+	name "Afterburner (1989)(Sega)(Side A)[cr NEC]"
+	description "Afterburner (1989)(Sega)(Side A)[cr NEC]"
+	rom ( name "Afterburner (1989)(Sega)(Side A)[cr NEC].g64" size 333744 crc 0x175a3f26 md5 36ecf1371d3391c06c16f751431c932b sha1 80353cb168dc5d7cc1dce57971f4ea2640a50ac4 )
+)
+`
+
+func TestParseConcatenatedDatFails(t *testing.T) {
+	_, _, err := ParseDat(strings.NewReader(datConcatenatedText), "testing/dat")
+	if err == nil {
+		t.Fatalf("expected error parsing concatenated dat")
+	}
+}
+
+func TestParseMulti(t *testing.T) {
+	dats, _, err := ParseMulti(strings.NewReader(datConcatenatedText), "testing/dat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	datGoldens := []*types.Dat{
+		&types.Dat{
+			Name:        "Acorn Archimedes - Applications",
+			Description: "Acorn Archimedes - Applications (TOSEC-v2008-10-11)",
+			Path:        "testing/dat",
+			Games: []*types.Game{
+				&types.Game{
+					Name:        "Acorn Archimedes RISC OS Application Suite v1.00 (19xx)(Acorn)(Disk 1 of 2)[a][Req RISC OS]",
+					Description: "Acorn Archimedes RISC OS Application Suite v1.00 (19xx)(Acorn)(Disk 1 of 2)[a][Req RISC OS]",
+					Roms: []*types.Rom{
+						&types.Rom{
+							Name: "Acorn Archimedes RISC OS Application Suite v1.00 (19xx)(Acorn)(Disk 1 of 2)[a][Req RISC OS].adf",
+							Size: 819200,
+							Crc:  []byte{0xe4, 0x31, 0x66, 0xb9},
+							Md5:  []byte{0x43, 0xee, 0x6a, 0xcc, 0xc, 0x17, 0x30, 0x48, 0xf4, 0x78, 0x26, 0x30, 0x7c, 0xa, 0x26, 0x2e},
+						},
+					},
+				},
+			},
+		},
+		&types.Dat{
+			Name:        "Commodore C64 - Games",
+			Description: "Commodore C64 - Games (TOSEC-v2008-10-11)",
+			Path:        "testing/dat",
+			Games: []*types.Game{
+				&types.Game{
+					Name:        "Afterburner (1989)(Sega)(Side A)[cr NEC]",
+					Description: "Afterburner (1989)(Sega)(Side A)[cr NEC]",
+					Roms: []*types.Rom{
+						&types.Rom{
+							Name: "Afterburner (1989)(Sega)(Side A)[cr NEC].g64",
+							Size: 333744,
+							Crc:  []byte{0x17, 0x5a, 0x3f, 0x26},
+							Md5:  []byte{0x36, 0xec, 0xf1, 0x37, 0x1d, 0x33, 0x91, 0xc0, 0x6c, 0x16, 0xf7, 0x51, 0x43, 0x1c, 0x93, 0x2b},
+							Sha1: []byte{0x80, 0x35, 0x3c, 0xb1, 0x68, 0xdc, 0x5d, 0x7c, 0xc1, 0xdc, 0xe5, 0x79, 0x71, 0xf4, 0xea, 0x26, 0x40, 0xa5, 0xa, 0xc4},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if len(dats) != len(datGoldens) {
+		t.Fatalf("expected %d dats, got %d", len(datGoldens), len(dats))
+	}
+
+	for k, datGolden := range datGoldens {
+		datGolden.Normalize()
+
+		if !datGolden.Equals(dats[k]) {
+			fmt.Printf("datGolden=%s\n", string(types.PrintDat(datGolden)))
+			fmt.Printf("dat=%s\n", string(types.PrintDat(dats[k])))
+			t.Fatalf("parsed dat %d differs from golden dat", k)
+		}
+	}
+}
+
+func TestParseFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dats/example.dat": &fstest.MapFile{Data: []byte(datText)},
+		"dats/example.xml": &fstest.MapFile{Data: []byte(xmlForceZipText[1:])},
+	}
+
+	dat, _, err := ParseFS(fsys, "dats/example.dat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	if dat.Name != "Acorn Archimedes - Applications" || len(dat.Games) != 2 {
+		t.Fatalf("unexpected dat %s with %d games", dat.Name, len(dat.Games))
+	}
+
+	dat, _, err = ParseFS(fsys, "dats/example.xml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	if dat.Name != "AgeMame Artwork" || !dat.UnzipGames {
+		t.Fatalf("unexpected dat %s parsed from xml", dat.Name)
+	}
+}
+
+const samplesDatText = `clrmamepro (
+	name "samples"
+	description "samples"
+)
+
+game (
+	name "invaders"
+	description "Space Invaders"
+	sampleof "invaders"
+	rom ( name "invaders.h" size 2048 crc 734f5ad8 )
+	sample "0.wav"
+	sample "1.wav"
+)
+`
+
+const samplesXmlText = `<?xml version="1.0"?>
+<mame build="0.200">
+	<machine name="sinvader" cloneof="invaders" sampleof="invaders">
+		<description>Space Invaders (clone)</description>
+		<rom name="invaders.h" size="2048" crc="734f5ad8"/>
+		<sample name="0"/>
+		<sample name="1"/>
+	</machine>
+</mame>
+`
+
+func TestParseSamples(t *testing.T) {
+	dat, _, err := ParseDat(strings.NewReader(samplesDatText), "testing/samples.dat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	g := dat.Games[0]
+	if g.SampleOf != "invaders" || len(g.Samples) != 2 || g.Samples[1].Name != "1.wav" {
+		t.Fatalf("expected game with sampleof invaders and 2 samples, got %s", string(types.PrintDat(dat)))
+	}
+
+	reparsed, _, err := ParseDat(strings.NewReader(string(types.PrintCompliantDat(dat))), "testing/samples.dat")
+	if err != nil {
+		t.Fatalf("error parsing printed dat: %v", err)
+	}
+	rg := reparsed.Games[0]
+	if rg.SampleOf != g.SampleOf || len(rg.Samples) != len(g.Samples) {
+		t.Fatalf("samples lost printing the dat: %s", string(types.PrintCompliantDat(dat)))
+	}
+
+	dat, _, err = ParseXml(strings.NewReader(samplesXmlText), "testing/samples.xml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	g = dat.Games[0]
+	if g.SampleOf != "invaders" || g.SampleSet() != "invaders" || len(g.Samples) != 2 || g.Samples[0].Name != "0" {
+		t.Fatalf("expected machine with sampleof invaders and 2 samples, got %+v", g)
+	}
+}
+
+const namelessRomDatText = `clrmamepro (
+	name "nameless"
+	description "nameless"
+)
+
+game (
+	name "game"
+	description "game"
+	rom ( name "named.bin" size 4 crc 8bd69e52 )
+	rom ( size 4 crc 8bd69e52 sha1 2fd4e1c67a2d28fced849ee1bb76e7391b93eb12 )
+)
+`
+
+const namelessRomXmlText = `<?xml version="1.0"?>
+<datafile>
+	<header>
+		<name>nameless</name>
+		<description>nameless</description>
+	</header>
+	<game name="game">
+		<description>game</description>
+		<rom name="named.bin" size="4" crc="8bd69e52"/>
+		<rom size="4" crc="8bd69e52" sha1="2fd4e1c67a2d28fced849ee1bb76e7391b93eb12"/>
+	</game>
+</datafile>
+`
+
+func TestParseNamelessRom(t *testing.T) {
+	defer SetNamelessRomPolicy(string(NamelessRomSynthesize))
+
+	parse := func(xml bool) (*types.Dat, error) {
+		if xml {
+			dat, _, err := ParseXml(strings.NewReader(namelessRomXmlText), "testing/nameless.xml")
+			return dat, err
+		}
+		dat, _, err := ParseDat(strings.NewReader(namelessRomDatText), "testing/nameless.dat")
+		return dat, err
+	}
+
+	for _, xml := range []bool{false, true} {
+		err := SetNamelessRomPolicy(string(NamelessRomSynthesize))
+		if err != nil {
+			t.Fatalf("failed to set policy: %v", err)
+		}
+
+		dat, err := parse(xml)
+		if err != nil {
+			t.Fatalf("error parsing dat with nameless rom: %v", err)
+		}
+		roms := dat.Games[0].Roms
+		if len(roms) != 2 || roms[0].Name != "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12.bin" {
+			t.Fatalf("expected nameless rom named after its sha1, got %s", string(types.PrintDat(dat)))
+		}
+
+		err = SetNamelessRomPolicy(string(NamelessRomSkip))
+		if err != nil {
+			t.Fatalf("failed to set policy: %v", err)
+		}
+
+		dat, err = parse(xml)
+		if err != nil {
+			t.Fatalf("error parsing dat with nameless rom: %v", err)
+		}
+		roms = dat.Games[0].Roms
+		if len(roms) != 1 || roms[0].Name != "named.bin" {
+			t.Fatalf("expected nameless rom skipped, got %s", string(types.PrintDat(dat)))
+		}
+
+		err = SetNamelessRomPolicy(string(NamelessRomError))
+		if err != nil {
+			t.Fatalf("failed to set policy: %v", err)
+		}
+
+		_, err = parse(xml)
+		if err == nil {
+			t.Fatalf("expected error parsing dat with nameless rom")
+		}
+	}
+
+	if err := SetNamelessRomPolicy("rename"); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
+
+const mergeDatText = `clrmamepro (
+	name "merge"
+	description "merge"
+)
+
+game (
+	name "pacmanf"
+	description "Pac-Man (speedup hack)"
+	cloneof "puckman"
+	rom ( name "pacman.6e" merge "pacman.6e" size 4096 crc c1e6ab10 )
+	rom ( name "pacmanf.6f" size 4096 crc 720dc3ee )
+)
+`
+
+const mergeXmlText = `<?xml version="1.0"?>
+<mame build="0.200">
+	<machine name="pacmanf" cloneof="puckman" romof="puckman">
+		<description>Pac-Man (speedup hack)</description>
+		<rom name="pacman.6e" merge="pacman.6e" size="4096" crc="c1e6ab10"/>
+		<rom name="pacmanf.6f" size="4096" crc="720dc3ee"/>
+	</machine>
+</mame>
+`
+
+func TestParseRomMerge(t *testing.T) {
+	dat, _, err := ParseDat(strings.NewReader(mergeDatText), "testing/merge.dat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	roms := dat.Games[0].Roms
+	if len(roms) != 2 || roms[0].Merge != "pacman.6e" || roms[1].Merge != "" {
+		t.Fatalf("expected first rom merged from pacman.6e, got %s", string(types.PrintDat(dat)))
+	}
+
+	reparsed, _, err := ParseDat(strings.NewReader(string(types.PrintCompliantDat(dat))), "testing/merge.dat")
+	if err != nil {
+		t.Fatalf("error parsing printed dat: %v", err)
+	}
+	if reparsed.Games[0].Roms[0].Merge != "pacman.6e" {
+		t.Fatalf("merge lost printing the dat: %s", string(types.PrintCompliantDat(dat)))
+	}
+
+	dat, _, err = ParseXml(strings.NewReader(mergeXmlText), "testing/merge.xml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	roms = dat.Games[0].Roms
+	if len(roms) != 2 || roms[0].Merge != "pacman.6e" || roms[1].Merge != "" {
+		t.Fatalf("expected first rom merged from pacman.6e, got %+v", roms)
+	}
+}
+
+func TestParseBiosSets(t *testing.T) {
+	dat, _, err := Parse("testdata/biosset.xml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	var neogeo *types.Game
+	for _, g := range dat.Games {
+		if g.Name == "neogeo" {
+			neogeo = g
+		}
+	}
+	if neogeo == nil {
+		t.Fatalf("machine neogeo missing from parsed dat")
+	}
+
+	if len(neogeo.BiosSets) != 3 || neogeo.BiosSets[1].Name != "asia" || neogeo.BiosSets[1].Default != "yes" {
+		t.Fatalf("expected 3 biossets with asia the default, got %+v", neogeo.BiosSets)
+	}
+
+	bios := make(map[string]string)
+	for _, r := range neogeo.Roms {
+		bios[r.Name] = r.Bios
+	}
+	if bios["sp-s2.sp1"] != "euro" || bios["vs-bios.rom"] != "japan" || bios["sm1.sm1"] != "" {
+		t.Fatalf("unexpected bios of roms %v", bios)
+	}
+
+	for _, tc := range []struct {
+		requested string
+		want      string
+	}{
+		{"", "asia"},
+		{"japan", "japan"},
+		{"unibios", "asia"},
+	} {
+		if got := neogeo.SelectBios(tc.requested); got != tc.want {
+			t.Fatalf("expected bios %s selected for %q, got %s", tc.want, tc.requested, got)
+		}
+	}
+
+	neogeo.BiosSets[1].Default = ""
+	if got := neogeo.SelectBios(""); got != "euro" {
+		t.Fatalf("expected first biosset selected without a default, got %s", got)
+	}
+}
+
+func TestParseNonstandardGameSize(t *testing.T) {
+	for _, path := range []string{"testdata/nonstandard.dat", "testdata/nonstandard.xml"} {
+		dat, _, err := Parse(path)
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", path, err)
+		}
+
+		if len(dat.Games) != 2 {
+			t.Fatalf("%s: expected 2 games, got %d", path, len(dat.Games))
+		}
+
+		sized, unsized := dat.Games[0], dat.Games[1]
+		if sized.Name != "sized" || sized.Size != 1536 || len(sized.Roms) != 2 {
+			t.Fatalf("%s: expected game sized with size 1536 and 2 roms, got %+v", path, sized)
+		}
+		if unsized.Name != "unsized" || unsized.Size != 0 || len(unsized.Roms) != 1 {
+			t.Fatalf("%s: expected game unsized without size and 1 rom, got %+v", path, unsized)
+		}
+	}
+}
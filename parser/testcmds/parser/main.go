@@ -36,6 +36,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/uwedeportivo/romba/parser"
 	"github.com/uwedeportivo/romba/worker"
@@ -72,7 +73,7 @@ func (pw *parseWorker) Close() error {
 type parseGru struct{}
 
 func (pm *parseGru) Accept(path string) bool {
-	ext := filepath.Ext(path)
+	ext := strings.ToLower(filepath.Ext(path))
 	return ext == ".dat" || ext == ".xml"
 }
 
@@ -42,6 +42,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/uwedeportivo/commander"
 	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
 )
 
 func findLatestResumeLog(prefixStr, logDir string) (string, error) {
@@ -132,12 +133,40 @@ func (rs *RombaService) startArchive(cmd *commander.Command, args []string) erro
 		skipInitialScan := cmd.Flag.Lookup("skip-initial-scan").Value.Get().(bool)
 		useGoZip := cmd.Flag.Lookup("use-golang-zip").Value.Get().(bool)
 		noDB := cmd.Flag.Lookup("no-db").Value.Get().(bool)
+		verifyExisting := cmd.Flag.Lookup("verifyExisting").Value.Get().(bool)
+		maxDepth := cmd.Flag.Lookup("maxDepth").Value.Get().(int)
+		trackZipHashes := cmd.Flag.Lookup("trackZipHashes").Value.Get().(bool)
+		hashBufferSize := cmd.Flag.Lookup("hashBufferSize").Value.Get().(int)
+		maxOpenFiles := cmd.Flag.Lookup("maxOpenFiles").Value.Get().(int)
+		reportOut := cmd.Flag.Lookup("reportOut").Value.Get().(string)
+		noSkipExtensions := cmd.Flag.Lookup("noSkipExtensions").Value.Get().(bool)
+		depotWriters := cmd.Flag.Lookup("depotWriters").Value.Get().(int)
+		maxFileSize := cmd.Flag.Lookup("maxFileSize").Value.Get().(int64)
+		recordNames := cmd.Flag.Lookup("recordNames").Value.Get().(bool)
+		checkRoom := cmd.Flag.Lookup("checkRoom").Value.Get().(bool)
+
+		eh := newExecHook(config.GlobalConfig.Archive.Hook, config.GlobalConfig.Archive.HookEvents)
 
 		endMsg, err := rs.depot.Archive(args, resume, includezips, includegzips, include7zips,
-			onlyneeded, numWorkers, rs.logDir, rs.pt, skipInitialScan, useGoZip, noDB)
+			onlyneeded, numWorkers, rs.logDir, rs.pt, skipInitialScan, useGoZip, noDB,
+			&archive.ArchiveOptions{
+				VerifyExisting:   verifyExisting,
+				MaxDepth:         maxDepth,
+				TrackZipHashes:   trackZipHashes,
+				HashBufferSize:   hashBufferSize,
+				MaxOpenFiles:     maxOpenFiles,
+				ReportOut:        reportOut,
+				NoSkipExtensions: noSkipExtensions,
+				NumWriters:       depotWriters,
+				MaxFileSize:      maxFileSize,
+				RecordNames:      recordNames,
+				CheckRoom:        checkRoom,
+				Hook:             eh.hook(),
+			})
 		if err != nil {
 			glog.Errorf("error archiving: %v", err)
 		}
+		eh.close()
 
 		ticker.Stop()
 		stopTicker <- true
@@ -85,6 +85,7 @@ func (rs *RombaService) popBloom(cmd *commander.Command, _ []string) error {
 
 	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
 	numSubWorkers := cmd.Flag.Lookup("subworkers").Value.Get().(int)
+	fromIndex := cmd.Flag.Lookup("fromIndex").Value.Get().(bool)
 
 	rs.pt.Reset()
 	rs.busy = true
@@ -119,8 +120,25 @@ func (rs *RombaService) popBloom(cmd *commander.Command, _ []string) error {
 				pt:            rs.pt,
 			}
 
-			rps, err := rs.depot.ResumePopBloomPaths()
-			if err != nil {
+			if fromIndex {
+				var numAdded int
+				numAdded, err = rs.depot.PopulateBloomFromIndex()
+				if err != nil {
+					glog.Errorf("error populating bloom from index: %v", err)
+				} else {
+					endMsg = fmt.Sprintf("populated bloom with %d sha1s from the index\n", numAdded)
+					err = rs.depot.SaveBloomFilters()
+				}
+			} else if rs.depot.HasManifests() {
+				var numAdded int
+				numAdded, err = rs.depot.PopulateBloomFromManifests()
+				if err != nil {
+					glog.Errorf("error populating bloom from depot manifests: %v", err)
+				} else {
+					endMsg = fmt.Sprintf("populated bloom with %d sha1s from depot manifests\n", numAdded)
+					err = rs.depot.SaveBloomFilters()
+				}
+			} else if rps, err := rs.depot.ResumePopBloomPaths(); err != nil {
 				glog.Errorf("error finding resume points for populating bloom: %v", err)
 			} else {
 				endMsg, err = worker.ResumeWork("populating bloom", rps, pm)
@@ -31,15 +31,19 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package service
 
 import (
+	"crypto/sha1"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 	"github.com/uwedeportivo/commander"
 	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
 	"github.com/uwedeportivo/romba/dedup"
 	"github.com/uwedeportivo/romba/parser"
 	"github.com/uwedeportivo/romba/types"
@@ -47,7 +51,8 @@ import (
 )
 
 type buildWorker struct {
-	pm *buildGru
+	pm         *buildGru
+	scratchDir string
 }
 
 func (pw *buildWorker) Process(path string, size int64) error {
@@ -77,7 +82,7 @@ func (pw *buildWorker) Process(path string, size int64) error {
 	}
 
 	datdir := filepath.Join(pw.pm.outpath, reldatdir)
-	if pw.pm.sha1Tree > 0 {
+	if pw.pm.sha1Tree != nil {
 		datdir = pw.pm.outpath
 	}
 
@@ -88,6 +93,12 @@ func (pw *buildWorker) Process(path string, size int64) error {
 		return err
 	}
 
+	dat = skipBuildGames(dat, pw.pm.skipBios, pw.pm.skipDevice)
+	if pw.pm.split {
+		dat = splitBuildGames(dat)
+	}
+	dat = selectBiosBuildGames(dat, pw.pm.bios)
+
 	for _, game := range dat.Games {
 		for _, rom := range game.Roms {
 			_, err = pw.pm.rs.romDB.CompleteRom(rom)
@@ -99,10 +110,18 @@ func (pw *buildWorker) Process(path string, size int64) error {
 
 	datInComplete := false
 	if pw.pm.fixdatOnly {
-		datInComplete, err = pw.pm.rs.depot.FixDat(dat, datdir, pw.pm.numSubWorkers, pw.pm.deduper, pw.pm.bloomOnly)
+		datInComplete, err = pw.pm.rs.depot.FixDat(dat, datdir, pw.pm.numSubWorkers, pw.pm.deduper,
+			pw.pm.matchKey, pw.pm.bloomOnly)
 	} else {
 		datInComplete, err = pw.pm.rs.depot.BuildDat(dat, datdir, pw.pm.numSubWorkers, pw.pm.deduper,
-			pw.pm.unzipAllGames, pw.pm.sha1Tree)
+			pw.pm.unzipAllGames, &archive.BuildOptions{
+				Sha1Tree:       pw.pm.sha1Tree,
+				Format:         pw.pm.format,
+				ZipCompression: pw.pm.zipCompression,
+				ScratchDir:     pw.scratchDir,
+				SamplesDir:     pw.pm.samplesDir,
+				MatchKey:       pw.pm.matchKey,
+			})
 	}
 
 	if err != nil {
@@ -117,7 +136,10 @@ func (pw *buildWorker) Process(path string, size int64) error {
 }
 
 func (pw *buildWorker) Close() error {
-	return nil
+	if pw.scratchDir == "" {
+		return nil
+	}
+	return os.RemoveAll(pw.scratchDir)
 }
 
 type buildGru struct {
@@ -130,8 +152,100 @@ type buildGru struct {
 	fixdatOnly     bool
 	bloomOnly      bool
 	unzipAllGames  bool
-	sha1Tree       int
+	sha1Tree       *archive.Sha1Tree
+	format         string
+	zipCompression *archive.ZipCompression
 	deduper        dedup.Deduper
+	matchKey       dedup.MatchKey
+	skipBios       bool
+	skipDevice     bool
+	split          bool
+	bios           string
+	samplesDir     string
+}
+
+// skipBuildGames returns dat without the BIOS and/or device games. Games
+// depending on them list the shared roms themselves, so they still build.
+func skipBuildGames(dat *types.Dat, skipBios, skipDevice bool) *types.Dat {
+	if !skipBios && !skipDevice {
+		return dat
+	}
+
+	dc := new(types.Dat)
+	*dc = *dat
+	dc.Games = nil
+
+	for _, g := range dat.Games {
+		if (skipBios && g.Bios()) || (skipDevice && g.Device()) {
+			glog.V(4).Infof("skipping build of game %s in dat %s", g.Name, dat.Name)
+			continue
+		}
+		dc.Games = append(dc.Games, g)
+	}
+	return dc
+}
+
+// splitBuildGames returns dat without the roms carrying a merge attribute. In
+// MAME DATs those roms are inherited from the parent or BIOS set, so a clone
+// built this way only holds the roms it doesn't share.
+func splitBuildGames(dat *types.Dat) *types.Dat {
+	dc := new(types.Dat)
+	*dc = *dat
+	dc.Games = make(types.GameSlice, 0, len(dat.Games))
+
+	for _, g := range dat.Games {
+		gc := new(types.Game)
+		*gc = *g
+		gc.Roms = nil
+
+		for _, r := range g.Roms {
+			if r.Merge != "" {
+				glog.V(4).Infof("leaving rom %s merged from %s out of game %s", r.Name, r.Merge, g.Name)
+				continue
+			}
+			gc.Roms = append(gc.Roms, r)
+		}
+		dc.Games = append(dc.Games, gc)
+	}
+	return dc
+}
+
+// allBios is the -bios value that builds the roms of every biosset.
+const allBios = "all"
+
+// selectBiosBuildGames returns dat with only the roms of the selected biosset
+// left in the games that have biossets, see types.Game.SelectBios. Roms not
+// belonging to a biosset are kept. With allBios dat is returned as is.
+func selectBiosBuildGames(dat *types.Dat, bios string) *types.Dat {
+	if bios == allBios {
+		return dat
+	}
+
+	dc := new(types.Dat)
+	*dc = *dat
+	dc.Games = make(types.GameSlice, 0, len(dat.Games))
+
+	for _, g := range dat.Games {
+		selected := g.SelectBios(bios)
+		if selected == "" {
+			dc.Games = append(dc.Games, g)
+			continue
+		}
+
+		gc := new(types.Game)
+		*gc = *g
+		gc.Roms = nil
+
+		for _, r := range g.Roms {
+			if r.Bios != "" && r.Bios != selected {
+				glog.V(4).Infof("leaving rom %s of bios %s out of game %s", r.Name, r.Bios, g.Name)
+				continue
+			}
+			gc.Roms = append(gc.Roms, r)
+		}
+		dc.Games = append(dc.Games, gc)
+	}
+	return dc
 }
 
 func (pm *buildGru) CalculateWork() bool {
@@ -143,13 +257,20 @@ func (pm *buildGru) NeedsSizeInfo() bool {
 }
 
 func (pm *buildGru) Accept(path string) bool {
-	ext := filepath.Ext(path)
+	ext := strings.ToLower(filepath.Ext(path))
 	return ext == ".dat" || ext == ".xml"
 }
 
 func (pm *buildGru) NewWorker(workerIndex int) worker.Worker {
+	scratchDir, err := archive.NewScratchDir(workerIndex)
+	if err != nil {
+		glog.Errorf("failed to create scratch dir for worker %d, using tmp dir: %v", workerIndex, err)
+		scratchDir = ""
+	}
+
 	return &buildWorker{
-		pm: pm,
+		pm:         pm,
+		scratchDir: scratchDir,
 	}
 }
 
@@ -182,6 +303,50 @@ func (pm *buildGru) Scanned(numFiles int, numBytes int64, commonRootPath string)
 	}
 }
 
+// sha1TreeFlags returns the sha1 tree layout selected by the build flags, nil for
+// a regular build, and the output dir given with -sha1TreeOut.
+func sha1TreeFlags(cmd *commander.Command) (*archive.Sha1Tree, string, error) {
+	legacy := cmd.Flag.Lookup("sha1Tree").Value.Get().(int)
+	out := cmd.Flag.Lookup("sha1TreeOut").Value.Get().(string)
+	depth := cmd.Flag.Lookup("sha1TreeDepth").Value.Get().(int)
+	keepGzip := cmd.Flag.Lookup("sha1TreeKeepGzip").Value.Get().(bool)
+
+	if out == "" {
+		if depth != archive.DefaultSha1TreeDepth || keepGzip {
+			return nil, "", errors.New("-sha1TreeDepth and -sha1TreeKeepGzip require -sha1TreeOut")
+		}
+		return archive.Sha1TreeFromLegacy(legacy), "", nil
+	}
+
+	if legacy > 0 {
+		return nil, "", errors.New("-sha1Tree can't be used together with -sha1TreeOut")
+	}
+	// a sha1 has 20 bytes, one per level
+	if depth < 0 || depth > sha1.Size {
+		return nil, "", fmt.Errorf("-sha1TreeDepth must be between 0 and %d", sha1.Size)
+	}
+	return &archive.Sha1Tree{
+		Depth:    depth,
+		KeepGzip: keepGzip,
+	}, out, nil
+}
+
+// zipCompressionFlags returns the compression selected with -zipLevel and -store,
+// nil for regular torrentzips.
+func zipCompressionFlags(cmd *commander.Command, format string) (*archive.ZipCompression, error) {
+	level := cmd.Flag.Lookup("zipLevel").Value.Get().(int)
+	store := cmd.Flag.Lookup("store").Value.Get().(bool)
+
+	zc, err := archive.CheckZipCompression(level, store)
+	if err != nil {
+		return nil, err
+	}
+	if zc != nil && format != archive.BuildFormatZip {
+		return nil, fmt.Errorf("-zipLevel and -store only apply to the %s format", archive.BuildFormatZip)
+	}
+	return zc, nil
+}
+
 func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 	rs.jobMutex.Lock()
 	defer rs.jobMutex.Unlock()
@@ -194,7 +359,23 @@ func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 		return err
 	}
 
+	sha1Tree, sha1TreeOut, err := sha1TreeFlags(cmd)
+	if err != nil {
+		_, ferr := fmt.Fprintf(cmd.Stdout, "%v", err)
+		if ferr != nil {
+			return ferr
+		}
+		return err
+	}
+
 	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
+	if sha1TreeOut != "" {
+		if outpath != "" {
+			_, err := fmt.Fprintf(cmd.Stdout, "-out and -sha1TreeOut can't be used together")
+			return err
+		}
+		outpath = sha1TreeOut
+	}
 	if outpath == "" {
 		_, err := fmt.Fprintf(cmd.Stdout, "-out flag is required")
 		return err
@@ -203,7 +384,47 @@ func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 	fixdatOnly := cmd.Flag.Lookup("fixdatOnly").Value.Get().(bool)
 	bloomOnly := cmd.Flag.Lookup("bloomOnly").Value.Get().(bool)
 	unzipAllGames := cmd.Flag.Lookup("unzipAllGames").Value.Get().(bool)
-	sha1Tree := cmd.Flag.Lookup("sha1Tree").Value.Get().(int)
+	format := cmd.Flag.Lookup("format").Value.Get().(string)
+	skipBios := cmd.Flag.Lookup("skipBios").Value.Get().(bool)
+	skipDevice := cmd.Flag.Lookup("skipDevice").Value.Get().(bool)
+	split := cmd.Flag.Lookup("split").Value.Get().(bool)
+	bios := cmd.Flag.Lookup("bios").Value.Get().(string)
+	includeSamples := cmd.Flag.Lookup("includeSamples").Value.Get().(bool)
+
+	var samplesDir string
+	if includeSamples {
+		samplesDir = config.GlobalConfig.Depot.Samples
+		if samplesDir == "" {
+			_, err := fmt.Fprintf(cmd.Stdout, "-includeSamples requires samples to be set in the depot section of the config")
+			if err != nil {
+				return err
+			}
+			return errors.New("no samples dir configured")
+		}
+	}
+
+	matchKey, err := matchKeyFlag(cmd)
+	if err != nil {
+		return err
+	}
+
+	err = archive.CheckBuildFormat(format)
+	if err != nil {
+		_, ferr := fmt.Fprintf(cmd.Stdout, "%v", err)
+		if ferr != nil {
+			return ferr
+		}
+		return err
+	}
+
+	zipCompression, err := zipCompressionFlags(cmd, format)
+	if err != nil {
+		_, ferr := fmt.Fprintf(cmd.Stdout, "%v", err)
+		if ferr != nil {
+			return ferr
+		}
+		return err
+	}
 
 	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
 	numSubWorkers := cmd.Flag.Lookup("subworkers").Value.Get().(int)
@@ -220,7 +441,7 @@ func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 		return err
 	}
 
-	deduper, err := dedup.NewLevelDBDeduper()
+	deduper, err := dedup.NewLevelDBDeduper(matchKey)
 	if err != nil {
 		return err
 	}
@@ -248,16 +469,24 @@ func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 		}()
 
 		pm := &buildGru{
-			outpath:       outpath,
-			rs:            rs,
-			numWorkers:    numWorkers,
-			numSubWorkers: numSubWorkers,
-			pt:            rs.pt,
-			fixdatOnly:    fixdatOnly,
-			bloomOnly:     bloomOnly,
-			unzipAllGames: unzipAllGames,
-			sha1Tree:      sha1Tree,
-			deduper:       deduper,
+			outpath:        outpath,
+			rs:             rs,
+			numWorkers:     numWorkers,
+			numSubWorkers:  numSubWorkers,
+			pt:             rs.pt,
+			fixdatOnly:     fixdatOnly,
+			bloomOnly:      bloomOnly,
+			unzipAllGames:  unzipAllGames,
+			sha1Tree:       sha1Tree,
+			format:         format,
+			zipCompression: zipCompression,
+			deduper:        deduper,
+			matchKey:       matchKey,
+			skipBios:       skipBios,
+			skipDevice:     skipDevice,
+			split:          split,
+			bios:           bios,
+			samplesDir:     samplesDir,
 		}
 
 		endMsg, err := worker.Work("building dats", args, pm)
@@ -303,7 +532,12 @@ func (rs *RombaService) dir2dat(cmd *commander.Command, args []string) error {
 	dat.Name = cmd.Flag.Lookup("name").Value.Get().(string)
 	dat.Description = cmd.Flag.Lookup("description").Value.Get().(string)
 
-	err = archive.Dir2Dat(dat, srcpath, outpath)
+	basename := cmd.Flag.Lookup("basename").Value.Get().(bool)
+	lowercase := cmd.Flag.Lookup("lowercase").Value.Get().(bool)
+	stripExt := cmd.Flag.Lookup("stripExt").Value.Get().(bool)
+	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+
+	err = archive.Dir2Dat(dat, srcpath, outpath, basename, lowercase, stripExt, numWorkers)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,189 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+const biosDatText = `<?xml version="1.0"?>
+<mame build="0.250">
+	<machine name="neogeo" isbios="yes">
+		<rom name="sp-s2.sp1" size="131072" crc="9036d879" sha1="4f5ed7105b7128794654ce82b51723e16e389543"/>
+	</machine>
+	<machine name="z80" isdevice="yes">
+		<rom name="z80.bin" size="1024" crc="12345678" sha1="0123456789abcdef0123456789abcdef01234567"/>
+	</machine>
+	<machine name="mslug" romof="neogeo">
+		<rom name="sp-s2.sp1" merge="sp-s2.sp1" size="131072" crc="9036d879" sha1="4f5ed7105b7128794654ce82b51723e16e389543"/>
+		<rom name="201-p1.p1" size="2097152" crc="08d8daa5" sha1="b53a6b3ae2d5a4ffe0e6ccf5ed8d4f2e4e1b3c1f"/>
+	</machine>
+</mame>
+`
+
+func TestSkipBuildGames(t *testing.T) {
+	dat, _, err := parser.ParseXml(strings.NewReader(biosDatText), "testing/bios.xml")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	if len(dat.Games) != 3 {
+		t.Fatalf("expected 3 games, got %d", len(dat.Games))
+	}
+
+	sdat := skipBuildGames(dat, false, false)
+	if len(sdat.Games) != 3 {
+		t.Fatalf("expected 3 games without skipping, got %d", len(sdat.Games))
+	}
+
+	sdat = skipBuildGames(dat, true, false)
+	if len(sdat.Games) != 2 {
+		t.Fatalf("expected 2 games when skipping bios, got %d", len(sdat.Games))
+	}
+	for _, g := range sdat.Games {
+		if g.Name == "neogeo" {
+			t.Fatalf("expected bios machine to be skipped")
+		}
+	}
+
+	sdat = skipBuildGames(dat, true, true)
+	if len(sdat.Games) != 1 || sdat.Games[0].Name != "mslug" {
+		t.Fatalf("expected only mslug to be built, got %d games", len(sdat.Games))
+	}
+
+	bios := false
+	for _, r := range sdat.Games[0].Roms {
+		if r.Name == "sp-s2.sp1" {
+			bios = true
+		}
+	}
+	if !bios {
+		t.Fatalf("expected mslug to keep the bios rom it references")
+	}
+
+	if len(dat.Games) != 3 {
+		t.Fatalf("expected original dat to keep all games, got %d", len(dat.Games))
+	}
+}
+
+func TestSplitBuildGames(t *testing.T) {
+	dat, _, err := parser.ParseXml(strings.NewReader(biosDatText), "testing/bios.xml")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	sdat := splitBuildGames(dat)
+	if len(sdat.Games) != 3 {
+		t.Fatalf("expected 3 games, got %d", len(sdat.Games))
+	}
+
+	for _, g := range sdat.Games {
+		switch g.Name {
+		case "mslug":
+			if len(g.Roms) != 1 || g.Roms[0].Name != "201-p1.p1" {
+				t.Fatalf("expected only the own rom of mslug, got %d roms", len(g.Roms))
+			}
+		default:
+			if len(g.Roms) != 1 {
+				t.Fatalf("expected game %s to keep its rom, got %d roms", g.Name, len(g.Roms))
+			}
+		}
+	}
+
+	for _, g := range dat.Games {
+		if g.Name == "mslug" && len(g.Roms) != 2 {
+			t.Fatalf("expected original mslug to keep both roms, got %d", len(g.Roms))
+		}
+	}
+}
+
+const biosSetDatText = `<?xml version="1.0"?>
+<mame build="0.250">
+	<machine name="neogeo" isbios="yes">
+		<biosset name="euro" description="Europe MVS (Ver. 2)"/>
+		<biosset name="asia" description="Asia MVS (Ver. 3)" default="yes"/>
+		<biosset name="japan" description="Japan MVS (Ver. 3)"/>
+		<rom name="sp-s2.sp1" bios="euro" size="131072" crc="9036d879" sha1="4f5ed7105b7128794654ce82b51723e16e389543"/>
+		<rom name="sp-s3.sp1" bios="asia" size="131072" crc="91b64be3" sha1="720a3e20d26818632aedf2c2fd16c54f213543e1"/>
+		<rom name="vs-bios.rom" bios="japan" size="131072" crc="f0e8f27d" sha1="ecf01eda815909f1facec62abf3594eaa8d11075"/>
+		<rom name="sm1.sm1" size="131072" crc="94416d67" sha1="42f9d7ddd6c0931fd64226a60dc73602b2819dcf"/>
+	</machine>
+	<machine name="10yard">
+		<rom name="yf-a-3p-b" size="8192" crc="2e205ec2" sha1="fcfa08f45423b35f2c99d4e6b5474ab1b3a84fec"/>
+	</machine>
+</mame>
+`
+
+func TestSelectBiosBuildGames(t *testing.T) {
+	dat, _, err := parser.ParseXml(strings.NewReader(biosSetDatText), "testing/biosset.xml")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	romNames := func(dat *types.Dat, game string) []string {
+		var names []string
+		for _, g := range dat.Games {
+			if g.Name == game {
+				for _, r := range g.Roms {
+					names = append(names, r.Name)
+				}
+			}
+		}
+		return names
+	}
+
+	for _, tc := range []struct {
+		bios string
+		want []string
+	}{
+		{"", []string{"sm1.sm1", "sp-s3.sp1"}},
+		{"euro", []string{"sm1.sm1", "sp-s2.sp1"}},
+		{"unibios", []string{"sm1.sm1", "sp-s3.sp1"}},
+		{allBios, []string{"sm1.sm1", "sp-s2.sp1", "sp-s3.sp1", "vs-bios.rom"}},
+	} {
+		sdat := selectBiosBuildGames(dat, tc.bios)
+		if got := romNames(sdat, "neogeo"); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("expected roms %v with bios %q, got %v", tc.want, tc.bios, got)
+		}
+		if got := romNames(sdat, "10yard"); len(got) != 1 {
+			t.Fatalf("expected 10yard to keep its rom with bios %q, got %v", tc.bios, got)
+		}
+	}
+
+	if got := romNames(dat, "neogeo"); len(got) != 4 {
+		t.Fatalf("expected original neogeo to keep all roms, got %v", got)
+	}
+}
@@ -38,9 +38,13 @@ import (
 
 	"github.com/gonuts/flag"
 	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
 	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/dedup"
 )
 
+const matchKeyUsage = "hashes that decide whether two roms are the same: sha1 (sha1, falling back to md5/crc and size) or crc (crc and size only)"
+
 type splitState struct {
 	inQuotedZone bool
 	previousRne  rune
@@ -111,20 +115,41 @@ func splitIntoArgs(argLine string) ([]string, error) {
 func newCommand(writer io.Writer, rs *RombaService) *commander.Command {
 	cmd := new(commander.Command)
 	cmd.UsageLine = "Romba"
-	cmd.Subcommands = make([]*commander.Command, 19)
+	cmd.Subcommands = make([]*commander.Command, 41)
 	cmd.Flag = *flag.NewFlagSet("romba", flag.ContinueOnError)
 	cmd.Stdout = writer
 	cmd.Stderr = writer
 
 	cmd.Subcommands[0] = &commander.Command{
 		Run:       rs.startRefreshDats,
-		UsageLine: "refresh-dats",
+		UsageLine: "refresh-dats [<list of extra DAT directories>]",
 		Short:     "Refreshes the DAT index from the files in the DAT master directory tree.",
 		Long: `
 Refreshes the DAT index from the files in the DAT master directory tree.
 Detects any changes in the DAT master directory tree and updates the DAT index
 accordingly, marking deleted or overwritten dats as orphaned and updating
-contents of any changed dats.`,
+contents of any changed dats.
+
+The DAT master directory tree can span several directories, each listed with
+its own dats= line in the [index] section of the config. Directories given as
+arguments are refreshed together with the configured ones. A dat is only
+orphaned if it isn't found in any of them.
+
+Every dat has two hashes. Its sha1 is the one of the DAT file's bytes and is
+the key of the dat in the index. Its logical sha1 only covers the dat name and
+the names, sizes and hashes of its games' roms and disks, so it survives
+reformatting and changes to the header description, version, author and such.
+If a changed DAT file has the logical sha1 of a dat that wasn't found in this
+refresh, the old entry is dropped instead of being orphaned.
+
+With -indexHashes only the listed rom hash indexes are built for newly indexed
+dats, which keeps the index smaller. Roms of those dats can then only be found
+by the listed hash types: without sha1 lookup and build can't find dats by rom
+sha1, without md5 or crc roms known only by that hash can't be resolved.
+
+With -encodingIssues the paths of dats containing game or rom names that are
+not valid UTF-8 are written to the given file. With -sourceEncoding latin1 such
+names are transcoded to UTF-8 before they are indexed.`,
 		Flag:   *flag.NewFlagSet("romba-refresh-dats", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -133,6 +158,14 @@ contents of any changed dats.`,
 	cmd.Subcommands[0].Flag.Int("workers", config.GlobalConfig.General.Workers,
 		"how many workers to launch for the job")
 	cmd.Subcommands[0].Flag.String("missingSha1s", "", "write paths of dats with missing sha1s into this file")
+	cmd.Subcommands[0].Flag.String("indexHashes", "crc,md5,sha1",
+		"comma separated list of rom hash types to index (crc, md5, sha1)")
+	cmd.Subcommands[0].Flag.String("encodingIssues", "",
+		"write paths of dats with names that are not valid UTF-8 into this file")
+	cmd.Subcommands[0].Flag.String("sourceEncoding", "",
+		"transcode names that are not valid UTF-8 from this encoding (latin1)")
+	cmd.Subcommands[0].Flag.Int("maxDepth", -1,
+		"only descend this many dir levels below the DAT master dir, 0 means only top-level files, -1 means no limit")
 
 	cmd.Subcommands[1] = &commander.Command{
 		Run:       rs.startArchive,
@@ -144,7 +177,39 @@ Traverses the specified directory trees looking for zip files and normal files.
 Unpacked files will be stored as individual entries. Prior to unpacking a zip
 file, the external SHA1 is checked against the DAT index. 
 If -only-needed is set, only those files are put in the ROM archive that
-have a current entry in the DAT index.`,
+have a current entry in the DAT index.
+If -verifyExisting is set, files whose SHA1 is already in the depot are not
+skipped: the stored copy is decompressed and compared byte-for-byte with the
+source file and any mismatches are reported.
+If -trackZipHashes is set, the SHA1 of each zip file whose contents got archived
+is stored in the index, and zip files with a stored SHA1 are skipped entirely
+on later runs.
+Files with an extension listed in the archive section of the config, or in the
+default list of .nfo, .sfv, .txt and similar non-rom files, are skipped without
+being hashed and counted separately. -noSkipExtensions processes them as well.
+With -depotWriters set, the -workers only hash and index roms and hand them
+over to that many goroutines compressing them into the depot, so hashing and
+depot writes can run at different parallelism.
+Files bigger than -maxFileSize bytes are skipped without being hashed and
+counted separately. Zip, gzip and 7z files are checked by their own size.
+If -recordNames is set, the path every rom was ingested from is stored in the
+index, next to any paths recorded before, and printed by lookup -showNames.
+Roms inside zip, gzip and 7z files get the path of the archive file joined with
+their name in it. Nothing is recorded with -no-db.
+With -no-db the DB index is neither read nor written, so -only-needed,
+-trackZipHashes and -recordNames have no effect. Roms already in the depot are
+still skipped, found through the bloom filters and files of the depot roots.
+With -checkRoom archive doesn't start if the files found by the initial scan
+are bigger than the room left in the depot roots, counting both their maxSize
+and the free space of their filesystems. Sizes are taken before compression and
+files already in the depot count too. Without the initial scan there is no such
+check.
+If hook is set in the archive section of the config, that command is run for
+archive events: added for every rom stored in the depot, with its sha1, source
+path and size, checkpoint about once a minute and complete at the end, both with
+the counts of the ingest report. The event is passed as JSON on stdin and its
+type in the ROMBA_EVENT environment variable. hookevents limits the event types.
+Hook commands run one after another, archiving waits when they fall behind.`,
 
 		Flag:   *flag.NewFlagSet("romba-archive", flag.ContinueOnError),
 		Stdout: writer,
@@ -163,7 +228,23 @@ have a current entry in the DAT index.`,
 		" to their contents, flag value > 1 means add 7zip files themselves but don't add content")
 	cmd.Subcommands[1].Flag.Bool("skip-initial-scan", false, "skip the initial scan of the files to determine amount of work")
 	cmd.Subcommands[1].Flag.Bool("use-golang-zip", false, "use go zip implementation instead of zlib")
-	cmd.Subcommands[1].Flag.Bool("no-db", false, "archive into depot but do not touch DB index and ignore only-needed flag")
+	cmd.Subcommands[1].Flag.Bool("no-db", false, "archive into depot but do not touch DB index and ignore only-needed flag,"+
+		" roms already in the depot are still skipped")
+	cmd.Subcommands[1].Flag.Bool("verifyExisting", false, "compare files already in the depot byte-for-byte with the source")
+	cmd.Subcommands[1].Flag.Int("maxDepth", -1,
+		"only descend this many dir levels below each specified dir, 0 means only top-level files, -1 means no limit")
+	cmd.Subcommands[1].Flag.Bool("trackZipHashes", false, "store SHA1 of archived zip files and skip zip files seen before")
+	cmd.Subcommands[1].Flag.Int("hashBufferSize", config.GlobalConfig.General.HashBufferSize,
+		"size in bytes of the read buffer used when hashing files")
+	cmd.Subcommands[1].Flag.Int("maxOpenFiles", config.GlobalConfig.General.MaxOpenFiles,
+		"maximum number of source files open at the same time across all workers, 0 means no limit")
+	cmd.Subcommands[1].Flag.Int("depotWriters", config.GlobalConfig.General.DepotWriters,
+		"how many goroutines write hashed roms into the depot, 0 means each worker writes its own")
+	cmd.Subcommands[1].Flag.String("reportOut", "", "write a JSON summary of the archive run into this file")
+	cmd.Subcommands[1].Flag.Bool("noSkipExtensions", false, "also process files with an extension on the skip list")
+	cmd.Subcommands[1].Flag.Int64("maxFileSize", 0, "skip files bigger than this many bytes, 0 means no limit")
+	cmd.Subcommands[1].Flag.Bool("recordNames", false, "store the path each rom was ingested from in the index")
+	cmd.Subcommands[1].Flag.Bool("checkRoom", false, "don't start if the scanned files don't fit into the depot")
 
 	cmd.Subcommands[2] = &commander.Command{
 		Run:       rs.purge,
@@ -192,7 +273,12 @@ structure. It also deletes the specified DATs from the DAT index.`,
 		Short:     "Creates a DAT file for the specified input directory and saves it to the -out filename.",
 		Long: `
 Walks the specified input directory and builds a DAT file that mirrors its
-structure. Saves this DAT file in specified output filename.`,
+structure. Saves this DAT file in specified output filename.
+Rom and game names are the file paths relative to the input directory. Use
+-basename to drop the directories, -lowercase to lowercase the names and
+-stripExt to remove the extension from game names (rom names keep it).
+With -workers above 1 the files are hashed concurrently and the games are
+sorted by name, so the DAT is the same on every run.`,
 		Flag:   *flag.NewFlagSet("romba-dir2dat", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -202,24 +288,31 @@ structure. Saves this DAT file in specified output filename.`,
 	cmd.Subcommands[3].Flag.String("source", "", "source directory")
 	cmd.Subcommands[3].Flag.String("name", "untitled", "name value in DAT header")
 	cmd.Subcommands[3].Flag.String("description", "", "description value in DAT header")
+	cmd.Subcommands[3].Flag.Bool("basename", false, "use only the file name for rom and game names")
+	cmd.Subcommands[3].Flag.Bool("lowercase", false, "lowercase rom and game names")
+	cmd.Subcommands[3].Flag.Bool("stripExt", false, "strip the extension from game names")
+	cmd.Subcommands[3].Flag.Int("workers", 1, "number of files to hash concurrently")
 
 	cmd.Subcommands[4] = &commander.Command{
 		Run:       rs.diffdat,
-		UsageLine: "diffdat -old <datfile> -new <datfile> -out <outputfile>",
+		UsageLine: "diffdat -old <datfile> [-old <datfile> ...] -new <datfile> -out <outputfile>",
 		Short:     "Creates a DAT file with those entries that are in -new DAT.",
 		Long: `
 Creates a DAT file with those entries that are in -new DAT file and not
-in -old DAT file. Ignores those entries in -old that are not in -new.`,
+in -old DAT file. Ignores those entries in -old that are not in -new.
+-old can be given several times, then only the entries of -new that are in
+none of the -old DAT files are written.`,
 		Flag:   *flag.NewFlagSet("romba-diffdat", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
 	cmd.Subcommands[4].Flag.String("out", "", "output filename")
-	cmd.Subcommands[4].Flag.String("old", "", "old DAT file")
+	cmd.Subcommands[4].Flag.Var(new(stringsFlag), "old", "old DAT file, repeat for several")
 	cmd.Subcommands[4].Flag.String("new", "", "new DAT file")
 	cmd.Subcommands[4].Flag.String("name", "", "name for out DAT file")
 	cmd.Subcommands[4].Flag.String("description", "", "description for out DAT file")
+	cmd.Subcommands[4].Flag.String("matchKey", string(dedup.MatchKeySha1), matchKeyUsage)
 
 	cmd.Subcommands[5] = &commander.Command{
 		Run:       rs.build,
@@ -229,8 +322,32 @@ in -old DAT file. Ignores those entries in -old that are not in -new.`,
 For each specified DAT file it creates the torrentzip files in the specified
 output dir. The files will be placed in the specified location using a folder
 structure according to the original DAT master directory tree structure unless
-the flag sha1Tree is used in which case the directory tree structure is the depot
-sha1 directories.`,
+-sha1TreeOut is given in which case the roms are copied into that dir as a tree
+of sha1 directories like the depot's instead of being built into games.
+-sha1TreeDepth sets the number of directory levels, each named after the next two
+hex digits of the sha1, and -sha1TreeKeepGzip copies the gzip files of the depot
+instead of decompressing them. The deprecated -sha1Tree 1 is -sha1TreeKeepGzip
+and -sha1Tree 2 a decompressed tree, both with -out as the tree dir.
+With -format t7z games are built as torrent7z files instead of torrentzips. This
+needs the t7z binary in PATH. Fixdats are generated the same way for both formats.
+-zipLevel sets the deflate level of the zip entries from 1 to 9 and -store
+stores them uncompressed, for roms that are compressed already. Entry order
+and timestamps still follow torrentzip, but only the default level 9 builds
+torrentzips, the others get no TORRENTZIPPED comment.
+With -skipBios and -skipDevice machines marked isbios or isdevice in MAME DATs
+are neither built nor listed in fixdats. Machines using them still get built
+with the BIOS or device roms they list.
+With -split roms carrying a merge attribute are left out of the games, since
+MAME DATs mark roms inherited from the parent or BIOS set that way. Clones then
+only hold their own roms, like in a split set. Combined with -skipBios the
+BIOS roms aren't built at all.
+Roms of MAME machines tagged with a biosset are only built for one biosset of
+the machine, the one given with -bios or the default biosset of the machine if
+-bios is not given or names none of its biossets. -bios all builds the roms of
+every biosset.
+With -includeSamples the MAME samples of the games are copied from the samples
+dir of the config into a samples folder next to the built games. Missing
+samples are listed in the fixdats.`,
 		Flag:   *flag.NewFlagSet("romba-build", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -239,8 +356,15 @@ sha1 directories.`,
 	cmd.Subcommands[5].Flag.String("out", "", "output dir")
 	cmd.Subcommands[5].Flag.Bool("fixdatOnly", false, "only fix dats and don't generate torrentzips")
 	cmd.Subcommands[5].Flag.Bool("unzipAllGames", false, "don't generate torrentzips")
-	cmd.Subcommands[5].Flag.Int("sha1Tree", 0, `if value >0 copy as sha1 tree. if value == 1,
+	cmd.Subcommands[5].Flag.String("format", archive.BuildFormatZip, "archive format of built games (zip or t7z)")
+	cmd.Subcommands[5].Flag.Int("zipLevel", archive.DefaultZipLevel, "deflate level of the entries of built zips")
+	cmd.Subcommands[5].Flag.Bool("store", false, "store the entries of built zips uncompressed")
+	cmd.Subcommands[5].Flag.Int("sha1Tree", 0, `deprecated, use -sha1TreeOut. if value >0 copy as sha1 tree. if value == 1,
 keep compressed gzip, if value > 1 uncompress into destination sha1`)
+	cmd.Subcommands[5].Flag.String("sha1TreeOut", "", "copy the roms into this dir as a sha1 tree instead of building games")
+	cmd.Subcommands[5].Flag.Int("sha1TreeDepth", archive.DefaultSha1TreeDepth,
+		"number of directory levels of the sha1 tree")
+	cmd.Subcommands[5].Flag.Bool("sha1TreeKeepGzip", false, "copy the gzip files of the depot into the sha1 tree")
 
 	cmd.Subcommands[5].Flag.Int("workers", config.GlobalConfig.General.Workers,
 		"how many workers to launch for the job")
@@ -249,20 +373,53 @@ keep compressed gzip, if value > 1 uncompress into destination sha1`)
 		"how many subworkers to launch for each worker")
 
 	cmd.Subcommands[5].Flag.Bool("bloomOnly", false, "pretend bloom positives are 100% true. only used in fixdatOnly case")
+	cmd.Subcommands[5].Flag.String("matchKey", string(dedup.MatchKeySha1), matchKeyUsage)
+	cmd.Subcommands[5].Flag.Bool("skipBios", false, "don't build machines marked as BIOS")
+	cmd.Subcommands[5].Flag.Bool("skipDevice", false, "don't build machines marked as device")
+	cmd.Subcommands[5].Flag.Bool("split", false, "leave roms with a merge attribute out of the games")
+	cmd.Subcommands[5].Flag.String("bios", "", "biosset to build the bios roms of, all for every biosset")
+	cmd.Subcommands[5].Flag.Bool("includeSamples", false, "gather the samples of the machines as well")
 
 	cmd.Subcommands[6] = &commander.Command{
 		Run:       rs.lookup,
-		UsageLine: "lookup <list of hashes>",
+		UsageLine: "lookup [-inputFile <file>] <list of hashes or paths>",
 		Short:     "For each specified hash it looks up any available information.",
 		Long: `
-For each specified hash it looks up any available information (dat or rom).`,
+For each specified hash it looks up any available information (dat or rom).
+An argument naming an existing file or dir is hashed instead: the sha1 of the
+file, or of every file below the dir, is looked up. Paths are checked first,
+so a file named like a hash is hashed. Otherwise the argument must be a hex
+crc, md5 or sha1. Paths are resolved by the server, relative paths against its
+working dir.
+If a sha1 hash matches a DAT in the index, the DAT's header info and game and
+rom counts are printed and no rom lookup is done for that hash.
+If -quick is set, the uncompressed size of every rom found in the depot is
+checked against its indexed size by reading the gzip footer instead of
+decompressing. Roms of 4GB or more are fully decompressed for that check
+since the gzip footer only stores the size modulo 2^32.
+If -printPath is set, the absolute path of every rom file found in the depot is
+printed, and "indexed but not stored" for roms that are only in the index.
+If -showSource is set, the labels a rom was imported with are printed.
+If -showNames is set, the paths archive -recordNames recorded for a rom are printed.
+With -inputFile the newline-delimited hashes in the file are looked up as well.
+With -exactSize every indexed rom of that many bytes is looked up as well. This
+needs the size index, turned on with sizeindex=true in the index section of
+romba.ini. Roms of size 0 aren't in the size index.
+With the romba command line client, -inputFile - reads the hashes from stdin.
+Malformed hashes are reported and skipped.`,
 		Flag:   *flag.NewFlagSet("romba-lookup", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
 	cmd.Subcommands[6].Flag.Int64("size", -1, "size of the rom to lookup")
+	cmd.Subcommands[6].Flag.Bool("quick", false, "check depot file sizes against the gzip footer")
+	cmd.Subcommands[6].Flag.Bool("printPath", false, "print the absolute depot path of found roms")
 	cmd.Subcommands[6].Flag.String("out", "", "output dir")
+	cmd.Subcommands[6].Flag.String("inputFile", "", "file with newline-delimited hashes to lookup")
+	cmd.Subcommands[6].Flag.Bool("showSource", false, "print the import source label of found roms")
+	cmd.Subcommands[6].Flag.Bool("showNames", false, "print the paths found roms were ingested from")
+	cmd.Subcommands[6].Flag.Int64("exactSize", -1, "lookup all indexed roms of this size")
 
 	cmd.Subcommands[7] = &commander.Command{
 		Run:       rs.progress,
@@ -288,7 +445,7 @@ Gracefully shuts down server saving all the cached data.`,
 
 	cmd.Subcommands[9] = &commander.Command{
 		Run:       rs.memstats,
-		UsageLine: "memstats",
+		UsageLine: "memstats [-json]",
 		Short:     "Prints memory stats.",
 		Long: `
 Print memory stats.`,
@@ -297,17 +454,24 @@ Print memory stats.`,
 		Stderr: writer,
 	}
 
+	cmd.Subcommands[9].Flag.Bool("json", false, "print the stats as a JSON object")
+
 	cmd.Subcommands[10] = &commander.Command{
 		Run:       rs.dbstats,
-		UsageLine: "dbstats",
+		UsageLine: "dbstats [-json]",
 		Short:     "Prints db stats.",
 		Long: `
-Print db stats.`,
+Print db stats, followed by the size, max size, utilization, filesystem free space
+and bloom filter state of each depot root. Sizes are the cached depot sizes.
+With -json the db stats are the generation, the number of DATs and orphaned DATs
+and the disk size of every store of the index.`,
 		Flag:   *flag.NewFlagSet("romba-dbstats", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
+	cmd.Subcommands[10].Flag.Bool("json", false, "print the stats as a JSON object")
+
 	cmd.Subcommands[11] = &commander.Command{
 		Run:       rs.cancel,
 		UsageLine: "cancel",
@@ -324,7 +488,16 @@ Cancels current long-running job.`,
 		UsageLine: "merge",
 		Short:     "Merges depot",
 		Long: `
-Merges specified depot into current depot.`,
+Merges specified depot into current depot.
+With -rateLimit the copying of depot files is throttled to the given number of
+bytes per second, 0 means unlimited. The default comes from the mergeratelimit
+setting in the depot section of the config.
+With -checkRoom merge doesn't start if the files found by the initial scan are
+bigger than the room left in the depot roots, counting files already in the
+depot too.
+With -verifySource every source file is decompressed and its sha1 compared with
+its name before it's copied. Files that are truncated, corrupt or have more than
+one gzip member are logged and skipped, the way fsck would report them.`,
 		Flag:   *flag.NewFlagSet("romba-merge", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -335,6 +508,10 @@ Merges specified depot into current depot.`,
 	cmd.Subcommands[12].Flag.Int("workers", config.GlobalConfig.General.Workers,
 		"how many workers to launch for the job")
 	cmd.Subcommands[12].Flag.Bool("skip-initial-scan", false, "skip the initial scan of the files to determine amount of work")
+	cmd.Subcommands[12].Flag.Int64("rateLimit", config.GlobalConfig.Depot.MergeRateLimit,
+		"maximum bytes per second to copy, 0 means unlimited")
+	cmd.Subcommands[12].Flag.Bool("checkRoom", false, "don't start if the scanned files don't fit into the depot")
+	cmd.Subcommands[12].Flag.Bool("verifySource", false, "check the sha1 of every source file before copying it")
 
 	cmd.Subcommands[13] = &commander.Command{
 		Run:       rs.printVersion,
@@ -362,50 +539,78 @@ in -old DAT files. Ignores those entries in -old that are not in -new.`,
 	cmd.Subcommands[14].Flag.String("out", "", "output dir")
 	cmd.Subcommands[14].Flag.String("old", "", "old DAT file")
 	cmd.Subcommands[14].Flag.String("new", "", "new DAT file")
+	cmd.Subcommands[14].Flag.String("matchKey", string(dedup.MatchKeySha1), matchKeyUsage)
 
 	cmd.Subcommands[15] = &commander.Command{
 		Run:       rs.datstats,
-		UsageLine: "datstats",
+		UsageLine: "datstats [-json] [-file <datfile>]",
 		Short:     "Prints dat stats.",
 		Long: `
-Print dat stats.`,
+Print dat stats. DATs configured as reference-only are not counted.
+Roms are counted once per unique sha1 across all DATs, so the total rom size
+is the size a complete depot needs. For comparison the rom count and size
+summed over the DATs, which counts shared roms once per DAT, are printed too.
+With -file the stats of the given DAT file are printed instead. The file is
+parsed directly, so it doesn't need to be indexed. Besides the game and rom
+counts they include the number of unique sha1s and of roms missing a crc, md5
+or sha1.`,
 		Flag:   *flag.NewFlagSet("romba-datstats", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
+	cmd.Subcommands[15].Flag.Bool("json", false, "print the stats as a JSON object")
+	cmd.Subcommands[15].Flag.String("file", "", "DAT file to print stats for without using the DB")
+
 	cmd.Subcommands[16] = &commander.Command{
 		Run:       rs.export,
-		UsageLine: "export",
+		UsageLine: "export -out <datfile> [-gzip]",
 		Short:     "Exports the hashes associations as a DAT file.",
 		Long: `
-Exports the hashes associations as a DAT file.`,
+Exports the hashes associations as a DAT file.
+With -gzip, or if the output file name ends in .gz, the DAT is written gzip
+compressed. The printed sha1 is the one of the uncompressed DAT.`,
 		Flag:   *flag.NewFlagSet("romba-export", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
 	cmd.Subcommands[16].Flag.String("out", "", "output DAT file")
+	cmd.Subcommands[16].Flag.Bool("gzip", false, "gzip compress the output DAT file")
 
 	cmd.Subcommands[17] = &commander.Command{
 		Run:       rs.imprt,
-		UsageLine: "import",
+		UsageLine: "import -in <datfile> [-source <label>]",
 		Short:     "Import the hashes associations as a DAT file.",
 		Long: `
-Imports the hashes associations as a DAT file.`,
+Imports the hashes associations as a DAT file.
+The DAT file can be gzip compressed, like the ones written by export -gzip.
+With -source the imported roms are tagged with the label, so lookup -showSource
+can tell which imports an association came from. A rom keeps the label of every
+DAT file it was imported from, importing the same file again replaces its label.`,
 		Flag:   *flag.NewFlagSet("romba-import", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
 	}
 
 	cmd.Subcommands[17].Flag.String("in", "", "input DAT file")
+	cmd.Subcommands[17].Flag.String("source", "", "label to tag the imported associations with")
 
 	cmd.Subcommands[18] = &commander.Command{
 		Run:       rs.popBloom,
-		UsageLine: "popbloom",
+		UsageLine: "popbloom [-fromIndex]",
 		Short:     "Populate the bloom filter.",
 		Long: `
-Populate the bloom filter.`,
+Populate the bloom filter. If the depot roots maintain manifests, the bloom
+filter is populated from the manifests instead of walking the depot.
+With -fromIndex the bloom filters are populated from the sha1s in the DB index,
+which is much faster than walking the depot but reflects the index's view of
+the depot, not the files in it. The index doesn't know the root of a rom, so
+the filter of every root gets every sha1. Indexed sha1s that aren't in the depot,
+like roms only referenced by DATs, cost a file check on lookup. Depot files the
+index doesn't know are missing from the filters, so archive stores them again.
+Use popbloom without -fromIndex to get filters matching the depot files, and
+fsck to check the depot files themselves.`,
 		Flag:   *flag.NewFlagSet("romba-popbloom", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -416,6 +621,416 @@ Populate the bloom filter.`,
 
 	cmd.Subcommands[18].Flag.Int("subworkers", config.GlobalConfig.General.Workers,
 		"how many subworkers to launch for each worker")
+	cmd.Subcommands[18].Flag.Bool("fromIndex", false, "populate the bloom filters from the sha1s in the DB index")
+
+	cmd.Subcommands[19] = &commander.Command{
+		Run:       rs.splitdat,
+		UsageLine: "splitdat -in <datfile> -out <outputdir> [-maxGames <n>] [-maxBytes <n>]",
+		Short:     "Splits a DAT file into smaller DAT files.",
+		Long: `
+Splits the -in DAT file into several DAT files written into the -out directory.
+Each DAT file holds at most -maxGames games and at most -maxBytes bytes of roms.
+The header of the -in DAT is kept in each DAT file with a chunk suffix added
+to name and description.`,
+		Flag:   *flag.NewFlagSet("romba-splitdat", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[19].Flag.String("in", "", "input DAT file")
+	cmd.Subcommands[19].Flag.String("out", "", "output dir")
+	cmd.Subcommands[19].Flag.Int("maxGames", 0, "maximum number of games per DAT file")
+	cmd.Subcommands[19].Flag.Int64("maxBytes", 0, "maximum number of rom bytes per DAT file")
+
+	cmd.Subcommands[20] = &commander.Command{
+		Run:       rs.fsck,
+		UsageLine: "fsck [-quarantine <dir>] [-depot <depotpath>] [-useManifest]",
+		Short:     "Checks the gzip files in the depot for truncation and corruption.",
+		Long: `
+Reads every gzip file in the depot completely. Files that end early or
+decompress to a different size than recorded when they were archived are
+reported as truncated. Files whose content doesn't match their sha1 are
+reported as corrupt. Files with more than one gzip member, which archive never
+writes, are reported as multi-member. If -quarantine is given, flagged files
+are moved into its truncated, corrupt and multimember subdirectories so that
+they can be archived again from their source. With -useManifest the files to
+check are read from the depot root manifests instead of walking the depot.`,
+		Flag:   *flag.NewFlagSet("romba-fsck", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[20].Flag.String("quarantine", "", "move truncated, corrupt and multi-member files into this directory")
+	cmd.Subcommands[20].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+	cmd.Subcommands[20].Flag.String("depot", "", "work only on specified depot path")
+	cmd.Subcommands[20].Flag.Int("hashBufferSize", config.GlobalConfig.General.HashBufferSize,
+		"size in bytes of the read buffer used when hashing depot files")
+	cmd.Subcommands[20].Flag.Bool("useManifest", false,
+		"read the depot files to check from the depot root manifests instead of walking the depot")
+
+	cmd.Subcommands[21] = &commander.Command{
+		Run:       rs.whereis,
+		UsageLine: "whereis -sha1 <hash>",
+		Short:     "Shows which depot roots hold the specified sha1.",
+		Long: `
+For each depot root shows whether its bloom filter claims the specified sha1
+and whether the rom file is actually present in that root.`,
+		Flag:   *flag.NewFlagSet("romba-whereis", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[21].Flag.String("sha1", "", "sha1 of the rom to look for")
+
+	cmd.Subcommands[22] = &commander.Command{
+		Run:       rs.purgeRom,
+		UsageLine: "purge-rom -sha1 <hash>",
+		Short:     "Deletes the rom with the specified sha1 from the depot and the index.",
+		Long: `
+Deletes the rom file with the specified sha1 from whichever depot root holds it
+and removes its crc and md5 mappings from the index. Bloom filters can't
+remove entries, so they may still report the rom as present until they are
+rebuilt with popbloom.`,
+		Flag:   *flag.NewFlagSet("romba-purge-rom", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[22].Flag.String("sha1", "", "sha1 of the rom to purge")
+
+	cmd.Subcommands[23] = &commander.Command{
+		Run:       rs.indexAudit,
+		UsageLine: "index-audit -dats <datsdir>",
+		Short:     "Checks the DAT index against the DATs in the specified directory.",
+		Long: `
+Parses the DATs in the specified directory and checks that the DAT index holds
+each of them and associates each of their roms with them. DATs and rom
+associations missing from the index are reported, as well as current DATs in the
+index that are not in the specified directory and rom associations of audited
+DATs that the DAT files don't have. The report is written into the log
+directory. This checks the index only, not whether roms are in the depot.`,
+		Flag:   *flag.NewFlagSet("romba-index-audit", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[23].Flag.String("dats", "", "directory with the DATs to audit the index against")
+	cmd.Subcommands[23].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[24] = &commander.Command{
+		Run:       rs.status,
+		UsageLine: "status -dats <datsdir> -out <outputdir>",
+		Short:     "For each DAT in the specified directory it creates a have DAT and a miss DAT.",
+		Long: `
+For each DAT file in the specified directory it creates a have DAT listing the
+roms present in the depot and a miss DAT listing the roms missing from the depot.
+The DATs are placed in the specified output dir using the folder structure of
+the DAT directory and are named after the original DAT with a have- or miss-
+prefix. A DAT without any present (or missing) roms gets no have (or miss) DAT.
+DATs configured as reference-only are skipped.`,
+		Flag:   *flag.NewFlagSet("romba-status", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[24].Flag.String("dats", "", "directory with the DATs to compute the status for")
+	cmd.Subcommands[24].Flag.String("out", "", "output dir for the have and miss DATs")
+	cmd.Subcommands[24].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[25] = &commander.Command{
+		Run:       rs.verifyTZ,
+		UsageLine: "verify-tz <space-separated list of directories with zip files>",
+		Short:     "Checks that the zip files in the specified directories are valid torrentzips.",
+		Long: `
+Checks each zip file in the specified directories against the torrentzip spec:
+entries in canonical order, deflate compression, the fixed torrentzip timestamp
+and flags, no extra fields or comments and a zip comment matching the crc of the
+central directory. Nonconformant files and their violations are written into a
+report in the log directory.`,
+		Flag:   *flag.NewFlagSet("romba-verify-tz", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[25].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[26] = &commander.Command{
+		Run:       rs.retagDat,
+		UsageLine: "retag-dat -sha1 <hash> [-name <name>] [-description <description>]",
+		Short:     "Changes the name and description of an indexed DAT.",
+		Long: `
+Changes the name and/or description stored in the DAT index for the DAT with
+the specified sha1 without refreshing the index. The roms of the DAT and their
+associations with it stay untouched. The next refresh-dats stores the header
+from the DAT file again.`,
+		Flag:   *flag.NewFlagSet("romba-retag-dat", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[26].Flag.String("sha1", "", "sha1 of the DAT to retag")
+	cmd.Subcommands[26].Flag.String("name", "", "new name of the DAT")
+	cmd.Subcommands[26].Flag.String("description", "", "new description of the DAT")
+
+	cmd.Subcommands[27] = &commander.Command{
+		Run:       rs.pruneEmptyDirs,
+		UsageLine: "prune-empty-dirs",
+		Short:     "Removes empty directories from the depot.",
+		Long: `
+Walks every depot root bottom-up and removes the directories that contain no
+files, like the ones left behind by purge-rom and purge-backup. The depot roots
+themselves and their size, bloom filter and manifest files stay untouched.
+Reports the number of removed directories per depot root.`,
+		Flag:   *flag.NewFlagSet("romba-prune-empty-dirs", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[28] = &commander.Command{
+		Run:       rs.mergedat,
+		UsageLine: "mergedat -in <datsdir> -out <datfile> [-name <name>] [-description <description>]",
+		Short:     "Merges the DAT files in a directory into one DAT file.",
+		Long: `
+Parses every DAT file in the -in directory tree and writes all their games into
+the single DAT file -out, under a header with the given -name and -description.
+Name defaults to the name of the -in directory, description to the name.
+Games that have the same name and the same roms as an already merged game are
+skipped. Games that share a name but differ in their roms are all kept, the later
+ones renamed with a " (2)", " (3)", ... suffix. The games of the merged DAT are
+sorted by name.`,
+		Flag:   *flag.NewFlagSet("romba-mergedat", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[28].Flag.String("in", "", "input dir with the DATs to merge")
+	cmd.Subcommands[28].Flag.String("out", "", "output DAT file")
+	cmd.Subcommands[28].Flag.String("name", "", "name of the merged DAT")
+	cmd.Subcommands[28].Flag.String("description", "", "description of the merged DAT")
+	cmd.Subcommands[28].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[29] = &commander.Command{
+		Run:       rs.findDupDats,
+		UsageLine: "find-dup-dats [<list of extra DAT directories>]",
+		Short:     "Reports duplicate DAT files in the DAT master directory tree.",
+		Long: `
+Computes the sha1 of every DAT file in the DAT master directory tree and in the
+directories given as arguments, and reports the groups of files with the same
+sha1. refresh-dats indexes such a DAT only once, so all but one of the files can
+be removed from the tree.`,
+		Flag:   *flag.NewFlagSet("romba-find-dup-dats", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[29].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[30] = &commander.Command{
+		Run:       rs.benchmark,
+		UsageLine: "benchmark [-dir <scratchdir>] [-files <n>] [-size <bytes>] [-workers <n>]",
+		Short:     "Measures hashing and depot write and read throughput.",
+		Long: `
+Creates -files files of -size random bytes and measures how fast -workers
+workers hash them, store them as depot gzip files and read them back, using
+the same code as archive and build. The files are written into a scratch
+depot root below -dir, which defaults to the configured tmp dir, and are
+removed afterwards. Point -dir at the drive of a depot root to measure it.
+The fsync setting of the depot applies to the writes.`,
+		Flag:   *flag.NewFlagSet("romba-benchmark", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[30].Flag.String("dir", "", "dir to create the scratch depot root in")
+	cmd.Subcommands[30].Flag.Int("files", 100, "number of files to write and read")
+	cmd.Subcommands[30].Flag.Int64("size", 10<<20, "size of each file in bytes")
+	cmd.Subcommands[30].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[31] = &commander.Command{
+		Run:       rs.flushRoot,
+		UsageLine: "flush-root -depot <depotroot>",
+		Short:     "Writes the size file and bloom filter of a depot root.",
+		Long: `
+Marks the specified depot root as changed and writes its size file and bloom
+filter right away instead of waiting for the next periodic flush. Use it before
+backing up a root or after manipulating it outside of romba. It doesn't run while
+another job is busy, and the bloom filter isn't written while it is still being
+loaded.`,
+		Flag:   *flag.NewFlagSet("romba-flush-root", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[31].Flag.String("depot", "", "depot root to flush")
+
+	cmd.Subcommands[32] = &commander.Command{
+		Run:       rs.roots,
+		UsageLine: "roots [-json]",
+		Short:     "Prints the configured depot roots.",
+		Long: `
+Prints the path, current size and max size of every depot root configured for
+this instance, and whether romba can create files in it.`,
+		Flag:   *flag.NewFlagSet("romba-roots", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[32].Flag.Bool("json", false, "print the roots as a JSON array")
+
+	cmd.Subcommands[33] = &commander.Command{
+		Run:       rs.incomplete,
+		UsageLine: "incomplete [-json] -dat <datfile>",
+		Short:     "Lists the games of a DAT that are partially present or missing.",
+		Long: `
+Classifies every game of the specified DAT file as complete, partial or missing
+depending on which of its roms are in the depot. Partial games are listed with
+the names of their missing roms, missing games by name. Complete games are only
+counted. With -json all games are printed with their classification.`,
+		Flag:   *flag.NewFlagSet("romba-incomplete", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[33].Flag.String("dat", "", "DAT file to check")
+	cmd.Subcommands[33].Flag.Bool("json", false, "print the games as a JSON object")
+
+	cmd.Subcommands[34] = &commander.Command{
+		Run:       rs.verifyZip,
+		UsageLine: "verify-zip [-json] -zip <file> -dat <datfile> -game <name>",
+		Short:     "Checks a zip file against a game of a DAT.",
+		Long: `
+Hashes every entry of the specified zip file and compares the entries with the
+roms of the named game in the specified DAT file. Roms without a matching entry
+are reported as missing, entries matching a rom under another name as misnamed
+and entries matching no rom as extra. The zip is a valid complete set if every
+rom is present under its name and there are no extra entries.`,
+		Flag:   *flag.NewFlagSet("romba-verify-zip", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[34].Flag.String("zip", "", "zip file to check")
+	cmd.Subcommands[34].Flag.String("dat", "", "DAT file with the game")
+	cmd.Subcommands[34].Flag.String("game", "", "name of the game to check the zip against")
+	cmd.Subcommands[34].Flag.Bool("json", false, "print the result as a JSON object")
+
+	cmd.Subcommands[35] = &commander.Command{
+		Run:       rs.generation,
+		UsageLine: "generation [-set <n>]",
+		Short:     "Prints the generation counter of the DAT index.",
+		Long: `
+Prints the generation counter read from the romba-generation file of the DAT
+index. Every refresh-dats increments it, and DATs indexed in an older
+generation count as orphaned.
+With -set the counter is overwritten, in the file and in the running server,
+for recovering from a lost or damaged generation file. Setting it to a value
+other than the one the current DATs got indexed with orphans them until the
+next refresh-dats.`,
+		Flag:   *flag.NewFlagSet("romba-generation", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[35].Flag.Int64("set", -1, "overwrite the generation counter with this value")
+
+	cmd.Subcommands[36] = &commander.Command{
+		Run:       rs.lexTokens,
+		UsageLine: "lextokens -file <datfile>",
+		Short:     "Debug tool printing the lexer tokens of a DAT file.",
+		Long: `
+Runs the DAT lexer over the specified file without parsing it and prints the
+line, type and value of every token, up to the end of the file or the first
+lexer error. Meant for debugging DAT files that fail to parse.`,
+		Flag:   *flag.NewFlagSet("romba-lextokens", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[36].Flag.String("file", "", "DAT file to lex")
+
+	cmd.Subcommands[37] = &commander.Command{
+		Run:       rs.snapshot,
+		UsageLine: "snapshot -out <dir>",
+		Short:     "Writes a consistent copy of the index into a directory.",
+		Long: `
+Copies every store of the index, and the generation file, into the specified
+directory, which must not hold an index yet. No other command can start while
+the snapshot is written, so the copy reflects the index at a single generation.
+A snapshot is complete once its romba-generation file exists.
+
+To restore a snapshot, stop rombaserver, move the directory configured as db in
+the index section of romba.ini out of the way, copy the snapshot directory in
+its place and start rombaserver again.`,
+		Flag:   *flag.NewFlagSet("romba-snapshot", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[37].Flag.String("out", "", "directory to write the snapshot into")
+
+	cmd.Subcommands[38] = &commander.Command{
+		Run:       rs.datCoverage,
+		UsageLine: "dat-coverage -file <datfile>",
+		Short:     "Reports the keywords of a DAT file the parser ignores.",
+		Long: `
+Reads the specified clrmamepro DAT file and prints the keywords in it the parser
+doesn't handle, like biosset or archive, with the block they appear in and how
+often, most frequent first. Whatever follows such a keyword is dropped when the
+DAT gets indexed. Blocks the parser ignores are reported by their keyword only.`,
+		Flag:   *flag.NewFlagSet("romba-dat-coverage", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[38].Flag.String("file", "", "DAT file to check")
+
+	cmd.Subcommands[39] = &commander.Command{
+		Run:       rs.normalizeDat,
+		UsageLine: "normalize-dat -in <datfile> [-out <datfile>]",
+		Short:     "Rewrites a DAT file in canonical sorted form.",
+		Long: `
+Parses the -in DAT file and writes it as a clrmamepro DAT into the -out file,
+or back into the -in file without -out. Games are sorted by name and their roms
+by name, size and hashes, values are quoted the same way throughout, so DAT
+versions can be diffed. Only what romba reads from a DAT is written, disks and
+unknown fields are dropped, see dat-coverage. XML DATs are written as clrmamepro
+DATs as well.`,
+		Flag:   *flag.NewFlagSet("romba-normalize-dat", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[39].Flag.String("in", "", "input DAT file")
+	cmd.Subcommands[39].Flag.String("out", "", "output DAT file, defaults to the input DAT file")
+
+	cmd.Subcommands[40] = &commander.Command{
+		Run:       rs.intersectdat,
+		UsageLine: "intersectdat -a <datfile> -b <datfile> -out <outputfile>",
+		Short:     "Creates a DAT file with those entries that are in both -a and -b DAT.",
+		Long: `
+Creates a DAT file with those entries of -a DAT file that are in -b DAT file as
+well, in the games of -a they belong to. Games without any such entries are
+left out. Entries are matched the same way diffdat matches them, by SHA1 or,
+for entries without one, by MD5 or CRC together with the size. -matchKey crc
+matches by CRC and size only.`,
+		Flag:   *flag.NewFlagSet("romba-intersectdat", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[40].Flag.String("out", "", "output filename")
+	cmd.Subcommands[40].Flag.String("a", "", "first DAT file")
+	cmd.Subcommands[40].Flag.String("b", "", "second DAT file")
+	cmd.Subcommands[40].Flag.String("name", "", "name for out DAT file")
+	cmd.Subcommands[40].Flag.String("description", "", "description for out DAT file")
+	cmd.Subcommands[40].Flag.String("matchKey", string(dedup.MatchKeySha1), matchKeyUsage)
 
 	return cmd
 }
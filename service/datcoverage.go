@@ -0,0 +1,74 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/parser"
+)
+
+func (rs *RombaService) datCoverage(cmd *commander.Command, args []string) error {
+	path := cmd.Flag.Lookup("file").Value.Get().(string)
+	if path == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-file argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing file argument")
+	}
+
+	kcs, err := parser.UnhandledKeywords(path)
+	if err != nil {
+		return err
+	}
+
+	if len(kcs) == 0 {
+		_, err = fmt.Fprintf(cmd.Stdout, "the parser handles all keywords in %s\n", path)
+		return err
+	}
+
+	bw := bufio.NewWriter(cmd.Stdout)
+	for _, kc := range kcs {
+		block := kc.Block
+		if block == "" {
+			block = "top level"
+		}
+		_, err = fmt.Fprintf(bw, "%d\t%s\t%s\n", kc.Count, block, kc.Keyword)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -50,14 +50,63 @@ import (
 	"github.com/uwedeportivo/romba/worker"
 )
 
+// matchKeyFlag parses the -matchKey flag of cmd, reporting an invalid value on cmd.Stdout.
+func matchKeyFlag(cmd *commander.Command) (dedup.MatchKey, error) {
+	matchKey, err := dedup.ParseMatchKey(cmd.Flag.Lookup("matchKey").Value.Get().(string))
+	if err != nil {
+		_, ferr := fmt.Fprintf(cmd.Stdout, "%v", err)
+		if ferr != nil {
+			return "", ferr
+		}
+		return "", err
+	}
+	return matchKey, nil
+}
+
+// stringsFlag collects the values of a flag that can be given several times.
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
+}
+
+func (sf *stringsFlag) Set(s string) error {
+	*sf = append(*sf, s)
+	return nil
+}
+
+func (sf *stringsFlag) Get() interface{} {
+	return []string(*sf)
+}
+
+// diffDats returns the roms of newDat that are in none of oldDats, or nil if
+// there are none. Empty roms are left out.
+func diffDats(oldDats []*types.Dat, newDat *types.Dat, dd dedup.Deduper) (*types.Dat, error) {
+	for _, oldDat := range oldDats {
+		err := dedup.Declare(oldDat, dd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	diffDat, err := dedup.Dedup(newDat, dd)
+	if err != nil || diffDat == nil {
+		return nil, err
+	}
+
+	return diffDat.FilterRoms(func(r *types.Rom) bool {
+		return r.Size > 0
+	}), nil
+}
+
 func (rs *RombaService) diffdat(cmd *commander.Command, args []string) error {
-	oldDatPath := cmd.Flag.Lookup("old").Value.Get().(string)
+	oldDatPaths := cmd.Flag.Lookup("old").Value.Get().([]string)
 	newDatPath := cmd.Flag.Lookup("new").Value.Get().(string)
 	outPath := cmd.Flag.Lookup("out").Value.Get().(string)
 	givenName := cmd.Flag.Lookup("name").Value.Get().(string)
 	givenDescription := cmd.Flag.Lookup("description").Value.Get().(string)
 
-	if oldDatPath == "" {
+	if len(oldDatPaths) == 0 {
 		_, err := fmt.Fprintf(cmd.Stdout, "-old argument required")
 		if err != nil {
 			return err
@@ -79,13 +128,22 @@ func (rs *RombaService) diffdat(cmd *commander.Command, args []string) error {
 		return errors.New("missing out argument")
 	}
 
-	glog.Infof("diffdat new dat %s and old dat %s into %s", newDatPath, oldDatPath, outPath)
-
-	oldDat, _, err := parser.Parse(oldDatPath)
+	matchKey, err := matchKeyFlag(cmd)
 	if err != nil {
 		return err
 	}
 
+	glog.Infof("diffdat new dat %s and old dats %s into %s", newDatPath, strings.Join(oldDatPaths, ", "), outPath)
+
+	oldDats := make([]*types.Dat, 0, len(oldDatPaths))
+	for _, oldDatPath := range oldDatPaths {
+		oldDat, _, err := parser.Parse(oldDatPath)
+		if err != nil {
+			return err
+		}
+		oldDats = append(oldDats, oldDat)
+	}
+
 	newDat, _, err := parser.Parse(newDatPath)
 	if err != nil {
 		return err
@@ -99,7 +157,7 @@ func (rs *RombaService) diffdat(cmd *commander.Command, args []string) error {
 		givenDescription = givenName
 	}
 
-	dd, err := dedup.NewLevelDBDeduper()
+	dd, err := dedup.NewLevelDBDeduper(matchKey)
 	if err != nil {
 		return err
 	}
@@ -110,20 +168,11 @@ func (rs *RombaService) diffdat(cmd *commander.Command, args []string) error {
 		}
 	}()
 
-	err = dedup.Declare(oldDat, dd)
-	if err != nil {
-		return err
-	}
-
-	diffDat, err := dedup.Dedup(newDat, dd)
+	diffDat, err := diffDats(oldDats, newDat, dd)
 	if err != nil {
 		return err
 	}
 
-	diffDat = diffDat.FilterRoms(func(r *types.Rom) bool {
-		return r.Size > 0
-	})
-
 	var endMsg string
 
 	if diffDat != nil {
@@ -251,14 +300,19 @@ func (rs *RombaService) ediffdatWork(cmd *commander.Command, args []string) erro
 		return errors.New("missing out argument")
 	}
 
-	err := os.MkdirAll(outPath, 0777)
+	matchKey, err := matchKeyFlag(cmd)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(outPath, 0777)
 	if err != nil {
 		return err
 	}
 
 	glog.Infof("ediffdat new dat %s and old dat %s into %s", newDatPath, oldDatPath, outPath)
 
-	dd, err := dedup.NewLevelDBDeduper()
+	dd, err := dedup.NewLevelDBDeduper(matchKey)
 	if err != nil {
 		return err
 	}
@@ -279,7 +333,7 @@ func (rs *RombaService) ediffdatWork(cmd *commander.Command, args []string) erro
 				return nil
 			}
 
-			ext := filepath.Ext(path)
+			ext := strings.ToLower(filepath.Ext(path))
 			if ext == ".dat" || ext == ".xml" {
 				rs.pt.DeclareFile(path)
 
@@ -309,7 +363,7 @@ func (rs *RombaService) ediffdatWork(cmd *commander.Command, args []string) erro
 				return nil
 			}
 
-			ext := filepath.Ext(path)
+			ext := strings.ToLower(filepath.Ext(path))
 			if ext == ".dat" || ext == ".xml" {
 				rs.pt.DeclareFile(path)
 
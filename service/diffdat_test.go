@@ -0,0 +1,107 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gonuts/flag"
+	"github.com/uwedeportivo/romba/dedup"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// diffTestDat returns a DAT with one game per sha1 suffix, each holding one rom.
+func diffTestDat(t *testing.T, name string, suffixes ...int) *types.Dat {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "clrmamepro (\n\tname \"%s\"\n\tdescription \"%s\"\n)\n", name, name)
+	for _, n := range suffixes {
+		fmt.Fprintf(&sb, "game (\n\tname \"game%d\"\n\trom ( name \"rom%d.bin\" size 4 sha1 %040x )\n)\n", n, n, n)
+	}
+
+	dat, _, err := parser.ParseDat(strings.NewReader(sb.String()), "testing/"+name+".dat")
+	if err != nil {
+		t.Fatalf("failed to parse dat %s: %v", name, err)
+	}
+	return dat
+}
+
+func TestDiffDatsSeveralOlds(t *testing.T) {
+	oldDats := []*types.Dat{
+		diffTestDat(t, "a", 1, 2),
+		diffTestDat(t, "b", 3),
+		diffTestDat(t, "c", 4, 9),
+	}
+	newDat := diffTestDat(t, "latest", 1, 2, 3, 4, 5, 6)
+
+	diffDat, err := diffDats(oldDats, newDat, dedup.NewMemoryDeduper(dedup.MatchKeySha1))
+	if err != nil {
+		t.Fatalf("failed to diff dats: %v", err)
+	}
+	if diffDat == nil {
+		t.Fatalf("expected diffs")
+	}
+
+	var names []string
+	for _, g := range diffDat.Games {
+		names = append(names, g.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"game5", "game6"}) {
+		t.Fatalf("expected only the games in none of the old dats, got %v", names)
+	}
+
+	diffDat, err = diffDats(oldDats, diffTestDat(t, "older", 2, 3), dedup.NewMemoryDeduper(dedup.MatchKeySha1))
+	if err != nil {
+		t.Fatalf("failed to diff dats: %v", err)
+	}
+	if diffDat != nil {
+		t.Fatalf("expected no diffs, got %d games", len(diffDat.Games))
+	}
+}
+
+func TestStringsFlag(t *testing.T) {
+	fs := flag.NewFlagSet("romba-diffdat", flag.ContinueOnError)
+	fs.Var(new(stringsFlag), "old", "old DAT file, repeat for several")
+
+	err := fs.Parse([]string{"-old", "a.dat", "-old", "b.dat"})
+	if err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+
+	olds := fs.Lookup("old").Value.Get().([]string)
+	if !reflect.DeepEqual(olds, []string{"a.dat", "b.dat"}) {
+		t.Fatalf("expected both old dats, got %v", olds)
+	}
+}
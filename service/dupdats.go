@@ -0,0 +1,228 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type dupDatsWorker struct {
+	pm *dupDatsGru
+}
+
+type dupDatsGru struct {
+	numWorkers int
+	pt         worker.ProgressTracker
+
+	mutex sync.Mutex
+	paths map[string][]string
+}
+
+func newDupDatsGru(numWorkers int, pt worker.ProgressTracker) *dupDatsGru {
+	return &dupDatsGru{
+		numWorkers: numWorkers,
+		pt:         pt,
+		paths:      make(map[string][]string),
+	}
+}
+
+// dupDatGroup lists the paths of DAT files that share a sha1.
+type dupDatGroup struct {
+	sha1Hex string
+	paths   []string
+}
+
+// groups returns the sha1s seen at more than one path, ordered by their first path.
+func (pm *dupDatsGru) groups() []*dupDatGroup {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	var dgs []*dupDatGroup
+	for sha1Hex, paths := range pm.paths {
+		if len(paths) < 2 {
+			continue
+		}
+		ps := append([]string(nil), paths...)
+		sort.Strings(ps)
+		dgs = append(dgs, &dupDatGroup{
+			sha1Hex: sha1Hex,
+			paths:   ps,
+		})
+	}
+
+	sort.Slice(dgs, func(i, j int) bool {
+		return dgs[i].paths[0] < dgs[j].paths[0]
+	})
+	return dgs
+}
+
+func (pw *dupDatsWorker) Process(path string, size int64) error {
+	hh, err := archive.HashesForFile(path)
+	if err != nil {
+		return err
+	}
+
+	sha1Hex := hex.EncodeToString(hh.Sha1)
+
+	pw.pm.mutex.Lock()
+	pw.pm.paths[sha1Hex] = append(pw.pm.paths[sha1Hex], path)
+	pw.pm.mutex.Unlock()
+	return nil
+}
+
+func (pw *dupDatsWorker) Close() error {
+	return nil
+}
+
+func (pm *dupDatsGru) CalculateWork() bool {
+	return true
+}
+
+func (pm *dupDatsGru) NeedsSizeInfo() bool {
+	return true
+}
+
+func (pm *dupDatsGru) Accept(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".dat" || ext == ".xml"
+}
+
+func (pm *dupDatsGru) NewWorker(workerIndex int) worker.Worker {
+	return &dupDatsWorker{
+		pm: pm,
+	}
+}
+
+func (pm *dupDatsGru) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *dupDatsGru) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *dupDatsGru) FinishUp() error {
+	return nil
+}
+
+func (pm *dupDatsGru) Start() error {
+	return nil
+}
+
+func (pm *dupDatsGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+
+func formatDupDatGroups(dgs []*dupDatGroup) string {
+	var sb strings.Builder
+	numDups := 0
+	for _, dg := range dgs {
+		fmt.Fprintf(&sb, "dat with sha1 %s found at:\n", dg.sha1Hex)
+		for _, p := range dg.paths {
+			fmt.Fprintf(&sb, "  %s\n", p)
+		}
+		numDups += len(dg.paths) - 1
+	}
+	fmt.Fprintf(&sb, "number of dats with duplicates: %d\nnumber of duplicate dat files: %d\n", len(dgs), numDups)
+	return sb.String()
+}
+
+func (rs *RombaService) findDupDats(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		p := rs.pt.GetProgress()
+
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
+			p.FilesSoFar, p.TotalFiles, humanize.IBytes(uint64(p.BytesSoFar)), humanize.IBytes(uint64(p.TotalBytes)))
+		return err
+	}
+
+	datsPaths := refreshDatsPaths(rs.dats, args)
+	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+
+	rs.pt.Reset()
+	rs.busy = true
+	rs.jobName = "find-dup-dats"
+
+	go func() {
+		glog.Infof("service starting find-dup-dats")
+		rs.broadCastProgress(time.Now(), true, false, "", nil)
+		ticker := time.NewTicker(time.Second * 5)
+		stopTicker := make(chan bool)
+		go func() {
+			glog.Infof("starting progress broadcaster")
+			for {
+				select {
+				case t := <-ticker.C:
+					rs.broadCastProgress(t, false, false, "", nil)
+				case <-stopTicker:
+					glog.Info("stopped progress broadcaster")
+					return
+				}
+			}
+		}()
+
+		pm := newDupDatsGru(numWorkers, rs.pt)
+
+		endMsg, err := worker.Work("find duplicate dats", datsPaths, pm)
+		if err != nil {
+			glog.Errorf("error finding duplicate dats: %v", err)
+		} else {
+			endMsg += formatDupDatGroups(pm.groups())
+		}
+
+		ticker.Stop()
+		stopTicker <- true
+
+		rs.jobMutex.Lock()
+		rs.busy = false
+		rs.jobName = ""
+		rs.jobMutex.Unlock()
+
+		rs.broadCastProgress(time.Now(), false, true, endMsg, err)
+		glog.Infof("service finished find-dup-dats")
+	}()
+
+	_, err := fmt.Fprintf(cmd.Stdout, "started find-dup-dats")
+	return err
+}
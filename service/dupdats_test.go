@@ -0,0 +1,93 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestFindDupDats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dupdats")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a/one.dat":      mergeDatA,
+		"b/one copy.dat": mergeDatA,
+		"b/c/one.xml":    mergeDatA,
+		"b/two.dat":      mergeDatB,
+		"b/notes.txt":    mergeDatB,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0777)
+		if err != nil {
+			t.Fatalf("cannot create dir for %s: %v", name, err)
+		}
+		err = ioutil.WriteFile(path, []byte(content), 0666)
+		if err != nil {
+			t.Fatalf("cannot write %s: %v", name, err)
+		}
+	}
+
+	pm := newDupDatsGru(2, worker.NewProgressTracker(2))
+	_, err = worker.Work("find duplicate dats", []string{dir}, pm)
+	if err != nil {
+		t.Fatalf("failed to find duplicate dats: %v", err)
+	}
+
+	dgs := pm.groups()
+	if len(dgs) != 1 {
+		t.Fatalf("expected 1 group of duplicates, got %d", len(dgs))
+	}
+
+	expected := []string{
+		filepath.Join(dir, "a/one.dat"),
+		filepath.Join(dir, "b/c/one.xml"),
+		filepath.Join(dir, "b/one copy.dat"),
+	}
+	if strings.Join(dgs[0].paths, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected duplicates %v, got %v", expected, dgs[0].paths)
+	}
+
+	msg := formatDupDatGroups(dgs)
+	if !strings.Contains(msg, "number of duplicate dat files: 2") {
+		t.Fatalf("unexpected report %s", msg)
+	}
+}
@@ -33,6 +33,7 @@ package service
 import (
 	"bufio"
 	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/uwedeportivo/romba/combine"
@@ -40,12 +41,15 @@ import (
 	"github.com/uwedeportivo/romba/db"
 	"github.com/uwedeportivo/romba/parser"
 	"github.com/uwedeportivo/romba/types"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
+	"github.com/klauspost/compress/gzip"
 
 	"github.com/uwedeportivo/commander"
 )
@@ -82,6 +86,8 @@ func (rs *RombaService) exportWork(cmd *commander.Command, args []string) error
 		return errors.New("missing out argument")
 	}
 
+	compress := cmd.Flag.Lookup("gzip").Value.Get().(bool) || strings.HasSuffix(outPath, ".gz")
+
 	glog.Infof("export hashes into %s", outPath)
 
 	tempPath, err := ioutil.TempDir(config.GlobalConfig.General.TmpDir, "romba_combine")
@@ -128,13 +134,18 @@ func (rs *RombaService) exportWork(cmd *commander.Command, args []string) error
 		}
 	}()
 
-	writer := bufio.NewWriter(file)
-	defer func(){
-		err := writer.Flush()
-		if err != nil {
-			glog.Errorf("error, failed to flush %s: %v", outPath, err)
-		}
-	}()
+	var out io.Writer = file
+	var gzw *gzip.Writer
+	if compress {
+		gzw = gzip.NewWriter(file)
+		out = gzw
+	}
+
+	// games are written out as they come from the combiner, hashing the
+	// bytes on the way so the DAT sha1 is known without reading it back.
+	// The sha1 is over the uncompressed DAT, the one parsing it yields.
+	hh := sha1.New()
+	writer := bufio.NewWriter(io.MultiWriter(out, hh))
 
 	err = types.ComposeCompliantDat(exportDat, writer)
 	if err != nil {
@@ -170,10 +181,22 @@ func (rs *RombaService) exportWork(cmd *commander.Command, args []string) error
 		return err
 	}
 
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	if gzw != nil {
+		err = gzw.Close()
+		if err != nil {
+			return err
+		}
+	}
+
 	var endMsg string
 
-	endMsg = fmt.Sprintf("export finished, %d roms written to exportdat file %s",
-		numRoms, outPath)
+	endMsg = fmt.Sprintf("export finished, %d roms written to exportdat file %s with sha1 %s",
+		numRoms, outPath, hex.EncodeToString(hh.Sum(nil)))
 
 	glog.Infof(endMsg)
 	_, err = fmt.Fprintf(cmd.Stdout, endMsg)
@@ -300,6 +323,8 @@ type imprtParseListener struct {
 	numRoms int
 	rs *RombaService
 	activeBatch db.RomBatch
+	path string
+	source string
 }
 
 func (ipl *imprtParseListener) ParsedDatStmt(dat *types.Dat) error {
@@ -314,6 +339,11 @@ func (ipl *imprtParseListener) ParsedGameStmt(game *types.Game) error {
 		if err != nil {
 			return err
 		}
+
+		err = ipl.activeBatch.IndexRomSource(r, ipl.path, ipl.source)
+		if err != nil {
+			return err
+		}
 	}
 
 	if ipl.activeBatch.Size() > 10 * MB {
@@ -327,6 +357,41 @@ func (ipl *imprtParseListener) ParsedGameStmt(game *types.Game) error {
 	return nil
 }
 
+// parseImportDat parses the DAT at path with pl, decompressing it first if it
+// is gzipped, as written by export -gzip.
+func parseImportDat(path string, pl parser.ParseListener) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close %s: %v", path, err)
+		}
+	}()
+
+	br := bufio.NewReader(file)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		_, err = parser.ParseReaderWithListener(br, path, pl)
+		return err
+	}
+
+	gzr, err := gzip.NewReader(br)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	_, err = parser.ParseReaderWithListener(gzr, path, pl)
+	return err
+}
+
 func (rs *RombaService) importWork(cmd *commander.Command, args []string) error {
 	inPath := cmd.Flag.Lookup("in").Value.Get().(string)
 
@@ -338,14 +403,18 @@ func (rs *RombaService) importWork(cmd *commander.Command, args []string) error
 		return errors.New("missing in argument")
 	}
 
+	source := cmd.Flag.Lookup("source").Value.Get().(string)
+
 	glog.Infof("import hashes from %s", inPath)
 
 	ipl := &imprtParseListener{
 		rs: rs,
 		activeBatch: rs.depot.RomDB.StartBatch(),
+		path: inPath,
+		source: source,
 	}
 
-	_, err := parser.ParseWithListener(inPath, ipl)
+	err := parseImportDat(inPath, ipl)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,106 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+type countingParseListener struct {
+	numGames int
+	numRoms  int
+}
+
+func (cpl *countingParseListener) ParsedDatStmt(dat *types.Dat) error {
+	return nil
+}
+
+func (cpl *countingParseListener) ParsedGameStmt(game *types.Game) error {
+	cpl.numGames++
+	cpl.numRoms += len(game.Roms)
+	return nil
+}
+
+func TestParseImportDatGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "importgz")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	plainPath := filepath.Join(dir, "export.dat")
+	err = ioutil.WriteFile(plainPath, []byte(mergeDatA), 0666)
+	if err != nil {
+		t.Fatalf("cannot write dat: %v", err)
+	}
+
+	gzPath := filepath.Join(dir, "export.dat.gz")
+	file, err := os.Create(gzPath)
+	if err != nil {
+		t.Fatalf("cannot create gzip dat: %v", err)
+	}
+	gzw := gzip.NewWriter(file)
+	_, err = gzw.Write([]byte(mergeDatA))
+	if err != nil {
+		t.Fatalf("cannot write gzip dat: %v", err)
+	}
+	err = gzw.Close()
+	if err != nil {
+		t.Fatalf("cannot close gzip writer: %v", err)
+	}
+	err = file.Close()
+	if err != nil {
+		t.Fatalf("cannot close gzip dat: %v", err)
+	}
+
+	plain := new(countingParseListener)
+	err = parseImportDat(plainPath, plain)
+	if err != nil {
+		t.Fatalf("failed to parse plain dat: %v", err)
+	}
+
+	gz := new(countingParseListener)
+	err = parseImportDat(gzPath, gz)
+	if err != nil {
+		t.Fatalf("failed to parse gzip dat: %v", err)
+	}
+
+	if plain.numRoms == 0 || *plain != *gz {
+		t.Fatalf("plain dat gave %+v, gzip dat gave %+v", *plain, *gz)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/uwedeportivo/commander"
+)
+
+func (rs *RombaService) flushRoot(cmd *commander.Command, args []string) error {
+	depotPath := cmd.Flag.Lookup("depot").Value.Get().(string)
+	if depotPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-depot argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing depot argument")
+	}
+
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s, try again later\n", rs.jobName)
+		return err
+	}
+
+	bloomWritten, err := rs.depot.FlushRoot(depotPath)
+	if err != nil {
+		_, ferr := fmt.Fprintf(cmd.Stdout, "flush-root failed: %v", err)
+		if ferr != nil {
+			return ferr
+		}
+		return err
+	}
+
+	if !bloomWritten {
+		_, err = fmt.Fprintf(cmd.Stdout,
+			"flushed size file of %s, bloom filter not written since it is still loading", depotPath)
+		return err
+	}
+
+	_, err = fmt.Fprintf(cmd.Stdout, "flushed size file and bloom filter of %s", depotPath)
+	return err
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+)
+
+func (rs *RombaService) generation(cmd *commander.Command, args []string) error {
+	set := cmd.Flag.Lookup("set").Value.Get().(int64)
+
+	if set < 0 {
+		gen, err := db.ReadGenerationFile(config.GlobalConfig.Index.Db)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(cmd.Stdout, "generation = %d\n", gen)
+		return err
+	}
+
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s, try again later\n", rs.jobName)
+		return err
+	}
+
+	old := rs.romDB.Generation()
+
+	err := rs.romDB.SetGeneration(set)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("set generation from %d to %d", old, set)
+	_, err = fmt.Fprintf(cmd.Stdout, "generation = %d, was %d\n", set, old)
+	return err
+}
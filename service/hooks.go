@@ -0,0 +1,130 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/romba/archive"
+)
+
+// execHook runs the hook command configured in the archive section of the
+// config for archive events. Commands run one at a time in the order of the
+// events, with the event as JSON on stdin and its type in ROMBA_EVENT. Failing
+// commands are logged, they don't fail the archive run.
+type execHook struct {
+	command []string
+	events  map[string]bool
+	queue   chan *archive.ArchiveEvent
+	done    chan bool
+}
+
+// newExecHook returns nil if command is empty. Without events every event
+// type is passed to the command.
+func newExecHook(command string, events []string) *execHook {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	eh := &execHook{
+		command: fields,
+		queue:   make(chan *archive.ArchiveEvent, 1024),
+		done:    make(chan bool),
+	}
+	if len(events) > 0 {
+		eh.events = make(map[string]bool)
+		for _, ev := range events {
+			eh.events[strings.ToLower(strings.TrimSpace(ev))] = true
+		}
+	}
+
+	go eh.run()
+	return eh
+}
+
+// hook returns the archive hook feeding eh, nil if eh is nil.
+func (eh *execHook) hook() archive.ArchiveHook {
+	if eh == nil {
+		return nil
+	}
+	return eh.fire
+}
+
+func (eh *execHook) fire(ev *archive.ArchiveEvent) {
+	if eh.events != nil && !eh.events[ev.Type] {
+		return
+	}
+	eh.queue <- ev
+}
+
+func (eh *execHook) run() {
+	defer close(eh.done)
+
+	for ev := range eh.queue {
+		err := eh.exec(ev)
+		if err != nil {
+			glog.Errorf("archive hook %s failed for %s event: %v", eh.command[0], ev.Type, err)
+		}
+	}
+}
+
+func (eh *execHook) exec(ev *archive.ArchiveEvent) error {
+	evBytes, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(eh.command[0], eh.command[1:]...)
+	cmd.Stdin = bytes.NewReader(evBytes)
+	cmd.Env = append(os.Environ(), "ROMBA_EVENT="+ev.Type)
+
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		glog.Infof("archive hook %s output: %s", eh.command[0], out)
+	}
+	return err
+}
+
+// close waits for the commands of all fired events to finish. A nil eh is fine.
+func (eh *execHook) close() {
+	if eh == nil {
+		return
+	}
+
+	close(eh.queue)
+	<-eh.done
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/parser"
+)
+
+type incompleteJSON struct {
+	NumComplete int                   `json:"numComplete"`
+	NumPartial  int                   `json:"numPartial"`
+	NumMissing  int                   `json:"numMissing"`
+	Games       []*archive.GameStatus `json:"games"`
+}
+
+func newIncompleteJSON(gss []*archive.GameStatus) *incompleteJSON {
+	ij := &incompleteJSON{
+		Games: gss,
+	}
+
+	for _, gs := range gss {
+		switch gs.Status {
+		case archive.GameComplete:
+			ij.NumComplete++
+		case archive.GamePartial:
+			ij.NumPartial++
+		case archive.GameMissing:
+			ij.NumMissing++
+		}
+	}
+	return ij
+}
+
+// text lists the partial games with their missing roms, followed by the
+// missing games. Complete games are only counted.
+func (ij *incompleteJSON) text() string {
+	var msgBuffer bytes.Buffer
+
+	fmt.Fprintf(&msgBuffer, "complete games = %d\n", ij.NumComplete)
+	fmt.Fprintf(&msgBuffer, "partial games = %d\n", ij.NumPartial)
+	fmt.Fprintf(&msgBuffer, "missing games = %d\n", ij.NumMissing)
+
+	for _, gs := range ij.Games {
+		if gs.Status != archive.GamePartial {
+			continue
+		}
+		fmt.Fprintf(&msgBuffer, "partial: %s\n", gs.Name)
+		for _, name := range gs.MissingRoms {
+			fmt.Fprintf(&msgBuffer, "  missing rom: %s\n", name)
+		}
+	}
+
+	for _, gs := range ij.Games {
+		if gs.Status == archive.GameMissing {
+			fmt.Fprintf(&msgBuffer, "missing: %s\n", gs.Name)
+		}
+	}
+	return msgBuffer.String()
+}
+
+func (rs *RombaService) incomplete(cmd *commander.Command, args []string) error {
+	datPath := cmd.Flag.Lookup("dat").Value.Get().(string)
+	if datPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-dat argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing dat argument")
+	}
+
+	dat, _, err := parser.Parse(datPath)
+	if err != nil {
+		return err
+	}
+
+	gss, err := rs.depot.GameStatuses(dat)
+	if err != nil {
+		return err
+	}
+
+	ij := newIncompleteJSON(gss)
+
+	if cmd.Flag.Lookup("json").Value.Get().(bool) {
+		return writeJSON(cmd.Stdout, ij)
+	}
+
+	_, err = fmt.Fprint(cmd.Stdout, ij.text())
+	return err
+}
@@ -0,0 +1,375 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type auditWorker struct {
+	pm *auditGru
+}
+
+type auditGru struct {
+	rs         *RombaService
+	numWorkers int
+	pt         worker.ProgressTracker
+
+	mutex          sync.Mutex
+	reportWriter   *bufio.Writer
+	seenDats       map[string]bool
+	auditedDats    map[string]string
+	datAssocs      db.KVStore // scratch store of the rom associations of the audited DATs
+	numDats        int
+	numMissingDats int
+	numMissingRoms int
+	numExtraDats   int
+	numExtraRoms   int
+}
+
+// romDatAssocKeys returns the sha1, md5 and crc index keys associating rom with the DAT datSha1,
+// skipping the hashes rom doesn't have.
+func romDatAssocKeys(rom *types.Rom, datSha1 []byte) [][]byte {
+	var keys [][]byte
+	for _, key := range [][]byte{
+		rom.Sha1Sha1Key(datSha1),
+		rom.Md5WithSizeAndSha1Key(datSha1),
+		rom.CrcWithSizeAndSha1Key(datSha1),
+	} {
+		if key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// declareDatAssocs writes the rom associations of dat into the scratch store, in
+// batches of at most db.MaxBatchSize bytes.
+func (pm *auditGru) declareDatAssocs(dat *types.Dat, datSha1 []byte) error {
+	batch := pm.datAssocs.StartBatch()
+	var batchSize int
+
+	for _, g := range dat.Games {
+		for _, r := range g.Roms {
+			for _, key := range romDatAssocKeys(r, datSha1) {
+				err := batch.Set(key, []byte{1})
+				if err != nil {
+					return err
+				}
+				batchSize += len(key)
+				if batchSize >= db.MaxBatchSize {
+					err = pm.datAssocs.WriteBatch(batch)
+					if err != nil {
+						return err
+					}
+					batch.Clear()
+					batchSize = 0
+				}
+			}
+		}
+	}
+	return pm.datAssocs.WriteBatch(batch)
+}
+
+func (pm *auditGru) report(format string, args ...interface{}) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	fmt.Fprintf(pm.reportWriter, format, args...)
+}
+
+func (pw *auditWorker) Process(path string, size int64) error {
+	dat, sha1Bytes, err := parser.Parse(path)
+	if err != nil {
+		return err
+	}
+
+	pw.pm.mutex.Lock()
+	pw.pm.seenDats[string(sha1Bytes)] = true
+	pw.pm.numDats++
+	pw.pm.mutex.Unlock()
+
+	romDB := pw.pm.rs.romDB
+
+	idat, err := romDB.GetDat(sha1Bytes)
+	if err != nil {
+		return err
+	}
+
+	if idat == nil || idat.Generation != romDB.Generation() {
+		pw.pm.report("missing dat %s (sha1 %s)\n", path, hex.EncodeToString(sha1Bytes))
+
+		pw.pm.mutex.Lock()
+		pw.pm.numMissingDats++
+		pw.pm.mutex.Unlock()
+		return nil
+	}
+
+	pw.pm.mutex.Lock()
+	pw.pm.auditedDats[string(sha1Bytes)] = path
+	pw.pm.mutex.Unlock()
+
+	err = pw.pm.declareDatAssocs(dat, sha1Bytes)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range dat.Games {
+		for _, r := range g.Roms {
+			if r.Sha1 == nil && r.Md5 == nil && r.Crc == nil {
+				continue
+			}
+
+			found, err := romDB.HasRomDatAssociation(r, sha1Bytes)
+			if err != nil {
+				return err
+			}
+
+			if !found {
+				pw.pm.report("missing rom %s in game %s of dat %s\n", r.Name, g.Name, path)
+
+				pw.pm.mutex.Lock()
+				pw.pm.numMissingRoms++
+				pw.pm.mutex.Unlock()
+			}
+		}
+	}
+	return nil
+}
+
+func (pw *auditWorker) Close() error {
+	return nil
+}
+
+func (pm *auditGru) CalculateWork() bool {
+	return true
+}
+
+func (pm *auditGru) NeedsSizeInfo() bool {
+	return false
+}
+
+func (pm *auditGru) Accept(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".dat" || ext == ".xml"
+}
+
+func (pm *auditGru) NewWorker(workerIndex int) worker.Worker {
+	return &auditWorker{
+		pm: pm,
+	}
+}
+
+func (pm *auditGru) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *auditGru) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+// FinishUp reports current dats in the index that weren't found in the audited DATs
+// and rom associations of audited DATs that their parsed DAT doesn't have.
+func (pm *auditGru) FinishUp() error {
+	err := pm.rs.romDB.ForEachDatWithSha1(func(sha1Bytes []byte, dat *types.Dat) error {
+		if dat.Generation != pm.rs.romDB.Generation() || pm.seenDats[string(sha1Bytes)] {
+			return nil
+		}
+
+		pm.report("extra dat %s (sha1 %s)\n", dat.Path, hex.EncodeToString(sha1Bytes))
+		pm.numExtraDats++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return pm.rs.romDB.ForEachRomDatAssociation(func(rom *types.Rom, datSha1 []byte) error {
+		path, audited := pm.auditedDats[string(datSha1)]
+		if !audited {
+			return nil
+		}
+
+		for _, key := range romDatAssocKeys(rom, datSha1) {
+			found, err := pm.datAssocs.Exists(key)
+			if err != nil {
+				return err
+			}
+			if !found {
+				pm.report("extra rom %s in dat %s\n", db.RomsKey(rom), path)
+				pm.numExtraRoms++
+			}
+		}
+		return nil
+	})
+}
+
+func (pm *auditGru) Start() error {
+	return nil
+}
+
+func (pm *auditGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+
+func (rs *RombaService) indexAudit(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		p := rs.pt.GetProgress()
+
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
+			p.FilesSoFar, p.TotalFiles, humanize.IBytes(uint64(p.BytesSoFar)), humanize.IBytes(uint64(p.TotalBytes)))
+		return err
+	}
+
+	datsPath := cmd.Flag.Lookup("dats").Value.Get().(string)
+	if datsPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-dats argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing dats argument")
+	}
+
+	reportPath := filepath.Join(rs.logDir,
+		fmt.Sprintf("index-audit-%s.log", time.Now().Format(archive.ResumeDateFormat)))
+
+	rs.pt.Reset()
+	rs.busy = true
+	rs.jobName = "index-audit"
+
+	go func() {
+		glog.Infof("service starting index-audit")
+		rs.broadCastProgress(time.Now(), true, false, "", nil)
+		ticker := time.NewTicker(time.Second * 5)
+		stopTicker := make(chan bool)
+		go func() {
+			glog.Infof("starting progress broadcaster")
+			for {
+				select {
+				case t := <-ticker.C:
+					rs.broadCastProgress(t, false, false, "", nil)
+				case <-stopTicker:
+					glog.Info("stopped progress broadcaster")
+					return
+				}
+			}
+		}()
+
+		numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+
+		endMsg, err := rs.auditIndex(datsPath, reportPath, numWorkers)
+		if err != nil {
+			glog.Errorf("error auditing index: %v", err)
+		}
+
+		ticker.Stop()
+		stopTicker <- true
+
+		rs.jobMutex.Lock()
+		rs.busy = false
+		rs.jobName = ""
+		rs.jobMutex.Unlock()
+
+		rs.broadCastProgress(time.Now(), false, true, endMsg, err)
+		glog.Infof("service finished index-audit")
+	}()
+
+	_, err := fmt.Fprintf(cmd.Stdout, "started index-audit, writing report to %s", reportPath)
+	return err
+}
+
+func (rs *RombaService) auditIndex(datsPath, reportPath string, numWorkers int) (string, error) {
+	reportFile, err := os.Create(reportPath)
+	if err != nil {
+		return "", err
+	}
+	defer reportFile.Close()
+
+	// the rom associations of all audited DATs don't necessarily fit into memory
+	scratchDir, err := ioutil.TempDir(config.GlobalConfig.Index.Db, "romba_audit")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(scratchDir)
+
+	datAssocs, err := db.StoreOpener(filepath.Join(scratchDir, "assocs_db"), md5.Size+8+sha1.Size)
+	if err != nil {
+		return "", err
+	}
+	defer datAssocs.Close()
+
+	pm := &auditGru{
+		rs:           rs,
+		numWorkers:   numWorkers,
+		pt:           rs.pt,
+		reportWriter: bufio.NewWriter(reportFile),
+		seenDats:     make(map[string]bool),
+		auditedDats:  make(map[string]string),
+		datAssocs:    datAssocs,
+	}
+
+	endMsg, err := worker.Work("index audit", []string{datsPath}, pm)
+
+	ferr := pm.reportWriter.Flush()
+	if err != nil {
+		return "", err
+	}
+	if ferr != nil {
+		return "", ferr
+	}
+
+	return endMsg + fmt.Sprintf("number of audited dats: %d\nnumber of dats missing from index: %d\n"+
+		"number of rom associations missing from index: %d\nnumber of extra dats in index: %d\n"+
+		"number of extra rom associations in index: %d\nreport: %s\n",
+		pm.numDats, pm.numMissingDats, pm.numMissingRoms, pm.numExtraDats, pm.numExtraRoms, reportPath), nil
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/worker"
+
+	_ "github.com/uwedeportivo/romba/db/clevel"
+)
+
+const auditDatText = `clrmamepro (
+	name "audit"
+	description "audit"
+)
+
+game (
+	name "a"
+	description "a"
+	rom ( name "a.bin" size 4 crc 0a1b2c3d sha1 1111111111111111111111111111111111111111 )
+)
+`
+
+const auditStaleGameText = `
+game (
+	name "b"
+	description "b"
+	rom ( name "b.bin" size 8 crc 4d3c2b1a sha1 2222222222222222222222222222222222222222 )
+)
+`
+
+func TestIndexAuditExtraRoms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_indexaudit")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+	}
+
+	datsDir := filepath.Join(dir, "dats")
+	dbDir := filepath.Join(dir, "db")
+	for _, d := range []string{datsDir, dbDir} {
+		err = os.MkdirAll(d, 0777)
+		if err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+
+	datPath := filepath.Join(datsDir, "audit.dat")
+	err = ioutil.WriteFile(datPath, []byte(auditDatText), 0666)
+	if err != nil {
+		t.Fatalf("failed to write %s: %v", datPath, err)
+	}
+
+	_, sha1Bytes, err := parser.Parse(datPath)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", datPath, err)
+	}
+
+	// Index the DAT under its sha1 with a game the file doesn't have, as left
+	// behind by an earlier version of the DAT.
+	staleDat, _, err := parser.ParseDat(strings.NewReader(auditDatText+auditStaleGameText), datPath)
+	if err != nil {
+		t.Fatalf("failed to parse stale dat: %v", err)
+	}
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	err = krdb.IndexDat(staleDat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index stale dat: %v", err)
+	}
+
+	rs := &RombaService{
+		romDB: krdb,
+		pt:    worker.NewProgressTracker(1),
+	}
+
+	reportPath := filepath.Join(dir, "report.log")
+	endMsg, err := rs.auditIndex(datsDir, reportPath, 1)
+	if err != nil {
+		t.Fatalf("failed to audit index: %v", err)
+	}
+
+	report, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+
+	expected := "extra rom 2222222222222222222222222222222222222222 in dat " + datPath + "\n" +
+		"extra rom 4d3c2b1a in dat " + datPath + "\n"
+	if string(report) != expected {
+		t.Fatalf("expected report %q, got %q", expected, report)
+	}
+	if !strings.Contains(endMsg, "number of extra rom associations in index: 2\n") {
+		t.Fatalf("expected 2 extra rom associations in %q", endMsg)
+	}
+}
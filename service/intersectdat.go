@@ -0,0 +1,180 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/dedup"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// intersectDats returns the roms of aDat that are in bDat as well, in the games
+// of aDat, or nil if there are none. Roms are matched by dd like diffdat matches
+// them. Empty roms are left out.
+func intersectDats(aDat, bDat *types.Dat, dd dedup.Deduper) (*types.Dat, error) {
+	err := dedup.Declare(bDat, dd)
+	if err != nil {
+		return nil, err
+	}
+
+	dc := new(types.Dat)
+	dc.CopyHeader(aDat)
+
+	for _, g := range aDat.Games {
+		gc := new(types.Game)
+		gc.CopyHeader(g)
+		for _, r := range g.Roms {
+			if !r.Valid() || r.Size == 0 {
+				continue
+			}
+			seen, err := dd.Seen(r)
+			if err != nil {
+				return nil, err
+			}
+			if seen {
+				gc.Roms = append(gc.Roms, r)
+			}
+		}
+		if len(gc.Roms) > 0 {
+			dc.Games = append(dc.Games, gc)
+		}
+	}
+
+	if len(dc.Games) > 0 {
+		return dc, nil
+	}
+	return nil, nil
+}
+
+func (rs *RombaService) intersectdat(cmd *commander.Command, args []string) error {
+	aDatPath := cmd.Flag.Lookup("a").Value.Get().(string)
+	bDatPath := cmd.Flag.Lookup("b").Value.Get().(string)
+	outPath := cmd.Flag.Lookup("out").Value.Get().(string)
+	givenName := cmd.Flag.Lookup("name").Value.Get().(string)
+	givenDescription := cmd.Flag.Lookup("description").Value.Get().(string)
+
+	if aDatPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-a argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing a argument")
+	}
+	if bDatPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-b argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing b argument")
+	}
+	if outPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-out argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing out argument")
+	}
+
+	matchKey, err := matchKeyFlag(cmd)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("intersectdat dats %s and %s into %s", aDatPath, bDatPath, outPath)
+
+	aDat, _, err := parser.Parse(aDatPath)
+	if err != nil {
+		return err
+	}
+
+	bDat, _, err := parser.Parse(bDatPath)
+	if err != nil {
+		return err
+	}
+
+	if givenName == "" {
+		givenName = strings.TrimSuffix(filepath.Base(outPath), filepath.Ext(outPath))
+	}
+
+	if givenDescription == "" {
+		givenDescription = givenName
+	}
+
+	dd, err := dedup.NewLevelDBDeduper(matchKey)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := dd.Close()
+		if err != nil {
+			glog.Errorf("error closing dedup leveldb: %v", err)
+		}
+	}()
+
+	interDat, err := intersectDats(aDat, bDat, dd)
+	if err != nil {
+		return err
+	}
+
+	var endMsg string
+
+	if interDat != nil {
+		interDat.Name = givenName
+		interDat.Description = givenDescription
+
+		err = writeDat(interDat, outPath)
+		if err != nil {
+			return err
+		}
+
+		endMsg = fmt.Sprintf("intersectdat finished, %d games with common roms found, written intersection file %s",
+			len(interDat.Games), outPath)
+	} else {
+		endMsg = "intersectdat finished, no common roms found, no intersection file written"
+	}
+
+	glog.Infof(endMsg)
+	_, err = fmt.Fprintf(cmd.Stdout, endMsg)
+	if err != nil {
+		return err
+	}
+	rs.broadCastProgress(time.Now(), false, true, endMsg, nil)
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/uwedeportivo/romba/dedup"
+)
+
+func TestIntersectDats(t *testing.T) {
+	aDat := diffTestDat(t, "a", 1, 2, 3, 4)
+	bDat := diffTestDat(t, "b", 2, 4, 7)
+
+	interDat, err := intersectDats(aDat, bDat, dedup.NewMemoryDeduper(dedup.MatchKeySha1))
+	if err != nil {
+		t.Fatalf("failed to intersect dats: %v", err)
+	}
+	if interDat == nil {
+		t.Fatalf("expected common roms")
+	}
+
+	var names []string
+	for _, g := range interDat.Games {
+		names = append(names, g.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"game2", "game4"}) {
+		t.Fatalf("expected only the games in both dats, got %v", names)
+	}
+
+	interDat, err = intersectDats(aDat, diffTestDat(t, "c", 5, 6), dedup.NewMemoryDeduper(dedup.MatchKeySha1))
+	if err != nil {
+		t.Fatalf("failed to intersect dats: %v", err)
+	}
+	if interDat != nil {
+		t.Fatalf("expected no common roms, got %d games", len(interDat.Games))
+	}
+}
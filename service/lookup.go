@@ -31,26 +31,105 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package service
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/db"
 	"github.com/uwedeportivo/romba/types"
 	"github.com/uwedeportivo/romba/util"
 	"github.com/uwedeportivo/romba/worker"
 )
 
-func (rs *RombaService) lookupRom(cmd *commander.Command, r *types.Rom, outpath string) error {
+// printQuickSizeCheck checks the size of the depot file at rompath against the
+// size the index has for rom.
+func (rs *RombaService) printQuickSizeCheck(cmd *commander.Command, rompath string, rom *types.Rom) error {
+	size, err := rs.romDB.IndexedSize(rom)
+	if err != nil {
+		return err
+	}
+
+	if size < 0 {
+		fmt.Fprintf(cmd.Stdout, "quick size check = skipped, no indexed size\n")
+		return nil
+	}
+
+	ok, found, err := archive.QuickSizeCheck(rompath, size)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		fmt.Fprintf(cmd.Stdout, "quick size check = ok\n")
+	} else {
+		fmt.Fprintf(cmd.Stdout, "quick size check = MISMATCH, expected %d, found %d\n", size, found)
+	}
+	return nil
+}
+
+// printRomSources prints the import source labels of the rom with the given sha1.
+func (rs *RombaService) printRomSources(cmd *commander.Command, sha1Bytes []byte) error {
+	sources, err := rs.romDB.RomSources(sha1Bytes)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "-----------------\n")
+	fmt.Fprintf(cmd.Stdout, "sha1 = %s\n", hex.EncodeToString(sha1Bytes))
+	if len(sources) == 0 {
+		fmt.Fprintf(cmd.Stdout, "import source = none\n")
+	}
+	for _, source := range sources {
+		fmt.Fprintf(cmd.Stdout, "import source = %s\n", source)
+	}
+	return nil
+}
+
+// printDepotPath prints the absolute path of a rom file found in the depot, or a
+// marker for an indexed rom that isn't stored.
+func printDepotPath(cmd *commander.Command, rompath string) error {
+	if rompath == "" {
+		fmt.Fprintf(cmd.Stdout, "depot path = indexed but not stored\n")
+		return nil
+	}
+
+	absPath, err := filepath.Abs(rompath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "depot path = %s\n", absPath)
+	return nil
+}
+
+// lookupOptions are the flags of a lookup, together with the DATs of the sha1s
+// of an input file resolved in bulk beforehand, keyed by db.RomsKey.
+type lookupOptions struct {
+	outpath    string
+	quick      bool
+	printPath  bool
+	showSource bool
+	showNames  bool
+	dats       map[string][]*types.Dat
+}
+
+func (rs *RombaService) lookupRom(cmd *commander.Command, r *types.Rom, opts *lookupOptions) error {
 	croms, err := rs.romDB.CompleteRom(r)
 	if err != nil {
 		return err
 	}
 
+	var depotPath string
+
 	if r.Sha1 != nil {
 		sha1Str := hex.EncodeToString(r.Sha1)
 
@@ -60,16 +139,24 @@ func (rs *RombaService) lookupRom(cmd *commander.Command, r *types.Rom, outpath
 		}
 
 		if inDepot {
+			depotPath = rompath
 			fmt.Fprintf(cmd.Stdout, "-----------------\n")
-			fmt.Fprintf(cmd.Stdout, "rom file %s in depot\n", rompath)
+			fmt.Fprintf(cmd.Stdout, "rom hit: rom file %s in depot\n", rompath)
 			fmt.Fprintf(cmd.Stdout, "crc = %s\n", hex.EncodeToString(hh.Crc))
 			fmt.Fprintf(cmd.Stdout, "md5 = %s\n", hex.EncodeToString(hh.Md5))
 			fmt.Fprintf(cmd.Stdout, "size = %d\n", size)
 			r.Crc = hh.Crc
 			r.Md5 = hh.Md5
 
-			if outpath != "" {
-				worker.Cp(rompath, filepath.Join(outpath, filepath.Base(rompath)))
+			if opts.quick {
+				err = rs.printQuickSizeCheck(cmd, rompath, r)
+				if err != nil {
+					return err
+				}
+			}
+
+			if opts.outpath != "" {
+				worker.Cp(rompath, filepath.Join(opts.outpath, filepath.Base(rompath)))
 			}
 		}
 	}
@@ -91,15 +178,65 @@ func (rs *RombaService) lookupRom(cmd *commander.Command, r *types.Rom, outpath
 			crom.Crc = hh.Crc
 			crom.Md5 = hh.Md5
 
-			if outpath != "" {
-				worker.Cp(rompath, filepath.Join(outpath, filepath.Base(rompath)))
+			if opts.printPath {
+				err = printDepotPath(cmd, rompath)
+				if err != nil {
+					return err
+				}
+			}
+
+			if opts.quick {
+				err = rs.printQuickSizeCheck(cmd, rompath, crom)
+				if err != nil {
+					return err
+				}
+			}
+
+			if opts.outpath != "" {
+				worker.Cp(rompath, filepath.Join(opts.outpath, filepath.Base(rompath)))
 			}
 		}
 	}
 
-	dats, err := rs.romDB.DatsForRom(r)
-	if err != nil {
-		return err
+	if opts.showSource {
+		if r.Sha1 != nil {
+			err = rs.printRomSources(cmd, r.Sha1)
+			if err != nil {
+				return err
+			}
+		}
+		for _, crom := range croms {
+			if crom.Sha1 == nil || bytes.Equal(crom.Sha1, r.Sha1) {
+				continue
+			}
+			err = rs.printRomSources(cmd, crom.Sha1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.showNames && r.Sha1 != nil {
+		names, err := rs.romDB.RomNames(r.Sha1)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.Stdout, "-----------------\n")
+		if len(names) == 0 {
+			fmt.Fprintf(cmd.Stdout, "ingested from = none\n")
+		}
+		for _, name := range names {
+			fmt.Fprintf(cmd.Stdout, "ingested from = %s\n", name)
+		}
+	}
+
+	// bulk resolved DATs only hold for a bare sha1, a size adds hash lookups
+	dats, resolved := opts.dats[db.RomsKey(r)]
+	if !resolved || r.Sha1 == nil || r.Size >= 0 {
+		dats, err = rs.romDB.DatsForRom(r)
+		if err != nil {
+			return err
+		}
 	}
 
 	if len(dats) > 0 {
@@ -112,90 +249,352 @@ func (rs *RombaService) lookupRom(cmd *commander.Command, r *types.Rom, outpath
 			}
 		}
 	}
+
+	if opts.printPath && (depotPath != "" || (r.Sha1 != nil && len(dats) > 0)) {
+		fmt.Fprintf(cmd.Stdout, "-----------------\n")
+		return printDepotPath(cmd, depotPath)
+	}
+	return nil
+}
+
+func printDatHit(cmd *commander.Command, sha1Str string, dat *types.Dat) {
+	numRoms := 0
+	for _, g := range dat.Games {
+		numRoms += len(g.Roms)
+	}
+
+	fmt.Fprintf(cmd.Stdout, "-----------------\n")
+	fmt.Fprintf(cmd.Stdout, "DAT hit: dat with sha1 %s\n", sha1Str)
+	fmt.Fprintf(cmd.Stdout, "name = %s\n", dat.Name)
+	fmt.Fprintf(cmd.Stdout, "description = %s\n", dat.Description)
+	fmt.Fprintf(cmd.Stdout, "path = %s\n", dat.Path)
+	if dat.LogicalSha1 != nil {
+		fmt.Fprintf(cmd.Stdout, "logical sha1 = %s\n", hex.EncodeToString(dat.LogicalSha1))
+	}
+	fmt.Fprintf(cmd.Stdout, "generation = %d\n", dat.Generation)
+	fmt.Fprintf(cmd.Stdout, "number of games = %d\n", len(dat.Games))
+	fmt.Fprintf(cmd.Stdout, "number of roms = %d\n", numRoms)
+}
+
+// normalizeHash strips surrounding space and a 0x prefix from a pasted hash and
+// lowercases it. It fails unless the rest is 8, 32, 40 or 64 hex digits.
+func normalizeHash(arg string) (string, error) {
+	h := strings.ToLower(strings.TrimSpace(arg))
+	h = strings.TrimPrefix(h, "0x")
+
+	switch len(h) {
+	case 2 * crc32.Size, 2 * md5.Size, 2 * sha1.Size, 64:
+	default:
+		return "", fmt.Errorf("found unknown hash length: %d", len(h))
+	}
+
+	for _, c := range h {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return "", fmt.Errorf("invalid hex digit %q", c)
+		}
+	}
+	return h, nil
+}
+
+// parseLookupHash normalizes arg and decodes it as a crc, md5 or sha1 hash.
+func parseLookupHash(arg string) (string, []byte, error) {
+	h, err := normalizeHash(arg)
+	if err != nil {
+		return "", nil, err
+	}
+
+	hash, err := hex.DecodeString(h)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch len(hash) {
+	case crc32.Size, md5.Size, sha1.Size:
+		return h, hash, nil
+	}
+	return "", nil, fmt.Errorf("found unknown hash size: %d", len(hash))
+}
+
+// forEachLookupFile hashes the file at path, or every file below path if it's
+// a dir, and calls f with the file's path, hashes and size.
+func forEachLookupFile(path string, f func(p string, hh *archive.Hashes, size int64) error) error {
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		hh, err := archive.HashesForFile(p)
+		if err != nil {
+			return err
+		}
+		return f(p, hh, info.Size())
+	})
+}
+
+// lookupHash looks up hash, with arg being its normalized hex form.
+func (rs *RombaService) lookupHash(cmd *commander.Command, arg string, hash []byte, size int64,
+	opts *lookupOptions) error {
+	if len(hash) == sha1.Size {
+		dat, err := rs.romDB.GetDat(hash)
+		if err != nil {
+			return err
+		}
+
+		if dat != nil {
+			printDatHit(cmd, arg, dat)
+			return nil
+		}
+	}
+
+	if size != -1 || len(hash) == sha1.Size {
+		r := new(types.Rom)
+		r.Size = size
+		switch len(hash) {
+		case md5.Size:
+			r.Md5 = hash
+		case crc32.Size:
+			r.Crc = hash
+		case sha1.Size:
+			r.Sha1 = hash
+		default:
+			return fmt.Errorf("found unknown hash size: %d", len(hash))
+		}
+
+		err := rs.lookupRom(cmd, r, opts)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.Stdout, "-----------------\n")
+		fmt.Fprintf(cmd.Stdout, "DebugGet:\n%s\n", rs.romDB.DebugGet(hash, size))
+
+		fmt.Fprintf(cmd.Stdout, "-----------------\n")
+		if len(hash) == sha1.Size {
+			fmt.Fprintf(cmd.Stdout, "bloom filter hits: %v", rs.depot.DebugBloom(arg))
+		}
+		return nil
+	}
+
+	suffixes, err := rs.romDB.ResolveHash(hash)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(suffixes); i += sha1.Size + 8 {
+		r := new(types.Rom)
+		r.Size = util.BytesToInt64(suffixes[i : i+8])
+		switch len(hash) {
+		case md5.Size:
+			r.Md5 = hash
+		case crc32.Size:
+			r.Crc = hash
+		default:
+			return fmt.Errorf("found unknown hash size: %d", len(hash))
+		}
+		r.Sha1 = suffixes[i+8 : i+8+sha1.Size]
+
+		err = rs.lookupRom(cmd, r, opts)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (rs *RombaService) lookup(cmd *commander.Command, args []string) error {
 	size := cmd.Flag.Lookup("size").Value.Get().(int64)
-	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
+	opts := &lookupOptions{
+		outpath:    cmd.Flag.Lookup("out").Value.Get().(string),
+		quick:      cmd.Flag.Lookup("quick").Value.Get().(bool),
+		printPath:  cmd.Flag.Lookup("printPath").Value.Get().(bool),
+		showSource: cmd.Flag.Lookup("showSource").Value.Get().(bool),
+		showNames:  cmd.Flag.Lookup("showNames").Value.Get().(bool),
+	}
+	inputFile := cmd.Flag.Lookup("inputFile").Value.Get().(string)
+	exactSize := cmd.Flag.Lookup("exactSize").Value.Get().(int64)
 
-	for _, arg := range args {
+	lookupArg := func(arg, where string) error {
 		fmt.Fprintf(cmd.Stdout, "----------------------------------------\n")
 		fmt.Fprintf(cmd.Stdout, "key: %s\n", arg)
 
-		if strings.HasPrefix(arg, "0x") {
-			arg = arg[2:]
+		// an existing path wins over a hash, so a file named like a hash
+		// is hashed rather than taken literally
+		if exists, _ := archive.PathExists(arg); exists {
+			return forEachLookupFile(arg, func(p string, hh *archive.Hashes, size int64) error {
+				sha1Str := hex.EncodeToString(hh.Sha1)
+				fmt.Fprintf(cmd.Stdout, "-----------------\n")
+				fmt.Fprintf(cmd.Stdout, "file %s has sha1 = %s, size = %d\n", p, sha1Str, size)
+				return rs.lookupHash(cmd, sha1Str, hh.Sha1, size, opts)
+			})
 		}
 
-		hash, err := hex.DecodeString(arg)
+		h, hash, err := parseLookupHash(arg)
+		if err != nil {
+			fmt.Fprintf(cmd.Stdout, "malformed hash %s: %v\n", where, err)
+			return nil
+		}
+		return rs.lookupHash(cmd, h, hash, size, opts)
+	}
+
+	for _, arg := range args {
+		err := lookupArg(arg, "argument")
 		if err != nil {
 			return err
 		}
+	}
 
-		if len(hash) == sha1.Size {
-			dat, err := rs.romDB.GetDat(hash)
-			if err != nil {
-				return err
-			}
+	if exactSize >= 0 {
+		err := rs.lookupExactSize(cmd, exactSize, opts)
+		if err != nil {
+			return err
+		}
+	}
 
-			if dat != nil {
-				fmt.Fprintf(cmd.Stdout, "-----------------\n")
-				fmt.Fprintf(cmd.Stdout, "dat with sha1 %s = %s\n", arg, types.PrintShortDat(dat))
-			}
+	if inputFile == "" {
+		return nil
+	}
+
+	if inputFile == "-" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-inputFile - is only supported by the romba command line client")
+		if err != nil {
+			return err
 		}
+		return errors.New("stdin not available to the server")
+	}
 
-		if size != -1 || len(hash) == sha1.Size {
-			r := new(types.Rom)
-			r.Size = size
-			switch len(hash) {
-			case md5.Size:
-				r.Md5 = hash
-			case crc32.Size:
-				r.Crc = hash
-			case sha1.Size:
-				r.Sha1 = hash
-			default:
-				return fmt.Errorf("found unknown hash size: %d", len(hash))
-			}
+	file, err := os.Open(inputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-			err = rs.lookupRom(cmd, r, outpath)
-			if err != nil {
-				return err
-			}
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
 
-			fmt.Fprintf(cmd.Stdout, "-----------------\n")
-			fmt.Fprintf(cmd.Stdout, "DebugGet:\n%s\n", rs.romDB.DebugGet(hash, size))
+	if size == -1 {
+		opts.dats, err = rs.romDB.DatsForRoms(bulkLookupRoms(lines))
+		if err != nil {
+			return err
+		}
+	}
 
-			fmt.Fprintf(cmd.Stdout, "-----------------\n")
-			if len(hash) == sha1.Size {
-				fmt.Fprintf(cmd.Stdout, "bloom filter hits: %v", rs.depot.DebugBloom(arg))
-			}
-		} else {
-			suffixes, err := rs.romDB.ResolveHash(hash)
-			if err != nil {
-				return err
-			}
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
 
-			for i := 0; i < len(suffixes); i += sha1.Size + 8 {
-				r := new(types.Rom)
-				r.Size = util.BytesToInt64(suffixes[i : i+8])
-				switch len(hash) {
-				case md5.Size:
-					r.Md5 = hash
-				case crc32.Size:
-					r.Crc = hash
-				default:
-					return fmt.Errorf("found unknown hash size: %d", len(hash))
-				}
-				r.Sha1 = suffixes[i+8 : i+8+sha1.Size]
+		err = lookupArg(line, fmt.Sprintf("on line %d", i+1))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-				err = rs.lookupRom(cmd, r, outpath)
-				if err != nil {
-					return err
-				}
-			}
+// lookupExactSize looks up every rom of the given size in the size index.
+func (rs *RombaService) lookupExactSize(cmd *commander.Command, size int64, opts *lookupOptions) error {
+	roms, err := rs.romDB.RomsOfSize(size)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "----------------------------------------\n")
+	fmt.Fprintf(cmd.Stdout, "exact size: %d, %d roms\n", size, len(roms))
+
+	for _, r := range roms {
+		fmt.Fprintf(cmd.Stdout, "-----------------\n")
+		fmt.Fprintf(cmd.Stdout, "rom sha1 = %s\n", hex.EncodeToString(r.Sha1))
+
+		err = rs.lookupRom(cmd, r, opts)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
+// bulkLookupRoms returns a rom for every line of a lookup input file that holds
+// a sha1, so that their DATs can be resolved with one DatsForRoms call.
+func bulkLookupRoms(lines []string) []*types.Rom {
+	var roms []*types.Rom
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if exists, _ := archive.PathExists(line); exists {
+			continue
+		}
+
+		_, hash, err := parseLookupHash(line)
+		if err != nil || len(hash) != sha1.Size {
+			continue
+		}
+		roms = append(roms, &types.Rom{
+			Sha1: hash,
+			Size: -1,
+		})
+	}
+	return roms
+}
+
+func (rs *RombaService) whereis(cmd *commander.Command, args []string) error {
+	sha1Str := strings.ToLower(cmd.Flag.Lookup("sha1").Value.Get().(string))
+
+	if sha1Str == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-sha1 argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing sha1 argument")
+	}
+
+	hash, err := hex.DecodeString(sha1Str)
+	if err != nil {
+		return err
+	}
+	if len(hash) != sha1.Size {
+		return fmt.Errorf("expected sha1 hash, got hash size: %d", len(hash))
+	}
+
+	rps, err := rs.depot.WhereIs(sha1Str)
+	if err != nil {
+		return err
+	}
+
+	for _, rp := range rps {
+		var bloomStr string
+		switch {
+		case !rp.BloomReady:
+			bloomStr = "not ready"
+		case rp.BloomHit:
+			bloomStr = "yes"
+		default:
+			bloomStr = "no"
+		}
+
+		fmt.Fprintf(cmd.Stdout, "-----------------\n")
+		fmt.Fprintf(cmd.Stdout, "root %s\n", rp.Root)
+		fmt.Fprintf(cmd.Stdout, "bloom filter = %s\n", bloomStr)
+		fmt.Fprintf(cmd.Stdout, "file present = %v\n", rp.Exists)
+
+		if rp.BloomHit && !rp.Exists {
+			fmt.Fprintf(cmd.Stdout, "bloom says yes but file missing (false positive)\n")
+		}
+		if rp.BloomReady && !rp.BloomHit && rp.Exists {
+			fmt.Fprintf(cmd.Stdout, "file %s present but bloom says no (bloom filter out of date)\n", rp.Path)
+		} else if rp.Exists {
+			fmt.Fprintf(cmd.Stdout, "file %s\n", rp.Path)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,188 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+)
+
+func TestNormalizeHash(t *testing.T) {
+	testCases := []struct {
+		arg      string
+		expected string
+		ok       bool
+	}{
+		{"175a3f26", "175a3f26", true},
+		{"175A3F26", "175a3f26", true},
+		{"0x175a3f26", "175a3f26", true},
+		{"0X175A3F26", "175a3f26", true},
+		{" 36ECF1371D3391C06C16F751431C932B\t", "36ecf1371d3391c06c16f751431c932b", true},
+		{"0x80353CB168DC5D7CC1DCE57971F4EA2640A50AC4", "80353cb168dc5d7cc1dce57971f4ea2640a50ac4", true},
+		{"E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855",
+			"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", true},
+		{"175a3f", "", false},
+		{"0x", "", false},
+		{"175a3g26", "", false},
+		{"not a hash", "", false},
+	}
+
+	for _, tc := range testCases {
+		h, err := normalizeHash(tc.arg)
+		if tc.ok != (err == nil) {
+			t.Fatalf("normalizeHash(%s): expected ok = %v, got error %v", tc.arg, tc.ok, err)
+		}
+		if h != tc.expected {
+			t.Fatalf("normalizeHash(%s): expected %s, got %s", tc.arg, tc.expected, h)
+		}
+	}
+}
+
+func TestParseLookupHash(t *testing.T) {
+	testCases := []struct {
+		arg  string
+		size int
+		ok   bool
+	}{
+		{"175a3f26", 4, true},
+		{"0x175a3f26", 4, true},
+		{"0X175A3F26", 4, true},
+		{"36ecf1371d3391c06c16f751431c932b", 16, true},
+		{"80353cb168dc5d7cc1dce57971f4ea2640a50ac4", 20, true},
+		{"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", 0, false},
+		{"175a3f", 0, false},
+		{"not a hash", 0, false},
+	}
+
+	for _, tc := range testCases {
+		_, hash, err := parseLookupHash(tc.arg)
+		if tc.ok != (err == nil) {
+			t.Fatalf("parseLookupHash(%s): expected ok = %v, got error %v", tc.arg, tc.ok, err)
+		}
+		if len(hash) != tc.size {
+			t.Fatalf("parseLookupHash(%s): expected %d bytes, got %d", tc.arg, tc.size, len(hash))
+		}
+	}
+}
+
+func TestPrintDepotPath(t *testing.T) {
+	buf := new(bytes.Buffer)
+	cmd := &commander.Command{Stdout: buf}
+
+	err := printDepotPath(cmd, "")
+	if err != nil {
+		t.Fatalf("failed to print depot path: %v", err)
+	}
+	if buf.String() != "depot path = indexed but not stored\n" {
+		t.Fatalf("unexpected output for missing rom: %q", buf.String())
+	}
+
+	buf.Reset()
+	rompath := filepath.Join("depot", "80", "35", "3c", "b1", "80353cb168dc5d7cc1dce57971f4ea2640a50ac4.gz")
+	err = printDepotPath(cmd, rompath)
+	if err != nil {
+		t.Fatalf("failed to print depot path: %v", err)
+	}
+
+	absPath, err := filepath.Abs(rompath)
+	if err != nil {
+		t.Fatalf("failed to get absolute path: %v", err)
+	}
+	if buf.String() != "depot path = "+absPath+"\n" {
+		t.Fatalf("unexpected output for stored rom: %q", buf.String())
+	}
+}
+
+func TestForEachLookupFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lookupfiles")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	if err != nil {
+		t.Fatalf("cannot create sub dir: %v", err)
+	}
+
+	files := map[string]string{
+		filepath.Join(dir, "a.rom"):        "hello",
+		filepath.Join(dir, "sub", "b.rom"): "",
+	}
+	for p, content := range files {
+		err = ioutil.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("cannot write %s: %v", p, err)
+		}
+	}
+
+	expected := map[string]string{
+		filepath.Join(dir, "a.rom"):        "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		filepath.Join(dir, "sub", "b.rom"): "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+	}
+
+	found := make(map[string]string)
+	err = forEachLookupFile(dir, func(p string, hh *archive.Hashes, size int64) error {
+		if size != int64(len(files[p])) {
+			t.Fatalf("unexpected size %d for %s", size, p)
+		}
+		found[p] = hex.EncodeToString(hh.Sha1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to hash lookup files: %v", err)
+	}
+
+	if len(found) != len(expected) {
+		t.Fatalf("expected %d files, got %v", len(expected), found)
+	}
+	for p, sha1Str := range expected {
+		if found[p] != sha1Str {
+			t.Fatalf("expected sha1 %s for %s, got %s", sha1Str, p, found[p])
+		}
+	}
+
+	var n int
+	err = forEachLookupFile(filepath.Join(dir, "a.rom"), func(p string, hh *archive.Hashes, size int64) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("expected single file to be hashed once, got %d: %v", n, err)
+	}
+}
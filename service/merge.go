@@ -38,6 +38,7 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
 )
 
 func (rs *RombaService) startMerge(cmd *commander.Command, args []string) error {
@@ -95,8 +96,16 @@ func (rs *RombaService) startMerge(cmd *commander.Command, args []string) error
 		onlyneeded := cmd.Flag.Lookup("only-needed").Value.Get().(bool)
 		numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
 		skipInitialScan := cmd.Flag.Lookup("skip-initial-scan").Value.Get().(bool)
-
-		endMsg, err := rs.depot.Merge(args, resume, onlyneeded, numWorkers, rs.logDir, rs.pt, skipInitialScan)
+		rateLimit := cmd.Flag.Lookup("rateLimit").Value.Get().(int64)
+		checkRoom := cmd.Flag.Lookup("checkRoom").Value.Get().(bool)
+		verifySource := cmd.Flag.Lookup("verifySource").Value.Get().(bool)
+
+		endMsg, err := rs.depot.Merge(args, resume, onlyneeded, numWorkers, rs.logDir, rs.pt, skipInitialScan,
+			&archive.MergeOptions{
+				RateLimit:    rateLimit,
+				CheckRoom:    checkRoom,
+				VerifySource: verifySource,
+			})
 		if err != nil {
 			glog.Errorf("error merging: %v", err)
 		}
@@ -0,0 +1,308 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+// gameKey identifies a game by its name and its roms and disks. Parsing sorts
+// the roms of a game by name, so equal games get equal keys.
+func gameKey(g *types.Game) string {
+	var sb strings.Builder
+	sb.WriteString(g.Name)
+	for _, r := range g.Roms {
+		sb.WriteString("\x00")
+		sb.WriteString(r.Name)
+		sb.WriteString("\x00")
+		sb.WriteString(strconv.FormatInt(r.Size, 10))
+		sb.WriteString("\x00")
+		sb.WriteString(hex.EncodeToString(r.Crc))
+		sb.WriteString(hex.EncodeToString(r.Md5))
+		sb.WriteString(hex.EncodeToString(r.Sha1))
+	}
+	for _, d := range g.Disks {
+		sb.WriteString("\x00")
+		sb.WriteString(d.Name)
+		sb.WriteString("\x00")
+		sb.WriteString(hex.EncodeToString(d.Md5))
+		sb.WriteString(hex.EncodeToString(d.Sha1))
+	}
+	return sb.String()
+}
+
+type keyedGame struct {
+	key  string
+	game *types.Game
+}
+
+type mergeDatWorker struct {
+	pm *mergeDatGru
+}
+
+type mergeDatGru struct {
+	numWorkers int
+	pt         worker.ProgressTracker
+
+	mutex         sync.Mutex
+	games         []keyedGame
+	seen          map[string]bool
+	numDats       int
+	numDuplicates int
+}
+
+func newMergeDatGru(numWorkers int, pt worker.ProgressTracker) *mergeDatGru {
+	return &mergeDatGru{
+		numWorkers: numWorkers,
+		pt:         pt,
+		seen:       make(map[string]bool),
+	}
+}
+
+// add appends the games of dat that aren't identical to an already added game.
+func (pm *mergeDatGru) add(dat *types.Dat) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.numDats++
+	for _, g := range dat.Games {
+		key := gameKey(g)
+		if pm.seen[key] {
+			pm.numDuplicates++
+			continue
+		}
+		pm.seen[key] = true
+		pm.games = append(pm.games, keyedGame{key: key, game: g})
+	}
+}
+
+// mergedDat returns a DAT with the given header holding all added games. DATs are
+// processed concurrently, so the games are sorted to keep the output reproducible.
+// Games that share a name but not their roms get a numbered suffix added to the
+// name, so every game of the merged DAT has a name of its own.
+func (pm *mergeDatGru) mergedDat(name, description string) *types.Dat {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	sort.Slice(pm.games, func(i, j int) bool {
+		return pm.games[i].key < pm.games[j].key
+	})
+
+	dat := &types.Dat{
+		Name:        name,
+		Description: description,
+		Games:       make(types.GameSlice, len(pm.games)),
+	}
+	names := make(map[string]bool, len(pm.games))
+	for _, kg := range pm.games {
+		names[kg.game.Name] = true
+	}
+
+	taken := make(map[string]bool, len(pm.games))
+	for i, kg := range pm.games {
+		g := kg.game
+		if taken[g.Name] {
+			name := g.Name
+			for n := 2; names[name]; n++ {
+				name = fmt.Sprintf("%s (%d)", g.Name, n)
+			}
+			renamed := *g
+			renamed.Name = name
+			g = &renamed
+			names[name] = true
+			glog.Infof("mergedat: renamed game %s with different roms to %s", kg.game.Name, name)
+		}
+		taken[g.Name] = true
+		dat.Games[i] = g
+	}
+	return dat
+}
+
+func (pw *mergeDatWorker) Process(path string, size int64) error {
+	dat, _, err := parser.Parse(path)
+	if err != nil {
+		return err
+	}
+
+	pw.pm.add(dat)
+	return nil
+}
+
+func (pw *mergeDatWorker) Close() error {
+	return nil
+}
+
+func (pm *mergeDatGru) CalculateWork() bool {
+	return true
+}
+
+func (pm *mergeDatGru) NeedsSizeInfo() bool {
+	return false
+}
+
+func (pm *mergeDatGru) Accept(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".dat" || ext == ".xml"
+}
+
+func (pm *mergeDatGru) NewWorker(workerIndex int) worker.Worker {
+	return &mergeDatWorker{
+		pm: pm,
+	}
+}
+
+func (pm *mergeDatGru) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *mergeDatGru) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *mergeDatGru) FinishUp() error {
+	return nil
+}
+
+func (pm *mergeDatGru) Start() error {
+	return nil
+}
+
+func (pm *mergeDatGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+
+func (rs *RombaService) mergedat(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		p := rs.pt.GetProgress()
+
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
+			p.FilesSoFar, p.TotalFiles, humanize.IBytes(uint64(p.BytesSoFar)), humanize.IBytes(uint64(p.TotalBytes)))
+		return err
+	}
+
+	inPath := cmd.Flag.Lookup("in").Value.Get().(string)
+	if inPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-in argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing in argument")
+	}
+
+	outPath := cmd.Flag.Lookup("out").Value.Get().(string)
+	if outPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-out argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing out argument")
+	}
+
+	name := cmd.Flag.Lookup("name").Value.Get().(string)
+	if name == "" {
+		name = filepath.Base(inPath)
+	}
+	description := cmd.Flag.Lookup("description").Value.Get().(string)
+	if description == "" {
+		description = name
+	}
+
+	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+
+	rs.pt.Reset()
+	rs.busy = true
+	rs.jobName = "mergedat"
+
+	go func() {
+		glog.Infof("service starting mergedat")
+		rs.broadCastProgress(time.Now(), true, false, "", nil)
+		ticker := time.NewTicker(time.Second * 5)
+		stopTicker := make(chan bool)
+		go func() {
+			glog.Infof("starting progress broadcaster")
+			for {
+				select {
+				case t := <-ticker.C:
+					rs.broadCastProgress(t, false, false, "", nil)
+				case <-stopTicker:
+					glog.Info("stopped progress broadcaster")
+					return
+				}
+			}
+		}()
+
+		pm := newMergeDatGru(numWorkers, rs.pt)
+
+		endMsg, err := worker.Work("merging dats", []string{inPath}, pm)
+		if err != nil {
+			glog.Errorf("error merging dats: %v", err)
+		} else {
+			dat := pm.mergedDat(name, description)
+			err = writeDat(dat, outPath)
+			if err != nil {
+				glog.Errorf("error writing merged dat %s: %v", outPath, err)
+			} else {
+				endMsg += fmt.Sprintf("number of dats merged: %d\nnumber of games written: %d\n"+
+					"number of duplicate games skipped: %d\n", pm.numDats, len(dat.Games), pm.numDuplicates)
+			}
+		}
+
+		ticker.Stop()
+		stopTicker <- true
+
+		rs.jobMutex.Lock()
+		rs.busy = false
+		rs.jobName = ""
+		rs.jobMutex.Unlock()
+
+		rs.broadCastProgress(time.Now(), false, true, endMsg, err)
+		glog.Infof("service finished mergedat")
+	}()
+
+	_, err := fmt.Fprintf(cmd.Stdout, "started mergedat")
+	return err
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+const mergeDatA = `
+clrmamepro (
+	name "A"
+	description "A"
+)
+
+game (
+	name "shared"
+	rom ( name "shared.bin" size 4 crc 11111111 )
+)
+
+game (
+	name "only a"
+	rom ( name "a.bin" size 4 crc 22222222 )
+)
+`
+
+const mergeDatB = `
+clrmamepro (
+	name "B"
+	description "B"
+)
+
+game (
+	name "shared"
+	rom ( name "shared.bin" size 4 crc 11111111 )
+)
+
+game (
+	name "only a"
+	rom ( name "a.bin" size 4 crc 33333333 )
+)
+`
+
+func TestMergeDats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mergedat")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	inDir := filepath.Join(dir, "in")
+	err = os.MkdirAll(filepath.Join(inDir, "sub"), 0777)
+	if err != nil {
+		t.Fatalf("cannot create input dir: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(inDir, "a.dat"), []byte(mergeDatA), 0666)
+	if err != nil {
+		t.Fatalf("cannot write test dat: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(inDir, "sub", "b.dat"), []byte(mergeDatB), 0666)
+	if err != nil {
+		t.Fatalf("cannot write test dat: %v", err)
+	}
+
+	pm := newMergeDatGru(2, worker.NewProgressTracker(2))
+	_, err = worker.Work("merging dats", []string{inDir}, pm)
+	if err != nil {
+		t.Fatalf("failed to merge dats: %v", err)
+	}
+
+	if pm.numDats != 2 {
+		t.Fatalf("expected 2 merged dats, got %d", pm.numDats)
+	}
+	if pm.numDuplicates != 1 {
+		t.Fatalf("expected 1 duplicate game, got %d", pm.numDuplicates)
+	}
+
+	outPath := filepath.Join(dir, "merged.dat")
+	err = writeDat(pm.mergedDat("merged", "merged dats"), outPath)
+	if err != nil {
+		t.Fatalf("failed to write merged dat: %v", err)
+	}
+
+	dat, _, err := parser.Parse(outPath)
+	if err != nil {
+		t.Fatalf("failed to parse merged dat: %v", err)
+	}
+
+	if dat.Name != "merged" || dat.Description != "merged dats" {
+		t.Fatalf("unexpected header %s, %s", dat.Name, dat.Description)
+	}
+	if len(dat.Games) != 3 {
+		t.Fatalf("expected 3 games, got %d", len(dat.Games))
+	}
+	if dat.Games[2].Name != "shared" {
+		t.Fatalf("expected games sorted by name, got %s last", dat.Games[2].Name)
+	}
+
+	// the two "only a" games differ in their roms, so one of them is renamed
+	if dat.Games[0].Name != "only a" || dat.Games[1].Name != "only a (2)" {
+		t.Fatalf("expected colliding games named only a and only a (2), got %s and %s",
+			dat.Games[0].Name, dat.Games[1].Name)
+	}
+	if dat.Games[0].Roms[0].Crc[1] != 0x22 || dat.Games[1].Roms[0].Crc[1] != 0x33 {
+		t.Fatalf("expected renamed game to keep its own roms")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// canonicalRomLess orders roms by name, breaking ties by size and hashes so
+// that the order doesn't depend on the order in the input DAT.
+func canonicalRomLess(a, b *types.Rom) bool {
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if a.Size != b.Size {
+		return a.Size < b.Size
+	}
+	if c := bytes.Compare(a.Sha1, b.Sha1); c != 0 {
+		return c < 0
+	}
+	if c := bytes.Compare(a.Md5, b.Md5); c != 0 {
+		return c < 0
+	}
+	return bytes.Compare(a.Crc, b.Crc) < 0
+}
+
+// canonicalizeDat sorts the games of a parsed, and so normalized, dat by name
+// and their roms and samples by canonicalRomLess and name. Games of the same
+// name are ordered by their roms.
+func canonicalizeDat(dat *types.Dat) {
+	if dat.OriginalName != "" {
+		dat.Name = dat.OriginalName
+	}
+
+	for _, g := range dat.Games {
+		sort.SliceStable(g.Roms, func(i, j int) bool {
+			return canonicalRomLess(g.Roms[i], g.Roms[j])
+		})
+		sort.SliceStable(g.Samples, func(i, j int) bool {
+			return g.Samples[i].Name < g.Samples[j].Name
+		})
+	}
+
+	sort.SliceStable(dat.Games, func(i, j int) bool {
+		gi, gj := dat.Games[i], dat.Games[j]
+		if gi.Name != gj.Name {
+			return gi.Name < gj.Name
+		}
+		return gameKey(gi) < gameKey(gj)
+	})
+}
+
+// replaceDat writes dat to a temp file next to outPath and renames it to outPath
+// once it is complete, so that outPath can be the DAT dat was parsed from.
+func replaceDat(dat *types.Dat, outPath string) error {
+	dat.Path = outPath
+
+	file, err := ioutil.TempFile(filepath.Dir(outPath), filepath.Base(outPath)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	err = types.ComposeCompliantDat(dat, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), outPath)
+	}
+	if err != nil {
+		rerr := os.Remove(file.Name())
+		if rerr != nil && !os.IsNotExist(rerr) {
+			glog.Errorf("error removing %s: %v", file.Name(), rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (rs *RombaService) normalizeDat(cmd *commander.Command, args []string) error {
+	inPath := cmd.Flag.Lookup("in").Value.Get().(string)
+	outPath := cmd.Flag.Lookup("out").Value.Get().(string)
+
+	if inPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-in argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing in argument")
+	}
+	if outPath == "" {
+		outPath = inPath
+	}
+
+	glog.Infof("normalize-dat %s into %s", inPath, outPath)
+
+	dat, _, err := parser.Parse(inPath)
+	if err != nil {
+		return err
+	}
+
+	canonicalizeDat(dat)
+
+	err = replaceDat(dat, outPath)
+	if err != nil {
+		return err
+	}
+
+	endMsg := fmt.Sprintf("normalize-dat finished, written %d games into %s", len(dat.Games), outPath)
+	glog.Infof(endMsg)
+	_, err = fmt.Fprintf(cmd.Stdout, endMsg)
+	return err
+}
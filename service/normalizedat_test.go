@@ -0,0 +1,139 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+const unsortedDat = `clrmamepro (
+	name "unsorted"
+	description "unsorted dat"
+)
+
+game (
+	name "zeta"
+	description "zeta"
+	rom ( name z2.bin size 2 crc 00000002 )
+	rom ( name z1.bin size 1 crc 00000001 )
+)
+
+game (
+	name alpha
+	description alpha
+	rom ( name "a.bin" size 3 crc 00000003 )
+)
+`
+
+func TestCanonicalizeDat(t *testing.T) {
+	dat := &types.Dat{
+		Name: "d",
+		Games: []*types.Game{
+			&types.Game{Name: "b", Roms: []*types.Rom{
+				&types.Rom{Name: "x.bin", Size: 2},
+				&types.Rom{Name: "x.bin", Size: 1},
+			}},
+			&types.Game{Name: "a", Roms: []*types.Rom{&types.Rom{Name: "a.bin", Size: 1}}},
+		},
+	}
+
+	canonicalizeDat(dat)
+
+	if dat.Games[0].Name != "a" || dat.Games[1].Name != "b" {
+		t.Fatalf("games not sorted: %s, %s", dat.Games[0].Name, dat.Games[1].Name)
+	}
+	if dat.Games[1].Roms[0].Size != 1 || dat.Games[1].Roms[1].Size != 2 {
+		t.Fatalf("roms of equal name not sorted by size")
+	}
+}
+
+func TestNormalizeDatIdempotent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "normalizedat")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	inPath := filepath.Join(dir, "in.dat")
+	err = ioutil.WriteFile(inPath, []byte(unsortedDat), 0644)
+	if err != nil {
+		t.Fatalf("failed to write dat: %v", err)
+	}
+
+	normalize := func(in, out string) []byte {
+		dat, _, err := parser.Parse(in)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", in, err)
+		}
+		canonicalizeDat(dat)
+		err = replaceDat(dat, out)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", out, err)
+		}
+		bs, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", out, err)
+		}
+		return bs
+	}
+
+	first := normalize(inPath, filepath.Join(dir, "once.dat"))
+	// in place, like normalize-dat without -out
+	second := normalize(filepath.Join(dir, "once.dat"), filepath.Join(dir, "once.dat"))
+
+	if !bytes.Equal(first, second) {
+		t.Fatalf("normalizing twice changed the dat:\n%s\n---\n%s", first, second)
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	if len(fis) != 2 {
+		t.Fatalf("expected only in.dat and once.dat, found %d files", len(fis))
+	}
+
+	alpha := bytes.Index(first, []byte(`"alpha"`))
+	zeta := bytes.Index(first, []byte(`"zeta"`))
+	if alpha < 0 || zeta < 0 || alpha > zeta {
+		t.Fatalf("games not sorted by name:\n%s", first)
+	}
+	if bytes.Index(first, []byte(`"z1.bin"`)) > bytes.Index(first, []byte(`"z2.bin"`)) {
+		t.Fatalf("roms not sorted by name:\n%s", first)
+	}
+}
@@ -31,7 +31,11 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package service
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -98,3 +102,55 @@ func (rs *RombaService) purge(cmd *commander.Command, args []string) error {
 	_, err := fmt.Fprintf(cmd.Stdout, "started purging")
 	return err
 }
+
+func (rs *RombaService) purgeRom(cmd *commander.Command, args []string) error {
+	sha1Str := strings.ToLower(cmd.Flag.Lookup("sha1").Value.Get().(string))
+
+	if sha1Str == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-sha1 argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing sha1 argument")
+	}
+
+	hash, err := hex.DecodeString(sha1Str)
+	if err != nil {
+		return err
+	}
+	if len(hash) != sha1.Size {
+		return fmt.Errorf("expected sha1 hash, got hash size: %d", len(hash))
+	}
+
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s, try again later\n", rs.jobName)
+		return err
+	}
+
+	rom, rompath, err := rs.depot.PurgeRom(sha1Str)
+	if err != nil {
+		return err
+	}
+
+	if rom == nil {
+		_, err = fmt.Fprintf(cmd.Stdout, "rom with sha1 %s not found in depot\n", sha1Str)
+		return err
+	}
+
+	glog.Infof("purged rom file %s from depot", rompath)
+	fmt.Fprintf(cmd.Stdout, "purged rom file %s from depot\n", rompath)
+
+	err = rs.romDB.DeleteRom(rom)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "removed index entries for rom with sha1 %s\n", sha1Str)
+
+	glog.Warningf("bloom filters can't remove sha1 %s, they may report it as present until rebuilt", sha1Str)
+	_, err = fmt.Fprintf(cmd.Stdout, "bloom filters may still report sha1 %s as present until rebuilt with popbloom\n",
+		sha1Str)
+	return err
+}
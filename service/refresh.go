@@ -31,6 +31,7 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package service
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -52,6 +53,30 @@ func (rs *RombaService) startRefreshDats(cmd *commander.Command, args []string)
 		return err
 	}
 
+	indexHashes, err := db.ParseIndexHashes(cmd.Flag.Lookup("indexHashes").Value.Get().(string))
+	if err != nil {
+		return err
+	}
+
+	transcode, err := db.ParseSourceEncoding(cmd.Flag.Lookup("sourceEncoding").Value.Get().(string))
+	if err != nil {
+		return err
+	}
+
+	referenceDats, err := db.ParseReferenceDats(rs.referenceOnly)
+	if err != nil {
+		return err
+	}
+
+	datsPaths := refreshDatsPaths(rs.dats, args)
+	if len(datsPaths) == 0 {
+		_, err := fmt.Fprintf(cmd.Stdout, "no DAT master directories configured or specified")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing dats directories")
+	}
+
 	rs.pt.Reset()
 	rs.busy = true
 	rs.jobName = "refresh-dats"
@@ -76,8 +101,11 @@ func (rs *RombaService) startRefreshDats(cmd *commander.Command, args []string)
 
 		numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
 		missingSha1s := cmd.Flag.Lookup("missingSha1s").Value.Get().(string)
+		encodingIssues := cmd.Flag.Lookup("encodingIssues").Value.Get().(string)
+		maxDepth := cmd.Flag.Lookup("maxDepth").Value.Get().(int)
 
-		endMsg, err := db.Refresh(rs.romDB, rs.dats, numWorkers, rs.pt, missingSha1s)
+		endMsg, err := db.Refresh(rs.romDB, datsPaths, numWorkers, rs.pt, missingSha1s, indexHashes,
+			encodingIssues, transcode, maxDepth, referenceDats)
 		if err != nil {
 			glog.Errorf("error refreshing dats: %v", err)
 		}
@@ -94,6 +122,22 @@ func (rs *RombaService) startRefreshDats(cmd *commander.Command, args []string)
 		glog.Infof("service finished refresh-dats")
 	}()
 
-	_, err :=fmt.Fprintf(cmd.Stdout, "started refresh dats")
+	_, err = fmt.Fprintf(cmd.Stdout, "started refresh dats")
 	return err
 }
+
+// refreshDatsPaths returns the configured DAT master directories followed by the
+// extra ones given on the command line, without duplicates. Refresh needs all of
+// them at once, otherwise DATs in the directories left out become orphans.
+func refreshDatsPaths(configured, extra []string) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, p := range append(append([]string(nil), configured...), extra...) {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		paths = append(paths, p)
+	}
+	return paths
+}
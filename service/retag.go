@@ -0,0 +1,94 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+)
+
+func (rs *RombaService) retagDat(cmd *commander.Command, args []string) error {
+	sha1Str := strings.ToLower(cmd.Flag.Lookup("sha1").Value.Get().(string))
+	name := cmd.Flag.Lookup("name").Value.Get().(string)
+	description := cmd.Flag.Lookup("description").Value.Get().(string)
+
+	if sha1Str == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-sha1 argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing sha1 argument")
+	}
+
+	if name == "" && description == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-name or -description argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing name or description argument")
+	}
+
+	hash, err := hex.DecodeString(sha1Str)
+	if err != nil {
+		return err
+	}
+	if len(hash) != sha1.Size {
+		return fmt.Errorf("expected sha1 hash, got hash size: %d", len(hash))
+	}
+
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s, try again later\n", rs.jobName)
+		return err
+	}
+
+	dat, err := rs.romDB.UpdateDatHeader(hash, name, description)
+	if err != nil {
+		return err
+	}
+
+	if dat == nil {
+		_, err = fmt.Fprintf(cmd.Stdout, "dat with sha1 %s not found in index\n", sha1Str)
+		return err
+	}
+
+	glog.Infof("retagged dat %s: name %s, description %s", sha1Str, dat.Name, dat.Description)
+	_, err = fmt.Fprintf(cmd.Stdout, "retagged dat %s: name = %s, description = %s\n", sha1Str, dat.Name, dat.Description)
+	return err
+}
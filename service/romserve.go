@@ -0,0 +1,110 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/klauspost/compress/gzip"
+)
+
+// ServeRom serves the decompressed content of a depot rom read-only over HTTP.
+// The path below the handler's prefix is the sha1 of the rom, optionally
+// followed by a file name for the download, like <sha1>/name.bin.
+func (rs *RombaService) ServeRom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sha1Str, name := r.URL.Path, ""
+	if i := strings.Index(sha1Str, "/"); i >= 0 {
+		sha1Str, name = sha1Str[:i], sha1Str[i+1:]
+	}
+
+	sha1Str, err := normalizeHash(sha1Str)
+	if err != nil || len(sha1Str) != 2*sha1.Size {
+		http.Error(w, fmt.Sprintf("expected sha1 in path, got %s", r.URL.Path), http.StatusBadRequest)
+		return
+	}
+
+	inDepot, _, rompath, size, err := rs.depot.SHA1InDepot(sha1Str)
+	if err != nil {
+		glog.Errorf("failed to look up %s in depot: %v", sha1Str, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !inDepot {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := os.Open(rompath)
+	if err != nil {
+		glog.Errorf("failed to open depot file %s: %v", rompath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		glog.Errorf("failed to open depot file %s: %v", rompath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer gzr.Close()
+
+	if name == "" {
+		name = sha1Str
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err = io.Copy(w, gzr)
+	if err != nil {
+		glog.Errorf("failed to serve depot file %s: %v", rompath, err)
+	}
+}
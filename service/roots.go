@@ -0,0 +1,91 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+)
+
+type rootInfo struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	MaxSize  int64  `json:"maxSize"`
+	Writable bool   `json:"writable"`
+}
+
+// dirWritable reports whether a file can be created in dir. It creates and
+// removes a probe file, since the permission bits alone don't tell for the
+// user running romba.
+func dirWritable(dir string) bool {
+	f, err := ioutil.TempFile(dir, ".romba_probe")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true
+}
+
+func newRootInfos(stats []*archive.RootStats) []*rootInfo {
+	ris := make([]*rootInfo, 0, len(stats))
+	for _, st := range stats {
+		ris = append(ris, &rootInfo{
+			Path:     st.Path,
+			Size:     st.Size,
+			MaxSize:  st.MaxSize,
+			Writable: dirWritable(st.Path),
+		})
+	}
+	return ris
+}
+
+func (rs *RombaService) roots(cmd *commander.Command, args []string) error {
+	ris := newRootInfos(rs.depot.RootStats())
+
+	if cmd.Flag.Lookup("json").Value.Get().(bool) {
+		return writeJSON(cmd.Stdout, ris)
+	}
+
+	for _, ri := range ris {
+		_, err := fmt.Fprintf(cmd.Stdout, "%s: size = %s, maxSize = %s, writable = %v\n",
+			ri.Path, humanize.IBytes(uint64(ri.Size)), humanize.IBytes(uint64(ri.MaxSize)), ri.Writable)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -67,13 +67,15 @@ type ProgressNessage struct {
 	TerminalMessage string
 	KnowTotal       bool
 	CurrentFiles    string
+	OpenFiles       int32
 }
 
 type RombaService struct {
 	romDB             db.RomDB
 	depot             *archive.Depot
 	logDir            string
-	dats              string
+	dats              []string
+	referenceOnly     []string
 	numWorkers        int
 	pt                worker.ProgressTracker
 	busy              bool
@@ -97,6 +99,7 @@ func NewRombaService(romDB db.RomDB, depot *archive.Depot, cfg *config.Config) *
 	rs.romDB = romDB
 	rs.depot = depot
 	rs.dats = cfg.Index.Dats
+	rs.referenceOnly = cfg.Index.ReferenceOnly
 	rs.logDir = cfg.General.LogDir
 	rs.numWorkers = cfg.General.Workers
 	rs.pt = worker.NewProgressTracker(rs.numWorkers)
@@ -150,6 +153,7 @@ func (rs *RombaService) broadCastProgress(t time.Time, starting bool,
 		pmsg.BytesSoFar = p.BytesSoFar
 		pmsg.FilesSoFar = p.FilesSoFar
 		pmsg.KnowTotal = p.KnowTotal()
+		pmsg.OpenFiles = p.OpenFiles
 		pmsg.JobName = jn
 		pmsg.Running = true
 
@@ -211,6 +215,9 @@ func (rs *RombaService) progress(cmd *commander.Command, args []string) error {
 
 		fmt.Fprintf(cmd.Stdout, "running %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
 			p.FilesSoFar, p.TotalFiles, humanize.IBytes(uint64(p.BytesSoFar)), humanize.IBytes(uint64(p.TotalBytes)))
+		if p.OpenFiles > 0 {
+			fmt.Fprintf(cmd.Stdout, "open files: %d\n", p.OpenFiles)
+		}
 		return nil
 	} else {
 		fmt.Fprintf(cmd.Stdout, "nothing currently running")
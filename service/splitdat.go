@@ -0,0 +1,143 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func gameSize(g *types.Game) int64 {
+	var size int64
+	for _, r := range g.Roms {
+		size += r.Size
+	}
+	return size
+}
+
+// splitDat breaks dat into chunks holding at most maxGames games and at most maxBytes
+// of rom data each. A limit <= 0 is ignored. A single game larger than maxBytes gets
+// a chunk of its own.
+func splitDat(dat *types.Dat, maxGames int, maxBytes int64) []*types.Dat {
+	var chunks []*types.Dat
+	var chunk *types.Dat
+	var chunkBytes int64
+
+	for _, g := range dat.Games {
+		gs := gameSize(g)
+
+		if chunk != nil && ((maxGames > 0 && len(chunk.Games) >= maxGames) ||
+			(maxBytes > 0 && chunkBytes+gs > maxBytes)) {
+			chunk = nil
+		}
+
+		if chunk == nil {
+			chunk = new(types.Dat)
+			chunk.CopyHeader(dat)
+			chunks = append(chunks, chunk)
+			chunkBytes = 0
+		}
+
+		chunk.Games = append(chunk.Games, g)
+		chunkBytes += gs
+	}
+
+	for i, chunk := range chunks {
+		chunk.Name = fmt.Sprintf("%s (%d of %d)", dat.Name, i+1, len(chunks))
+		chunk.Description = fmt.Sprintf("%s (%d of %d)", dat.Description, i+1, len(chunks))
+	}
+	return chunks
+}
+
+func (rs *RombaService) splitdat(cmd *commander.Command, args []string) error {
+	inPath := cmd.Flag.Lookup("in").Value.Get().(string)
+	outPath := cmd.Flag.Lookup("out").Value.Get().(string)
+	maxGames := cmd.Flag.Lookup("maxGames").Value.Get().(int)
+	maxBytes := cmd.Flag.Lookup("maxBytes").Value.Get().(int64)
+
+	if inPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-in argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing in argument")
+	}
+	if outPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-out argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing out argument")
+	}
+	if maxGames <= 0 && maxBytes <= 0 {
+		_, err := fmt.Fprintf(cmd.Stdout, "-maxGames or -maxBytes argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing maxGames or maxBytes argument")
+	}
+
+	glog.Infof("splitdat %s into %s", inPath, outPath)
+
+	dat, _, err := parser.Parse(inPath)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(outPath, 0777)
+	if err != nil {
+		return err
+	}
+
+	baseName := strings.TrimSuffix(filepath.Base(inPath), filepath.Ext(inPath))
+
+	chunks := splitDat(dat, maxGames, maxBytes)
+	for i, chunk := range chunks {
+		err = writeDat(chunk, filepath.Join(outPath, fmt.Sprintf("%s_%d.dat", baseName, i+1)))
+		if err != nil {
+			return err
+		}
+	}
+
+	endMsg := fmt.Sprintf("splitdat finished, written %d DAT files into %s", len(chunks), outPath)
+	glog.Infof(endMsg)
+	_, err = fmt.Fprintf(cmd.Stdout, endMsg)
+	return err
+}
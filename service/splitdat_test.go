@@ -0,0 +1,68 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestSplitDat(t *testing.T) {
+	dat := &types.Dat{
+		Name:        "big",
+		Description: "big dat",
+		Games: []*types.Game{
+			&types.Game{Name: "a", Roms: []*types.Rom{&types.Rom{Name: "a.bin", Size: 10}}},
+			&types.Game{Name: "b", Roms: []*types.Rom{&types.Rom{Name: "b.bin", Size: 10}}},
+			&types.Game{Name: "c", Roms: []*types.Rom{&types.Rom{Name: "c.bin", Size: 30}}},
+			&types.Game{Name: "d", Roms: []*types.Rom{&types.Rom{Name: "d.bin", Size: 10}}},
+			&types.Game{Name: "e", Roms: []*types.Rom{&types.Rom{Name: "e.bin", Size: 10}}},
+		},
+	}
+
+	chunks := splitDat(dat, 2, 0)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	if chunks[2].Name != "big (3 of 3)" || len(chunks[2].Games) != 1 {
+		t.Fatalf("unexpected last chunk %s with %d games", chunks[2].Name, len(chunks[2].Games))
+	}
+
+	chunks = splitDat(dat, 0, 25)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	if len(chunks[0].Games) != 2 || len(chunks[1].Games) != 1 || len(chunks[2].Games) != 2 {
+		t.Fatalf("unexpected chunk sizes %d, %d, %d", len(chunks[0].Games), len(chunks[1].Games),
+			len(chunks[2].Games))
+	}
+}
@@ -32,7 +32,9 @@ package service
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"runtime"
 	"runtime/debug"
 	"time"
@@ -41,7 +43,10 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/db"
 	"github.com/uwedeportivo/romba/dedup"
+	"github.com/uwedeportivo/romba/parser"
 	"github.com/uwedeportivo/romba/types"
 )
 
@@ -55,6 +60,72 @@ func (rs *RombaService) deprecated(cmd *commander.Command, args []string) error
 	return nil
 }
 
+// writeJSON writes v as indented JSON to w.
+func writeJSON(w io.Writer, v interface{}) error {
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", bs)
+	return err
+}
+
+type memStatsJSON struct {
+	Alloc        uint64 `json:"alloc"`
+	TotalAlloc   uint64 `json:"totalAlloc"`
+	Sys          uint64 `json:"sys"`
+	Lookups      uint64 `json:"lookups"`
+	Mallocs      uint64 `json:"mallocs"`
+	Frees        uint64 `json:"frees"`
+	HeapAlloc    uint64 `json:"heapAlloc"`
+	HeapSys      uint64 `json:"heapSys"`
+	HeapIdle     uint64 `json:"heapIdle"`
+	HeapInuse    uint64 `json:"heapInuse"`
+	HeapReleased uint64 `json:"heapReleased"`
+	HeapObjects  uint64 `json:"heapObjects"`
+	StackInuse   uint64 `json:"stackInuse"`
+	StackSys     uint64 `json:"stackSys"`
+	MSpanInuse   uint64 `json:"mSpanInuse"`
+	MSpanSys     uint64 `json:"mSpanSys"`
+	MCacheInuse  uint64 `json:"mCacheInuse"`
+	MCacheSys    uint64 `json:"mCacheSys"`
+	BuckHashSys  uint64 `json:"buckHashSys"`
+	NextGC       uint64 `json:"nextGC"`
+	PauseTotalNs uint64 `json:"pauseTotalNs"`
+	NumGC        uint32 `json:"numGC"`
+	EnableGC     bool   `json:"enableGC"`
+	DebugGC      bool   `json:"debugGC"`
+}
+
+func newMemStatsJSON(s *runtime.MemStats) *memStatsJSON {
+	return &memStatsJSON{
+		Alloc:        s.Alloc,
+		TotalAlloc:   s.TotalAlloc,
+		Sys:          s.Sys,
+		Lookups:      s.Lookups,
+		Mallocs:      s.Mallocs,
+		Frees:        s.Frees,
+		HeapAlloc:    s.HeapAlloc,
+		HeapSys:      s.HeapSys,
+		HeapIdle:     s.HeapIdle,
+		HeapInuse:    s.HeapInuse,
+		HeapReleased: s.HeapReleased,
+		HeapObjects:  s.HeapObjects,
+		StackInuse:   s.StackInuse,
+		StackSys:     s.StackSys,
+		MSpanInuse:   s.MSpanInuse,
+		MSpanSys:     s.MSpanSys,
+		MCacheInuse:  s.MCacheInuse,
+		MCacheSys:    s.MCacheSys,
+		BuckHashSys:  s.BuckHashSys,
+		NextGC:       s.NextGC,
+		PauseTotalNs: s.PauseTotalNs,
+		NumGC:        s.NumGC,
+		EnableGC:     s.EnableGC,
+		DebugGC:      s.DebugGC,
+	}
+}
+
 func (rs *RombaService) memstats(cmd *commander.Command, args []string) error {
 	rs.jobMutex.Lock()
 	defer rs.jobMutex.Unlock()
@@ -64,6 +135,10 @@ func (rs *RombaService) memstats(cmd *commander.Command, args []string) error {
 	s := new(runtime.MemStats)
 	runtime.ReadMemStats(s)
 
+	if cmd.Flag.Lookup("json").Value.Get().(bool) {
+		return writeJSON(cmd.Stdout, newMemStatsJSON(s))
+	}
+
 	fmt.Fprintf(cmd.Stdout, "\n# runtime.MemStats\n")
 	fmt.Fprintf(cmd.Stdout, "# Alloc = %s\n", humanize.IBytes(s.Alloc))
 	fmt.Fprintf(cmd.Stdout, "# TotalAlloc = %s\n", humanize.IBytes(s.TotalAlloc))
@@ -93,11 +168,45 @@ func (rs *RombaService) memstats(cmd *commander.Command, args []string) error {
 	return nil
 }
 
+type dbStatsJSON struct {
+	DB    *db.Stats            `json:"db"`
+	Roots []*archive.RootStats `json:"roots"`
+}
+
 func (rs *RombaService) dbstats(cmd *commander.Command, args []string) error {
 	rs.jobMutex.Lock()
 	defer rs.jobMutex.Unlock()
 
+	if cmd.Flag.Lookup("json").Value.Get().(bool) {
+		st, err := rs.romDB.Stats()
+		if err != nil {
+			return err
+		}
+
+		return writeJSON(cmd.Stdout, &dbStatsJSON{
+			DB:    st,
+			Roots: rs.depot.RootStats(),
+		})
+	}
+
 	fmt.Fprintf(cmd.Stdout, "dbstats = %s", rs.romDB.PrintStats())
+
+	fmt.Fprintf(cmd.Stdout, "\n# depot roots\n")
+	for _, st := range rs.depot.RootStats() {
+		utilization := 0.0
+		if st.MaxSize > 0 {
+			utilization = 100 * float64(st.Size) / float64(st.MaxSize)
+		}
+
+		free := "unknown"
+		if st.FreeSpace >= 0 {
+			free = humanize.IBytes(uint64(st.FreeSpace))
+		}
+
+		fmt.Fprintf(cmd.Stdout, "# %s: size = %s, maxSize = %s, utilization = %.1f%%, free = %s, bloomReady = %v, numBfAdded = %d\n",
+			st.Path, humanize.IBytes(uint64(st.Size)), humanize.IBytes(uint64(st.MaxSize)), utilization, free,
+			st.BloomReady, st.NumBfAdded)
+	}
 	return nil
 }
 
@@ -108,9 +217,172 @@ type datStats struct {
 	nGames       int
 	totalSize    uint64
 	nRomsBelow4k int
+	nRefDats     int
+
+	// declared counts are summed per DAT before deduping, so roms shared
+	// between DATs are counted once for every DAT they appear in.
+	nDeclaredRoms int
+	declaredSize  uint64
+}
+
+// declare adds the roms of dat to the declared counts.
+func (dts *datStats) declare(dat *types.Dat) {
+	for _, g := range dat.Games {
+		for _, r := range g.Roms {
+			dts.nDeclaredRoms++
+			dts.declaredSize += uint64(r.Size)
+		}
+	}
+}
+
+type percentileJSON struct {
+	Count      int64   `json:"count"`
+	Percentile float64 `json:"percentile"`
+	Size       int64   `json:"size"`
+}
+
+type sizeBucketJSON struct {
+	Count int64 `json:"count"`
+	Size  int64 `json:"size"`
+}
+
+type datStatsJSON struct {
+	NumDats         int               `json:"numDats"`
+	NumRefDats      int               `json:"numReferenceOnlyDats"`
+	NumGames        int               `json:"numGames"`
+	NumRoms         int               `json:"numRoms"`
+	TotalRomSize    uint64            `json:"totalRomSize"`
+	NumRomsBelow4k  int               `json:"numRomsBelow4k"`
+	NumDeclaredRoms int               `json:"numDeclaredRoms"`
+	DeclaredRomSize uint64            `json:"declaredRomSize"`
+	CumulativeDist  []*percentileJSON `json:"cumulativeDistribution"`
+	SizeHistogram   []*sizeBucketJSON `json:"sizeHistogram"`
+}
+
+// json returns the dat stats as a JSON document.
+func (dts *datStats) json() (string, error) {
+	bs := dts.h.CumulativeDistribution()
+
+	dsj := &datStatsJSON{
+		NumDats:         dts.nDats,
+		NumRefDats:      dts.nRefDats,
+		NumGames:        dts.nGames,
+		NumRoms:         dts.nRoms,
+		TotalRomSize:    dts.totalSize,
+		NumRomsBelow4k:  dts.nRomsBelow4k,
+		NumDeclaredRoms: dts.nDeclaredRoms,
+		DeclaredRomSize: dts.declaredSize,
+	}
+
+	var lastCount int64
+	for i, b := range bs {
+		if i == len(bs)-1 || b.ValueAt != bs[i+1].ValueAt {
+			dsj.CumulativeDist = append(dsj.CumulativeDist, &percentileJSON{
+				Count:      b.Count,
+				Percentile: b.Quantile,
+				Size:       b.ValueAt,
+			})
+		}
+
+		count := b.Count - lastCount
+		if count > 0 {
+			dsj.SizeHistogram = append(dsj.SizeHistogram, &sizeBucketJSON{
+				Count: count,
+				Size:  b.ValueAt,
+			})
+		}
+		lastCount = b.Count
+	}
+
+	var buf bytes.Buffer
+	err := writeJSON(&buf, dsj)
+	return buf.String(), err
+}
+
+// fileDatStats are the stats of a single DAT file, computed without the DB.
+type fileDatStats struct {
+	Path           string `json:"path"`
+	Name           string `json:"name"`
+	NumGames       int    `json:"numGames"`
+	NumRoms        int    `json:"numRoms"`
+	TotalRomSize   uint64 `json:"totalRomSize"`
+	NumUniqueSha1s int    `json:"numUniqueSha1s"`
+	NumMissingCrc  int    `json:"numMissingCrc"`
+	NumMissingMd5  int    `json:"numMissingMd5"`
+	NumMissingSha1 int    `json:"numMissingSha1"`
+}
+
+func newFileDatStats(dat *types.Dat) *fileDatStats {
+	fds := &fileDatStats{
+		Path: dat.Path,
+		Name: dat.Name,
+	}
+
+	sha1s := make(map[string]bool)
+
+	for _, g := range dat.Games {
+		fds.NumGames++
+		for _, r := range g.Roms {
+			fds.NumRoms++
+			fds.TotalRomSize += uint64(r.Size)
+			if len(r.Crc) == 0 {
+				fds.NumMissingCrc++
+			}
+			if len(r.Md5) == 0 {
+				fds.NumMissingMd5++
+			}
+			if len(r.Sha1) == 0 {
+				fds.NumMissingSha1++
+			} else {
+				sha1s[string(r.Sha1)] = true
+			}
+		}
+	}
+	fds.NumUniqueSha1s = len(sha1s)
+	return fds
+}
+
+// text returns the file dat stats as human readable text.
+func (fds *fileDatStats) text() string {
+	var msgBuffer bytes.Buffer
+
+	fmt.Fprintf(&msgBuffer, "dat = %s (%s)\n", fds.Name, fds.Path)
+	fmt.Fprintf(&msgBuffer, "number of games = %d\n", fds.NumGames)
+	fmt.Fprintf(&msgBuffer, "number of roms = %d\n", fds.NumRoms)
+	fmt.Fprintf(&msgBuffer, "total rom size = %s\n", humanize.IBytes(fds.TotalRomSize))
+	fmt.Fprintf(&msgBuffer, "number of unique sha1s = %d\n", fds.NumUniqueSha1s)
+	fmt.Fprintf(&msgBuffer, "number of roms without crc = %d\n", fds.NumMissingCrc)
+	fmt.Fprintf(&msgBuffer, "number of roms without md5 = %d\n", fds.NumMissingMd5)
+	fmt.Fprintf(&msgBuffer, "number of roms without sha1 = %d\n", fds.NumMissingSha1)
+
+	return msgBuffer.String()
+}
+
+// fileDatstats prints the stats of the DAT file in path. It parses the file
+// and doesn't touch the DB, so it also works for DATs that aren't indexed.
+func fileDatstats(cmd *commander.Command, path string, asJSON bool) error {
+	dat, _, err := parser.Parse(path)
+	if err != nil {
+		return err
+	}
+
+	fds := newFileDatStats(dat)
+
+	if asJSON {
+		return writeJSON(cmd.Stdout, fds)
+	}
+
+	_, err = fmt.Fprint(cmd.Stdout, fds.text())
+	return err
 }
 
 func (rs *RombaService) datstats(cmd *commander.Command, args []string) error {
+	asJSON := cmd.Flag.Lookup("json").Value.Get().(bool)
+
+	if file := cmd.Flag.Lookup("file").Value.Get().(string); file != "" {
+		return fileDatstats(cmd, file, asJSON)
+	}
+
 	rs.jobMutex.Lock()
 	defer rs.jobMutex.Unlock()
 
@@ -144,7 +416,7 @@ func (rs *RombaService) datstats(cmd *commander.Command, args []string) error {
 			}
 		}()
 
-		deduper, err := dedup.NewLevelDBDeduper()
+		deduper, err := dedup.NewLevelDBDeduper(dedup.MatchKeySha1)
 		if err != nil {
 			glog.Errorf("error datstats: %v", err)
 			rs.broadCastProgress(time.Now(), false, true, "error collecting datstats", err)
@@ -161,6 +433,11 @@ func (rs *RombaService) datstats(cmd *commander.Command, args []string) error {
 			if dat.Generation != rs.romDB.Generation() {
 				return nil
 			}
+			if dat.ReferenceOnly {
+				dts.nRefDats = dts.nRefDats + 1
+				return nil
+			}
+			dts.declare(dat)
 			dedat, err := dedup.Dedup(dat, deduper)
 			if err != nil {
 				return err
@@ -190,37 +467,11 @@ func (rs *RombaService) datstats(cmd *commander.Command, args []string) error {
 			return
 		}
 
-		bs := dts.h.CumulativeDistribution()
-
-		var msgBuffer bytes.Buffer
-
-		fmt.Fprintf(&msgBuffer, "number of dats = %d\n", dts.nDats)
-		fmt.Fprintf(&msgBuffer, "number of games = %d\n", dts.nGames)
-		fmt.Fprintf(&msgBuffer, "number of roms = %d\n", dts.nRoms)
-		fmt.Fprintf(&msgBuffer, "total rom size = %s\n", humanize.IBytes(dts.totalSize))
-		fmt.Fprintf(&msgBuffer, "number of roms below 4k size = %d\n\n", dts.nRomsBelow4k)
-
-		fmt.Fprintf(&msgBuffer, "rom size cumulative distribution = \n")
-		fmt.Fprintf(&msgBuffer, "count, percentile, file size\n")
-		for i := 0; i < len(bs); i++ {
-			b := bs[i]
-
-			vstr := humanize.IBytes(uint64(b.ValueAt))
-
-			if (i < len(bs)-1 && vstr != humanize.IBytes(uint64(bs[i+1].ValueAt))) || (i == len(bs)-1) {
-				fmt.Fprintf(&msgBuffer, "%d, %.8f, %s\n", b.Count, b.Quantile, humanize.IBytes(uint64(b.ValueAt)))
-			}
-		}
-
-		fmt.Fprintf(&msgBuffer, "\nrom size histogram = \n")
-		fmt.Fprintf(&msgBuffer, "count, file size\n")
-		var lastCount int64
-		for _, b := range bs {
-			count := b.Count - lastCount
-			if count > 0 {
-				fmt.Fprintf(&msgBuffer, "%d, %s\n", count, humanize.IBytes(uint64(b.ValueAt)))
-			}
-			lastCount = b.Count
+		var msg string
+		if asJSON {
+			msg, err = dts.json()
+		} else {
+			msg = dts.text()
 		}
 
 		ticker.Stop()
@@ -231,10 +482,51 @@ func (rs *RombaService) datstats(cmd *commander.Command, args []string) error {
 		rs.jobName = ""
 		rs.jobMutex.Unlock()
 
-		rs.broadCastProgress(time.Now(), false, true, msgBuffer.String(), err)
+		rs.broadCastProgress(time.Now(), false, true, msg, err)
 		glog.Infof("service finished datstats")
 
 	}()
 
 	return nil
 }
+
+// text returns the dat stats as human readable text.
+func (dts *datStats) text() string {
+	bs := dts.h.CumulativeDistribution()
+
+	var msgBuffer bytes.Buffer
+
+	fmt.Fprintf(&msgBuffer, "number of dats = %d\n", dts.nDats)
+	fmt.Fprintf(&msgBuffer, "number of reference-only dats (not counted) = %d\n", dts.nRefDats)
+	fmt.Fprintf(&msgBuffer, "number of games = %d\n", dts.nGames)
+	fmt.Fprintf(&msgBuffer, "number of roms = %d\n", dts.nRoms)
+	fmt.Fprintf(&msgBuffer, "total rom size = %s\n", humanize.IBytes(dts.totalSize))
+	fmt.Fprintf(&msgBuffer, "number of roms below 4k size = %d\n", dts.nRomsBelow4k)
+	fmt.Fprintf(&msgBuffer, "number of roms summed over dats = %d\n", dts.nDeclaredRoms)
+	fmt.Fprintf(&msgBuffer, "rom size summed over dats = %s\n\n", humanize.IBytes(dts.declaredSize))
+
+	fmt.Fprintf(&msgBuffer, "rom size cumulative distribution = \n")
+	fmt.Fprintf(&msgBuffer, "count, percentile, file size\n")
+	for i := 0; i < len(bs); i++ {
+		b := bs[i]
+
+		vstr := humanize.IBytes(uint64(b.ValueAt))
+
+		if (i < len(bs)-1 && vstr != humanize.IBytes(uint64(bs[i+1].ValueAt))) || (i == len(bs)-1) {
+			fmt.Fprintf(&msgBuffer, "%d, %.8f, %s\n", b.Count, b.Quantile, humanize.IBytes(uint64(b.ValueAt)))
+		}
+	}
+
+	fmt.Fprintf(&msgBuffer, "\nrom size histogram = \n")
+	fmt.Fprintf(&msgBuffer, "count, file size\n")
+	var lastCount int64
+	for _, b := range bs {
+		count := b.Count - lastCount
+		if count > 0 {
+			fmt.Fprintf(&msgBuffer, "%d, %s\n", count, humanize.IBytes(uint64(b.ValueAt)))
+		}
+		lastCount = b.Count
+	}
+
+	return msgBuffer.String()
+}
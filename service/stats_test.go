@@ -0,0 +1,112 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/codahale/hdrhistogram"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func TestDatStatsJSON(t *testing.T) {
+	dts := &datStats{
+		h:         hdrhistogram.New(0, 1000000000000, 5),
+		nDats:     2,
+		nRefDats:  1,
+		nGames:    3,
+		nRoms:     4,
+		totalSize: 7000,
+	}
+	for _, size := range []int64{1000, 1000, 2000, 3000} {
+		dts.h.RecordValue(size)
+	}
+	dts.declare(&types.Dat{
+		Games: types.GameSlice{
+			{Roms: types.RomSlice{{Size: 1000}, {Size: 2000}}},
+			{Roms: types.RomSlice{{Size: 1000}}},
+		},
+	})
+	dts.declare(&types.Dat{
+		Games: types.GameSlice{
+			{Roms: types.RomSlice{{Size: 1000}, {Size: 3000}}},
+		},
+	})
+
+	msg, err := dts.json()
+	if err != nil {
+		t.Fatalf("failed to encode dat stats: %v", err)
+	}
+
+	var dsj datStatsJSON
+	err = json.Unmarshal([]byte(msg), &dsj)
+	if err != nil {
+		t.Fatalf("failed to decode dat stats %s: %v", msg, err)
+	}
+
+	if dsj.NumDats != 2 || dsj.NumRefDats != 1 || dsj.NumGames != 3 || dsj.NumRoms != 4 || dsj.TotalRomSize != 7000 {
+		t.Fatalf("unexpected dat stats %s", msg)
+	}
+	if dsj.NumDeclaredRoms != 5 || dsj.DeclaredRomSize != 8000 {
+		t.Fatalf("unexpected declared dat stats %s", msg)
+	}
+}
+
+func TestNewFileDatStats(t *testing.T) {
+	dat := &types.Dat{
+		Name: "stats",
+		Games: types.GameSlice{
+			{
+				Name: "a",
+				Roms: types.RomSlice{
+					{Name: "1", Size: 100, Crc: []byte{1}, Sha1: []byte{1}},
+					{Name: "2", Size: 200, Crc: []byte{2}, Md5: []byte{2}},
+				},
+			},
+			{
+				Name: "b",
+				Roms: types.RomSlice{
+					{Name: "1", Size: 100, Crc: []byte{1}, Sha1: []byte{1}},
+				},
+			},
+		},
+	}
+
+	fds := newFileDatStats(dat)
+
+	if fds.NumGames != 2 || fds.NumRoms != 3 || fds.TotalRomSize != 400 || fds.NumUniqueSha1s != 1 {
+		t.Fatalf("unexpected file dat stats %+v", fds)
+	}
+	if fds.NumMissingCrc != 0 || fds.NumMissingMd5 != 2 || fds.NumMissingSha1 != 1 {
+		t.Fatalf("unexpected missing hash counts %+v", fds)
+	}
+}
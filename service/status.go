@@ -0,0 +1,266 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type statusWorker struct {
+	pm *statusGru
+}
+
+type statusGru struct {
+	rs             *RombaService
+	numWorkers     int
+	pt             worker.ProgressTracker
+	commonRootPath string
+	outpath        string
+	referenceDats  *db.ReferenceDats
+
+	mutex       sync.Mutex
+	numDats     int
+	numRefDats  int
+	numHaveRoms int
+	numMissRoms int
+}
+
+func (pw *statusWorker) Process(path string, size int64) error {
+	dat, sha1Bytes, err := parser.Parse(path)
+	if err != nil {
+		return err
+	}
+
+	if pw.pm.referenceDats.Matches(dat, sha1Bytes) {
+		pw.pm.mutex.Lock()
+		pw.pm.numRefDats++
+		pw.pm.mutex.Unlock()
+		return nil
+	}
+
+	reldatdir, err := filepath.Rel(pw.pm.commonRootPath, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	datdir := filepath.Join(pw.pm.outpath, reldatdir)
+
+	err = os.MkdirAll(datdir, 0777)
+	if err != nil {
+		return err
+	}
+
+	numHave, numMiss, err := pw.pm.rs.depot.WriteHaveMiss(dat, datdir)
+	if err != nil {
+		return err
+	}
+
+	pw.pm.mutex.Lock()
+	pw.pm.numDats++
+	pw.pm.numHaveRoms += numHave
+	pw.pm.numMissRoms += numMiss
+	pw.pm.mutex.Unlock()
+	return nil
+}
+
+func (pw *statusWorker) Close() error {
+	return nil
+}
+
+func (pm *statusGru) CalculateWork() bool {
+	return true
+}
+
+func (pm *statusGru) NeedsSizeInfo() bool {
+	return false
+}
+
+func (pm *statusGru) Accept(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".dat" || ext == ".xml"
+}
+
+func (pm *statusGru) NewWorker(workerIndex int) worker.Worker {
+	return &statusWorker{
+		pm: pm,
+	}
+}
+
+func (pm *statusGru) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *statusGru) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *statusGru) FinishUp() error {
+	return nil
+}
+
+func (pm *statusGru) Start() error {
+	return nil
+}
+
+func (pm *statusGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {
+	pm.commonRootPath = commonRootPath
+	fi, err := os.Stat(pm.commonRootPath)
+	if err != nil {
+		pm.commonRootPath = "/"
+		return
+	}
+	if !fi.IsDir() {
+		pm.commonRootPath = filepath.Dir(pm.commonRootPath)
+	}
+}
+
+func (rs *RombaService) status(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		p := rs.pt.GetProgress()
+
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
+			p.FilesSoFar, p.TotalFiles, humanize.IBytes(uint64(p.BytesSoFar)), humanize.IBytes(uint64(p.TotalBytes)))
+		return err
+	}
+
+	datsPath := cmd.Flag.Lookup("dats").Value.Get().(string)
+	if datsPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-dats argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing dats argument")
+	}
+
+	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
+	if outpath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-out argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing out argument")
+	}
+
+	if !filepath.IsAbs(outpath) {
+		absoutpath, err := filepath.Abs(outpath)
+		if err != nil {
+			return err
+		}
+		outpath = absoutpath
+	}
+
+	if err := os.MkdirAll(outpath, 0777); err != nil {
+		return err
+	}
+
+	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+
+	referenceDats, err := db.ParseReferenceDats(rs.referenceOnly)
+	if err != nil {
+		return err
+	}
+
+	rs.pt.Reset()
+	rs.busy = true
+	rs.jobName = "status"
+
+	go func() {
+		glog.Infof("service starting status")
+		rs.broadCastProgress(time.Now(), true, false, "", nil)
+		ticker := time.NewTicker(time.Second * 5)
+		stopTicker := make(chan bool)
+		go func() {
+			glog.Infof("starting progress broadcaster")
+			for {
+				select {
+				case t := <-ticker.C:
+					rs.broadCastProgress(t, false, false, "", nil)
+				case <-stopTicker:
+					glog.Info("stopped progress broadcaster")
+					return
+				}
+			}
+		}()
+
+		pm := &statusGru{
+			rs:            rs,
+			numWorkers:    numWorkers,
+			pt:            rs.pt,
+			outpath:       outpath,
+			referenceDats: referenceDats,
+		}
+
+		endMsg, err := worker.Work("have/miss status", []string{datsPath}, pm)
+		if err != nil {
+			glog.Errorf("error computing have/miss status: %v", err)
+		} else {
+			endMsg += fmt.Sprintf("number of dats: %d\nnumber of reference-only dats skipped: %d\n"+
+				"number of roms present: %d\nnumber of roms missing: %d\n",
+				pm.numDats, pm.numRefDats, pm.numHaveRoms, pm.numMissRoms)
+		}
+
+		ticker.Stop()
+		stopTicker <- true
+
+		derr := archive.DeleteEmptyFolders(outpath)
+		if derr != nil {
+			glog.Errorf("error cleaning up %s: %v", outpath, derr)
+		}
+
+		rs.jobMutex.Lock()
+		rs.busy = false
+		rs.jobName = ""
+		rs.jobMutex.Unlock()
+
+		rs.broadCastProgress(time.Now(), false, true, endMsg, err)
+		glog.Infof("service finished status")
+	}()
+
+	_, err = fmt.Fprintf(cmd.Stdout, "started status")
+	return err
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type verifyTZWorker struct {
+	pm *verifyTZGru
+}
+
+type verifyTZGru struct {
+	numWorkers int
+	pt         worker.ProgressTracker
+
+	mutex            sync.Mutex
+	reportWriter     *bufio.Writer
+	numZips          int
+	numNonconformant int
+}
+
+func (pw *verifyTZWorker) Process(path string, size int64) error {
+	violations, err := archive.CheckTorrentZip(path)
+	if err != nil {
+		return err
+	}
+
+	pw.pm.mutex.Lock()
+	defer pw.pm.mutex.Unlock()
+
+	pw.pm.numZips++
+	if len(violations) == 0 {
+		return nil
+	}
+
+	pw.pm.numNonconformant++
+	_, err = fmt.Fprintf(pw.pm.reportWriter, "%s: %s\n", path, strings.Join(violations, "; "))
+	return err
+}
+
+func (pw *verifyTZWorker) Close() error {
+	return nil
+}
+
+func (pm *verifyTZGru) CalculateWork() bool {
+	return true
+}
+
+func (pm *verifyTZGru) NeedsSizeInfo() bool {
+	return true
+}
+
+func (pm *verifyTZGru) Accept(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".zip"
+}
+
+func (pm *verifyTZGru) NewWorker(workerIndex int) worker.Worker {
+	return &verifyTZWorker{
+		pm: pm,
+	}
+}
+
+func (pm *verifyTZGru) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *verifyTZGru) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *verifyTZGru) FinishUp() error {
+	return nil
+}
+
+func (pm *verifyTZGru) Start() error {
+	return nil
+}
+
+func (pm *verifyTZGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+
+func (rs *RombaService) verifyTZ(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		p := rs.pt.GetProgress()
+
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
+			p.FilesSoFar, p.TotalFiles, humanize.IBytes(uint64(p.BytesSoFar)), humanize.IBytes(uint64(p.TotalBytes)))
+		return err
+	}
+
+	if len(args) == 0 {
+		_, err := fmt.Fprintf(cmd.Stdout, "at least one directory argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing directory argument")
+	}
+
+	reportPath := filepath.Join(rs.logDir,
+		fmt.Sprintf("verify-tz-%s.log", time.Now().Format(archive.ResumeDateFormat)))
+
+	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+
+	rs.pt.Reset()
+	rs.busy = true
+	rs.jobName = "verify-tz"
+
+	go func() {
+		glog.Infof("service starting verify-tz")
+		rs.broadCastProgress(time.Now(), true, false, "", nil)
+		ticker := time.NewTicker(time.Second * 5)
+		stopTicker := make(chan bool)
+		go func() {
+			glog.Infof("starting progress broadcaster")
+			for {
+				select {
+				case t := <-ticker.C:
+					rs.broadCastProgress(t, false, false, "", nil)
+				case <-stopTicker:
+					glog.Info("stopped progress broadcaster")
+					return
+				}
+			}
+		}()
+
+		endMsg, err := rs.verifyTorrentZips(args, reportPath, numWorkers)
+		if err != nil {
+			glog.Errorf("error verifying torrentzips: %v", err)
+		}
+
+		ticker.Stop()
+		stopTicker <- true
+
+		rs.jobMutex.Lock()
+		rs.busy = false
+		rs.jobName = ""
+		rs.jobMutex.Unlock()
+
+		rs.broadCastProgress(time.Now(), false, true, endMsg, err)
+		glog.Infof("service finished verify-tz")
+	}()
+
+	_, err := fmt.Fprintf(cmd.Stdout, "started verify-tz, writing report to %s", reportPath)
+	return err
+}
+
+func (rs *RombaService) verifyTorrentZips(paths []string, reportPath string, numWorkers int) (string, error) {
+	reportFile, err := os.Create(reportPath)
+	if err != nil {
+		return "", err
+	}
+	defer reportFile.Close()
+
+	pm := &verifyTZGru{
+		numWorkers:   numWorkers,
+		pt:           rs.pt,
+		reportWriter: bufio.NewWriter(reportFile),
+	}
+
+	endMsg, err := worker.Work("verify torrentzips", paths, pm)
+
+	ferr := pm.reportWriter.Flush()
+	if err != nil {
+		return "", err
+	}
+	if ferr != nil {
+		return "", ferr
+	}
+
+	return endMsg + fmt.Sprintf("number of zips checked: %d\nnumber of nonconformant zips: %d\nreport: %s\n",
+		pm.numZips, pm.numNonconformant, reportPath), nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func zipVerificationText(zv *archive.ZipVerification) string {
+	var msgBuffer bytes.Buffer
+
+	for _, name := range zv.Missing {
+		fmt.Fprintf(&msgBuffer, "missing: %s\n", name)
+	}
+	for _, me := range zv.Misnamed {
+		fmt.Fprintf(&msgBuffer, "misnamed: %s should be %s\n", me.Entry, me.Rom)
+	}
+	for _, name := range zv.Extra {
+		fmt.Fprintf(&msgBuffer, "extra: %s\n", name)
+	}
+
+	if zv.Complete {
+		fmt.Fprintf(&msgBuffer, "%s is a valid complete set\n", zv.Game)
+	} else {
+		fmt.Fprintf(&msgBuffer, "%s is not a valid complete set: %d matched, %d missing, %d misnamed, %d extra\n",
+			zv.Game, len(zv.Matched), len(zv.Missing), len(zv.Misnamed), len(zv.Extra))
+	}
+	return msgBuffer.String()
+}
+
+func (rs *RombaService) verifyZip(cmd *commander.Command, args []string) error {
+	for _, name := range []string{"zip", "dat", "game"} {
+		if cmd.Flag.Lookup(name).Value.Get().(string) == "" {
+			_, err := fmt.Fprintf(cmd.Stdout, "-%s argument required", name)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("missing %s argument", name)
+		}
+	}
+
+	zipPath := cmd.Flag.Lookup("zip").Value.Get().(string)
+	datPath := cmd.Flag.Lookup("dat").Value.Get().(string)
+	gameName := cmd.Flag.Lookup("game").Value.Get().(string)
+
+	dat, _, err := parser.Parse(datPath)
+	if err != nil {
+		return err
+	}
+
+	var game *types.Game
+	for _, g := range dat.Games {
+		if g.Name == gameName {
+			game = g
+			break
+		}
+	}
+
+	if game == nil {
+		_, err := fmt.Fprintf(cmd.Stdout, "no game %s in %s", gameName, datPath)
+		if err != nil {
+			return err
+		}
+		return errors.New("game not found")
+	}
+
+	zv, err := archive.VerifyZip(zipPath, game)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Flag.Lookup("json").Value.Get().(bool) {
+		return writeJSON(cmd.Stdout, zv)
+	}
+
+	_, err = fmt.Fprint(cmd.Stdout, zipVerificationText(zv))
+	return err
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package types
+
+import (
+	"crypto/sha1"
+	"fmt"
+)
+
+// ComputeLogicalSha1 returns the logical identity of d: the sha1 of its name and
+// of the names, sizes and hashes of the roms and disks of its games. Unlike the
+// sha1 of the DAT file, which identifies a DAT in the index, it stays the same
+// when the file is only reformatted or its header cosmetics (description,
+// version, author, comments, ...) change. d is expected to be normalized, so
+// that games and roms are sorted.
+func (d *Dat) ComputeLogicalSha1() []byte {
+	h := sha1.New()
+
+	fmt.Fprintf(h, "dat %q\n", d.Name)
+	for _, g := range d.Games {
+		fmt.Fprintf(h, "game %q\n", g.Name)
+		for _, r := range g.Roms {
+			fmt.Fprintf(h, "rom %q %d %x %x %x\n", r.Name, r.Size, r.Crc, r.Md5, r.Sha1)
+		}
+		for _, disk := range g.Disks {
+			fmt.Fprintf(h, "disk %q %x %x\n", disk.Name, disk.Md5, disk.Sha1)
+		}
+	}
+	return h.Sum(nil)
+}
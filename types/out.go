@@ -38,46 +38,62 @@ import (
 	"text/template"
 )
 
+// datHeaderFields holds the optional header fields carried over from the original DAT.
+const datHeaderFields = `{{if not .FixDat}}{{with .Category}}
+	category "{{omitQuote .}}"{{end}}{{end}}{{with .ID}}
+	id "{{omitQuote .}}"{{end}}{{with .Version}}
+	version "{{omitQuote .}}"{{end}}{{with .Date}}
+	date "{{omitQuote .}}"{{end}}{{with .Author}}
+	author "{{omitQuote .}}"{{end}}{{with .Homepage}}
+	homepage "{{omitQuote .}}"{{end}}{{with .URL}}
+	url "{{omitQuote .}}"{{end}}{{with .Comment}}
+	comment "{{omitQuote .}}"{{end}}
+`
+
 const datTemplate = `
 dat (
 	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
-	{{if .FixDat}}category "FIXDATFILE"{{end}}
+	description "{{omitQuote .Description}}"` + datHeaderFields + `	{{if .FixDat}}category "FIXDATFILE"{{end}}
 	path "{{.Path}}"
 	{{if .UnzipGames}}forcezipping "no"{{end}}
 )
 {{with .Games}}{{range .}}
 game (
 	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
+	description "{{omitQuote .Description}}"{{with .SampleOf}}
+	sampleof "{{omitQuote .}}"{{end}}
 	{{with .Roms}}{{range .}}
-	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}} ){{end}}{{end}}
+	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}}{{with .Merge}} merge "{{omitQuote .}}"{{end}} ){{end}}{{end}}{{with .Samples}}{{range .}}
+	sample "{{omitQuote .Name}}"{{end}}{{end}}
 ){{end}}{{end}}
 `
 
 const compliantDatTemplate = `clrmamepro (
 	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
-	{{if .FixDat}}category "FIXDATFILE"{{end}}
+	description "{{omitQuote .Description}}"` + datHeaderFields + `	{{if .FixDat}}category "FIXDATFILE"{{end}}
 	{{if .UnzipGames}}forcezipping "no"{{end}}
 ){{with .Games}}{{range .}}
 game (
 	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
+	description "{{omitQuote .Description}}"{{with .SampleOf}}
+	sampleof "{{omitQuote .}}"{{end}}
 	{{with .Roms}}{{range .}}
-	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}} ){{end}}{{end}}
+	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}}{{with .Merge}} merge "{{omitQuote .}}"{{end}} ){{end}}{{end}}{{with .Samples}}{{range .}}
+	sample "{{omitQuote .Name}}"{{end}}{{end}}
 ){{end}}{{end}}
 `
 
 const romTemplate = `
-rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}} )
+rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}}{{with .Merge}} merge "{{omitQuote .}}"{{end}} )
 `
 
 const gameTemplate = `game (
 	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
+	description "{{omitQuote .Description}}"{{with .SampleOf}}
+	sampleof "{{omitQuote .}}"{{end}}
 	{{with .Roms}}{{range .}}
-	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}} ){{end}}{{end}}
+	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}}{{with .Merge}} merge "{{omitQuote .}}"{{end}} ){{end}}{{end}}{{with .Samples}}{{range .}}
+	sample "{{omitQuote .Name}}"{{end}}{{end}}
 )
 `
 
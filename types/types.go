@@ -32,21 +32,38 @@ package types
 
 import (
 	"bytes"
+	"encoding/xml"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 type Clrmamepro struct {
+	Header       string `xml:"header,attr"`
 	ForcePacking string `xml:"forcepacking,attr"`
 	ForceZipping string `xml:"forcezipping,attr"`
 }
 
+type Romvault struct {
+	Header       string `xml:"header,attr"`
+	ForcePacking string `xml:"forcepacking,attr"`
+}
+
 type Dat struct {
 	Name          string      `xml:"header>name"`
 	OriginalName  string
 	Description   string      `xml:"header>description"`
 	Clr           *Clrmamepro `xml:"header>clrmamepro"`
+	Rv            *Romvault   `xml:"header>romvault"`
+	ID            string      `xml:"header>id"`
+	Category      string      `xml:"header>category"`
+	Version       string      `xml:"header>version"`
+	Date          string      `xml:"header>date"`
+	Author        string      `xml:"header>author"`
+	Homepage      string      `xml:"header>homepage"`
+	URL           string      `xml:"header>url"`
+	Comment       string      `xml:"header>comment"`
 	Games         GameSlice   `xml:"game"`
 	Generation    int64
 	Path          string
@@ -55,16 +72,80 @@ type Dat struct {
 	UnzipGames    bool
 	FixDat        bool
 	MissingSha1s  bool
+	ReferenceOnly bool
+	LogicalSha1   []byte
 	SLName        string `xml:"name,attr"`
 	SLDescription string `xml:"description,attr"`
 }
 
 type Game struct {
-	Name        string   `xml:"name,attr"`
-	Description string   `xml:"description"`
-	Roms        RomSlice `xml:"rom"`
-	Parts       RomSlice `xml:"part>dataarea>rom"`
-	Regions     RomSlice `xml:"region>rom"`
+	Name        string       `xml:"name,attr"`
+	Description string       `xml:"description"`
+	Roms        RomSlice     `xml:"rom"`
+	Parts       RomSlice     `xml:"part>dataarea>rom"`
+	Regions     RomSlice     `xml:"region>rom"`
+	Disks       DiskSlice    `xml:"disk"`
+	DiskParts   DiskSlice    `xml:"part>diskarea>disk"`
+	IsBios      string       `xml:"isbios,attr"`
+	IsDevice    string       `xml:"isdevice,attr"`
+	SampleOf    string       `xml:"sampleof,attr"`
+	Samples     SampleSlice  `xml:"sample"`
+	BiosSets    BiosSetSlice `xml:"biosset"`
+	Size        GameSize     `xml:"size,attr"`
+}
+
+// GameSize is the total size some nonstandard DATs give for a whole game. Romba
+// doesn't use it for anything.
+type GameSize int64
+
+// UnmarshalXMLAttr decodes a game size attribute. Values that aren't a decimal
+// number are ignored instead of failing the decoding of the DAT.
+func (gs *GameSize) UnmarshalXMLAttr(attr xml.Attr) error {
+	v, err := strconv.ParseInt(strings.TrimSpace(attr.Value), 10, 64)
+	if err != nil || v < 0 {
+		*gs = 0
+		return nil
+	}
+	*gs = GameSize(v)
+	return nil
+}
+
+// Bios reports whether the game is marked as a MAME BIOS set.
+func (g *Game) Bios() bool { return g.IsBios == "yes" }
+
+// Device reports whether the game is marked as a MAME device.
+func (g *Game) Device() bool { return g.IsDevice == "yes" }
+
+// SampleSet returns the name of the sample set holding the samples of the game.
+func (g *Game) SampleSet() string {
+	if g.SampleOf != "" {
+		return g.SampleOf
+	}
+	return g.Name
+}
+
+// SelectBios returns the name of the biosset of the game called requested. If
+// requested is empty or the game has no such biosset it returns the default
+// biosset, which is the first one unless one is marked default, like in MAME.
+// Games without biossets return the empty string.
+func (g *Game) SelectBios(requested string) string {
+	if len(g.BiosSets) == 0 {
+		return ""
+	}
+
+	def := ""
+	for _, bs := range g.BiosSets {
+		if requested != "" && bs.Name == requested {
+			return bs.Name
+		}
+		if def == "" && bs.Default == "yes" {
+			def = bs.Name
+		}
+	}
+	if def == "" {
+		def = g.BiosSets[0].Name
+	}
+	return def
 }
 
 type GameSlice []*Game
@@ -76,11 +157,43 @@ type Rom struct {
 	Md5    []byte `xml:"md5,attr"`
 	Sha1   []byte `xml:"sha1,attr"`
 	Status string `xml:"status,attr"`
+	Merge  string `xml:"merge,attr"`
+	Bios   string `xml:"bios,attr"`
 	Path   string
 }
 
 type RomSlice []*Rom
 
+// Disk is a CHD entry of a game. Build copies the CHDs archived in the depot,
+// which are stored under the sha1 in their header, but disks never count towards
+// what a game requires during verify or build.
+type Disk struct {
+	Name   string `xml:"name,attr"`
+	Md5    []byte `xml:"md5,attr"`
+	Sha1   []byte `xml:"sha1,attr"`
+	Status string `xml:"status,attr"`
+}
+
+type DiskSlice []*Disk
+
+// Sample is a MAME audio sample of a game. Samples are no roms and are not
+// stored in the depot; build gathers them from the configured samples dir.
+type Sample struct {
+	Name string `xml:"name,attr"`
+}
+
+type SampleSlice []*Sample
+
+// BiosSet is one of the BIOSes a MAME machine can run with. Roms of the machine
+// carrying its name in their bios attribute belong to that BIOS only.
+type BiosSet struct {
+	Name        string `xml:"name,attr"`
+	Description string `xml:"description,attr"`
+	Default     string `xml:"default,attr"`
+}
+
+type BiosSetSlice []*BiosSet
+
 func (ar *Rom) HashesMatch(br *Rom) bool {
 	return (ar.Crc != nil && bytes.Equal(ar.Crc, br.Crc) && ar.Size == br.Size) ||
 		(ar.Md5 != nil && bytes.Equal(ar.Md5, br.Md5) && ar.Size == br.Size) ||
@@ -196,6 +309,15 @@ func (g *Game) Normalize() {
 	}
 
 	g.Roms = filteredRoms
+
+	if g.DiskParts != nil {
+		g.Disks = append(g.Disks, g.DiskParts...)
+		g.DiskParts = nil
+	}
+
+	for _, d := range g.Disks {
+		d.Name = strings.Replace(d.Name, "\\", "/", -1)
+	}
 }
 
 func (d *Dat) Normalize() {
@@ -241,6 +363,7 @@ func (d *Dat) NarrowToRom(rom *Rom) *Dat {
 	dc.FixDat = d.FixDat
 	dc.Generation = d.Generation
 	dc.UnzipGames = d.UnzipGames
+	dc.ReferenceOnly = d.ReferenceOnly
 
 	for _, g := range d.Games {
 		gc := new(Game)
@@ -291,9 +414,20 @@ func (d *Dat) CopyHeader(src *Dat) {
 	d.OriginalName = src.OriginalName
 	d.Path = src.Path
 	d.Description = src.Description
+	d.Clr = src.Clr
+	d.Rv = src.Rv
+	d.ID = src.ID
+	d.Category = src.Category
+	d.Version = src.Version
+	d.Date = src.Date
+	d.Author = src.Author
+	d.Homepage = src.Homepage
+	d.URL = src.URL
+	d.Comment = src.Comment
 	d.FixDat = src.FixDat
 	d.Generation = src.Generation
 	d.UnzipGames = src.UnzipGames
+	d.ReferenceOnly = src.ReferenceOnly
 }
 
 func (d *Dat) Filename() string {
@@ -312,6 +446,11 @@ func (r *Rom) Valid() bool {
 	return !(r.Size > 0 && len(r.Crc) == 0 && len(r.Md5) == 0 && len(r.Sha1) == 0) && r.Status != "nodump"
 }
 
+// Dumped reports whether a dump of the disk is known to exist.
+func (d *Disk) Dumped() bool {
+	return d.Status != "nodump" && len(d.Sha1) > 0
+}
+
 func (r *Rom) Copy(src *Rom) {
 	r.Name = src.Name
 	r.Path = src.Path
@@ -320,4 +459,5 @@ func (r *Rom) Copy(src *Rom) {
 	r.Sha1 = src.Sha1
 	r.Size = src.Size
 	r.Status = src.Status
+	r.Merge = src.Merge
 }
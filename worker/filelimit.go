@@ -0,0 +1,74 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package worker
+
+// FileLimiter is a semaphore limiting the number of files open at the same time across
+// all workers of a job. A slot stands for one source file and is held until that file
+// is closed, by whoever reads it last. Reading a file that already holds a slot must not
+// acquire another one, or a holder waiting for that reader can deadlock the job.
+// Acquiring blocks while the limit is reached. The number of open files is reported to
+// a ProgressTracker. It is safe for concurrent use.
+type FileLimiter struct {
+	sem chan struct{}
+	pt  ProgressTracker
+}
+
+// NewFileLimiter returns a limiter admitting maxOpen files at the same time. A zero or negative
+// maxOpen doesn't limit, but open files are still counted.
+func NewFileLimiter(maxOpen int, pt ProgressTracker) *FileLimiter {
+	fl := &FileLimiter{
+		pt: pt,
+	}
+	if maxOpen > 0 {
+		fl.sem = make(chan struct{}, maxOpen)
+	}
+	return fl
+}
+
+// Acquire blocks until another file may be opened.
+func (fl *FileLimiter) Acquire() {
+	if fl.sem != nil {
+		fl.sem <- struct{}{}
+	}
+	if fl.pt != nil {
+		fl.pt.AddOpenFiles(1)
+	}
+}
+
+// Release marks a file acquired with Acquire as closed.
+func (fl *FileLimiter) Release() {
+	if fl.pt != nil {
+		fl.pt.AddOpenFiles(-1)
+	}
+	if fl.sem != nil {
+		<-fl.sem
+	}
+}
@@ -39,6 +39,7 @@ type ProgressTracker interface {
 	SetTotalBytes(value int64)
 	SetTotalFiles(value int32)
 	AddBytesFromFile(value int64, erred bool)
+	AddOpenFiles(delta int32)
 	DeclareFile(path string)
 	Finished()
 	Reset()
@@ -54,6 +55,7 @@ type Progress struct {
 	ErrorFiles   int32
 	BytesSoFar   int64
 	FilesSoFar   int32
+	OpenFiles    int32
 	CurrentFiles []string
 	stopped      bool
 	knowTotal    bool
@@ -105,6 +107,13 @@ func (pt *Progress) AddBytesFromFile(value int64, erred bool) {
 	}
 }
 
+func (pt *Progress) AddOpenFiles(delta int32) {
+	pt.m.Lock()
+	defer pt.m.Unlock()
+
+	pt.OpenFiles += delta
+}
+
 func (pt *Progress) Stop(wc chan bool) {
 	pt.m.Lock()
 	defer pt.m.Unlock()
@@ -140,6 +149,7 @@ func (pt *Progress) Reset() {
 	pt.BytesSoFar = 0
 	pt.FilesSoFar = 0
 	pt.ErrorFiles = 0
+	pt.OpenFiles = 0
 	pt.CurrentFiles = nil
 	pt.stopped = false
 	pt.knowTotal = false
@@ -159,6 +169,7 @@ func (pt *Progress) GetProgress() *Progress {
 	p.ErrorFiles = pt.ErrorFiles
 	p.BytesSoFar = pt.BytesSoFar
 	p.FilesSoFar = pt.FilesSoFar
+	p.OpenFiles = pt.OpenFiles
 	p.knowTotal = pt.knowTotal
 
 	pt.rng.Do(func(v interface{}) {
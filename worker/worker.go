@@ -57,6 +57,8 @@ type countVisitor struct {
 	resumeLine string
 	// except root
 	root string
+	// dirs more than this many levels below root are skipped, negative means no limit
+	maxDepth int
 }
 
 var (
@@ -131,6 +133,9 @@ func (cv *countVisitor) visit(path string, f os.FileInfo, err error) error {
 	if f.IsDir() && cv.resumeLine != "" && !strings.HasPrefix(cv.resumeLine, path) && path < cv.resumeLine {
 		return filepath.SkipDir
 	}
+	if f.IsDir() && tooDeep(cv.root, path, cv.maxDepth) {
+		return filepath.SkipDir
+	}
 	if !f.IsDir() && cv.gru.Accept(path) {
 		glog.V(2).Infof("visiting path %s, current common root is %s", path, cv.commonRootPath)
 		cv.numFiles += 1
@@ -152,6 +157,9 @@ func (cv *countVisitor) visitFast(path string, de *godirwalk.Dirent) error {
 	if de.IsDir() && cv.resumeLine != "" && !strings.HasPrefix(cv.resumeLine, path) && path < cv.resumeLine {
 		return filepath.SkipDir
 	}
+	if de.IsDir() && tooDeep(cv.root, path, cv.maxDepth) {
+		return filepath.SkipDir
+	}
 	if !de.IsDir() && cv.gru.Accept(path) {
 		glog.V(2).Infof("visiting path %s, current common root is %s", path, cv.commonRootPath)
 		cv.numFiles += 1
@@ -173,6 +181,8 @@ type scanVisitor struct {
 	resumeLine string
 	// except root
 	root string
+	// dirs more than this many levels below root are skipped, negative means no limit
+	maxDepth int
 }
 
 var scanStopped = Error.New("scan stopped")
@@ -189,6 +199,9 @@ func (sv *scanVisitor) visit(path string, f os.FileInfo, err error) error {
 	if f.IsDir() && sv.resumeLine != "" && !strings.HasPrefix(sv.resumeLine, path) && path < sv.resumeLine {
 		return filepath.SkipDir
 	}
+	if f.IsDir() && tooDeep(sv.root, path, sv.maxDepth) {
+		return filepath.SkipDir
+	}
 	if !f.IsDir() && sv.gru.Accept(path) {
 		sv.inwork <- &workUnit{
 			path: path,
@@ -210,6 +223,9 @@ func (sv *scanVisitor) visitFast(path string, de *godirwalk.Dirent) error {
 	if de.IsDir() && sv.resumeLine != "" && !strings.HasPrefix(sv.resumeLine, path) && path < sv.resumeLine {
 		return filepath.SkipDir
 	}
+	if de.IsDir() && tooDeep(sv.root, path, sv.maxDepth) {
+		return filepath.SkipDir
+	}
 	if !de.IsDir() && sv.gru.Accept(path) {
 		sv.inwork <- &workUnit{
 			path: path,
@@ -228,6 +244,32 @@ type ErrorHandler interface {
 	Handle(path string)
 }
 
+// DepthLimiter can be implemented by a Gru to limit how deep the walk descends below each root.
+type DepthLimiter interface {
+	// MaxDepth returns the maximum dir depth below each root, 0 means only top-level files
+	// and a negative value means no limit.
+	MaxDepth() int
+}
+
+// ScanChecker can be implemented by a Gru to call off the work after the initial scan,
+// before any file is processed.
+type ScanChecker interface {
+	// CheckScanned returns an error if the work found by the initial scan shouldn't be started.
+	CheckScanned(numFiles int, numBytes int64) error
+}
+
+// tooDeep reports whether dir path lies more than maxDepth levels below root.
+func tooDeep(root, path string, maxDepth int) bool {
+	if maxDepth < 0 {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	return strings.Count(rel, string(filepath.Separator))+1 > maxDepth
+}
+
 type Gru interface {
 	Accept(path string) bool
 	NewWorker(workerIndex int) Worker
@@ -310,10 +352,11 @@ func runMinion(w *minion, inwork <-chan *workUnit, workerNum int, workname strin
 			if perr == nil {
 				perr = err
 			}
-			handleErredFile(path)
-
+			// a stop error calls off the run, it doesn't mean the file is bad
 			if StopProcessing.Contains(err) {
 				w.pt.Stop(nil)
+			} else {
+				handleErredFile(path)
 			}
 
 			if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENOSPC {
@@ -426,11 +469,17 @@ func WorkPathIterator(workname string, pi PathIterator, gru Gru) (string, error)
 		return "", err
 	}
 
+	maxDepth := -1
+	if dl, ok := gru.(DepthLimiter); ok {
+		maxDepth = dl.MaxDepth()
+	}
+
 	var cv *countVisitor
 
 	if gru.CalculateWork() {
 		cv = new(countVisitor)
 		cv.gru = gru
+		cv.maxDepth = maxDepth
 
 		for rp, goOn, err := pi.Next(); goOn; rp, goOn, err = pi.Next() {
 			if rp.Path == "" {
@@ -454,6 +503,21 @@ func WorkPathIterator(workname string, pi PathIterator, gru Gru) (string, error)
 
 		gru.Scanned(cv.numFiles, cv.numBytes, cv.commonRootPath)
 
+		if sc, ok := gru.(ScanChecker); ok {
+			err = sc.CheckScanned(cv.numFiles, cv.numBytes)
+			if err != nil {
+				glog.Errorf("not starting %s: %v\n", workname, err)
+
+				pt.Finished()
+
+				ferr := gru.FinishUp()
+				if ferr != nil {
+					glog.Errorf("failed to finish up gru: %v\n", ferr)
+				}
+				return "", err
+			}
+		}
+
 		pt.SetTotalBytes(cv.numBytes)
 		pt.SetTotalFiles(int32(cv.numFiles))
 	}
@@ -461,9 +525,10 @@ func WorkPathIterator(workname string, pi PathIterator, gru Gru) (string, error)
 	inwork := make(chan *workUnit, gru.NumWorkers())
 
 	sv := &scanVisitor{
-		inwork: inwork,
-		gru:    gru,
-		pt:     pt,
+		inwork:   inwork,
+		gru:      gru,
+		pt:       pt,
+		maxDepth: maxDepth,
 	}
 
 	closeC := make(chan error, gru.NumWorkers())
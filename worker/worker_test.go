@@ -32,6 +32,7 @@ package worker
 
 import (
 	"testing"
+	"time"
 )
 
 func executeTestCommonRoot(pa, pb, expected string, t *testing.T) {
@@ -58,3 +59,80 @@ func TestCommonRoot(t *testing.T) {
 	executeTestCommonRoot("/Users/uwe/romba/dats/AgeMAME/AgeMameRoms.dat", "/Users/uwe/romba/dats/AgeMAME",
 		"/Users/uwe/romba/dats/AgeMAME", t)
 }
+
+func TestTooDeep(t *testing.T) {
+	testCases := []struct {
+		path     string
+		maxDepth int
+		expected bool
+	}{
+		{"/roms", 0, false},
+		{"/roms/a", 0, true},
+		{"/roms/a", 1, false},
+		{"/roms/a/b", 1, true},
+		{"/roms/a/b", 2, false},
+		{"/roms/a/b/c/d", -1, false},
+	}
+
+	for _, tc := range testCases {
+		if got := tooDeep("/roms", tc.path, tc.maxDepth); got != tc.expected {
+			t.Fatalf("tooDeep(/roms, %s, %d): expected %v, got %v", tc.path, tc.maxDepth, tc.expected, got)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if NewRateLimiter(0) != nil {
+		t.Fatalf("expected no limiter for zero rate")
+	}
+
+	rl := NewRateLimiter(10000)
+
+	start := time.Now()
+	// drain the bucket, then 2000 more bytes need 200ms
+	rl.Wait(10000)
+	rl.Wait(2000)
+	elapsed := time.Since(start)
+
+	if elapsed < 150*time.Millisecond {
+		t.Fatalf("expected limiter to wait around 200ms, waited %v", elapsed)
+	}
+	if elapsed > 2*time.Second {
+		t.Fatalf("limiter waited too long: %v", elapsed)
+	}
+}
+
+func TestFileLimiter(t *testing.T) {
+	pt := NewProgressTracker(1)
+	fl := NewFileLimiter(1, pt)
+
+	fl.Acquire()
+	if n := pt.GetProgress().OpenFiles; n != 1 {
+		t.Fatalf("expected 1 open file, got %d", n)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		fl.Acquire()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("expected acquire to block while the limit is reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fl.Release()
+
+	select {
+	case <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected acquire to proceed after release")
+	}
+	fl.Release()
+
+	if n := pt.GetProgress().OpenFiles; n != 0 {
+		t.Fatalf("expected 0 open files, got %d", n)
+	}
+}